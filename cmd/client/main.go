@@ -5,7 +5,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"time"
 
 	"github.com/umputun/go-flags"
 
@@ -24,17 +23,55 @@ type Client interface {
 	GetFile() error
 	AddCard() error
 	GetCard() error
+	UpdateCredentials() error
+	UpdateText() error
+	UpdateCard() error
+	UpdateFile() error
 	Delete() error
+	Versions() error
+	Restore() error
+	Sync() error
+	Conflicts() error
+	ChangePassword() error
+	Sessions() error
+	RevokeSession() error
+	EnrollTOTP() error
+	EnableTOTP() error
+	DisableTOTP() error
+	RecoveryCodes() error
+	Usage() error
+	Share() error
+	Grants() error
+	Unshare() error
+	Shared() error
+	Orgs() error
+	CreateOrg() error
+	OrgMembers() error
+	SetMember() error
+	RemoveMember() error
+	Teams() error
+	CreateTeam() error
+	DeleteTeam() error
+	TeamMembers() error
+	AddTeamMember() error
+	RemoveTeamMember() error
+	Folders() error
+	CreateFolder() error
+	RenameFolder() error
+	MoveFolder() error
+	DeleteFolder() error
+	Move() error
+	Tag() error
+	Untag() error
+	SetDetails() error
+	Export() error
+	Import() error
+	ImportFrom() error
 }
 
 var revision = "unknown"
 
-var opts struct {
-	URL     string        `short:"s" long:"server" env:"SERVER" default:"localhost:8080" description:"server connection address"`
-	Command string        `short:"c" long:"command" env:"COMMAND" default:"list" description:"command to execute"`
-	Timeout time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"10s" description:"connection timeout"`
-	Dbg     bool          `long:"dbg" env:"DEBUG" description:"show debug info"`
-}
+var opts client.Options
 
 func main() {
 	fmt.Printf("gophkeeper client %s\n", revision)
@@ -52,7 +89,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cli := client.NewClient(opts)
+	var cli Client = client.NewClient(opts)
 	err := cli.Run(ctx)
 	if err != nil {
 		fmt.Printf("[ERROR] failed to run client: %v", err)
@@ -0,0 +1,222 @@
+// Package archive implements the format of vault exports.
+//
+// An archive is a tar stream of the manifest followed by the content of
+// every resource of the manifest, encrypted as a single stream envelope with
+// a key derived from the export passphrase, see package envelope. Segments
+// of the stream are authenticated, so a tampered or truncated archive fails
+// to read instead of importing damaged content.
+//
+// Entries of the tar stream:
+//
+//	manifest.json       Manifest
+//	resources/<id>      content of the resource, decrypted unless opaque
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/stream"
+)
+
+const (
+	Version1     = 1
+	manifestName = "manifest.json"
+	resourceDir  = "resources/"
+	opaqueRecord = "GOPHKEEPER.opaque"
+
+	// maxManifestSize protects from manifests exhausting memory
+	maxManifestSize = 64 << 20
+)
+
+var (
+	ErrInvalid    = fmt.Errorf("archive invalid")
+	ErrPassphrase = fmt.Errorf("archive passphrase wrong or archive damaged")
+)
+
+// Manifest describes the exported vault
+type Manifest struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	Folders   []Folder   `json:"folders"`
+	Resources []Resource `json:"resources"`
+}
+
+// Folder of the exported vault, zero Parent is the root
+type Folder struct {
+	ID     int64  `json:"id"`
+	Parent int64  `json:"parent,omitempty"`
+	Name   string `json:"name"`
+}
+
+// Resource of the exported vault, its content follows the manifest
+type Resource struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"` // piece or blob
+	Kind    string          `json:"kind"`
+	Meta    string          `json:"meta"`
+	Folder  int64           `json:"folder,omitempty"`
+	Tags    []string        `json:"tags,omitempty"`
+	Details json.RawMessage `json:"details,omitempty"`
+
+	ContentType string `json:"content_type,omitempty"` // ContentType of blobs.
+	Filename    string `json:"filename,omitempty"`     // Filename of blobs.
+}
+
+// Entry is the content header of a resource
+type Entry struct {
+	ID     int64 // ID of the resource in the manifest.
+	Size   int64 // Size of the content.
+	Opaque bool  // Content is an envelope encrypted by the client.
+}
+
+// Writer writes an archive
+type Writer struct {
+	enc io.WriteCloser
+	tw  *tar.Writer
+}
+
+// NewWriter starts an archive encrypted with the passphrase and writes the
+// manifest. Content of the resources is written with WriteEntry, Close
+// completes the archive.
+func NewWriter(w io.Writer, passphrase string, params envelope.KDFParams, m Manifest) (*Writer, error) {
+	enc, err := envelope.NewArchiveKeyring(passphrase, params).NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	m.Version = Version1
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	aw := &Writer{enc: enc, tw: tar.NewWriter(enc)}
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0o600,
+		Size:    int64(len(manifest)),
+		ModTime: m.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := aw.tw.Write(manifest); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// WriteEntry writes the content of the resource, exactly Size bytes are
+// copied from content
+func (w *Writer) WriteEntry(e Entry, content io.Reader) error {
+	header := &tar.Header{
+		Name: resourceDir + strconv.FormatInt(e.ID, 10),
+		Mode: 0o600,
+		Size: e.Size,
+	}
+	if e.Opaque {
+		header.PAXRecords = map[string]string{opaqueRecord: "1"}
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.tw, content, e.Size); err != nil {
+		return fmt.Errorf("failed to write resource %d: %w", e.ID, err)
+	}
+	return nil
+}
+
+// Close writes the end of the archive and the final segment of the stream
+func (w *Writer) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.enc.Close()
+}
+
+// Reader reads an archive
+type Reader struct {
+	Manifest Manifest
+
+	dec io.Reader
+	tr  *tar.Reader
+}
+
+// NewReader opens the archive with the passphrase and reads the manifest
+func NewReader(r io.Reader, passphrase string) (*Reader, error) {
+	dec, err := envelope.NewArchiveKeyring(passphrase, envelope.DefaultKDF).NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	ar := &Reader{dec: dec, tr: tar.NewReader(dec)}
+	header, err := ar.tr.Next()
+	if err != nil {
+		return nil, readError(err)
+	}
+	if header.Name != manifestName || header.Size > maxManifestSize {
+		return nil, fmt.Errorf("%w: manifest expected", ErrInvalid)
+	}
+	if err := json.NewDecoder(io.LimitReader(ar.tr, header.Size)).Decode(&ar.Manifest); err != nil {
+		return nil, readError(err)
+	}
+	if ar.Manifest.Version != Version1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalid, ar.Manifest.Version)
+	}
+	return ar, nil
+}
+
+// Next returns the next entry and its content, valid until the next call.
+// It returns io.EOF at the end of the archive once the stream is verified
+// to be complete.
+func (r *Reader) Next() (Entry, io.Reader, error) {
+	header, err := r.tr.Next()
+	if errors.Is(err, io.EOF) {
+		// the final segment follows the end of the tar stream
+		if _, err := io.Copy(io.Discard, r.dec); err != nil {
+			return Entry{}, nil, readError(err)
+		}
+		return Entry{}, nil, io.EOF
+	}
+	if err != nil {
+		return Entry{}, nil, readError(err)
+	}
+	id, ok := strings.CutPrefix(header.Name, resourceDir)
+	if !ok {
+		return Entry{}, nil, fmt.Errorf("%w: unexpected entry %q", ErrInvalid, header.Name)
+	}
+	entry := Entry{Size: header.Size, Opaque: header.PAXRecords[opaqueRecord] == "1"}
+	if entry.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return Entry{}, nil, fmt.Errorf("%w: unexpected entry %q", ErrInvalid, header.Name)
+	}
+	return entry, &contentReader{r.tr}, nil
+}
+
+// contentReader reports errors of the stream as read errors of the archive
+type contentReader struct {
+	r io.Reader
+}
+
+func (c *contentReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = readError(err)
+	}
+	return n, err
+}
+
+func readError(err error) error {
+	switch {
+	case errors.Is(err, stream.ErrAuth):
+		return ErrPassphrase
+	case errors.Is(err, stream.ErrTruncated), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: truncated", ErrInvalid)
+	case errors.Is(err, ErrInvalid), errors.Is(err, ErrPassphrase):
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrInvalid, err)
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+)
+
+// cheap parameters keep tests fast
+var testKDF = envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1}
+
+func testArchive(t *testing.T) []byte {
+	manifest := Manifest{
+		CreatedAt: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		Folders:   []Folder{{ID: 1, Name: "work"}},
+		Resources: []Resource{
+			{ID: 7, Type: "piece", Kind: "text", Meta: "note", Folder: 1, Tags: []string{"prod"}},
+			{ID: 9, Type: "blob", Kind: "binary", Meta: "dump"},
+		},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "export passphrase", testKDF, manifest)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteEntry(Entry{ID: 7, Size: 5}, strings.NewReader("hello")))
+	blob := bytes.Repeat([]byte("x"), 100*1024)
+	require.NoError(t, w.WriteEntry(Entry{ID: 9, Size: int64(len(blob)), Opaque: true}, bytes.NewReader(blob)))
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+	data := testArchive(t)
+
+	r, err := NewReader(bytes.NewReader(data), "export passphrase")
+	require.NoError(t, err)
+	assert.Equal(t, Version1, r.Manifest.Version)
+	assert.Equal(t, []Folder{{ID: 1, Name: "work"}}, r.Manifest.Folders)
+	require.Len(t, r.Manifest.Resources, 2)
+	assert.Equal(t, []string{"prod"}, r.Manifest.Resources[0].Tags)
+
+	entry, content, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, Entry{ID: 7, Size: 5}, entry)
+	piece, err := io.ReadAll(content)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(piece))
+
+	// unread content is skipped
+	entry, _, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, Entry{ID: 9, Size: 100 * 1024, Opaque: true}, entry)
+
+	_, _, err = r.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestArchive_Damaged(t *testing.T) {
+	data := testArchive(t)
+
+	_, err := NewReader(bytes.NewReader(data), "wrong passphrase")
+	assert.ErrorIs(t, err, ErrPassphrase)
+
+	_, err = NewReader(strings.NewReader("not an archive"), "export passphrase")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	// a truncated archive never reaches its end
+	r, err := NewReader(bytes.NewReader(data[:len(data)-100]), "export passphrase")
+	require.NoError(t, err)
+	for err == nil {
+		_, _, err = r.Next()
+	}
+	assert.NotErrorIs(t, err, io.EOF)
+
+	tampered := bytes.Clone(data)
+	tampered[len(tampered)-200] ^= 1
+	r, err = NewReader(bytes.NewReader(tampered), "export passphrase")
+	require.NoError(t, err)
+	for err == nil {
+		_, _, err = r.Next()
+	}
+	assert.ErrorIs(t, err, ErrPassphrase)
+}
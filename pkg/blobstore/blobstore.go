@@ -0,0 +1,44 @@
+// Package blobstore implements storage backends for blob contents. Blobs
+// are encrypted before they reach a backend, backends only keep bytes by key.
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = fmt.Errorf("blob not found")
+	ErrInvalidKey = fmt.Errorf("invalid blob key")
+)
+
+// Info describes a stored blob
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// checkKey allows keys usable as a single file name and an object name
+func checkKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// contextReader stops reading once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
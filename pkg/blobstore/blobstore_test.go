@@ -0,0 +1,400 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backend interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	GetFrom(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	List(ctx context.Context, fn func(Info) error) error
+}
+
+// testBackend runs the checks every backend must pass
+func testBackend(t *testing.T, b backend) {
+	ctx := context.Background()
+	content := make([]byte, 3000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	size, err := b.Put(ctx, "0f1e2d3c-blob", bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	r, err := b.Get(ctx, "0f1e2d3c-blob")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+
+	for _, offset := range []int64{0, 1, 2999} {
+		r, err = b.GetFrom(ctx, "0f1e2d3c-blob", offset)
+		require.NoError(t, err)
+		got, err = io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, content[offset:], got, "offset %d", offset)
+	}
+	_, err = b.GetFrom(ctx, "missing", 10)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	info, err := b.Stat(ctx, "0f1e2d3c-blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	// replaced as a whole
+	_, err = b.Put(ctx, "0f1e2d3c-blob", strings.NewReader("short"))
+	require.NoError(t, err)
+	info, err = b.Stat(ctx, "0f1e2d3c-blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+
+	_, err = b.Put(ctx, "empty", strings.NewReader(""))
+	require.NoError(t, err)
+	info, err = b.Stat(ctx, "empty")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size)
+	assert.Equal(t, map[string]int64{"0f1e2d3c-blob": 5, "empty": 0}, listed(t, b))
+
+	require.NoError(t, b.Delete(ctx, "0f1e2d3c-blob"))
+	require.NoError(t, b.Delete(ctx, "0f1e2d3c-blob"), "deleting a missing blob is fine")
+	_, err = b.Get(ctx, "0f1e2d3c-blob")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = b.Stat(ctx, "0f1e2d3c-blob")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	for _, key := range []string{"", "..", "a/b", `a\b`, ".hidden"} {
+		_, err = b.Put(ctx, key, strings.NewReader("x"))
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+		_, err = b.Get(ctx, key)
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+	}
+}
+
+// listed returns the sizes of the blobs the backend lists by key
+func listed(t *testing.T, b backend) map[string]int64 {
+	sizes := map[string]int64{}
+	require.NoError(t, b.List(context.Background(), func(info Info) error {
+		assert.False(t, info.ModTime.IsZero())
+		sizes[info.Key] = info.Size
+		return nil
+	}))
+	return sizes
+}
+
+func TestFS(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFS(root)
+	require.NoError(t, err)
+	testBackend(t, fs)
+
+	// sharded by the first characters of the key, no temporary files left
+	_, err = fs.Put(context.Background(), "abcdef", strings.NewReader("data"))
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(root, "ab", "cd"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "abcdef", entries[0].Name())
+
+	// temporary files of writes in progress are not blobs
+	require.NoError(t, os.WriteFile(filepath.Join(root, "ab", "cd", ".abcdef.123"), []byte("partial"), 0o600))
+	assert.Equal(t, map[string]int64{"empty": 0, "abcdef": 4}, listed(t, fs))
+}
+
+func TestFS_Flat(t *testing.T) {
+	// blobs written before sharding are kept directly in the root
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "legacy-blob"), []byte("old"), 0o600))
+	fs, err := NewFS(root)
+	require.NoError(t, err)
+
+	r, err := fs.Get(context.Background(), "legacy-blob")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "old", string(got))
+
+	assert.Equal(t, map[string]int64{"legacy-blob": 3}, listed(t, fs))
+
+	require.NoError(t, fs.Delete(context.Background(), "legacy-blob"))
+	_, err = os.Stat(filepath.Join(root, "legacy-blob"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFS_Canceled(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewFS(root)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.Put(ctx, "abcdef", strings.NewReader("data"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// neither the blob nor the temporary file is left
+	entries, err := os.ReadDir(filepath.Join(root, "ab", "cd"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestS3(t *testing.T) {
+	fake := newFakeS3(t, "bucket")
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s3, err := NewS3(S3Config{
+		Endpoint:  ts.URL,
+		Bucket:    "bucket",
+		AccessKey: fakeAccessKey,
+		SecretKey: fakeSecretKey,
+		Prefix:    "blobs/",
+		PartSize:  1024,
+	}, ts.Client())
+	require.NoError(t, err)
+	testBackend(t, s3)
+
+	// 3000 bytes in parts of 1024 bytes
+	assert.Equal(t, 1, fake.multipart)
+	assert.Empty(t, fake.uploads, "completed uploads are gone")
+	assert.Contains(t, fake.objects, "blobs/empty")
+
+	_, err = s3.Put(context.Background(), "abcdef", strings.NewReader("data"))
+	require.NoError(t, err)
+	// listed a page at a time, objects out of the prefix are skipped
+	fake.objects["other"] = []byte("x")
+	assert.Equal(t, map[string]int64{"empty": 0, "abcdef": 4}, listed(t, s3))
+	assert.Greater(t, fake.pages, 1)
+
+	wrong, err := NewS3(S3Config{Endpoint: ts.URL, Bucket: "bucket", AccessKey: fakeAccessKey, SecretKey: "wrong"}, ts.Client())
+	require.NoError(t, err)
+	_, err = wrong.Get(context.Background(), "abcdef")
+	assert.EqualError(t, err, "s3: SignatureDoesNotMatch: signature mismatch")
+}
+
+func TestS3_AbortUpload(t *testing.T) {
+	fake := newFakeS3(t, "bucket")
+	fake.failPart = 2
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s3, err := NewS3(S3Config{
+		Endpoint: ts.URL, Bucket: "bucket", AccessKey: fakeAccessKey, SecretKey: fakeSecretKey, PartSize: 16,
+	}, ts.Client())
+	require.NoError(t, err)
+
+	_, err = s3.Put(context.Background(), "abcdef", bytes.NewReader(make([]byte, 100)))
+	assert.Error(t, err)
+	assert.Empty(t, fake.uploads, "failed upload is aborted")
+	assert.NotContains(t, fake.objects, "abcdef")
+}
+
+func TestSignatureV4(t *testing.T) {
+	// GET Object example of the AWS Signature Version 4 documentation
+	header := http.Header{}
+	header.Set("Range", "bytes=0-9")
+	header.Set("X-Amz-Content-Sha256", emptyHash)
+	header.Set("X-Amz-Date", "20130524T000000Z")
+	signature := signatureV4(
+		"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "us-east-1",
+		http.MethodGet, "/test.txt", url.Values{}, "examplebucket.s3.amazonaws.com",
+		header, []string{"host", "range", "x-amz-content-sha256", "x-amz-date"},
+		emptyHash, "20130524T000000Z",
+	)
+	assert.Equal(t, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41", signature)
+}
+
+const (
+	fakeAccessKey = "access"
+	fakeSecretKey = "secret"
+)
+
+// fakeS3 is an in-memory stand-in of an S3 compatible storage checking
+// request signatures
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	mu        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	multipart int
+	failPart  int
+	pages     int
+}
+
+func newFakeS3(t *testing.T, bucket string) *fakeS3 {
+	return &fakeS3{t: t, bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.verify(r) {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", "signature mismatch")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	require.NoError(f.t, err)
+	if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		f.fail(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash mismatch")
+		return
+	}
+	key, found := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !found {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket", "no such bucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+f.multipart+1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", "no such upload")
+			return
+		}
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		if number == f.failPart {
+			f.fail(w, http.StatusInternalServerError, "InternalError", "failed part")
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", "no such upload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		require.NoError(f.t, xml.Unmarshal(body, &complete))
+		var numbers []int
+		for _, p := range complete.Parts {
+			assert.Equal(f.t, fmt.Sprintf(`"part-%d"`, p.PartNumber), p.ETag)
+			numbers = append(numbers, p.PartNumber)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		f.multipart++
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil && offset < len(object) {
+			w.Header().Set("Content-Length", fmt.Sprint(len(object)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(object[offset:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+		w.Write(object)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// list writes the ListObjectsV2 page of the query, a single object per
+// page so that listing has to continue
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	f.pages++
+	fmt.Fprint(w, "<ListBucketResult>")
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			keys[0], len(f.objects[keys[0]]), time.Now().UTC().Format(time.RFC3339))
+	}
+	if len(keys) > 1 {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// verify recomputes the signature of the request as S3 does
+func (f *fakeS3) verify(r *http.Request) bool {
+	var credential, signedHeaders, signature string
+	for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) < 8 || credential != fakeAccessKey+"/"+credentialScope(amzDate, "us-east-1") {
+		return false
+	}
+	expected := signatureV4(fakeSecretKey, "us-east-1", r.Method, r.URL.EscapedPath(), r.URL.Query(), r.Host,
+		r.Header, strings.Split(signedHeaders, ";"), r.Header.Get("X-Amz-Content-Sha256"), amzDate)
+	return expected == signature
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
@@ -0,0 +1,171 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS keeps blobs as files in a directory tree sharded by the first key
+// characters, so no directory grows too large. Files are written to a
+// temporary file, synced and renamed, so a blob is either complete or absent.
+type FS struct {
+	root string
+}
+
+// NewFS returns FS keeping blobs under the root directory, the directory
+// is created if missing.
+func NewFS(root string) (*FS, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &FS{root: root}, nil
+}
+
+// Put writes the blob and returns its size, an existing blob is replaced
+func (f *FS) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	location := f.path(key)
+	dir := filepath.Dir(location)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+key+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+
+	size, err := io.Copy(tmp, contextReader{ctx: ctx, r: r})
+	if err != nil {
+		_ = tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), location); err != nil {
+		return 0, err
+	}
+	return size, syncDir(dir)
+}
+
+// Get opens the blob for reading
+func (f *FS) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		file, err = os.Open(f.flatPath(key))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// GetFrom opens the blob for reading from the offset to the end
+func (f *FS) GetFrom(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	r, err := f.Get(ctx, key)
+	if err != nil || offset == 0 {
+		return r, err
+	}
+	if _, err := r.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Delete removes the blob, a missing blob is not an error
+func (f *FS) Delete(_ context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	for _, location := range []string{f.path(key), f.flatPath(key)} {
+		if err := os.Remove(location); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat returns size and modification time of the blob
+func (f *FS) Stat(_ context.Context, key string) (Info, error) {
+	if err := checkKey(key); err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, err = os.Stat(f.flatPath(key))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// List calls fn for every blob until it returns an error, temporary files
+// of writes in progress are skipped
+func (f *FS) List(ctx context.Context, fn func(Info) error) error {
+	return filepath.WalkDir(f.root, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || checkKey(entry.Name()) != nil {
+			return nil
+		}
+		fi, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(Info{Key: entry.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+// path returns the sharded location of the blob, "abcdef" is kept as "ab/cd/abcdef"
+func (f *FS) path(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(f.root, key)
+	}
+	return filepath.Join(f.root, key[:2], key[2:4], key)
+}
+
+// flatPath is the location of blobs written before sharding, directly in root
+func (f *FS) flatPath(key string) string {
+	return filepath.Join(f.root, key)
+}
+
+// syncDir makes the rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,451 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPartSize = 8 << 20
+	emptyHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+// S3Config configures an S3 compatible object storage
+type S3Config struct {
+	Endpoint    string // Endpoint is the base url, e.g. https://s3.eu-west-1.amazonaws.com.
+	Region      string // Region is used for request signing.
+	Bucket      string // Bucket keeps the blobs.
+	AccessKey   string
+	SecretKey   string
+	Prefix      string // Prefix is prepended to blob keys.
+	VirtualHost bool   // VirtualHost addresses the bucket as a subdomain instead of a path.
+	PartSize    int    // PartSize of multipart uploads, S3 requires at least 5 MiB.
+}
+
+// S3 keeps blobs as objects of an S3 compatible storage like AWS S3 or
+// MinIO. Requests are signed with AWS Signature Version 4. Contents up to
+// PartSize are uploaded in a single request, larger ones in parts, so only
+// one part is buffered in memory.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns S3 storing blobs in the configured bucket, nil client
+// means http.DefaultClient.
+func NewS3(cfg S3Config, client *http.Client) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3 endpoint: unsupported scheme %q", endpoint.Scheme)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+// Put uploads the blob and returns its size, an existing blob is replaced
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	var part = make([]byte, s.cfg.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), s.putObject(ctx, key, part[:n])
+	}
+	if err != nil {
+		return 0, err
+	}
+	return s.putMultipart(ctx, key, part, r)
+}
+
+// Get opens the blob for reading
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetFrom opens the blob for reading from the offset to the end
+func (s *S3) GetFrom(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.send(ctx, http.MethodGet, key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && offset > 0 {
+		// the range is ignored by the storage
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: range request answered with status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the blob, a missing blob is not an error
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stat returns size and modification time of the blob
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if err := checkKey(key); err != nil {
+		return Info{}, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	var info = Info{Key: key, Size: resp.ContentLength}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modified
+	}
+	return info, nil
+}
+
+// List calls fn for every blob under the prefix until it returns an
+// error, objects of other names are skipped
+func (s *S3) List(ctx context.Context, fn func(Info) error) error {
+	var query = url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+	for {
+		var page struct {
+			IsTruncated bool
+			Contents    []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			NextContinuationToken string
+		}
+		if err := s.doBucketXML(ctx, query, &page); err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(object.Key, s.cfg.Prefix)
+			if checkKey(key) != nil {
+				continue
+			}
+			if err := fn(Info{Key: key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *S3) putObject(ctx context.Context, key string, content []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, nil, content)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// putMultipart uploads the first part read already and the rest of r in
+// parts, the upload is aborted on failure so no parts are left behind.
+func (s *S3) putMultipart(ctx context.Context, key string, part []byte, r io.Reader) (int64, error) {
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &initiate); err != nil {
+		return 0, err
+	}
+	var uploadID = url.Values{"uploadId": {initiate.UploadID}}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var (
+		complete struct {
+			XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+			Parts   []completedPart `xml:"Part"`
+		}
+		size int64
+	)
+	uploadError := func() error {
+		for number := 1; len(part) > 0; number++ {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(number)},
+				"uploadId":   {initiate.UploadID},
+			}
+			resp, err := s.do(ctx, http.MethodPut, key, query, part)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+			size += int64(len(part))
+
+			n, err := io.ReadFull(r, part[:cap(part)])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			part = part[:n]
+		}
+		body, err := xml.Marshal(&complete)
+		if err != nil {
+			return err
+		}
+		return s.doXML(ctx, http.MethodPost, key, uploadID, body, nil)
+	}()
+	if uploadError != nil {
+		// a fresh context, the failure may be the canceled one
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, err := s.do(abortCtx, http.MethodDelete, key, uploadID, nil); err == nil {
+			resp.Body.Close()
+		}
+		return 0, uploadError
+	}
+	return size, nil
+}
+
+// doXML sends the request and decodes the XML response into v if given.
+// S3 may report a failure of a completed upload in a 200 response, so the
+// body is checked for an error document too.
+func (s *S3) doXML(ctx context.Context, method, key string, query url.Values, body []byte, v any) error {
+	resp, err := s.do(ctx, method, key, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var failure s3Error
+	if xml.Unmarshal(data, &failure) == nil && failure.XMLName.Local == "Error" {
+		return &failure
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// doBucketXML sends the GET request of the bucket and decodes the XML
+// response into v
+func (s *S3) doBucketXML(ctx context.Context, query url.Values, v any) error {
+	resp, err := s.request(ctx, http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends the signed request, a response with a failure status is
+// returned as an error, 404 as ErrNotFound.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	return s.send(ctx, method, key, query, nil, body)
+}
+
+// send is do with additional headers, they are signed too
+func (s *S3) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	return s.request(ctx, method, s.cfg.Prefix+key, query, header, body)
+}
+
+// request sends the signed request of the object, the bucket itself for an
+// empty object path
+func (s *S3) request(ctx context.Context, method, objectPath string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var u = *s.endpoint
+	if s.cfg.VirtualHost {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	} else {
+		objectPath = s.cfg.Bucket + "/" + objectPath
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + objectPath
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + uriEncode(objectPath, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var failure = s3Error{Status: resp.StatusCode}
+	if data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil {
+		_ = xml.Unmarshal(data, &failure)
+	}
+	return nil, &failure
+}
+
+// sign adds the AWS Signature Version 4 authorization to the request
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaders)
+
+	signature := signatureV4(s.cfg.SecretKey, s.cfg.Region, req.Method, req.URL.EscapedPath(), req.URL.Query(),
+		req.Host, req.Header, signedHeaders, payloadHash, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, credentialScope(amzDate, s.cfg.Region), strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// signatureV4 computes the request signature, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signatureV4(secretKey, region, method, escapedPath string, query url.Values, host string,
+	header http.Header, signedHeaders []string, payloadHash, amzDate string) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope(amzDate, region),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func credentialScope(amzDate, region string) string {
+	return amzDate[:8] + "/" + region + "/s3/aws4_request"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by name as signing requires
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes all but unreserved characters, slashes are kept
+// unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error is the error document of S3
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Status  int      `xml:"-"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
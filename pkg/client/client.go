@@ -1,32 +1,1421 @@
+// Package client contains gophkeeper command line client logic
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+var (
+	ErrUnknownCommand   = fmt.Errorf("unknown command")
+	ErrNoCredentials    = fmt.Errorf("login and password required")
+	ErrNoResourceID     = fmt.Errorf("resource id required")
+	ErrNoVersion        = fmt.Errorf("resource version required")
+	ErrNoNewPassword    = fmt.Errorf("new password required")
+	ErrNoSession        = fmt.Errorf("session id required")
+	ErrNoOTP            = fmt.Errorf("one-time code of the second factor required")
+	ErrNoGrantee        = fmt.Errorf("grantee login required")
+	ErrNoOrg            = fmt.Errorf("organisation id required")
+	ErrNoTeam           = fmt.Errorf("team id required")
+	ErrNoMember         = fmt.Errorf("member login required")
+	ErrNoName           = fmt.Errorf("name required")
+	ErrNoFolder         = fmt.Errorf("folder id required")
+	ErrNoTag            = fmt.Errorf("tag required")
+	ErrBadField         = fmt.Errorf("custom field must be name=value")
+	ErrNoFile           = fmt.Errorf("file required")
+	ErrNoExportPass     = fmt.Errorf("export passphrase required")
+	ErrNoFormat         = fmt.Errorf("import format required")
+	ErrBadMapping       = fmt.Errorf("column mapping must be field=column")
+	ErrImportFailed     = fmt.Errorf("items failed to import")
+	ErrBadChunkSize     = fmt.Errorf("chunk size must be a multiple of 64 KiB")
+	ErrResumeEncrypted  = fmt.Errorf("uploads encrypted on the client can't be resumed by another run")
+	ErrUnauthorized     = fmt.Errorf("unauthorized")
+	ErrForbidden        = fmt.Errorf("forbidden")
+	ErrNotFound         = fmt.Errorf("resource not found")
+	ErrConflict         = fmt.Errorf("conflict")
+	ErrBadRequest       = fmt.Errorf("bad request")
+	ErrNoPassphrase     = fmt.Errorf("passphrase required for client side encryption")
+	ErrWeakPassphrase   = fmt.Errorf("passphrase must differ from password")
+	ErrStale            = fmt.Errorf("resource changed on the server")
+	ErrCorrupted        = fmt.Errorf("content does not match its digest")
+	ErrQuotaExceeded    = fmt.Errorf("quota exceeded")
+	ErrOffline          = fmt.Errorf("command requires connection to the server")
+	ErrUnexpectedStatus = fmt.Errorf("unexpected status")
 )
 
+// Client talks to the gophkeeper server over its REST API and executes
+// a single command selected by Options.Command.
 type Client struct {
-	// TODO: implement me
-	options options
+	options Options
+	http    *http.Client
+	out     io.Writer
+	ctx     context.Context
+	token   string
+	refresh string            // refresh token of the session
+	keyring *envelope.Keyring // set when passphrase is given
+	kdf     envelope.KDFParams
+	offline bool // work with the local replica only
 }
 
-type options struct {
-	// TODO: implement me
-	URL     string        `short:"s" long:"server" env:"SERVER" default:"localhost:8080" description:"server connection address"`
-	Command string        `short:"c" long:"command" env:"COMMAND" default:"list" description:"command to execute"`
-	Timeout time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"10s" description:"connection timeout"`
-	Dbg     bool          `long:"dbg" env:"DEBUG" description:"show debug info"`
+// Options contains all command line parameters of the client
+type Options struct {
+	URL        string        `short:"s" long:"server" env:"SERVER" default:"localhost:8080" description:"server connection address"`
+	Command    string        `short:"c" long:"command" env:"COMMAND" default:"list" description:"command to execute"`
+	Timeout    time.Duration `short:"t" long:"timeout" env:"TIMEOUT" default:"10s" description:"connection timeout"`
+	Login      string        `short:"u" long:"login" env:"LOGIN" description:"user login"`
+	Password   string        `short:"p" long:"password" env:"PASSWORD" description:"user password"`
+	NewPass    string        `long:"new-password" env:"NEW_PASSWORD" description:"new user password for the change-password command"`
+	RID        int64         `short:"r" long:"rid" description:"resource id for get and delete commands"`
+	Session    string        `long:"session" description:"session id for the revoke-session command"`
+	OTP        string        `long:"otp" env:"OTP" description:"one-time code of the authenticator app or a recovery code"`
+	Grantee    string        `long:"grantee" description:"login of the user to share the resource with or to unshare"`
+	Permission string        `long:"permission" default:"read" choice:"read" choice:"write" description:"permission of the grantee for the share command"`
+	Org        int64         `long:"org" description:"organisation id for the organisation and team commands"`
+	Team       int64         `long:"team" description:"team id for the team commands, add commands store into the team vault"`
+	Member     string        `long:"member" description:"login of the organisation or team member to add or remove"`
+	Role       string        `long:"role" default:"viewer" choice:"owner" choice:"admin" choice:"editor" choice:"viewer" description:"role of the member for the set-member command"`
+	Name       string        `long:"name" description:"name of the organisation, team or folder to create or rename"`
+	Folder     int64         `long:"folder" description:"folder id, list shows the folder only, move puts the resource into it"`
+	Parent     int64         `long:"parent" description:"parent folder id for the create-folder and move-folder commands, zero is the root"`
+	Tag        string        `long:"tag" description:"tag to add or remove, list shows the tagged resources only"`
+	Type       string        `long:"type" choice:"piece" choice:"blob" description:"list shows the resources of the type only"`
+	Search     string        `long:"search" description:"list shows the resources with titles or meta matching the web search query only"`
+	Sort       string        `long:"sort" description:"sort of the list: id, name, created or updated, prefix - for the descending order"`
+	Limit      int           `long:"limit" description:"list shows a single page of the size and the cursor of the next page"`
+	Cursor     string        `long:"cursor" description:"cursor of the list page to show"`
+	Version    int64         `long:"version" description:"resource version for the restore command"`
+	Meta       string        `short:"m" long:"meta" description:"meta information of the stored resource"`
+	File       string        `long:"file" description:"file to upload or to save downloaded content to, archive of the export and import commands"`
+	ExportPass string        `long:"export-passphrase" env:"EXPORT_PASSPHRASE" description:"passphrase of the archive of the export and import commands"`
+	Text       string        `long:"text" description:"text to store"`
+	ChunkSize  int64         `long:"chunk-size" default:"8388608" description:"add-file uploads larger files in resumable chunks of the size, a multiple of 64 KiB"`
+	Upload     string        `long:"upload" description:"id of the interrupted upload the add-file command resumes"`
+
+	ImportFormat string   `long:"format" choice:"keepass" choice:"bitwarden" choice:"1password" choice:"lastpass" choice:"csv" description:"format of the file of the import-from command"`
+	SourcePass   string   `long:"source-password" env:"SOURCE_PASSWORD" description:"password of the KeePass database of the import-from command"`
+	Mapping      []string `long:"map" description:"CSV column of an item field as field=column for the import-from command, repeat for more"`
+	DryRun       bool     `long:"dry-run" description:"import-from only parses and validates the file, nothing is stored"`
+
+	ZeroKnowledge bool   `long:"zero-knowledge" env:"ZERO_KNOWLEDGE" description:"encrypt secrets on the client, the server gets ciphertext only"`
+	Passphrase    string `long:"passphrase" env:"PASSPHRASE" description:"passphrase of client side encryption, must differ from password"`
+
+	Creds struct {
+		URL      string `long:"url" description:"site or service url"`
+		Login    string `long:"login" description:"stored login"`
+		Password string `long:"password" description:"stored password"`
+		TOTPSeed string `long:"totp" description:"stored base32 TOTP seed"`
+	} `group:"credentials" namespace:"creds"`
+
+	Card struct {
+		Number string `long:"number" description:"card number"`
+		Holder string `long:"holder" description:"card holder name"`
+		Expiry string `long:"expiry" description:"card expiry date, MM/YY"`
+		CVV    string `long:"cvv" description:"card verification value"`
+	} `group:"card" namespace:"card"`
+
+	Details struct {
+		Title  string   `long:"title" description:"title of the resource"`
+		Notes  string   `long:"notes" description:"notes on the resource, stored unencrypted"`
+		URLs   []string `long:"url" description:"url of the resource, repeat for more"`
+		Fields []string `long:"field" description:"custom field as name=value, repeat for more"`
+	} `group:"details" namespace:"details"`
+
+	Offline bool   `long:"offline" env:"OFFLINE" description:"work with the local replica only, changes are pushed by the next sync"`
+	Cache   string `long:"cache" env:"CACHE" description:"local replica file, per user and server file in the user config dir by default"`
+
+	Dbg bool `long:"dbg" env:"DEBUG" description:"show debug info"`
 }
 
-func NewClient(opts options) *Client {
-	return &Client{
+type secretMessage struct {
+	Meta   string          `json:"meta"`
+	Data   json.RawMessage `json:"data"`
+	Opaque bool            `json:"opaque,omitempty"`
+}
+
+// encryptionHeader marks blob bodies encrypted by the client
+const (
+	encryptionHeader   = "X-Encryption"
+	encryptionEnvelope = "envelope"
+)
+
+type resource struct {
+	ID      int64
+	Type    int
+	Kind    secret.Kind
+	Meta    string
+	Version int64
+	Team    int64
+	Folder  int64
+	Tags    []string
+}
+
+const (
+	resourceTypePiece = iota + 1
+	resourceTypeBlob
+)
+
+// NewClient creates a new Client with the given options
+func NewClient(opts Options) *Client {
+	if !strings.HasPrefix(opts.URL, "http://") && !strings.HasPrefix(opts.URL, "https://") {
+		opts.URL = "http://" + opts.URL
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	c := &Client{
 		options: opts,
+		http:    &http.Client{Timeout: opts.Timeout},
+		out:     os.Stdout,
+		ctx:     context.Background(),
+		kdf:     envelope.DefaultKDF,
 	}
+	if opts.Passphrase != "" {
+		c.keyring = envelope.NewKeyring(opts.Passphrase, opts.Login, c.kdf)
+	}
+	return c
 }
 
+// Run executes the command given in options.
+//
+// Every command except register and dry runs of import-from logs in first
+// and uses the received token for the rest of the session, the session is
+// closed when the command is done. In offline mode, or when the server
+// can't be reached and a local replica exists, commands work with the
+// replica.
 func (c *Client) Run(ctx context.Context) error {
-	// TODO: implement me
-	fmt.Printf("gophkeeper client command %s\n", c.options.Command)
+	c.ctx = ctx
+
+	commands := map[string]func() error{
+		"register":           c.Register,
+		"list":               c.List,
+		"add-credentials":    c.AddCredentials,
+		"get-credentials":    c.GetCredentials,
+		"add-text":           c.AddText,
+		"get-text":           c.GetText,
+		"add-file":           c.AddFile,
+		"get-file":           c.GetFile,
+		"add-card":           c.AddCard,
+		"get-card":           c.GetCard,
+		"update-credentials": c.UpdateCredentials,
+		"update-text":        c.UpdateText,
+		"update-card":        c.UpdateCard,
+		"update-file":        c.UpdateFile,
+		"delete":             c.Delete,
+		"versions":           c.Versions,
+		"restore":            c.Restore,
+		"sync":               c.Sync,
+		"conflicts":          c.Conflicts,
+		"change-password":    c.ChangePassword,
+		"sessions":           c.Sessions,
+		"revoke-session":     c.RevokeSession,
+		"totp-enroll":        c.EnrollTOTP,
+		"totp-enable":        c.EnableTOTP,
+		"totp-disable":       c.DisableTOTP,
+		"recovery-codes":     c.RecoveryCodes,
+		"usage":              c.Usage,
+		"share":              c.Share,
+		"grants":             c.Grants,
+		"unshare":            c.Unshare,
+		"shared":             c.Shared,
+		"orgs":               c.Orgs,
+		"create-org":         c.CreateOrg,
+		"org-members":        c.OrgMembers,
+		"set-member":         c.SetMember,
+		"remove-member":      c.RemoveMember,
+		"teams":              c.Teams,
+		"create-team":        c.CreateTeam,
+		"delete-team":        c.DeleteTeam,
+		"team-members":       c.TeamMembers,
+		"add-team-member":    c.AddTeamMember,
+		"remove-team-member": c.RemoveTeamMember,
+		"folders":            c.Folders,
+		"create-folder":      c.CreateFolder,
+		"rename-folder":      c.RenameFolder,
+		"move-folder":        c.MoveFolder,
+		"delete-folder":      c.DeleteFolder,
+		"move":               c.Move,
+		"tag":                c.Tag,
+		"untag":              c.Untag,
+		"set-details":        c.SetDetails,
+		"export":             c.Export,
+		"import":             c.Import,
+		"import-from":        c.ImportFrom,
+	}
+	cmd, ok := commands[c.options.Command]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, c.options.Command)
+	}
+	if c.options.ZeroKnowledge && c.keyring == nil {
+		return ErrNoPassphrase
+	}
+	if c.keyring != nil && c.options.Passphrase == c.options.Password {
+		// the server sees the password on login and could derive the key
+		return ErrWeakPassphrase
+	}
+	c.offline = c.options.Offline
+	local := c.options.Command == "import-from" && c.options.DryRun
+	if c.options.Command != "register" && c.options.Command != "conflicts" && !local && !c.offline {
+		if err := c.login(); err != nil {
+			var urlErr *url.Error
+			if !errors.As(err, &urlErr) || !c.hasReplica() {
+				return err
+			}
+			fmt.Fprintf(c.out, "server is unreachable, working offline: %s\n", urlErr.Err)
+			c.offline = true
+		} else {
+			defer c.logout()
+		}
+	}
+	return cmd()
+}
+
+// Register creates a new user on the server
+func (c *Client) Register() error {
+	if c.options.Login == "" || c.options.Password == "" {
+		return ErrNoCredentials
+	}
+	resp, err := c.do(http.MethodPost, "/register", c.credsBody(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(c.out, "user %s registered\n", c.options.Login)
+	return nil
+}
+
+// List prints the resources of the vault selected by the list options.
+// Pages are followed to the end unless the limit option is set.
+func (c *Client) List() error {
+	if c.offline {
+		if c.options.Search != "" || c.options.Sort != "" || c.options.Limit != 0 || c.options.Cursor != "" {
+			return ErrOffline
+		}
+		return c.listReplica()
+	}
+	var (
+		resources []resource
+		cursor    = c.options.Cursor
+	)
+	for {
+		page, next, err := c.listPage(cursor)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, page...)
+		cursor = next
+		if cursor == "" || c.options.Limit != 0 {
+			break
+		}
+	}
+	if err := c.printResources(resources); err != nil {
+		return err
+	}
+	if cursor != "" {
+		fmt.Fprintf(c.out, "next cursor: %s\n", cursor)
+	}
+	return nil
+}
+
+// listPage requests the page of the list options after the cursor and
+// returns it with the cursor of the next page
+func (c *Client) listPage(cursor string) ([]resource, string, error) {
+	query := url.Values{}
+	if c.options.Type != "" {
+		query.Set("type", c.options.Type)
+	}
+	if c.options.Team != 0 {
+		query.Set("team", strconv.FormatInt(c.options.Team, 10))
+	}
+	if c.options.Folder != 0 {
+		query.Set("folder", strconv.FormatInt(c.options.Folder, 10))
+	}
+	if c.options.Tag != "" {
+		query.Set("tag", c.options.Tag)
+	}
+	if c.options.Search != "" {
+		query.Set("q", c.options.Search)
+	}
+	if c.options.Sort != "" {
+		query.Set("sort", c.options.Sort)
+	}
+	if c.options.Limit != 0 {
+		query.Set("limit", strconv.Itoa(c.options.Limit))
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	path := "/vault/"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := c.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var resources []resource
+	if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+		return nil, "", fmt.Errorf("failed to decode list: %w", err)
+	}
+	return resources, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// printResources prints the resources of the team, folder and tag options
+func (c *Client) printResources(resources []resource) error {
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tKIND\tTEAM\tFOLDER\tTAGS\tMETA")
+	for _, r := range resources {
+		if c.options.Team != 0 && r.Team != c.options.Team {
+			continue
+		}
+		if c.options.Folder != 0 && r.Folder != c.options.Folder {
+			continue
+		}
+		if c.options.Tag != "" && !slices.Contains(r.Tags, strings.ToLower(c.options.Tag)) {
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.ID, typeName(r.Type), r.Kind, teamName(r.Team), folderName(r.Folder), strings.Join(r.Tags, ","), r.Meta)
+	}
+	return w.Flush()
+}
+
+// AddCredentials stores a login/password pair
+func (c *Client) AddCredentials() error {
+	return c.addSecret(secret.KindCredentials, c.credentials())
+}
+
+// UpdateCredentials replaces a stored login/password pair and its meta
+func (c *Client) UpdateCredentials() error {
+	return c.updateSecret(secret.KindCredentials, c.credentials())
+}
+
+// GetCredentials prints a stored login/password pair
+func (c *Client) GetCredentials() error {
+	var creds secret.Credentials
+	meta, err := c.getSecret(secret.KindCredentials, &creds)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "url: %s\nlogin: %s\npassword: %s\n", creds.URL, creds.Username, creds.Password)
+	if creds.TOTPSeed != "" {
+		fmt.Fprintf(c.out, "totp seed: %s\n", creds.TOTPSeed)
+	}
+	fmt.Fprintf(c.out, "meta: %s\n", meta)
+	return nil
+}
+
+// AddText stores arbitrary text
+func (c *Client) AddText() error {
+	return c.addSecret(secret.KindText, secret.Text{Text: c.options.Text})
+}
+
+// UpdateText replaces stored text and its meta
+func (c *Client) UpdateText() error {
+	return c.updateSecret(secret.KindText, secret.Text{Text: c.options.Text})
+}
+
+// GetText prints stored text
+func (c *Client) GetText() error {
+	var text secret.Text
+	meta, err := c.getSecret(secret.KindText, &text)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s\nmeta: %s\n", text.Text, meta)
+	return nil
+}
+
+// AddCard stores bank card data
+func (c *Client) AddCard() error {
+	return c.addSecret(secret.KindCard, c.card())
+}
+
+// UpdateCard replaces stored bank card data and its meta
+func (c *Client) UpdateCard() error {
+	return c.updateSecret(secret.KindCard, c.card())
+}
+
+// GetCard prints stored bank card data
+func (c *Client) GetCard() error {
+	var card secret.Card
+	meta, err := c.getSecret(secret.KindCard, &card)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "number: %s\nholder: %s\nexpiry: %s\ncvv: %s\nmeta: %s\n", card.Number, card.Holder, card.Expiry, card.CVV, meta)
+	return nil
+}
+
+// AddFile uploads a file as a blob. In zero-knowledge mode the file is
+// encrypted into a stream envelope on the fly. Files larger than the chunk
+// size are uploaded in resumable chunks, as is the upload of the upload
+// option.
+func (c *Client) AddFile() error {
+	if c.offline {
+		return ErrOffline
+	}
+	file, err := os.Open(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", c.options.File, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if c.options.Upload != "" || info.Size() > c.chunkSize() {
+		return c.uploadFileChunked(file, info.Size())
+	}
+	resp, err := c.sendBlob(http.MethodPut, c.teamVault("/vault/binary/"), c.options.Meta, c.options.File, file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// UpdateFile replaces content and meta of a stored file keeping its rid
+func (c *Client) UpdateFile() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	return c.uploadFile(http.MethodPut, "/vault/binary/"+strconv.FormatInt(c.options.RID, 10))
+}
+
+// uploadFile sends the file as a blob body, encrypted in zero-knowledge mode
+func (c *Client) uploadFile(method, path string) error {
+	file, err := os.Open(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", c.options.File, err)
+	}
+	defer file.Close()
+
+	resp, err := c.sendBlob(method, path, c.options.Meta, c.options.File, file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// sendBlob sends the content of the named file as a blob body with the
+// meta. In zero-knowledge mode the content is encrypted into a stream
+// envelope on the fly.
+func (c *Client) sendBlob(method, path, meta, name string, content io.Reader) (*http.Response, error) {
+	body := content
+	headers := c.blobHeaders(meta, name)
+	if c.options.ZeroKnowledge {
+		body = c.encryptedContent(content)
+	}
+	return c.do(method, path, body, headers)
+}
+
+// blobHeaders returns the headers of the blob of the named file, its
+// content type is guessed from the extension. In zero-knowledge mode the
+// blob is marked as an envelope and the name is not sent.
+func (c *Client) blobHeaders(meta, name string) http.Header {
+	headers := http.Header{"X-Meta": {meta}}
+	if c.options.ZeroKnowledge {
+		headers.Set(encryptionHeader, encryptionEnvelope)
+		return headers
+	}
+	if name == "" {
+		return headers
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	headers.Set("Content-Type", contentType)
+	headers.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+	return headers
+}
+
+// GetFile downloads a blob to the given file or to stdout, a download
+// broken by the connection is resumed where it stopped. The content is
+// checked against the Digest header of the server.
+func (c *Client) GetFile() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	path := "/vault/binary/" + strconv.FormatInt(c.options.RID, 10)
+	resp, err := c.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	// a broken download continues from the bytes read
+	body := &resumingBody{c: c, path: path, etag: resp.Header.Get("ETag"), body: resp.Body}
+	defer body.Close()
+	digest, err := contentDigest(resp.Header.Get("Digest"))
+	if err != nil {
+		return err
+	}
+
+	var content io.Reader = body
+	if digest != nil {
+		content = &digestReader{r: body, digest: digest, hash: sha256.New()}
+	}
+	if resp.Header.Get(encryptionHeader) == encryptionEnvelope {
+		if c.keyring == nil {
+			return ErrNoPassphrase
+		}
+		if content, err = c.keyring.NewReader(content); err != nil {
+			return fmt.Errorf("failed to decrypt blob: %w", err)
+		}
+	}
+
+	if c.options.File == "" {
+		_, err = io.Copy(c.out, content)
+		return err
+	}
+
+	file, err := os.Create(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.options.File, err)
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", c.options.File, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "saved to %s, meta: %s\n", c.options.File, resp.Header.Get("X-Meta"))
+	return nil
+}
+
+// Delete removes a resource from the vault
+func (c *Client) Delete() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return c.queueChange(change{Op: changeDelete, RID: c.options.RID})
+	}
+	resp, err := c.do(http.MethodDelete, "/vault/"+strconv.FormatInt(c.options.RID, 10), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(c.out, "resource %d deleted\n", c.options.RID)
+	return nil
+}
+
+// Versions prints the current version of a resource and its kept revisions
+func (c *Client) Versions() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/vault/"+strconv.FormatInt(c.options.RID, 10)+"/versions", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var revisions []struct {
+		Version   int64
+		Meta      string
+		UpdatedBy string
+		UpdatedAt time.Time
+		Current   bool
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&revisions); err != nil {
+		return fmt.Errorf("failed to decode versions: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tUPDATED BY\tUPDATED AT\tMETA")
+	for _, r := range revisions {
+		version := strconv.FormatInt(r.Version, 10)
+		if r.Current {
+			version += " (current)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", version, r.UpdatedBy, r.UpdatedAt.Local().Format(time.DateTime), r.Meta)
+	}
+	return w.Flush()
+}
+
+// Restore makes the given version the current state of a resource, the
+// replaced state is kept as a revision.
+func (c *Client) Restore() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.options.Version == 0 {
+		return ErrNoVersion
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	path := "/vault/" + strconv.FormatInt(c.options.RID, 10) + "/versions/" + strconv.FormatInt(c.options.Version, 10) + "/restore"
+	resp, err := c.do(http.MethodPost, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// ChangePassword changes the user password on the server, the stored
+// secrets stay as they are. The local replica is sealed with the password,
+// so it is resealed with the new one.
+func (c *Client) ChangePassword() error {
+	if c.options.NewPass == "" {
+		return ErrNoNewPassword
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	r, err := c.loadReplica()
+	if err != nil && !errors.Is(err, ErrNoReplica) {
+		return err
+	}
+	hasReplica := err == nil
+
+	body, err := json.Marshal(struct {
+		Password    string `json:"password"`
+		NewPassword string `json:"new_password"`
+	}{c.options.Password, c.options.NewPass})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, "/account/password", bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	c.options.Password = c.options.NewPass
+	if hasReplica {
+		if err := c.saveReplica(r); err != nil {
+			return fmt.Errorf("password changed, failed to reseal local replica: %w", err)
+		}
+	}
+	fmt.Fprintf(c.out, "password of %s changed\n", c.options.Login)
 	return nil
 }
+
+// Sessions lists the open sessions of the user, the session of the client
+// is marked current
+func (c *Client) Sessions() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/sessions/", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var sessions []struct {
+		ID            string
+		UserAgent     string
+		IP            string
+		ZeroKnowledge bool
+		Current       bool
+		LastSeen      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return fmt.Errorf("failed to decode sessions: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID	LAST SEEN	IP	USER AGENT")
+	for _, s := range sessions {
+		id := s.ID
+		if s.Current {
+			id += " (current)"
+		}
+		if s.ZeroKnowledge {
+			id += " (zero-knowledge)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, s.LastSeen.Local().Format(time.DateTime), s.IP, s.UserAgent)
+	}
+	return w.Flush()
+}
+
+// Usage prints the usage of the vault of the user and of the team vaults of
+// the organisations of the user with their quotas
+func (c *Client) Usage() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/account/usage", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var vaults []struct {
+		Org       int64  `json:"org"`
+		Name      string `json:"name"`
+		Resources int64  `json:"resources"`
+		Bytes     int64  `json:"bytes"`
+		Uploads   int64  `json:"uploads"`
+		Quota     struct {
+			Resources int64 `json:"resources"`
+			Bytes     int64 `json:"bytes"`
+			BlobSize  int64 `json:"blob_size"`
+		} `json:"quota"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vaults); err != nil {
+		return fmt.Errorf("failed to decode usage: %w", err)
+	}
+
+	limit := func(used, quota int64) string {
+		if quota == 0 {
+			return strconv.FormatInt(used, 10)
+		}
+		return fmt.Sprintf("%d of %d", used, quota)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VAULT\tRESOURCES\tBYTES\tUPLOADS\tMAX BLOB")
+	for _, v := range vaults {
+		vault := "personal"
+		if v.Org != 0 {
+			vault = fmt.Sprintf("%s (org %d)", v.Name, v.Org)
+		}
+		maxBlob := "unlimited"
+		if v.Quota.BlobSize != 0 {
+			maxBlob = strconv.FormatInt(v.Quota.BlobSize, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", vault, limit(v.Resources, v.Quota.Resources),
+			limit(v.Bytes+v.Uploads, v.Quota.Bytes), v.Uploads, maxBlob)
+	}
+	return w.Flush()
+}
+
+// RevokeSession closes the session with the given id, e.g. of a lost device
+func (c *Client) RevokeSession() error {
+	if c.options.Session == "" {
+		return ErrNoSession
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodDelete, "/sessions/"+url.PathEscape(c.options.Session), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "session %s revoked\n", c.options.Session)
+	return nil
+}
+
+// EnrollTOTP generates a new TOTP secret of the user and prints it with the
+// otpauth:// URI to add to the authenticator app, e.g. as a QR code. The
+// second factor is required once enabled by totp-enable.
+func (c *Client) EnrollTOTP() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodPost, "/account/totp", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil {
+		return fmt.Errorf("failed to decode enrollment: %w", err)
+	}
+	fmt.Fprintf(c.out, "secret: %s\nuri: %s\n", enrollment.Secret, enrollment.URI)
+	fmt.Fprintln(c.out, "add the secret to the authenticator app and run totp-enable with its code")
+	return nil
+}
+
+// EnableTOTP requires the second factor at login from now on, the code of
+// the app is given by --otp. The recovery codes are printed once.
+func (c *Client) EnableTOTP() error {
+	if c.options.OTP == "" {
+		return ErrNoOTP
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	body, err := json.Marshal(struct {
+		Code string `json:"code"`
+	}{c.options.OTP})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, "/account/totp/enable", bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(c.out, "second factor of %s enabled\n", c.options.Login)
+	return c.printRecoveryCodes(resp.Body)
+}
+
+// DisableTOTP drops the second factor of the user
+func (c *Client) DisableTOTP() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodPost, "/account/totp/disable", c.passwordBody(), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "second factor of %s disabled\n", c.options.Login)
+	return nil
+}
+
+// RecoveryCodes replaces the recovery codes of the user and prints the new
+// ones
+func (c *Client) RecoveryCodes() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodPost, "/account/totp/recovery-codes", c.passwordBody(), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRecoveryCodes(resp.Body)
+}
+
+// Share gives the grantee read or write access to a resource, the grantee
+// reads and updates it by its id like an own resource. Secrets encrypted by
+// the client can't be shared.
+func (c *Client) Share() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.options.Grantee == "" {
+		return ErrNoGrantee
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	body, err := json.Marshal(struct {
+		Permission string `json:"permission"`
+	}{c.options.Permission})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPut, c.grantPath(), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "resource %d shared with %s, %s\n", c.options.RID, c.options.Grantee, c.options.Permission)
+	return nil
+}
+
+// Grants lists the users a resource is shared with
+func (c *Client) Grants() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/vault/"+strconv.FormatInt(c.options.RID, 10)+"/grants", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var grants []struct {
+		Grantee    string    `json:"grantee"`
+		Permission string    `json:"permission"`
+		GrantedBy  string    `json:"granted_by"`
+		CreatedAt  time.Time `json:"created_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&grants); err != nil {
+		return fmt.Errorf("failed to decode grants: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GRANTEE\tPERMISSION\tGRANTED AT")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", g.Grantee, g.Permission, g.CreatedAt.Local().Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+// Unshare revokes the access of the grantee to a resource, grantees may
+// unshare resources shared with them
+func (c *Client) Unshare() error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.options.Grantee == "" {
+		return ErrNoGrantee
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodDelete, c.grantPath(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "resource %d unshared with %s\n", c.options.RID, c.options.Grantee)
+	return nil
+}
+
+// Shared lists the resources other users shared with the user
+func (c *Client) Shared() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/vault/shared", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var shared []struct {
+		resource
+		Owner      string `json:"owner"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&shared); err != nil {
+		return fmt.Errorf("failed to decode shared resources: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tKIND\tOWNER\tPERMISSION\tMETA")
+	for _, r := range shared {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", r.ID, typeName(r.Type), r.Kind, r.Owner, r.Permission, r.Meta)
+	}
+	return w.Flush()
+}
+
+func (c *Client) grantPath() string {
+	return "/vault/" + strconv.FormatInt(c.options.RID, 10) + "/grants/" + url.PathEscape(c.options.Grantee)
+}
+
+func (c *Client) printRecoveryCodes(body io.Reader) error {
+	var response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode recovery codes: %w", err)
+	}
+	fmt.Fprintln(c.out, "recovery codes, each replaces a one-time code once, keep them safe:")
+	for _, code := range response.RecoveryCodes {
+		fmt.Fprintln(c.out, code)
+	}
+	return nil
+}
+
+// passwordBody is the body of requests confirmed by the password
+func (c *Client) passwordBody() io.Reader {
+	body, _ := json.Marshal(struct {
+		Password string `json:"password"`
+	}{c.options.Password})
+	return bytes.NewReader(body)
+}
+
+// login obtains an authorization token for the configured user
+func (c *Client) login() error {
+	if c.options.Login == "" || c.options.Password == "" {
+		return ErrNoCredentials
+	}
+	// in zero knowledge mode the session of the server keeps no data key
+	body, err := json.Marshal(struct {
+		Login         string `json:"username"`
+		Passw         string `json:"password"`
+		ZeroKnowledge bool   `json:"zero_knowledge,omitempty"`
+	}{c.options.Login, c.options.Password, c.options.ZeroKnowledge})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, "/login", bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return c.verifyLogin(resp)
+	}
+	return c.readTokens(resp)
+}
+
+// verifyLogin completes the login of a user with the second factor, the
+// challenge of the login response is answered with the one-time code
+func (c *Client) verifyLogin(resp *http.Response) error {
+	var challenge struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return fmt.Errorf("failed to decode challenge: %w", err)
+	}
+	if c.options.OTP == "" {
+		return ErrNoOTP
+	}
+	body, err := json.Marshal(struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}{challenge.ChallengeToken, c.options.OTP})
+	if err != nil {
+		return err
+	}
+	verified, err := c.do(http.MethodPost, "/login/verify", bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+	defer verified.Body.Close()
+	return c.readTokens(verified)
+}
+
+// readTokens keeps the tokens of the login or refresh response
+func (c *Client) readTokens(resp *http.Response) error {
+	c.token = resp.Header.Get("Authorization")
+	if c.token == "" {
+		return fmt.Errorf("%w: no token in response", ErrUnauthorized)
+	}
+	var tokens struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err == nil {
+		c.refresh = tokens.RefreshToken
+	}
+	return nil
+}
+
+// refreshSession replaces the expired access token using the refresh token
+func (c *Client) refreshSession() error {
+	body, err := json.Marshal(struct {
+		RefreshToken string `json:"refresh_token"`
+	}{c.refresh})
+	if err != nil {
+		return err
+	}
+	c.token, c.refresh = "", ""
+	resp, err := c.do(http.MethodPost, "/refresh", bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.readTokens(resp)
+}
+
+// logout closes the session, failures are ignored since the session
+// expires anyway
+func (c *Client) logout() {
+	if c.token == "" {
+		return
+	}
+	if resp, err := c.do(http.MethodPost, "/logout", nil, nil); err == nil {
+		resp.Body.Close()
+	}
+	c.token, c.refresh = "", ""
+}
+
+// addSecret stores a typed secret, the server validates it according to kind.
+// In zero-knowledge mode the secret is validated locally and sealed into an
+// envelope because the server can't look inside. Offline the secret is
+// validated locally and queued in the replica.
+func (c *Client) addSecret(kind secret.Kind, payload any) error {
+	msg, err := c.newSecretMessage(kind, c.options.Meta, payload)
+	if err != nil {
+		return err
+	}
+	if c.offline {
+		if c.options.Team != 0 {
+			// the replica queues changes of the own vault only
+			return ErrOffline
+		}
+		return c.queueChange(change{Op: changeAdd, Entry: &entry{
+			resource: resource{Type: resourceTypePiece, Kind: kind, Meta: msg.Meta},
+			Secret:   &msg,
+		}})
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPut, c.teamVault("/vault/"+string(kind)+"/"), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// updateSecret replaces data and meta of the secret with the given rid.
+// Offline the update is queued and pushed by sync unless the secret was
+// changed on the server meanwhile.
+func (c *Client) updateSecret(kind secret.Kind, payload any) error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	msg, err := c.newSecretMessage(kind, c.options.Meta, payload)
+	if err != nil {
+		return err
+	}
+	if c.offline {
+		return c.queueChange(change{Op: changeUpdate, RID: c.options.RID, Entry: &entry{
+			resource: resource{ID: c.options.RID, Type: resourceTypePiece, Kind: kind, Meta: msg.Meta},
+			Secret:   &msg,
+		}})
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	path := "/vault/" + string(kind) + "/" + strconv.FormatInt(c.options.RID, 10)
+	resp, err := c.do(http.MethodPut, path, bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// newSecretMessage encodes the secret payload for the server. In
+// zero-knowledge mode and offline the secret is validated locally, in
+// zero-knowledge mode it is also sealed into an envelope.
+func (c *Client) newSecretMessage(kind secret.Kind, meta string, payload any) (secretMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return secretMessage{}, err
+	}
+	msg := secretMessage{Meta: meta, Data: data}
+	if c.options.ZeroKnowledge || c.offline {
+		s := secret.Secret{Kind: kind, Data: data}
+		if err := s.Normalize(time.Now()); err != nil {
+			return secretMessage{}, err
+		}
+		msg.Data = s.Data
+	}
+	if c.options.ZeroKnowledge {
+		sealed, err := c.keyring.Seal(msg.Data)
+		if err != nil {
+			return secretMessage{}, err
+		}
+		if msg.Data, err = json.Marshal(sealed); err != nil {
+			return secretMessage{}, err
+		}
+		msg.Opaque = true
+	}
+	return msg, nil
+}
+
+func (c *Client) credentials() secret.Credentials {
+	return secret.Credentials{
+		URL:      c.options.Creds.URL,
+		Username: c.options.Creds.Login,
+		Password: c.options.Creds.Password,
+		TOTPSeed: c.options.Creds.TOTPSeed,
+	}
+}
+
+func (c *Client) card() secret.Card {
+	return secret.Card{
+		Number: c.options.Card.Number,
+		Holder: c.options.Card.Holder,
+		Expiry: c.options.Card.Expiry,
+		CVV:    c.options.Card.CVV,
+	}
+}
+
+// getSecret restores a typed secret into payload and returns its meta
+func (c *Client) getSecret(kind secret.Kind, payload any) (string, error) {
+	if c.options.RID == 0 {
+		return "", ErrNoResourceID
+	}
+	var (
+		msg secretMessage
+		err error
+	)
+	if c.offline {
+		msg, err = c.replicaSecret(kind, c.options.RID)
+	} else {
+		msg, err = c.fetchSecret(kind, c.options.RID)
+	}
+	if err != nil {
+		return "", err
+	}
+	if msg.Opaque {
+		if c.keyring == nil {
+			return "", ErrNoPassphrase
+		}
+		var sealed []byte
+		if err := json.Unmarshal(msg.Data, &sealed); err != nil {
+			return "", fmt.Errorf("failed to decode %s: %w", kind, err)
+		}
+		if msg.Data, err = c.keyring.Open(sealed); err != nil {
+			return "", fmt.Errorf("failed to decrypt %s: %w", kind, err)
+		}
+	}
+	if err := json.Unmarshal(msg.Data, payload); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+	return msg.Meta, nil
+}
+
+// fetchSecret downloads a typed secret as the server returns it
+func (c *Client) fetchSecret(kind secret.Kind, rid int64) (secretMessage, error) {
+	resp, err := c.do(http.MethodGet, "/vault/"+string(kind)+"/"+strconv.FormatInt(rid, 10), nil, nil)
+	if err != nil {
+		return secretMessage{}, err
+	}
+	defer resp.Body.Close()
+
+	var msg secretMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return secretMessage{}, fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+	return msg, nil
+}
+
+// hasReplica reports whether the local replica file exists
+func (c *Client) hasReplica() bool {
+	path, err := c.replicaPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (c *Client) printRID(body io.Reader) error {
+	var response struct {
+		RID     int64 `json:"rid"`
+		Version int64 `json:"version"`
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if response.Version != 0 {
+		fmt.Fprintf(c.out, "updated rid %d, version %d\n", response.RID, response.Version)
+		return nil
+	}
+	fmt.Fprintf(c.out, "stored with rid %d\n", response.RID)
+	return nil
+}
+
+func (c *Client) credsBody() io.Reader {
+	body, _ := json.Marshal(struct {
+		Login string `json:"username"`
+		Passw string `json:"password"`
+	}{c.options.Login, c.options.Password})
+	return bytes.NewReader(body)
+}
+
+// do sends a request to the server and checks the response status.
+// On success the caller owns the response body. An expired access token is
+// refreshed once if the body can be sent again.
+func (c *Client) do(method, path string, body io.Reader, headers http.Header) (*http.Response, error) {
+	resp, err := c.send(method, path, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && c.refresh != "" {
+		seeker, seekable := body.(io.Seeker)
+		if body == nil || seekable {
+			resp.Body.Close()
+			if err := c.refreshSession(); err != nil {
+				return nil, err
+			}
+			if seekable {
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+			if resp, err = c.send(method, path, body, headers); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		var response struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && response.Error != "" {
+			return nil, fmt.Errorf("%s %s: %w: %s", method, path, ErrBadRequest, response.Error)
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrBadRequest)
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrUnauthorized)
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrForbidden)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrNotFound)
+	case http.StatusConflict:
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrConflict)
+	case http.StatusPreconditionFailed:
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrStale)
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		var response struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && response.Error != "" {
+			return nil, fmt.Errorf("%s %s: %w: %s", method, path, ErrQuotaExceeded, response.Error)
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrQuotaExceeded)
+	}
+	return nil, fmt.Errorf("%s %s: %w %s", method, path, ErrUnexpectedStatus, resp.Status)
+}
+
+// send sends a request authorized by the access token
+func (c *Client) send(method, path string, body io.Reader, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, c.options.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return resp, nil
+}
+
+func typeName(t int) string {
+	switch t {
+	case resourceTypePiece:
+		return "piece"
+	case resourceTypeBlob:
+		return "blob"
+	}
+	return "unknown"
+}
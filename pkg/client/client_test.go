@@ -0,0 +1,1587 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// fakeVault emulates the server REST API with an in-memory store
+func fakeVault(t *testing.T) *httptest.Server {
+	ts, _ := fakeVaultStorage(t)
+	return ts
+}
+
+type fakeStorage struct {
+	secrets       map[string]secretMessage
+	blobs         map[string][]byte
+	opaque        map[string]bool
+	zeroKnowledge bool // of the last login
+}
+
+// fakeVaultStorage emulates the server and exposes its storage to check what the server sees
+func fakeVaultStorage(t *testing.T) (*httptest.Server, *fakeStorage) {
+	storage := &fakeStorage{secrets: map[string]secretMessage{}, blobs: map[string][]byte{}, opaque: map[string]bool{}}
+	secrets, blobs := storage.secrets, storage.blobs
+
+	auth := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			assert.Empty(t, r.Header.Get("X-Password"), "the password is sent at login only")
+			h(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /register", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		var creds struct {
+			Login         string `json:"username"`
+			Passw         string `json:"password"`
+			ZeroKnowledge bool   `json:"zero_knowledge"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&creds))
+		if creds.Login != "user" || creds.Passw != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		storage.zeroKnowledge = creds.ZeroKnowledge
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("PUT /vault/{kind}/", auth(func(w http.ResponseWriter, r *http.Request) {
+		var msg secretMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		if r.PathValue("kind") == "text" && string(msg.Data) == `{"text":""}` {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid secret: empty text"}`))
+			return
+		}
+		secrets[r.PathValue("kind")+"/1"] = msg
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"rid":1}`))
+	}))
+	mux.HandleFunc("GET /vault/{kind}/{rid}", auth(func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := secrets[r.PathValue("kind")+"/"+r.PathValue("rid")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(msg))
+	}))
+	mux.HandleFunc("PUT /vault/binary/", auth(func(w http.ResponseWriter, r *http.Request) {
+		content, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		blobs["2"] = content
+		storage.opaque["2"] = r.Header.Get(encryptionHeader) == encryptionEnvelope
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"rid":2}`))
+	}))
+	mux.HandleFunc("GET /vault/binary/{rid}", auth(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := blobs[r.PathValue("rid")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if storage.opaque[r.PathValue("rid")] {
+			w.Header().Set(encryptionHeader, encryptionEnvelope)
+		}
+		_, _ = w.Write(b)
+	}))
+	mux.HandleFunc("GET /vault/", auth(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"ID":1,"Type":1,"Kind":"credentials","Meta":"github"},{"ID":2,"Type":2,"Kind":"binary","Meta":"photo"}]`))
+	}))
+	mux.HandleFunc("DELETE /vault/{rid}", auth(func(w http.ResponseWriter, r *http.Request) {
+		for key := range secrets {
+			if strings.HasSuffix(key, "/"+r.PathValue("rid")) {
+				delete(secrets, key)
+			}
+		}
+	}))
+	return httptest.NewServer(mux), storage
+}
+
+func newTestClient(url, command string) (*Client, *bytes.Buffer) {
+	opts := Options{URL: url, Command: command, Login: "user", Password: "secret"}
+	cli := NewClient(opts)
+	out := &bytes.Buffer{}
+	cli.out = out
+	return cli, out
+}
+
+func TestClient_Credentials(t *testing.T) {
+	ts := fakeVault(t)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "add-credentials")
+	cli.options.Meta = "github"
+	cli.options.Creds.Login = "octocat"
+	cli.options.Creds.Password = "hunter2"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "stored with rid 1\n", out.String())
+
+	cli, out = newTestClient(ts.URL, "get-credentials")
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "login: octocat")
+	assert.Contains(t, out.String(), "password: hunter2")
+	assert.Contains(t, out.String(), "meta: github")
+}
+
+func TestClient_Card(t *testing.T) {
+	ts := fakeVault(t)
+	defer ts.Close()
+
+	cli, _ := newTestClient(ts.URL, "add-card")
+	cli.options.Card.Number = "4111111111111111"
+	cli.options.Card.Holder = "JOHN DOE"
+	cli.options.Card.Expiry = "12/30"
+	require.NoError(t, cli.Run(context.Background()))
+
+	cli, out := newTestClient(ts.URL, "get-card")
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "number: 4111111111111111")
+	assert.Contains(t, out.String(), "expiry: 12/30")
+}
+
+func TestClient_File(t *testing.T) {
+	ts := fakeVault(t)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	require.NoError(t, os.WriteFile(src, []byte("binary content"), 0o600))
+
+	cli, out := newTestClient(ts.URL, "add-file")
+	cli.options.File = src
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "stored with rid 2\n", out.String())
+
+	dst := filepath.Join(dir, "dst.bin")
+	cli, _ = newTestClient(ts.URL, "get-file")
+	cli.options.RID = 2
+	cli.options.File = dst
+	require.NoError(t, cli.Run(context.Background()))
+	content, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "binary content", string(content))
+}
+
+func TestClient_List(t *testing.T) {
+	ts := fakeVault(t)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "list")
+	require.NoError(t, cli.Run(context.Background()))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[1], "piece")
+	assert.Contains(t, lines[1], "credentials")
+	assert.Contains(t, lines[1], "github")
+	assert.Contains(t, lines[2], "blob")
+}
+
+func TestClient_Errors(t *testing.T) {
+	ts := fakeVault(t)
+	defer ts.Close()
+
+	cli, _ := newTestClient(ts.URL, "bad-command")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrUnknownCommand)
+
+	cli, _ = newTestClient(ts.URL, "list")
+	cli.options.Password = "wrong"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrUnauthorized)
+
+	cli, _ = newTestClient(ts.URL, "get-text")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoResourceID)
+
+	cli, _ = newTestClient(ts.URL, "get-text")
+	cli.options.RID = 42
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+
+	cli, _ = newTestClient(ts.URL, "add-text")
+	err := cli.Run(context.Background())
+	assert.ErrorIs(t, err, ErrBadRequest)
+	assert.Contains(t, err.Error(), "empty text")
+}
+
+func TestNewClient_URL(t *testing.T) {
+	assert.Equal(t, "http://localhost:8080", NewClient(Options{URL: "localhost:8080"}).options.URL)
+	assert.Equal(t, "https://example.com", NewClient(Options{URL: "https://example.com/"}).options.URL)
+}
+
+func TestClient_ZeroKnowledge(t *testing.T) {
+	ts, storage := fakeVaultStorage(t)
+	defer ts.Close()
+
+	zkClient := func(command string) (*Client, *bytes.Buffer) {
+		cli, out := newTestClient(ts.URL, command)
+		cli.options.ZeroKnowledge = true
+		cli.options.Passphrase = "correct horse battery staple"
+		cli.keyring = envelope.NewKeyring(cli.options.Passphrase, cli.options.Login, envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1})
+		return cli, out
+	}
+
+	cli, _ := zkClient("add-credentials")
+	cli.options.Creds.Login = "octocat"
+	cli.options.Creds.Password = "hunter2"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.True(t, storage.zeroKnowledge)
+
+	stored := storage.secrets["credentials/1"]
+	assert.True(t, stored.Opaque)
+	assert.NotContains(t, string(stored.Data), "hunter2")
+
+	cli, out := zkClient("get-credentials")
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "password: hunter2")
+
+	// without passphrase opaque secrets can't be read
+	cli, _ = newTestClient(ts.URL, "get-credentials")
+	cli.options.RID = 1
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoPassphrase)
+
+	// invalid secrets are rejected locally
+	cli, _ = zkClient("add-card")
+	cli.options.Card.Number = "4111111111111112"
+	assert.ErrorIs(t, cli.Run(context.Background()), secret.ErrInvalid)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	require.NoError(t, os.WriteFile(src, bytes.Repeat([]byte("binary content "), 10000), 0o600))
+	cli, _ = zkClient("add-file")
+	cli.options.File = src
+	require.NoError(t, cli.Run(context.Background()))
+	assert.True(t, storage.opaque["2"])
+	assert.NotContains(t, string(storage.blobs["2"]), "binary content")
+
+	dst := filepath.Join(dir, "dst.bin")
+	cli, _ = zkClient("get-file")
+	cli.options.RID = 2
+	cli.options.File = dst
+	require.NoError(t, cli.Run(context.Background()))
+	content, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("binary content "), 10000), content)
+
+	cli, _ = zkClient("list")
+	cli.options.Passphrase = cli.options.Password
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrWeakPassphrase)
+}
+
+// fakeSyncVault emulates the versioned vault and its change feed
+type fakeSyncVault struct {
+	mu        sync.Mutex
+	version   int64
+	lastRID   int64
+	resources map[int64]*fakeResource
+	deleted   map[int64]int64
+}
+
+type fakeResource struct {
+	kind    secret.Kind
+	msg     secretMessage
+	version int64
+	history map[int64]secretMessage
+}
+
+func (v *fakeSyncVault) put(kind secret.Kind, msg secretMessage) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.lastRID++
+	v.version++
+	v.resources[v.lastRID] = &fakeResource{kind: kind, msg: msg, version: v.version, history: map[int64]secretMessage{}}
+	return v.lastRID
+}
+
+// touch emulates an edit made on another device
+func (v *fakeSyncVault) touch(rid int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.version++
+	v.resources[rid].version = v.version
+}
+
+func newFakeSyncVault(t *testing.T) (*httptest.Server, *fakeSyncVault) {
+	vault := &fakeSyncVault{resources: map[int64]*fakeResource{}, deleted: map[int64]int64{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("PUT /vault/{kind}/", func(w http.ResponseWriter, r *http.Request) {
+		var msg secretMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		rid := vault.put(secret.Kind(r.PathValue("kind")), msg)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"rid":%d}`, rid)
+	})
+	mux.HandleFunc("GET /vault/{kind}/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		rid, _ := strconv.ParseInt(r.PathValue("rid"), 10, 64)
+		res, ok := vault.resources[rid]
+		if !ok || string(res.kind) != r.PathValue("kind") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(res.msg))
+	})
+	mux.HandleFunc("PUT /vault/{kind}/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		rid, _ := strconv.ParseInt(r.PathValue("rid"), 10, 64)
+		res, ok := vault.resources[rid]
+		if !ok || string(res.kind) != r.PathValue("kind") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != strconv.Quote(strconv.FormatInt(res.version, 10)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		var msg secretMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		res.history[res.version], res.msg = res.msg, msg
+		vault.version++
+		res.version = vault.version
+		_, _ = fmt.Fprintf(w, `{"rid":%d,"version":%d}`, rid, res.version)
+	})
+	mux.HandleFunc("DELETE /vault/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		rid, _ := strconv.ParseInt(r.PathValue("rid"), 10, 64)
+		res, ok := vault.resources[rid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != strconv.Quote(strconv.FormatInt(res.version, 10)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(vault.resources, rid)
+		vault.version++
+		vault.deleted[rid] = vault.version
+	})
+	mux.HandleFunc("GET /vault/{rid}/versions", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		rid, _ := strconv.ParseInt(r.PathValue("rid"), 10, 64)
+		res, ok := vault.resources[rid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		versions := []map[string]any{{"Version": res.version, "Meta": res.msg.Meta, "UpdatedBy": "user", "Current": true}}
+		for version, msg := range res.history {
+			versions = append(versions, map[string]any{"Version": version, "Meta": msg.Meta, "UpdatedBy": "user"})
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(versions))
+	})
+	mux.HandleFunc("POST /vault/{rid}/versions/{version}/restore", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		rid, _ := strconv.ParseInt(r.PathValue("rid"), 10, 64)
+		version, _ := strconv.ParseInt(r.PathValue("version"), 10, 64)
+		res, ok := vault.resources[rid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		msg, ok := res.history[version]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.history[res.version] = res.msg
+		res.msg = msg
+		vault.version++
+		res.version = vault.version
+		_, _ = fmt.Fprintf(w, `{"rid":%d,"version":%d}`, rid, res.version)
+	})
+	mux.HandleFunc("POST /account/password", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Password    string `json:"password"`
+			NewPassword string `json:"new_password"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if request.Password != "secret" || request.NewPassword == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/changes", func(w http.ResponseWriter, r *http.Request) {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		changes := map[string]any{"Resources": []resource{}, "Deleted": []map[string]int64{}, "Cursor": vault.version}
+		for rid, res := range vault.resources {
+			if res.version > since {
+				changes["Resources"] = append(changes["Resources"].([]resource),
+					resource{ID: rid, Type: resourceTypePiece, Kind: res.kind, Meta: res.msg.Meta, Version: res.version})
+			}
+		}
+		for rid, version := range vault.deleted {
+			if version > since {
+				changes["Deleted"] = append(changes["Deleted"].([]map[string]int64), map[string]int64{"ID": rid, "Version": version})
+			}
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(changes))
+	})
+	return httptest.NewServer(mux), vault
+}
+
+func TestClient_Sync(t *testing.T) {
+	ts, vault := newFakeSyncVault(t)
+	defer ts.Close()
+	cache := filepath.Join(t.TempDir(), "user.vault")
+
+	syncClient := func(command string, offline bool) (*Client, *bytes.Buffer) {
+		cli, out := newTestClient(ts.URL, command)
+		cli.options.Cache = cache
+		cli.options.Offline = offline
+		cli.kdf = envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1}
+		return cli, out
+	}
+
+	vault.put(secret.KindText, secretMessage{Meta: "first", Data: json.RawMessage(`{"text":"server note"}`)})
+	vault.put(secret.KindText, secretMessage{Meta: "second", Data: json.RawMessage(`{"text":"to delete"}`)})
+
+	cli, _ := syncClient("list", true)
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoReplica)
+
+	cli, out := syncClient("sync", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "0 pushed, 2 pulled, 0 deleted")
+
+	sealed, err := os.ReadFile(cache)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "server note")
+
+	cli, out = syncClient("get-text", true)
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "server note")
+
+	cli, out = syncClient("add-text", true)
+	cli.options.Text = "offline note"
+	cli.options.Meta = "train"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "stored locally with rid -1")
+
+	cli, _ = syncClient("add-text", true)
+	assert.ErrorIs(t, cli.Run(context.Background()), secret.ErrInvalid)
+
+	cli, _ = syncClient("delete", true)
+	cli.options.RID = 2
+	require.NoError(t, cli.Run(context.Background()))
+
+	cli, _ = syncClient("add-file", true)
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrOffline)
+
+	cli, out = syncClient("list", true)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "train")
+	assert.NotContains(t, out.String(), "second")
+	assert.Contains(t, out.String(), "2 local changes pending sync")
+
+	cli, _ = syncClient("update-text", true)
+	cli.options.RID = 1
+	cli.options.Text = "edited on train"
+	require.NoError(t, cli.Run(context.Background()))
+	cli, _ = syncClient("update-text", true)
+	cli.options.RID = 1
+	cli.options.Text = "edited twice"
+	require.NoError(t, cli.Run(context.Background()))
+
+	// the deleted secret was edited on another device meanwhile
+	vault.touch(2)
+
+	cli, out = syncClient("sync", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "2 pushed, 3 pulled, 0 deleted")
+	assert.Contains(t, out.String(), "1 local changes conflict")
+	assert.Len(t, vault.resources, 3)
+	assert.JSONEq(t, `{"text":"edited twice"}`, string(vault.resources[1].msg.Data))
+
+	cli, out = syncClient("get-text", true)
+	cli.options.RID = 3
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "offline note")
+
+	// an offline edit of a secret edited elsewhere is refused
+	cli, _ = syncClient("update-text", true)
+	cli.options.RID = 3
+	cli.options.Text = "stale edit"
+	require.NoError(t, cli.Run(context.Background()))
+	vault.touch(3)
+	cli, out = syncClient("sync", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "0 pushed, 1 pulled")
+	assert.Contains(t, out.String(), "1 local changes conflict")
+	cli, out = syncClient("get-text", true)
+	cli.options.RID = 3
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "offline note")
+
+	cli, out = syncClient("conflicts", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "delete 2")
+	assert.Contains(t, out.String(), ErrStale.Error())
+	assert.Contains(t, out.String(), "update 3")
+	assert.Contains(t, out.String(), "stale edit")
+
+	cli, out = syncClient("conflicts", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "no conflicts")
+
+	// deletes made on the server come as tombstones
+	cli, _ = syncClient("delete", false)
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	cli, out = syncClient("sync", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "0 pushed, 0 pulled, 1 deleted")
+
+	// unreachable server falls back to the replica
+	ts.Close()
+	cli, out = syncClient("list", false)
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "working offline")
+	assert.Contains(t, out.String(), "train")
+	assert.NotContains(t, out.String(), "first")
+}
+
+func TestClient_Update(t *testing.T) {
+	ts, vault := newFakeSyncVault(t)
+	defer ts.Close()
+	vault.put(secret.KindText, secretMessage{Meta: "note", Data: json.RawMessage(`{"text":"old"}`)})
+
+	cli, out := newTestClient(ts.URL, "update-text")
+	cli.options.RID = 1
+	cli.options.Text = "new"
+	cli.options.Meta = "renamed"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "updated rid 1, version 2")
+	assert.Equal(t, "renamed", vault.resources[1].msg.Meta)
+	assert.JSONEq(t, `{"text":"new"}`, string(vault.resources[1].msg.Data))
+
+	cli, _ = newTestClient(ts.URL, "update-card")
+	cli.options.RID = 1
+	cli.options.Card.Number = "4111111111111111"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+
+	cli, _ = newTestClient(ts.URL, "update-text")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoResourceID)
+
+	cli, out = newTestClient(ts.URL, "versions")
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[1], "2 (current)")
+	assert.Contains(t, lines[1], "renamed")
+	assert.Contains(t, lines[2], "note")
+
+	cli, _ = newTestClient(ts.URL, "restore")
+	cli.options.RID = 1
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoVersion)
+
+	cli, out = newTestClient(ts.URL, "restore")
+	cli.options.RID = 1
+	cli.options.Version = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "updated rid 1, version 3")
+	assert.Equal(t, "note", vault.resources[1].msg.Meta)
+	assert.JSONEq(t, `{"text":"old"}`, string(vault.resources[1].msg.Data))
+
+	cli, _ = newTestClient(ts.URL, "restore")
+	cli.options.RID = 1
+	cli.options.Version = 42
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	ts, vault := newFakeSyncVault(t)
+	defer ts.Close()
+	cache := filepath.Join(t.TempDir(), "user.vault")
+
+	passwordClient := func(command, password string) (*Client, *bytes.Buffer) {
+		cli, out := newTestClient(ts.URL, command)
+		cli.options.Cache = cache
+		cli.options.Password = password
+		cli.kdf = envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1}
+		return cli, out
+	}
+
+	vault.put(secret.KindText, secretMessage{Meta: "note", Data: json.RawMessage(`{"text":"server note"}`)})
+	cli, _ := passwordClient("sync", "secret")
+	require.NoError(t, cli.Run(context.Background()))
+
+	cli, _ = passwordClient("change-password", "secret")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoNewPassword)
+
+	cli, out := passwordClient("change-password", "secret")
+	cli.options.NewPass = "new secret"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "password of user changed")
+
+	// the replica is resealed with the new password
+	cli, out = passwordClient("list", "new secret")
+	cli.options.Offline = true
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "note")
+
+	cli, _ = passwordClient("list", "secret")
+	cli.options.Offline = true
+	assert.Error(t, cli.Run(context.Background()))
+}
+
+func TestClient_Sessions(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		logouts []string
+		revoked []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "expired")
+		_, _ = w.Write([]byte(`{"access_token":"expired","refresh_token":"sid.r1"}`))
+	})
+	mux.HandleFunc("POST /refresh", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if request.RefreshToken != "sid.r1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Authorization", "fresh")
+		_, _ = w.Write([]byte(`{"access_token":"fresh","refresh_token":"sid.r2"}`))
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		logouts = append(logouts, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"ID":"sid","UserAgent":"Go-http-client/1.1","IP":"127.0.0.1","Current":true},
+			{"ID":"other","UserAgent":"phone","IP":"10.0.0.1","ZeroKnowledge":true}]`))
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "other" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		revoked = append(revoked, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// the expired access token is refreshed and the session closed at the end
+	cli, out := newTestClient(ts.URL, "sessions")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "sid (current)")
+	assert.Contains(t, out.String(), "other (zero-knowledge)")
+	assert.Contains(t, out.String(), "phone")
+	assert.Equal(t, []string{"fresh"}, logouts)
+
+	cli, _ = newTestClient(ts.URL, "revoke-session")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoSession)
+
+	cli, out = newTestClient(ts.URL, "revoke-session")
+	cli.options.Session = "other"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "session other revoked")
+	assert.Equal(t, []string{"other"}, revoked)
+
+	cli, _ = newTestClient(ts.URL, "revoke-session")
+	cli.options.Session = "unknown"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+}
+
+func TestClient_TOTP(t *testing.T) {
+	var enabled bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			w.Header().Set("Authorization", "token")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"challenge_token":"sid.challenge"}`))
+	})
+	mux.HandleFunc("POST /login/verify", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if request.ChallengeToken != "sid.challenge" || request.Code != "123456" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /account/totp", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"secret":"GEZDGNBV","uri":"otpauth://totp/gophkeeper:user?secret=GEZDGNBV"}`))
+	})
+	mux.HandleFunc("POST /account/totp/enable", func(w http.ResponseWriter, r *http.Request) {
+		enabled = true
+		_, _ = w.Write([]byte(`{"recovery_codes":["AAAA-BBBB-CCCC-DDDD"]}`))
+	})
+	mux.HandleFunc("POST /account/totp/disable", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Password string `json:"password"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if request.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		enabled = false
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "totp-enroll")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "otpauth://totp/gophkeeper:user")
+
+	cli, _ = newTestClient(ts.URL, "totp-enable")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoOTP)
+
+	cli, out = newTestClient(ts.URL, "totp-enable")
+	cli.options.OTP = "123456"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "AAAA-BBBB-CCCC-DDDD")
+	require.True(t, enabled)
+
+	// the login requires the second factor now
+	cli, _ = newTestClient(ts.URL, "totp-disable")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoOTP)
+
+	cli, _ = newTestClient(ts.URL, "totp-disable")
+	cli.options.OTP = "654321"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrUnauthorized)
+
+	cli, out = newTestClient(ts.URL, "totp-disable")
+	cli.options.OTP = "123456"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "second factor of user disabled")
+	assert.False(t, enabled)
+}
+
+func TestClient_Sharing(t *testing.T) {
+	grants := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /vault/{rid}/grants/{grantee}", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Permission string `json:"permission"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if r.PathValue("grantee") == "nobody" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		grants[r.PathValue("grantee")] = request.Permission
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/{rid}/grants", func(w http.ResponseWriter, r *http.Request) {
+		response := []map[string]string{}
+		for grantee, permission := range grants {
+			response = append(response, map[string]string{"grantee": grantee, "permission": permission, "created_at": "2024-05-01T10:00:00Z"})
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	})
+	mux.HandleFunc("DELETE /vault/{rid}/grants/{grantee}", func(w http.ResponseWriter, r *http.Request) {
+		delete(grants, r.PathValue("grantee"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/shared", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"ID":7,"Type":1,"Kind":"credentials","Meta":"team db","owner":"alice","permission":"write"}]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, _ := newTestClient(ts.URL, "share")
+	cli.options.RID = 1
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoGrantee)
+
+	cli, out := newTestClient(ts.URL, "share")
+	cli.options.RID = 1
+	cli.options.Grantee = "bob"
+	cli.options.Permission = "write"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "resource 1 shared with bob, write")
+	assert.Equal(t, map[string]string{"bob": "write"}, grants)
+
+	cli, _ = newTestClient(ts.URL, "share")
+	cli.options.RID = 1
+	cli.options.Grantee = "nobody"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+
+	cli, out = newTestClient(ts.URL, "grants")
+	cli.options.RID = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "bob")
+
+	cli, out = newTestClient(ts.URL, "shared")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "alice")
+	assert.Contains(t, out.String(), "team db")
+
+	cli, out = newTestClient(ts.URL, "unshare")
+	cli.options.RID = 1
+	cli.options.Grantee = "bob"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "resource 1 unshared with bob")
+	assert.Empty(t, grants)
+}
+
+func TestClient_Orgs(t *testing.T) {
+	members := map[string]string{"user": "owner"}
+	teamMembers := map[string]bool{"user": true}
+	var storedTeam string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /orgs/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":5}`))
+	})
+	mux.HandleFunc("GET /orgs/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":5,"name":"acme","role":"owner"}]`))
+	})
+	mux.HandleFunc("PUT /orgs/5/members/{login}", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Role string `json:"role"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		members[r.PathValue("login")] = request.Role
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /orgs/5/members", func(w http.ResponseWriter, r *http.Request) {
+		response := []map[string]string{}
+		for login, role := range members {
+			response = append(response, map[string]string{"login": login, "role": role})
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	})
+	mux.HandleFunc("POST /orgs/5/teams", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":9}`))
+	})
+	mux.HandleFunc("PUT /orgs/5/teams/9/members/{login}", func(w http.ResponseWriter, r *http.Request) {
+		if members[r.PathValue("login")] == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		teamMembers[r.PathValue("login")] = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /orgs/5/teams/9/members/{login}", func(w http.ResponseWriter, r *http.Request) {
+		delete(teamMembers, r.PathValue("login"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /orgs/5/teams/9", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	mux.HandleFunc("PUT /vault/credentials/", func(w http.ResponseWriter, r *http.Request) {
+		storedTeam = r.URL.Query().Get("team")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"rid":11}`))
+	})
+	mux.HandleFunc("GET /vault/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"ID":11,"Type":1,"Kind":"credentials","Meta":"ci token","Team":9}]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, _ := newTestClient(ts.URL, "create-org")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoName)
+
+	cli, out := newTestClient(ts.URL, "create-org")
+	cli.options.Name = "acme"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "organisation acme created with id 5")
+
+	cli, out = newTestClient(ts.URL, "orgs")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "acme")
+
+	cli, out = newTestClient(ts.URL, "set-member")
+	cli.options.Org = 5
+	cli.options.Member = "bob"
+	cli.options.Role = "editor"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "bob is editor of organisation 5")
+
+	cli, out = newTestClient(ts.URL, "org-members")
+	cli.options.Org = 5
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "editor")
+
+	cli, out = newTestClient(ts.URL, "create-team")
+	cli.options.Org = 5
+	cli.options.Name = "ops"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "team ops created with id 9")
+
+	cli, _ = newTestClient(ts.URL, "add-team-member")
+	cli.options.Org = 5
+	cli.options.Member = "bob"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoTeam)
+
+	cli, _ = newTestClient(ts.URL, "add-team-member")
+	cli.options.Org = 5
+	cli.options.Team = 9
+	cli.options.Member = "nobody"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNotFound)
+
+	cli, out = newTestClient(ts.URL, "add-team-member")
+	cli.options.Org = 5
+	cli.options.Team = 9
+	cli.options.Member = "bob"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "bob added to team 9")
+	assert.True(t, teamMembers["bob"])
+
+	cli, out = newTestClient(ts.URL, "add-credentials")
+	cli.options.Team = 9
+	cli.options.Meta = "ci token"
+	cli.options.Creds.Login = "ci"
+	cli.options.Creds.Password = "token"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "stored with rid 11")
+	assert.Equal(t, "9", storedTeam)
+
+	cli, out = newTestClient(ts.URL, "list")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "TEAM")
+	assert.Regexp(t, `11\s+piece\s+credentials\s+9\s+/\s+ci token`, out.String())
+
+	cli, _ = newTestClient(ts.URL, "delete-team")
+	cli.options.Org = 5
+	cli.options.Team = 9
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrConflict)
+
+	cli, out = newTestClient(ts.URL, "remove-team-member")
+	cli.options.Org = 5
+	cli.options.Team = 9
+	cli.options.Member = "bob"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "bob removed from team 9")
+	assert.False(t, teamMembers["bob"])
+}
+
+func TestClient_Folders(t *testing.T) {
+	var (
+		moved   map[string]any
+		details map[string]any
+		tags    = map[string]bool{}
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /vault/folders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":3}`))
+	})
+	mux.HandleFunc("GET /vault/folders", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":1,"parent":0,"name":"work"},{"id":2,"parent":0,"name":"home"},{"id":3,"parent":1,"name":"servers"}]`))
+	})
+	mux.HandleFunc("PATCH /vault/folders/{folder}", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&moved))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /vault/folders/{folder}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	mux.HandleFunc("PUT /vault/{rid}/folder", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"rid":7,"version":20}`))
+	})
+	mux.HandleFunc("PUT /vault/{rid}/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tags[r.PathValue("tag")] = true
+		_, _ = w.Write([]byte(`{"rid":7,"version":21}`))
+	})
+	mux.HandleFunc("DELETE /vault/{rid}/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		delete(tags, r.PathValue("tag"))
+		_, _ = w.Write([]byte(`{"rid":7,"version":22}`))
+	})
+	mux.HandleFunc("PUT /vault/{rid}/details", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&details))
+		_, _ = w.Write([]byte(`{"rid":7,"version":23}`))
+	})
+	mux.HandleFunc("GET /vault/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[
+			{"ID":7,"Type":1,"Kind":"credentials","Meta":"db","Folder":3,"Tags":["prod","sql"]},
+			{"ID":8,"Type":1,"Kind":"text","Meta":"recipe","Folder":2,"Tags":[]}
+		]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "create-folder")
+	cli.options.Name = "servers"
+	cli.options.Parent = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "folder servers created with id 3")
+
+	cli, out = newTestClient(ts.URL, "folders")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Regexp(t, `1\s+work\n3\s+  servers\n2\s+home`, out.String())
+
+	cli, _ = newTestClient(ts.URL, "move-folder")
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoFolder)
+
+	cli, out = newTestClient(ts.URL, "move-folder")
+	cli.options.Folder = 3
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "folder 3 moved")
+	assert.Equal(t, map[string]any{"parent": float64(0)}, moved)
+
+	cli, _ = newTestClient(ts.URL, "delete-folder")
+	cli.options.Folder = 1
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrConflict)
+
+	cli, out = newTestClient(ts.URL, "move")
+	cli.options.RID = 7
+	cli.options.Folder = 3
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "updated rid 7, version 20")
+
+	cli, _ = newTestClient(ts.URL, "tag")
+	cli.options.RID = 7
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoTag)
+
+	cli, _ = newTestClient(ts.URL, "tag")
+	cli.options.RID = 7
+	cli.options.Tag = "prod"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.True(t, tags["prod"])
+
+	cli, _ = newTestClient(ts.URL, "untag")
+	cli.options.RID = 7
+	cli.options.Tag = "prod"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Empty(t, tags)
+
+	cli, _ = newTestClient(ts.URL, "set-details")
+	cli.options.RID = 7
+	cli.options.Details.Fields = []string{"no value"}
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrBadField)
+
+	cli, out = newTestClient(ts.URL, "set-details")
+	cli.options.RID = 7
+	cli.options.Details.Title = "Prod DB"
+	cli.options.Details.URLs = []string{"https://db.example.com"}
+	cli.options.Details.Fields = []string{"port=5432"}
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "version 23")
+	assert.Equal(t, "Prod DB", details["title"])
+	assert.Equal(t, []any{map[string]any{"name": "port", "value": "5432"}}, details["fields"])
+
+	cli, out = newTestClient(ts.URL, "list")
+	cli.options.Tag = "SQL"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Regexp(t, `7\s+piece\s+credentials\s+-\s+3\s+prod,sql\s+db`, out.String())
+	assert.NotContains(t, out.String(), "recipe")
+
+	cli, out = newTestClient(ts.URL, "list")
+	cli.options.Folder = 2
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "recipe")
+	assert.NotContains(t, out.String(), "db")
+}
+
+func TestClient_ListPages(t *testing.T) {
+	var queries []url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/", func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		if r.URL.Query().Get("cursor") == "" {
+			w.Header().Set("X-Next-Cursor", "page2")
+			_, _ = w.Write([]byte(`[{"ID":7,"Type":1,"Kind":"credentials","Meta":"db"}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"ID":9,"Type":2,"Kind":"binary","Meta":"dump"}]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "list")
+	cli.options.Search = "db"
+	cli.options.Sort = "-name"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Regexp(t, `7\s+piece\s+credentials.*db\n9\s+blob\s+binary.*dump\n$`, out.String())
+	require.Len(t, queries, 2)
+	assert.Equal(t, url.Values{"q": {"db"}, "sort": {"-name"}}, queries[0])
+	assert.Equal(t, "page2", queries[1].Get("cursor"))
+
+	queries = nil
+	cli, out = newTestClient(ts.URL, "list")
+	cli.options.Type = "piece"
+	cli.options.Tag = "prod"
+	cli.options.Limit = 1
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "next cursor: page2")
+	assert.NotContains(t, out.String(), "dump")
+	require.Len(t, queries, 1)
+	assert.Equal(t, url.Values{"type": {"piece"}, "tag": {"prod"}, "limit": {"1"}}, queries[0])
+}
+
+func TestClient_ExportImport(t *testing.T) {
+	var imported []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Export-Passphrase") != "export passphrase" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("archive"))
+	})
+	mux.HandleFunc("POST /vault/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Export-Passphrase") != "export passphrase" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		imported, _ = io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`{"folders":{"1":4},"resources":[{"id":7,"rid":12},{"id":9,"rid":3,"duplicate":true}]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "vault.gpkx")
+
+	cli, _ := newTestClient(ts.URL, "export")
+	cli.options.File = file
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoExportPass)
+
+	cli, _ = newTestClient(ts.URL, "export")
+	cli.options.File = file
+	cli.options.ExportPass = "wrong"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrBadRequest)
+
+	cli, out := newTestClient(ts.URL, "export")
+	cli.options.File = file
+	cli.options.ExportPass = "export passphrase"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Contains(t, out.String(), "vault exported to "+file+", 7 bytes")
+
+	cli, out = newTestClient(ts.URL, "import")
+	cli.options.File = file
+	cli.options.ExportPass = "export passphrase"
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "archive", string(imported))
+	assert.Regexp(t, `7\s+12\s+imported\n9\s+3\s+duplicate\n`, out.String())
+	assert.Contains(t, out.String(), "1 resources imported, 1 duplicates skipped, 1 folders")
+}
+
+func TestClient_ImportFrom(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		stored   []secretMessage
+		rid      int64
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /vault/folders", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":5,"parent":0,"name":"Work"}]`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/vault/folders":
+			_, _ = w.Write([]byte(`{"id":6}`))
+		case r.Method == http.MethodPut && (r.URL.Path == "/vault/credentials/" || r.URL.Path == "/vault/text/"):
+			var msg secretMessage
+			_ = json.NewDecoder(r.Body).Decode(&msg)
+			stored = append(stored, msg)
+			rid++
+			fmt.Fprintf(w, `{"rid":%d}`, rid)
+		default:
+			fmt.Fprintf(w, `{"rid":%d,"version":2}`, rid)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "export.csv")
+	require.NoError(t, os.WriteFile(file, []byte("name,url,username,password,extra,grouping\n"+
+		"Git,https://git.example.com,bob,pw,deploy key,Work\\Dev\n"+
+		"Bad,,,,,\n"+
+		"Visa,http://sn,,,\"NoteType:Credit Card\nNumber:1234\",\n"), 0o600))
+
+	cli, _ := newTestClient(ts.URL, "import-from")
+	cli.options.File = file
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrNoFormat)
+
+	cli, out := newTestClient("http://127.0.0.1:1", "import-from")
+	cli.options.File = file
+	cli.options.ImportFormat = "lastpass"
+	cli.options.DryRun = true
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Regexp(t, `Git\s+credentials\s+/Work/Dev\s+0\s+valid\n`, out.String())
+	assert.Regexp(t, `Visa\s+card\s+/\s+0\s+invalid secret: card number`, out.String())
+	assert.Contains(t, out.String(), "dry run: 1 items to import, 1 invalid")
+
+	cli, out = newTestClient(ts.URL, "import-from")
+	cli.options.File = file
+	cli.options.ImportFormat = "lastpass"
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrImportFailed)
+	assert.Regexp(t, `Git\s+credentials\s+/Work/Dev\s+0\s+imported, rid 1,2\n`, out.String())
+	assert.Contains(t, out.String(), "1 items imported, 1 failed")
+	assert.Equal(t, []string{
+		"POST /vault/folders",
+		"PUT /vault/credentials/", "PUT /vault/1/folder", "PUT /vault/1/details",
+		"PUT /vault/text/", "PUT /vault/2/folder", "PUT /vault/2/details",
+	}, requests)
+	require.Len(t, stored, 2)
+	assert.Equal(t, "Git", stored[0].Meta)
+	assert.JSONEq(t, `{"url":"https://git.example.com","username":"bob","password":"pw"}`, string(stored[0].Data))
+	assert.Equal(t, "Git notes", stored[1].Meta)
+	assert.JSONEq(t, `{"text":"deploy key"}`, string(stored[1].Data))
+}
+
+// fakeUploads emulates the upload sessions of the server, the second chunk
+// is stored but its response is lost and the third fails once
+type fakeUploads struct {
+	mu        sync.Mutex
+	content   []byte
+	length    string
+	meta      string
+	puts      int
+	committed []byte
+}
+
+func (f *fakeUploads) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /vault/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.length, f.meta, f.content = r.Header.Get("Upload-Length"), r.Header.Get("X-Meta"), nil
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":"u1","offset":0}`))
+	})
+	mux.HandleFunc("HEAD /vault/uploads/u1", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(f.content)))
+	})
+	mux.HandleFunc("PUT /vault/uploads/u1", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(len(f.content)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		chunk, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		f.puts++
+		switch f.puts {
+		case 2:
+			f.content = append(f.content, chunk...)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case 3:
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		f.content = append(f.content, chunk...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(f.content)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /vault/uploads/u1/commit", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		sum := sha256.Sum256(f.content)
+		if r.Header.Get("Upload-Checksum") != "sha256 "+base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		f.committed = f.content
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"rid":5}`))
+	})
+	return mux
+}
+
+func TestClient_ChunkedUpload(t *testing.T) {
+	uploads := &fakeUploads{}
+	ts := httptest.NewServer(uploads.handler(t))
+	defer ts.Close()
+
+	content := make([]byte, 3*chunkAlignment+10)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(file, content, 0o600))
+
+	cli, _ := newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	cli.options.ChunkSize = chunkAlignment + 1
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrBadChunkSize)
+
+	cli, out := newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	cli.options.Meta = "large"
+	cli.options.ChunkSize = chunkAlignment
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "upload u1 started, resume it with --upload u1\nstored with rid 5\n", out.String())
+	assert.Equal(t, strconv.Itoa(len(content)), uploads.length)
+	assert.Equal(t, "large", uploads.meta)
+	assert.Equal(t, content, uploads.committed)
+
+	// resumed by another run
+	uploads.content, uploads.committed, uploads.puts = content[:chunkAlignment], nil, 10
+	cli, out = newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	cli.options.Upload = "u1"
+	cli.options.ChunkSize = chunkAlignment
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "stored with rid 5\n", out.String())
+	assert.Equal(t, content, uploads.committed)
+
+	cli, _ = newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	cli.options.Upload = "u1"
+	cli.options.ZeroKnowledge = true
+	cli.options.Passphrase = "passphrase"
+	cli.keyring = envelope.NewKeyring("passphrase", "user", envelope.DefaultKDF)
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrResumeEncrypted)
+}
+
+func TestClient_ResumedDownload(t *testing.T) {
+	content := make([]byte, 100<<10)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	version := `"3"`
+	var ranges []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	digest := sha256.Sum256(content)
+	mux.HandleFunc("GET /vault/binary/7", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", version)
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		w.Header().Set("X-Meta", "photo")
+		if r.Header.Get("Range") == "" {
+			// the connection breaks halfway
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "photo.bin")
+	cli, out := newTestClient(ts.URL, "get-file")
+	cli.options.RID = 7
+	cli.options.File = file
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "saved to "+file+", meta: photo\n", out.String())
+	saved, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, content, saved)
+	require.Len(t, ranges, 1)
+	assert.Regexp(t, `^bytes=\d+- "3"$`, ranges[0])
+
+	// changed meanwhile, If-Range gets the whole new content
+	mux.HandleFunc("GET /vault/binary/8", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("ETag", `"3"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			return
+		}
+		w.Header().Set("ETag", `"4"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	cli, _ = newTestClient(ts.URL, "get-file")
+	cli.options.RID = 8
+	cli.options.File = file
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrStale)
+}
+
+func TestClient_BlobIntegrity(t *testing.T) {
+	content := []byte("photo content")
+	digest := sha256.Sum256(content)
+	var headers http.Header
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /vault/binary/", func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"rid":7}`))
+	})
+	mux.HandleFunc("GET /vault/binary/{rid}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		if r.PathValue("rid") == "8" {
+			_, _ = w.Write([]byte("photo c0ntent"))
+			return
+		}
+		_, _ = w.Write(content)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// content type and name of the file are sent with the blob
+	file := filepath.Join(t.TempDir(), "photo.png")
+	require.NoError(t, os.WriteFile(file, content, 0o600))
+	cli, _ := newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "image/png", headers.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=photo.png`, headers.Get("Content-Disposition"))
+
+	// but not in zero-knowledge mode
+	cli, _ = newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	cli.options.ZeroKnowledge = true
+	cli.options.Passphrase = "correct horse battery staple"
+	cli.keyring = envelope.NewKeyring(cli.options.Passphrase, cli.options.Login, envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1})
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Empty(t, headers.Get("Content-Disposition"))
+	assert.Equal(t, encryptionEnvelope, headers.Get(encryptionHeader))
+
+	saved := filepath.Join(t.TempDir(), "saved.png")
+	cli, _ = newTestClient(ts.URL, "get-file")
+	cli.options.RID = 7
+	cli.options.File = saved
+	require.NoError(t, cli.Run(context.Background()))
+
+	cli, _ = newTestClient(ts.URL, "get-file")
+	cli.options.RID = 8
+	cli.options.File = saved
+	assert.ErrorIs(t, cli.Run(context.Background()), ErrCorrupted)
+}
+
+func TestClient_Usage(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Authorization", "token")
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /account/usage", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"resources":3,"bytes":1000,"uploads":24,"quota":{"resources":100,"bytes":4096,"blob_size":2048}},
+			{"org":5,"name":"acme","resources":7,"bytes":0,"uploads":0,"quota":{"resources":0,"bytes":0,"blob_size":0}}]`))
+	})
+	mux.HandleFunc("PUT /vault/binary/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		_, _ = w.Write([]byte(`{"error":"quota exceeded: bytes 1024 of 4096 used","quota":"bytes","limit":4096,"used":1024}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cli, out := newTestClient(ts.URL, "usage")
+	require.NoError(t, cli.Run(context.Background()))
+	assert.Equal(t, "VAULT         RESOURCES  BYTES         UPLOADS  MAX BLOB\n"+
+		"personal      3 of 100   1024 of 4096  24       2048\n"+
+		"acme (org 5)  7          0             0        unlimited\n", out.String())
+
+	file := filepath.Join(t.TempDir(), "photo.png")
+	require.NoError(t, os.WriteFile(file, []byte("photo"), 0o600))
+	cli, _ = newTestClient(ts.URL, "add-file")
+	cli.options.File = file
+	err := cli.Run(context.Background())
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.ErrorContains(t, err, "bytes 1024 of 4096 used")
+}
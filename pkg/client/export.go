@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+// exportPassphraseHeader carries the passphrase of the archive
+const exportPassphraseHeader = "X-Export-Passphrase"
+
+// Export saves the vault, or the team vault with the team option, to the
+// file as an archive encrypted with the export passphrase
+func (c *Client) Export() error {
+	if c.options.File == "" {
+		return ErrNoFile
+	}
+	if c.options.ExportPass == "" {
+		return ErrNoExportPass
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, c.teamVault("/vault/export"), nil, http.Header{exportPassphraseHeader: {c.options.ExportPass}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.options.File, err)
+	}
+	size, err := io.Copy(file, resp.Body)
+	if err == nil {
+		err = file.Close()
+	} else {
+		_ = file.Close()
+	}
+	if err != nil {
+		// a cut archive fails to import anyway
+		_ = os.Remove(c.options.File)
+		return fmt.Errorf("failed to write %s: %w", c.options.File, err)
+	}
+	fmt.Fprintf(c.out, "vault exported to %s, %d bytes\n", c.options.File, size)
+	return nil
+}
+
+// Import restores the archive of the file into the vault, or the team vault
+// with the team option, and prints the new ids of the archived resources.
+// Resources the vault already has are skipped as duplicates, so a failed
+// import is completed by importing again.
+func (c *Client) Import() error {
+	if c.options.File == "" {
+		return ErrNoFile
+	}
+	if c.options.ExportPass == "" {
+		return ErrNoExportPass
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	file, err := os.Open(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", c.options.File, err)
+	}
+	defer file.Close()
+
+	headers := http.Header{exportPassphraseHeader: {c.options.ExportPass}, "Content-Type": {"application/octet-stream"}}
+	resp, err := c.do(http.MethodPost, c.teamVault("/vault/import"), file, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report struct {
+		Folders   map[string]int64 `json:"folders"`
+		Resources []struct {
+			ID        int64 `json:"id"`
+			RID       int64 `json:"rid"`
+			Duplicate bool  `json:"duplicate"`
+		} `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("failed to decode import report: %w", err)
+	}
+
+	var duplicates int
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARCHIVE ID\tRID\tSTATUS")
+	for _, r := range report.Resources {
+		status := "imported"
+		if r.Duplicate {
+			status = "duplicate"
+			duplicates++
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\n", r.ID, r.RID, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%d resources imported, %d duplicates skipped, %d folders\n",
+		len(report.Resources)-duplicates, duplicates, len(report.Folders))
+	return nil
+}
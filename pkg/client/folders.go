@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Folders lists the folders of the vault, or of the team vault with the
+// team option, as a tree
+func (c *Client) Folders() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, c.teamVault("/vault/folders"), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var folders []struct {
+		ID     int64  `json:"id"`
+		Parent int64  `json:"parent"`
+		Name   string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&folders); err != nil {
+		return fmt.Errorf("failed to decode folders: %w", err)
+	}
+
+	children := map[int64][]int{}
+	for i, f := range folders {
+		children[f.Parent] = append(children[f.Parent], i)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME")
+	var walk func(parent int64, depth int)
+	walk = func(parent int64, depth int) {
+		for _, i := range children[parent] {
+			fmt.Fprintf(w, "%d\t%s%s\n", folders[i].ID, strings.Repeat("  ", depth), folders[i].Name)
+			walk(folders[i].ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return w.Flush()
+}
+
+// CreateFolder creates a folder in the parent folder or in the root
+func (c *Client) CreateFolder() error {
+	if c.options.Name == "" {
+		return ErrNoName
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	body, err := json.Marshal(struct {
+		Name   string `json:"name"`
+		Parent int64  `json:"parent"`
+	}{c.options.Name, c.options.Parent})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, c.teamVault("/vault/folders"), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	fmt.Fprintf(c.out, "folder %s created with id %d\n", c.options.Name, response.ID)
+	return nil
+}
+
+// RenameFolder gives the folder a new name
+func (c *Client) RenameFolder() error {
+	if c.options.Name == "" {
+		return ErrNoName
+	}
+	return c.updateFolder(struct {
+		Name string `json:"name"`
+	}{c.options.Name}, "folder %d renamed\n")
+}
+
+// MoveFolder moves the folder into the parent folder, zero parent is the root
+func (c *Client) MoveFolder() error {
+	return c.updateFolder(struct {
+		Parent int64 `json:"parent"`
+	}{c.options.Parent}, "folder %d moved\n")
+}
+
+// DeleteFolder removes a folder without subfolders, its resources move to
+// the root
+func (c *Client) DeleteFolder() error {
+	if c.options.Folder == 0 {
+		return ErrNoFolder
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodDelete, c.folderPath(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "folder %d deleted\n", c.options.Folder)
+	return nil
+}
+
+// Move puts the resource into the folder, zero folder is the root
+func (c *Client) Move() error {
+	body, err := json.Marshal(struct {
+		Folder int64 `json:"folder"`
+	}{c.options.Folder})
+	if err != nil {
+		return err
+	}
+	return c.organise(http.MethodPut, "/folder", body)
+}
+
+// Tag adds the tag to the resource
+func (c *Client) Tag() error {
+	if c.options.Tag == "" {
+		return ErrNoTag
+	}
+	return c.organise(http.MethodPut, "/tags/"+url.PathEscape(c.options.Tag), nil)
+}
+
+// Untag removes the tag from the resource
+func (c *Client) Untag() error {
+	if c.options.Tag == "" {
+		return ErrNoTag
+	}
+	return c.organise(http.MethodDelete, "/tags/"+url.PathEscape(c.options.Tag), nil)
+}
+
+// SetDetails replaces the title, notes, urls and custom fields of the
+// resource. Details are stored unencrypted like meta.
+func (c *Client) SetDetails() error {
+	details := resourceDetails{Title: c.options.Details.Title, Notes: c.options.Details.Notes, URLs: c.options.Details.URLs}
+	for _, f := range c.options.Details.Fields {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("%w: %q", ErrBadField, f)
+		}
+		details.Fields = append(details.Fields, detailsField{Name: name, Value: value})
+	}
+	body, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	return c.organise(http.MethodPut, "/details", body)
+}
+
+// resourceDetails is the structured meta of a resource
+type resourceDetails struct {
+	Title  string         `json:"title,omitempty"`
+	Notes  string         `json:"notes,omitempty"`
+	URLs   []string       `json:"urls,omitempty"`
+	Fields []detailsField `json:"fields,omitempty"`
+}
+
+type detailsField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// organise sends the change of the resource organisation and prints its
+// new version
+func (c *Client) organise(method, path string, body []byte) error {
+	if c.options.RID == 0 {
+		return ErrNoResourceID
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.organiseResource(c.options.RID, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// organiseResource sends the change of the organisation of the resource
+func (c *Client) organiseResource(rid int64, method, path string, body []byte) (*http.Response, error) {
+	headers := http.Header{}
+	if body != nil {
+		headers.Set("Content-Type", "application/json")
+	}
+	return c.do(method, "/vault/"+strconv.FormatInt(rid, 10)+path, bytes.NewReader(body), headers)
+}
+
+func (c *Client) updateFolder(update any, format string) error {
+	if c.options.Folder == 0 {
+		return ErrNoFolder
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPatch, c.folderPath(), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, format, c.options.Folder)
+	return nil
+}
+
+func (c *Client) folderPath() string {
+	return "/vault/folders/" + strconv.FormatInt(c.options.Folder, 10)
+}
+
+func folderName(folder int64) string {
+	if folder == 0 {
+		return "/"
+	}
+	return strconv.FormatInt(folder, 10)
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stsg/gophkeeper/pkg/importer"
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// ImportFrom converts the file exported by another password manager into
+// secrets of the vault, or of the team vault with the team option. Folders
+// of the items are created as needed, attachments become blobs. Notes and
+// hidden fields of credentials and cards are stored as a text secret next
+// to them, titles, urls and visible fields become details.
+//
+// With the dry-run option the file is only parsed and validated, nothing is
+// sent to the server.
+func (c *Client) ImportFrom() error {
+	if c.options.File == "" {
+		return ErrNoFile
+	}
+	if c.options.ImportFormat == "" {
+		return ErrNoFormat
+	}
+	mapping := map[string]string{}
+	for _, m := range c.options.Mapping {
+		field, column, ok := strings.Cut(m, "=")
+		if !ok || field == "" || column == "" {
+			return fmt.Errorf("%w: %q", ErrBadMapping, m)
+		}
+		mapping[strings.ToLower(field)] = column
+	}
+	if c.offline && !c.options.DryRun {
+		return ErrOffline
+	}
+
+	file, err := os.Open(c.options.File)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", c.options.File, err)
+	}
+	defer file.Close()
+	items, err := importer.Parse(importer.Format(c.options.ImportFormat), file, importer.Options{
+		Password: c.options.SourcePass,
+		Mapping:  mapping,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", c.options.File, err)
+	}
+
+	folders := importedFolders{}
+	if !c.options.DryRun {
+		if folders, err = c.importedFolders(); err != nil {
+			return err
+		}
+	}
+	var failed int
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tKIND\tFOLDER\tATTACHMENTS\tSTATUS")
+	for _, item := range items {
+		status := "valid"
+		err := validateItem(item)
+		if err == nil && !c.options.DryRun {
+			status, err = c.importItem(item, folders)
+		}
+		if err != nil {
+			failed++
+			status = err.Error()
+		}
+		kind := string(item.Kind)
+		if kind == "" {
+			kind = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t/%s\t%d\t%s\n", item.Title, kind, strings.Join(item.Folder, "/"), len(item.Attachments), status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if c.options.DryRun {
+		fmt.Fprintf(c.out, "dry run: %d items to import, %d invalid\n", len(items)-failed, failed)
+		return nil
+	}
+	fmt.Fprintf(c.out, "%d items imported, %d failed\n", len(items)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrImportFailed, failed, len(items))
+	}
+	return nil
+}
+
+// validateItem checks the secret of the item as the server does
+func validateItem(item importer.Item) error {
+	if item.Kind == "" {
+		return nil
+	}
+	data, err := json.Marshal(item.Secret)
+	if err != nil {
+		return err
+	}
+	s := secret.Secret{Kind: item.Kind, Data: data}
+	return s.Normalize(time.Now())
+}
+
+// importItem stores the secret of the item with its private notes and
+// attachments and returns the status of the item
+func (c *Client) importItem(item importer.Item, folders importedFolders) (string, error) {
+	folder, err := c.importFolder(item.Folder, folders)
+	if err != nil {
+		return "", err
+	}
+	var rids []string
+	store := func(kind secret.Kind, meta string, payload any, details resourceDetails) error {
+		msg, err := c.newSecretMessage(kind, meta, payload)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(http.MethodPut, c.teamVault("/vault/"+string(kind)+"/"), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+		if err != nil {
+			return err
+		}
+		return c.importedResource(resp, folder, item.Tags, details, &rids)
+	}
+
+	if item.Kind != "" {
+		details := resourceDetails{Title: item.Title, URLs: item.URLs}
+		for _, f := range item.Fields {
+			details.Fields = append(details.Fields, detailsField{Name: f.Name, Value: f.Value})
+		}
+		if err := store(item.Kind, item.Title, item.Secret, details); err != nil {
+			return "", err
+		}
+	}
+	if private := item.Private(); private != "" {
+		title := item.Title + " notes"
+		if err := store(secret.KindText, title, secret.Text{Text: private}, resourceDetails{Title: title}); err != nil {
+			return "", err
+		}
+	}
+	for _, a := range item.Attachments {
+		resp, err := c.sendBlob(http.MethodPut, c.teamVault("/vault/binary/"), a.Name, a.Name, bytes.NewReader(a.Data))
+		if err != nil {
+			return "", err
+		}
+		if err := c.importedResource(resp, folder, item.Tags, resourceDetails{Title: a.Name}, &rids); err != nil {
+			return "", err
+		}
+	}
+	return "imported, rid " + strings.Join(rids, ","), nil
+}
+
+// importedResource reads the rid of the stored resource and puts it into
+// the folder with the tags and details of the item
+func (c *Client) importedResource(resp *http.Response, folder int64, tags []string, details resourceDetails, rids *[]string) error {
+	defer resp.Body.Close()
+	var response struct {
+		RID int64 `json:"rid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	*rids = append(*rids, fmt.Sprint(response.RID))
+
+	type change struct {
+		path string
+		body []byte
+	}
+	var changes []change
+	if folder != 0 {
+		body, err := json.Marshal(struct {
+			Folder int64 `json:"folder"`
+		}{folder})
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change{"/folder", body})
+	}
+	for _, tag := range tags {
+		changes = append(changes, change{"/tags/" + url.PathEscape(tag), nil})
+	}
+	body, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, change{"/details", body})
+	for _, ch := range changes {
+		resp, err := c.organiseResource(response.RID, http.MethodPut, ch.path, ch.body)
+		if err != nil {
+			return fmt.Errorf("rid %d stored, organising failed: %w", response.RID, err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// importedFolders maps the parent folder id and the name of folders of the
+// vault to their ids
+type importedFolders map[string]int64
+
+func folderKey(parent int64, name string) string {
+	return fmt.Sprintf("%d/%s", parent, name)
+}
+
+// importedFolders returns the folders of the vault
+func (c *Client) importedFolders() (importedFolders, error) {
+	resp, err := c.do(http.MethodGet, c.teamVault("/vault/folders"), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []struct {
+		ID     int64  `json:"id"`
+		Parent int64  `json:"parent"`
+		Name   string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode folders: %w", err)
+	}
+	folders := importedFolders{}
+	for _, f := range list {
+		folders[folderKey(f.Parent, f.Name)] = f.ID
+	}
+	return folders, nil
+}
+
+// importFolder returns the id of the folder of the path, missing folders
+// are created
+func (c *Client) importFolder(path []string, folders importedFolders) (int64, error) {
+	var parent int64
+	for _, name := range path {
+		if id, ok := folders[folderKey(parent, name)]; ok {
+			parent = id
+			continue
+		}
+		body, err := json.Marshal(struct {
+			Name   string `json:"name"`
+			Parent int64  `json:"parent"`
+		}{name, parent})
+		if err != nil {
+			return 0, err
+		}
+		resp, err := c.do(http.MethodPost, c.teamVault("/vault/folders"), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create folder %s: %w", name, err)
+		}
+		var response struct {
+			ID int64 `json:"id"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode response: %w", err)
+		}
+		folders[folderKey(parent, name)] = response.ID
+		parent = response.ID
+	}
+	return parent, nil
+}
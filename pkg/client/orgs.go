@@ -0,0 +1,300 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Orgs lists the organisations of the user with the role of the user
+func (c *Client) Orgs() error {
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, "/orgs/", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var orgs []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&orgs); err != nil {
+		return fmt.Errorf("failed to decode organisations: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tROLE")
+	for _, o := range orgs {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", o.ID, o.Name, o.Role)
+	}
+	return w.Flush()
+}
+
+// CreateOrg creates an organisation owned by the user
+func (c *Client) CreateOrg() error {
+	if c.options.Name == "" {
+		return ErrNoName
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	id, err := c.create("/orgs/")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "organisation %s created with id %d\n", c.options.Name, id)
+	return nil
+}
+
+// OrgMembers lists the members of the organisation with their roles
+func (c *Client) OrgMembers() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	return c.printMembers(c.orgPath() + "/members")
+}
+
+// SetMember adds the user to the organisation or changes the role of the
+// member. Owners and admins manage members, only owners manage owners and
+// admins.
+func (c *Client) SetMember() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Member == "" {
+		return ErrNoMember
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	body, err := json.Marshal(struct {
+		Role string `json:"role"`
+	}{c.options.Role})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPut, c.orgPath()+"/members/"+url.PathEscape(c.options.Member), bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "%s is %s of organisation %d\n", c.options.Member, c.options.Role, c.options.Org)
+	return nil
+}
+
+// RemoveMember removes the member from the organisation and its teams
+func (c *Client) RemoveMember() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Member == "" {
+		return ErrNoMember
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodDelete, c.orgPath()+"/members/"+url.PathEscape(c.options.Member), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "%s removed from organisation %d\n", c.options.Member, c.options.Org)
+	return nil
+}
+
+// Teams lists the teams of the organisation
+func (c *Client) Teams() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodGet, c.orgPath()+"/teams", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var teams []struct {
+		ID     int64  `json:"id"`
+		Name   string `json:"name"`
+		Member bool   `json:"member"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&teams); err != nil {
+		return fmt.Errorf("failed to decode teams: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMEMBER")
+	for _, t := range teams {
+		fmt.Fprintf(w, "%d\t%s\t%t\n", t.ID, t.Name, t.Member)
+	}
+	return w.Flush()
+}
+
+// CreateTeam creates a team of the organisation with the user as its first
+// member
+func (c *Client) CreateTeam() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Name == "" {
+		return ErrNoName
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	id, err := c.create(c.orgPath() + "/teams")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "team %s created with id %d\n", c.options.Name, id)
+	return nil
+}
+
+// DeleteTeam removes a team with an empty vault
+func (c *Client) DeleteTeam() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Team == 0 {
+		return ErrNoTeam
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(http.MethodDelete, c.teamPath(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, "team %d deleted\n", c.options.Team)
+	return nil
+}
+
+// TeamMembers lists the members of the team with their organisation roles
+func (c *Client) TeamMembers() error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Team == 0 {
+		return ErrNoTeam
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	return c.printMembers(c.teamPath() + "/members")
+}
+
+// AddTeamMember gives the organisation member access to the team vault,
+// only team members may add members
+func (c *Client) AddTeamMember() error {
+	return c.changeTeamMember(http.MethodPut, "%s added to team %d\n")
+}
+
+// RemoveTeamMember removes the member from the team, members may leave by
+// themselves
+func (c *Client) RemoveTeamMember() error {
+	return c.changeTeamMember(http.MethodDelete, "%s removed from team %d\n")
+}
+
+func (c *Client) changeTeamMember(method, format string) error {
+	if c.options.Org == 0 {
+		return ErrNoOrg
+	}
+	if c.options.Team == 0 {
+		return ErrNoTeam
+	}
+	if c.options.Member == "" {
+		return ErrNoMember
+	}
+	if c.offline {
+		return ErrOffline
+	}
+	resp, err := c.do(method, c.teamPath()+"/members/"+url.PathEscape(c.options.Member), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(c.out, format, c.options.Member, c.options.Team)
+	return nil
+}
+
+// create posts the name option and returns the id of the created entity
+func (c *Client) create(path string) (int64, error) {
+	body, err := json.Marshal(struct {
+		Name string `json:"name"`
+	}{c.options.Name})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(http.MethodPost, path, bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return response.ID, nil
+}
+
+func (c *Client) printMembers(path string) error {
+	resp, err := c.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var members []struct {
+		Login string `json:"login"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return fmt.Errorf("failed to decode members: %w", err)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LOGIN\tROLE")
+	for _, m := range members {
+		fmt.Fprintf(w, "%s\t%s\n", m.Login, m.Role)
+	}
+	return w.Flush()
+}
+
+func (c *Client) orgPath() string {
+	return "/orgs/" + strconv.FormatInt(c.options.Org, 10)
+}
+
+func (c *Client) teamPath() string {
+	return c.orgPath() + "/teams/" + strconv.FormatInt(c.options.Team, 10)
+}
+
+// teamVault adds the team option to the path of a store request
+func (c *Client) teamVault(path string) string {
+	if c.options.Team == 0 {
+		return path
+	}
+	return path + "?team=" + strconv.FormatInt(c.options.Team, 10)
+}
+
+func teamName(team int64) string {
+	if team == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(team, 10)
+}
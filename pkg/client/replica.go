@@ -0,0 +1,174 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+)
+
+var ErrNoReplica = fmt.Errorf("no local replica, run sync while online first")
+
+// replica is the local copy of the vault. It is kept in a single file
+// sealed into an envelope with the key derived from the user password.
+//
+// Entries are keyed by resource id, resources added offline get negative
+// ids until they are pushed. Pending holds local changes in the order they
+// were made, Cursor is the version of the last change pulled from the server.
+type replica struct {
+	Cursor    int64            `json:"cursor"`
+	Entries   map[int64]*entry `json:"entries"`
+	Pending   []change         `json:"pending,omitempty"`
+	Conflicts []conflict       `json:"conflicts,omitempty"`
+	LastLocal int64            `json:"last_local"`
+}
+
+// entry is a replicated resource, Secret is empty for blobs and legacy pieces
+type entry struct {
+	resource
+	Secret *secretMessage `json:"secret,omitempty"`
+}
+
+const (
+	changeAdd    = "add"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// change is a local change waiting to be pushed. Version is the version of
+// the resource the change is based on, the server rejects the change if the
+// resource was changed since.
+type change struct {
+	Op      string `json:"op"`
+	RID     int64  `json:"rid"`
+	Version int64  `json:"version,omitempty"`
+	Entry   *entry `json:"entry,omitempty"`
+}
+
+// conflict is a local change the server refused, kept until the user sees it
+type conflict struct {
+	Change change `json:"change"`
+	Reason string `json:"reason"`
+}
+
+func newReplica() *replica {
+	return &replica{Entries: map[int64]*entry{}}
+}
+
+// replicaPath returns the replica file location, by default a file per
+// user and server in the user config dir.
+func (c *Client) replicaPath() (string, error) {
+	if c.options.Cache != "" {
+		return c.options.Cache, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	host := c.options.URL
+	if u, err := url.Parse(c.options.URL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(c.options.Login + "@" + host)
+	return filepath.Join(dir, "gophkeeper", name+".vault"), nil
+}
+
+func (c *Client) replicaKeyring() *envelope.Keyring {
+	return envelope.NewKeyring(c.options.Password, c.options.Login, c.kdf)
+}
+
+// loadReplica reads the replica, a missing file gives an empty replica
+// and ErrNoReplica.
+func (c *Client) loadReplica() (*replica, error) {
+	path, err := c.replicaPath()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newReplica(), ErrNoReplica
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.replicaKeyring().Open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local replica %s: %w", path, err)
+	}
+	r := newReplica()
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to decode local replica %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// saveReplica seals the replica and atomically replaces the file
+func (c *Client) saveReplica(r *replica) error {
+	path, err := c.replicaPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	sealed, err := c.replicaKeyring().Seal(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// queue records a local change. Changes of a resource already changed
+// offline are merged into the pending change, so every resource has at
+// most one pending change based on the version pulled from the server.
+func (r *replica) queue(ch change) {
+	switch ch.Op {
+	case changeAdd, changeUpdate:
+		r.Entries[ch.RID] = ch.Entry
+	case changeDelete:
+		delete(r.Entries, ch.RID)
+	}
+
+	i := slices.IndexFunc(r.Pending, func(pending change) bool { return pending.RID == ch.RID })
+	if i < 0 {
+		r.Pending = append(r.Pending, ch)
+		return
+	}
+	pending := &r.Pending[i]
+	switch {
+	case pending.Op == changeAdd && ch.Op == changeDelete:
+		// never reached the server
+		r.Pending = slices.Delete(r.Pending, i, i+1)
+	case pending.Op == changeAdd:
+		pending.Entry = ch.Entry
+	default:
+		pending.Op, pending.Entry = ch.Op, ch.Entry
+	}
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// Sync pushes changes made offline and pulls changes made on the server,
+// possibly from other devices, into the local replica.
+//
+// Local changes are pushed first. A change the server refuses because the
+// resource was changed elsewhere since it was pulled is kept as a conflict
+// and the server state wins, see Conflicts.
+func (c *Client) Sync() error {
+	if c.offline {
+		return ErrOffline
+	}
+	r, err := c.loadReplica()
+	if err != nil && !errors.Is(err, ErrNoReplica) {
+		return err
+	}
+	conflicts := len(r.Conflicts)
+
+	pushed, err := c.push(r)
+	if err != nil {
+		// keep what was pushed, the rest stays queued
+		return errors.Join(err, c.saveReplica(r))
+	}
+	pulled, deleted, err := c.pull(r)
+	if err != nil {
+		return errors.Join(err, c.saveReplica(r))
+	}
+	if err := c.saveReplica(r); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "synced: %d pushed, %d pulled, %d deleted\n", pushed, pulled, deleted)
+	if n := len(r.Conflicts) - conflicts; n > 0 {
+		fmt.Fprintf(c.out, "%d local changes conflict with the server, see conflicts command\n", n)
+	}
+	return nil
+}
+
+// Conflicts prints local changes refused during sync and forgets them
+func (c *Client) Conflicts() error {
+	r, err := c.loadReplica()
+	if err != nil {
+		return err
+	}
+	if len(r.Conflicts) == 0 {
+		fmt.Fprintln(c.out, "no conflicts")
+		return nil
+	}
+	for _, cf := range r.Conflicts {
+		fmt.Fprintf(c.out, "%s %d: %s\n", cf.Change.Op, cf.Change.RID, cf.Reason)
+		if e := cf.Change.Entry; e != nil && e.Secret != nil {
+			fmt.Fprintf(c.out, "  kind: %s, meta: %s\n", e.Kind, e.Secret.Meta)
+			if !e.Secret.Opaque {
+				fmt.Fprintf(c.out, "  data: %s\n", e.Secret.Data)
+			}
+		}
+	}
+	r.Conflicts = nil
+	return c.saveReplica(r)
+}
+
+// push sends pending changes in order and stops at the first transport error
+func (c *Client) push(r *replica) (int, error) {
+	var pushed int
+	for len(r.Pending) > 0 {
+		ch := r.Pending[0]
+		err := c.pushChange(r, ch)
+		switch {
+		case err == nil:
+			pushed++
+		case ch.Op == changeDelete && errors.Is(err, ErrNotFound):
+			// already deleted on another device
+		case errors.Is(err, ErrStale), errors.Is(err, ErrNotFound), errors.Is(err, ErrBadRequest):
+			r.Conflicts = append(r.Conflicts, conflict{Change: ch, Reason: err.Error()})
+			if ch.Op == changeAdd {
+				delete(r.Entries, ch.RID)
+			}
+		default:
+			return pushed, err
+		}
+		r.Pending = r.Pending[1:]
+	}
+	return pushed, nil
+}
+
+func (c *Client) pushChange(r *replica, ch change) error {
+	switch ch.Op {
+	case changeAdd:
+		body, err := json.Marshal(ch.Entry.Secret)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(http.MethodPut, "/vault/"+string(ch.Entry.Kind)+"/", bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// the stored resource comes back with its server id on pull
+		delete(r.Entries, ch.RID)
+		return nil
+	case changeUpdate:
+		body, err := json.Marshal(ch.Entry.Secret)
+		if err != nil {
+			return err
+		}
+		headers := ifMatch(ch.Version)
+		headers.Set("Content-Type", "application/json")
+		path := "/vault/" + string(ch.Entry.Kind) + "/" + strconv.FormatInt(ch.RID, 10)
+		resp, err := c.do(http.MethodPut, path, bytes.NewReader(body), headers)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	case changeDelete:
+		resp, err := c.do(http.MethodDelete, "/vault/"+strconv.FormatInt(ch.RID, 10), nil, ifMatch(ch.Version))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return fmt.Errorf("unknown local change %q", ch.Op)
+}
+
+// ifMatch returns headers making the write conditional on the resource version
+func ifMatch(version int64) http.Header {
+	headers := http.Header{}
+	if version > 0 {
+		headers.Set("If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	}
+	return headers
+}
+
+// pull applies server changes after the replica cursor. Nothing is applied
+// unless all changed secrets are fetched.
+func (c *Client) pull(r *replica) (pulled, deleted int, err error) {
+	resp, err := c.do(http.MethodGet, "/vault/changes?since="+strconv.FormatInt(r.Cursor, 10), nil, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	var changes struct {
+		Resources []resource
+		Deleted   []struct {
+			ID      int64
+			Version int64
+		}
+		Cursor int64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode changes: %w", err)
+	}
+
+	entries := make([]*entry, 0, len(changes.Resources))
+	for _, res := range changes.Resources {
+		e := &entry{resource: res}
+		if res.Type == resourceTypePiece && slices.Contains(secret.Kinds, res.Kind) {
+			msg, err := c.fetchSecret(res.Kind, res.ID)
+			if errors.Is(err, ErrNotFound) {
+				continue // deleted meanwhile, the tombstone comes with the next sync
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			e.Secret = &msg
+		}
+		entries = append(entries, e)
+	}
+
+	for _, e := range entries {
+		r.Entries[e.ID] = e
+	}
+	for _, tombstone := range changes.Deleted {
+		delete(r.Entries, tombstone.ID)
+	}
+	r.Cursor = changes.Cursor
+	return len(entries), len(changes.Deleted), nil
+}
+
+// listReplica prints resources of the local replica, resources added
+// offline have negative ids until synced.
+func (c *Client) listReplica() error {
+	r, err := c.loadReplica()
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(r.Entries))
+	for id := range r.Entries {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	resources := make([]resource, 0, len(ids))
+	for _, id := range ids {
+		e := r.Entries[id].resource
+		e.ID = id
+		resources = append(resources, e)
+	}
+	if err := c.printResources(resources); err != nil {
+		return err
+	}
+	if len(r.Pending) > 0 {
+		fmt.Fprintf(c.out, "%d local changes pending sync\n", len(r.Pending))
+	}
+	return nil
+}
+
+// replicaSecret returns a secret of the given kind from the local replica
+func (c *Client) replicaSecret(kind secret.Kind, rid int64) (secretMessage, error) {
+	r, err := c.loadReplica()
+	if err != nil {
+		return secretMessage{}, err
+	}
+	e, ok := r.Entries[rid]
+	if !ok || e.Kind != kind || e.Secret == nil {
+		return secretMessage{}, ErrNotFound
+	}
+	return *e.Secret, nil
+}
+
+// queueChange records a change made offline in the local replica
+func (c *Client) queueChange(ch change) error {
+	r, err := c.loadReplica()
+	if err != nil {
+		return err
+	}
+	switch ch.Op {
+	case changeAdd:
+		r.LastLocal--
+		ch.RID = r.LastLocal
+		ch.Entry.ID = ch.RID
+	case changeUpdate:
+		e, ok := r.Entries[ch.RID]
+		if !ok || e.Kind != ch.Entry.Kind {
+			return ErrNotFound
+		}
+		ch.Version = e.Version
+		ch.Entry.Version = e.Version
+	case changeDelete:
+		e, ok := r.Entries[ch.RID]
+		if !ok {
+			return ErrNotFound
+		}
+		ch.Version = e.Version
+	}
+	r.queue(ch)
+	if err := c.saveReplica(r); err != nil {
+		return err
+	}
+	switch ch.Op {
+	case changeAdd:
+		fmt.Fprintf(c.out, "stored locally with rid %d, run sync to push it\n", ch.RID)
+	case changeUpdate:
+		fmt.Fprintf(c.out, "resource %d updated locally, run sync to push it\n", ch.RID)
+	case changeDelete:
+		fmt.Fprintf(c.out, "resource %d deleted locally, run sync to push it\n", ch.RID)
+	}
+	return nil
+}
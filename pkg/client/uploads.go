@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultChunkSize is the chunk size of uploads without the chunk-size
+	// option
+	defaultChunkSize = 8 << 20
+	// chunkAlignment is the segment size of blobs encrypted by the server,
+	// chunks but the last one must be its multiples
+	chunkAlignment = 64 << 10
+	// transferRetries limits the attempts of a chunk or of a download resume
+	transferRetries = 3
+)
+
+// uploadFileChunked uploads the file of the size in chunks, a chunk that
+// failed is sent again from the offset the server reports. The upload
+// option resumes the upload of an earlier run, only uploads of content
+// encrypted by the server can be resumed since client side encryption
+// never produces the same envelope twice.
+func (c *Client) uploadFileChunked(file *os.File, size int64) error {
+	chunkSize := c.chunkSize()
+	if chunkSize <= 0 || chunkSize%chunkAlignment != 0 {
+		return ErrBadChunkSize
+	}
+
+	var (
+		id      = c.options.Upload
+		offset  int64
+		content io.Reader = file
+		sum               = sha256.New()
+	)
+	if c.options.ZeroKnowledge {
+		if id != "" {
+			return ErrResumeEncrypted
+		}
+		content = c.encryptedContent(file)
+	}
+	if id == "" {
+		var err error
+		if id, err = c.createUpload(size); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "upload %s started, resume it with --upload %s\n", id, id)
+	} else {
+		var err error
+		if offset, err = c.uploadOffset(id); err != nil {
+			return err
+		}
+		// the checksum covers the content received already
+		if _, err := io.CopyN(sum, file, offset); err != nil {
+			return fmt.Errorf("failed to read %s: %w", c.options.File, err)
+		}
+	}
+
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(content, chunk)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return fmt.Errorf("failed to read %s: %w", c.options.File, err)
+		}
+		if n > 0 {
+			sum.Write(chunk[:n])
+			if offset, err = c.sendChunk(id, offset, chunk[:n]); err != nil {
+				return fmt.Errorf("upload %s stopped at %d bytes: %w", id, offset, err)
+			}
+		}
+		if last {
+			break
+		}
+	}
+	return c.commitUpload(id, sum)
+}
+
+// chunkSize returns the chunk size of uploads
+func (c *Client) chunkSize() int64 {
+	if c.options.ChunkSize == 0 {
+		return defaultChunkSize
+	}
+	return c.options.ChunkSize
+}
+
+// encryptedContent encrypts the content into a stream envelope on the fly
+func (c *Client) encryptedContent(content io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		ew, err := c.keyring.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(ew, content); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(ew.Close())
+	}()
+	return pr
+}
+
+// createUpload starts the upload of the blob, the length of envelopes is
+// not known in advance
+func (c *Client) createUpload(size int64) (string, error) {
+	headers := c.blobHeaders(c.options.Meta, c.options.File)
+	if !c.options.ZeroKnowledge {
+		headers.Set("Upload-Length", strconv.FormatInt(size, 10))
+	}
+	resp, err := c.do(http.MethodPost, c.teamVault("/vault/uploads/"), nil, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	return response.ID, nil
+}
+
+// uploadOffset returns the offset the upload continues from
+func (c *Client) uploadOffset(id string) (int64, error) {
+	resp, err := c.do(http.MethodHead, "/vault/uploads/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad upload offset", ErrUnexpectedStatus)
+	}
+	return offset, nil
+}
+
+// sendChunk sends the chunk at the offset and returns the new offset. A
+// failed chunk is sent again unless the server received it meanwhile.
+func (c *Client) sendChunk(id string, offset int64, chunk []byte) (int64, error) {
+	path := "/vault/uploads/" + url.PathEscape(id)
+	var err error
+	for attempt := 0; attempt < transferRetries; attempt++ {
+		var resp *http.Response
+		resp, err = c.do(http.MethodPut, path, bytes.NewReader(chunk), http.Header{
+			"Upload-Offset": {strconv.FormatInt(offset, 10)},
+			"Content-Type":  {"application/offset+octet-stream"},
+		})
+		if err == nil {
+			resp.Body.Close()
+			return offset + int64(len(chunk)), nil
+		}
+		if !retryable(err) {
+			return offset, err
+		}
+		received, offsetErr := c.uploadOffset(id)
+		switch {
+		case offsetErr != nil:
+		case received == offset+int64(len(chunk)):
+			// the response of the chunk was lost
+			return received, nil
+		case received != offset:
+			return offset, fmt.Errorf("%w: server is at %d bytes", ErrConflict, received)
+		}
+	}
+	return offset, err
+}
+
+// commitUpload stores the uploaded blob and prints its rid
+func (c *Client) commitUpload(id string, sum hash.Hash) error {
+	resp, err := c.do(http.MethodPost, "/vault/uploads/"+url.PathEscape(id)+"/commit", nil, http.Header{
+		"Upload-Checksum": {"sha256 " + base64.StdEncoding.EncodeToString(sum.Sum(nil))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.printRID(resp.Body)
+}
+
+// retryable tells if the request may succeed when sent again
+func retryable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, ErrConflict) || errors.Is(err, ErrUnexpectedStatus)
+}
+
+// resumingBody reads the body of a download and requests the rest of the
+// content with a range when the connection breaks. The ETag of the first
+// response is sent in If-Range, so a blob changed meanwhile fails the
+// download instead of mixing two contents.
+type resumingBody struct {
+	c       *Client
+	path    string
+	etag    string
+	body    io.ReadCloser
+	offset  int64
+	retries int
+	err     error // err of the last read, returned after the bytes read
+}
+
+func (rb *resumingBody) Read(p []byte) (int, error) {
+	for {
+		if rb.err == nil {
+			n, err := rb.body.Read(p)
+			rb.offset += int64(n)
+			if err == nil || err == io.EOF {
+				return n, err
+			}
+			rb.err = err
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if rb.etag == "" || rb.retries >= transferRetries || rb.c.ctx.Err() != nil {
+			return 0, rb.err
+		}
+		rb.retries++
+		if err := rb.resume(); err != nil {
+			return 0, errors.Join(rb.err, err)
+		}
+		rb.err = nil
+	}
+}
+
+// resume requests the content from the offset read so far
+func (rb *resumingBody) resume() error {
+	resp, err := rb.c.do(http.MethodGet, rb.path, nil, http.Header{
+		"Range":    {"bytes=" + strconv.FormatInt(rb.offset, 10) + "-"},
+		"If-Range": {rb.etag},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// the blob changed since the download started
+		resp.Body.Close()
+		return fmt.Errorf("%w: %s", ErrStale, resp.Status)
+	}
+	rb.body.Close()
+	rb.body = resp.Body
+	return nil
+}
+
+func (rb *resumingBody) Close() error {
+	return rb.body.Close()
+}
+
+// contentDigest parses the SHA-256 of the "Digest" header, nil if the
+// server sent none
+func contentDigest(header string) ([]byte, error) {
+	for _, value := range strings.Split(header, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+		if !ok || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%w: bad digest", ErrUnexpectedStatus)
+		}
+		return digest, nil
+	}
+	return nil, nil
+}
+
+// digestReader hashes the content read and fails at its end if the hash
+// differs from the digest
+type digestReader struct {
+	r      io.Reader
+	digest []byte
+	hash   hash.Hash
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	dr.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(dr.hash.Sum(nil), dr.digest) {
+		return n, ErrCorrupted
+	}
+	return n, err
+}
@@ -0,0 +1,302 @@
+// Package envelope implements the versioned format of data encrypted on the
+// client side. The server only checks the header and stores the rest opaquely.
+//
+// Header layout, all integers are big endian:
+//
+//	magic    [4]byte "GPKE"
+//	version  uint8
+//	mode     uint8   ModeMessage or ModeStream
+//	kdf      uint8   KDFArgon2id
+//	time     uint32  argon2 iterations
+//	memory   uint32  argon2 memory in KiB
+//	threads  uint8   argon2 parallelism
+//	salt     [16]byte
+//	nonce    [12]byte for ModeMessage, [7]byte prefix for ModeStream
+//
+// The header is authenticated as additional data of the ciphertext.
+package envelope
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/stsg/gophkeeper/pkg/stream"
+)
+
+const (
+	Magic    = "GPKE"
+	Version1 = 1
+
+	ModeMessage = 1
+	ModeStream  = 2
+
+	KDFArgon2id = 1
+
+	saltSize     = 16
+	messageNonce = 12
+	keyLen       = 32
+	fixedSize    = len(Magic) + 1 + 1 + 1 + 4 + 4 + 1 + saltSize
+
+	// MaxHeaderSize is the number of bytes enough to parse any header
+	MaxHeaderSize = fixedSize + messageNonce
+
+	// limits protect from envelopes demanding unreasonable KDF work
+	maxTime   = 16
+	maxMemory = 1024 * 1024
+)
+
+var (
+	ErrMalformed   = fmt.Errorf("malformed envelope")
+	ErrUnsupported = fmt.Errorf("unsupported envelope")
+	ErrDecrypt     = fmt.Errorf("envelope decryption failed")
+)
+
+// KDFParams are the Argon2id parameters used to derive the master key
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultKDF follows the second recommended option of RFC 9106
+var DefaultKDF = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// Header is a parsed envelope header
+type Header struct {
+	Version uint8
+	Mode    uint8
+	KDF     uint8
+	Params  KDFParams
+	Salt    []byte
+	Nonce   []byte
+}
+
+// Size returns the encoded header size
+func (h Header) Size() int {
+	return fixedSize + len(h.Nonce)
+}
+
+// Marshal encodes the header
+func (h Header) Marshal() []byte {
+	buf := make([]byte, 0, h.Size())
+	buf = append(buf, Magic...)
+	buf = append(buf, h.Version, h.Mode, h.KDF)
+	buf = binary.BigEndian.AppendUint32(buf, h.Params.Time)
+	buf = binary.BigEndian.AppendUint32(buf, h.Params.Memory)
+	buf = append(buf, h.Params.Threads)
+	buf = append(buf, h.Salt...)
+	return append(buf, h.Nonce...)
+}
+
+// ParseHeader decodes and checks the header at the beginning of data
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < fixedSize || string(data[:len(Magic)]) != Magic {
+		return Header{}, ErrMalformed
+	}
+	h := Header{
+		Version: data[4],
+		Mode:    data[5],
+		KDF:     data[6],
+		Params: KDFParams{
+			Time:    binary.BigEndian.Uint32(data[7:11]),
+			Memory:  binary.BigEndian.Uint32(data[11:15]),
+			Threads: data[15],
+		},
+		Salt: data[16:fixedSize],
+	}
+	if h.Version != Version1 || h.KDF != KDFArgon2id {
+		return Header{}, ErrUnsupported
+	}
+	if h.Params.Time == 0 || h.Params.Memory == 0 || h.Params.Threads == 0 {
+		return Header{}, ErrMalformed
+	}
+	if h.Params.Time > maxTime || h.Params.Memory > maxMemory {
+		return Header{}, ErrUnsupported
+	}
+	var nonceSize int
+	switch h.Mode {
+	case ModeMessage:
+		nonceSize = messageNonce
+	case ModeStream:
+		nonceSize = stream.NoncePrefixSize
+	default:
+		return Header{}, ErrUnsupported
+	}
+	if len(data) < fixedSize+nonceSize {
+		return Header{}, ErrMalformed
+	}
+	h.Nonce = data[fixedSize : fixedSize+nonceSize]
+	return h, nil
+}
+
+// ReadHeader reads and parses the header from r
+func ReadHeader(r io.Reader) (Header, error) {
+	fixed := make([]byte, fixedSize)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return Header{}, ErrMalformed
+	}
+	nonceSize := messageNonce
+	if fixed[5] == ModeStream {
+		nonceSize = stream.NoncePrefixSize
+	}
+	rest := make([]byte, nonceSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return Header{}, ErrMalformed
+	}
+	return ParseHeader(append(fixed, rest...))
+}
+
+// Keyring derives master keys from a passphrase and seals and opens
+// envelopes with them. Derived master keys are cached per KDF parameters.
+type Keyring struct {
+	passphrase []byte
+	salt       []byte
+	params     KDFParams
+
+	mu   sync.Mutex
+	keys map[KDFParams][]byte
+}
+
+// NewKeyring returns a Keyring for the given passphrase. The login is used
+// as the Argon2id salt, so the same passphrase gives the same master key on
+// every device of the user.
+func NewKeyring(passphrase, login string, params KDFParams) *Keyring {
+	salt := sha256.Sum256([]byte("gophkeeper:" + login))
+	return &Keyring{
+		passphrase: []byte(passphrase),
+		salt:       salt[:],
+		params:     params,
+		keys:       map[KDFParams][]byte{},
+	}
+}
+
+// NewArchiveKeyring returns a Keyring for archives not bound to a login,
+// such as vault exports moved between users and instances. The random salt
+// of every envelope still gives each archive its own content key.
+func NewArchiveKeyring(passphrase string, params KDFParams) *Keyring {
+	salt := sha256.Sum256([]byte("gophkeeper archive"))
+	return &Keyring{
+		passphrase: []byte(passphrase),
+		salt:       salt[:],
+		params:     params,
+		keys:       map[KDFParams][]byte{},
+	}
+}
+
+// Seal encrypts plaintext into a single message envelope
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	h, err := k.newHeader(ModeMessage, messageNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	header := h.Marshal()
+	return aead.Seal(header, h.Nonce, plaintext, header), nil
+}
+
+// Open decrypts a single message envelope
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	h, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.Mode != ModeMessage {
+		return nil, ErrUnsupported
+	}
+	aead, err := k.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	header := data[:h.Size()]
+	plaintext, err := aead.Open(nil, h.Nonce, data[h.Size():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// NewWriter writes a stream envelope header to w and returns a writer
+// encrypting everything written to it. Close writes the final segment.
+func (k *Keyring) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	h, err := k.newHeader(ModeStream, stream.NoncePrefixSize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	header := h.Marshal()
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return stream.NewWriter(w, aead, h.Nonce, header)
+}
+
+// NewReader reads a stream envelope header from r and returns a reader of
+// the decrypted content.
+func (k *Keyring) NewReader(r io.Reader) (io.Reader, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.Mode != ModeStream {
+		return nil, ErrUnsupported
+	}
+	aead, err := k.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewReader(r, aead, h.Nonce, h.Marshal())
+}
+
+func (k *Keyring) newHeader(mode uint8, nonceSize int) (Header, error) {
+	h := Header{
+		Version: Version1,
+		Mode:    mode,
+		KDF:     KDFArgon2id,
+		Params:  k.params,
+		Salt:    make([]byte, saltSize),
+		Nonce:   make([]byte, nonceSize),
+	}
+	if _, err := rand.Read(h.Salt); err != nil {
+		return Header{}, err
+	}
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return Header{}, err
+	}
+	return h, nil
+}
+
+// aead returns the cipher for the envelope, the content key is derived
+// from the master key and the envelope salt with HKDF.
+func (k *Keyring) aead(h Header) (cipher.AEAD, error) {
+	key := make([]byte, keyLen)
+	kdf := hkdf.New(sha256.New, k.master(h.Params), h.Salt, []byte("gophkeeper envelope v1"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return stream.NewAEAD(key)
+}
+
+func (k *Keyring) master(p KDFParams) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[p]; ok {
+		return key
+	}
+	key := argon2.IDKey(k.passphrase, k.salt, p.Time, p.Memory, p.Threads, keyLen)
+	k.keys[p] = key
+	return key
+}
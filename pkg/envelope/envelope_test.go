@@ -0,0 +1,85 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cheap parameters keep tests fast
+var testKDF = KDFParams{Time: 1, Memory: 1024, Threads: 1}
+
+func TestKeyring_Message(t *testing.T) {
+	k := NewKeyring("passphrase", "user", testKDF)
+	sealed, err := k.Seal([]byte("secret"))
+	require.NoError(t, err)
+
+	h, err := ParseHeader(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(ModeMessage), h.Mode)
+	assert.Equal(t, testKDF, h.Params)
+
+	// another device of the same user derives the same key
+	opened, err := NewKeyring("passphrase", "user", DefaultKDF).Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+
+	_, err = NewKeyring("wrong", "user", testKDF).Open(sealed)
+	assert.ErrorIs(t, err, ErrDecrypt)
+	_, err = NewKeyring("passphrase", "other", testKDF).Open(sealed)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	// header is authenticated
+	tampered := bytes.Clone(sealed)
+	tampered[20] ^= 1
+	_, err = k.Open(tampered)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestKeyring_Stream(t *testing.T) {
+	k := NewKeyring("passphrase", "user", testKDF)
+	plaintext := make([]byte, 200*1024)
+	_, _ = rand.Read(plaintext)
+
+	var buf bytes.Buffer
+	w, err := k.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	h, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint8(ModeStream), h.Mode)
+
+	r, err := k.NewReader(&buf)
+	require.NoError(t, err)
+	opened, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+}
+
+func TestParseHeader(t *testing.T) {
+	_, err := ParseHeader([]byte("plain text, not an envelope at all"))
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	h := Header{Version: 2, Mode: ModeMessage, KDF: KDFArgon2id, Params: testKDF, Salt: make([]byte, 16), Nonce: make([]byte, 12)}
+	_, err = ParseHeader(h.Marshal())
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	h.Version = Version1
+	h.Params.Memory = 1 << 30
+	_, err = ParseHeader(h.Marshal())
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	h.Params = testKDF
+	parsed, err := ParseHeader(h.Marshal())
+	require.NoError(t, err)
+	assert.Equal(t, h, parsed)
+	_, err = ParseHeader(h.Marshal()[:h.Size()-1])
+	assert.ErrorIs(t, err, ErrMalformed)
+}
@@ -0,0 +1,146 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// Bitwarden item types and custom field types
+const (
+	bitwardenLogin    = 1
+	bitwardenNote     = 2
+	bitwardenCard     = 3
+	bitwardenIdentity = 4
+
+	bitwardenFieldText    = 0
+	bitwardenFieldHidden  = 1
+	bitwardenFieldBoolean = 2
+)
+
+// bitwardenIdentityFields are the fields of identities in the order of the
+// Bitwarden forms
+var bitwardenIdentityFields = []string{
+	"title", "firstName", "middleName", "lastName", "company", "email", "phone",
+	"address1", "address2", "address3", "city", "state", "postalCode", "country",
+	"username", "ssn", "passportNumber", "licenseNumber",
+}
+
+type bitwardenExport struct {
+	Encrypted bool `json:"encrypted"`
+	Folders   []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	Items []bitwardenItem `json:"items"`
+}
+
+type bitwardenItem struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name"`
+	Notes    string `json:"notes"`
+	FolderID string `json:"folderId"`
+	Fields   []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+		Type  int    `json:"type"`
+	} `json:"fields"`
+	Login *struct {
+		URIs []struct {
+			URI string `json:"uri"`
+		} `json:"uris"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		TOTP     string `json:"totp"`
+	} `json:"login"`
+	Card *struct {
+		CardholderName string `json:"cardholderName"`
+		Number         string `json:"number"`
+		ExpMonth       string `json:"expMonth"`
+		ExpYear        string `json:"expYear"`
+		Code           string `json:"code"`
+	} `json:"card"`
+	Identity map[string]any `json:"identity"`
+}
+
+// parseBitwarden reads an unencrypted Bitwarden JSON export, folder names
+// are paths separated by slashes
+func parseBitwarden(r io.Reader) ([]Item, error) {
+	var export bitwardenExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if export.Encrypted {
+		return nil, fmt.Errorf("%w: encrypted Bitwarden export, export unencrypted JSON", ErrUnsupported)
+	}
+	folders := make(map[string][]string, len(export.Folders))
+	for _, f := range export.Folders {
+		folders[f.ID] = splitPath(f.Name, "/")
+	}
+
+	var items []Item
+	for _, b := range export.Items {
+		item := bitwardenItemOf(b)
+		if item.empty() {
+			continue
+		}
+		item.Folder = folders[b.FolderID]
+		for _, f := range b.Fields {
+			switch f.Type {
+			case bitwardenFieldText, bitwardenFieldBoolean:
+				item.addField(f.Name, f.Value, false)
+			case bitwardenFieldHidden:
+				item.addField(f.Name, f.Value, true)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func bitwardenItemOf(b bitwardenItem) Item {
+	switch {
+	case b.Type == bitwardenLogin && b.Login != nil:
+		creds := secret.Credentials{Username: b.Login.Username, Password: b.Login.Password, TOTPSeed: totpSeed(b.Login.TOTP)}
+		if len(b.Login.URIs) > 0 {
+			creds.URL = b.Login.URIs[0].URI
+		}
+		item := newItem(b.Name, creds, b.Notes)
+		for _, u := range b.Login.URIs[min(1, len(b.Login.URIs)):] {
+			item.addURL(u.URI)
+		}
+		return item
+	case b.Type == bitwardenCard && b.Card != nil:
+		item := Item{Title: b.Name, Notes: b.Notes, Kind: secret.KindCard}
+		month, year := b.Card.ExpMonth, b.Card.ExpYear
+		if len(month) == 1 {
+			month = "0" + month
+		}
+		if len(year) == 4 {
+			year = year[2:]
+		}
+		item.Secret = secret.Card{
+			Number: b.Card.Number,
+			Holder: b.Card.CardholderName,
+			Expiry: month + "/" + year,
+			CVV:    b.Card.Code,
+		}
+		return item
+	case b.Type == bitwardenIdentity:
+		// identities are personal data, kept encrypted as text
+		var lines []string
+		for _, key := range bitwardenIdentityFields {
+			if value, ok := b.Identity[key].(string); ok && value != "" {
+				lines = append(lines, key+": "+value)
+			}
+		}
+		if b.Notes != "" {
+			lines = append(lines, "", b.Notes)
+		}
+		return newItem(b.Name, secret.Credentials{}, strings.Join(lines, "\n"))
+	}
+	return newItem(b.Name, secret.Credentials{}, b.Notes)
+}
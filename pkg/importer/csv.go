@@ -0,0 +1,196 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// CSVFields are the item fields CSV columns map to. Columns of the generic
+// CSV format named after a field map to it unless mapped otherwise, other
+// columns become custom fields.
+var CSVFields = []string{
+	"title", "username", "password", "url", "totp", "notes", "folder", "tags",
+	"number", "holder", "expiry", "cvv",
+}
+
+// csvPreset is the column layout of the CSV export of a password manager
+type csvPreset struct {
+	columns   map[string]string // columns maps lower case column names to fields
+	ignored   []string          // ignored columns are not imported
+	separator string            // separator of folder paths
+}
+
+var csvPresets = map[Format]csvPreset{
+	FormatOnePassword: {
+		columns: map[string]string{
+			"title": "title", "url": "url", "website": "url", "username": "username",
+			"password": "password", "otpauth": "totp", "one-time password": "totp",
+			"notes": "notes", "notesplain": "notes", "tags": "tags",
+		},
+		ignored:   []string{"favorite", "archived", "type"},
+		separator: "/",
+	},
+	FormatLastPass: {
+		columns: map[string]string{
+			"name": "title", "url": "url", "username": "username", "password": "password",
+			"totp": "totp", "extra": "notes", "grouping": "folder",
+		},
+		ignored:   []string{"fav"},
+		separator: "\\",
+	},
+}
+
+// lastPassNote is the url LastPass gives secure notes
+const lastPassNote = "http://sn"
+
+// parseCSV reads a CSV file with a header row. The mapping of item fields
+// to column names overrides the columns of the format.
+func parseCSV(r io.Reader, format Format, mapping map[string]string) ([]Item, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+
+	preset, ok := csvPresets[format]
+	if !ok {
+		preset = csvPreset{columns: map[string]string{}, separator: "/"}
+		for _, field := range CSVFields {
+			preset.columns[field] = field
+		}
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch {
+		case slices.Contains(preset.ignored, name):
+			columns[i] = "-"
+		case preset.columns[name] != "":
+			columns[i] = preset.columns[name]
+		}
+	}
+	for field, column := range mapping {
+		if !slices.Contains(CSVFields, field) {
+			return nil, fmt.Errorf("%w: unknown field %q, use one of %s", ErrMapping, field, strings.Join(CSVFields, ", "))
+		}
+		i := slices.IndexFunc(header, func(name string) bool { return strings.EqualFold(strings.TrimSpace(name), column) })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: no column %q", ErrMapping, column)
+		}
+		columns[i] = field
+	}
+
+	var items []Item
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		values := map[string]string{}
+		var extra []Field
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch {
+			case i >= len(columns) || columns[i] == "-":
+			case columns[i] == "":
+				extra = append(extra, Field{Name: strings.TrimSpace(header[i]), Value: value})
+			default:
+				values[columns[i]] = value
+			}
+		}
+		item := csvItem(values, format)
+		if item.empty() {
+			continue
+		}
+		item.Folder = splitPath(values["folder"], preset.separator)
+		item.Tags = splitTags(values["tags"])
+		for _, f := range extra {
+			item.addField(f.Name, f.Value, false)
+		}
+		items = append(items, item)
+	}
+}
+
+func csvItem(values map[string]string, format Format) Item {
+	if format == FormatLastPass && values["url"] == lastPassNote {
+		return lastPassNoteItem(values["title"], values["notes"])
+	}
+	if values["number"] != "" {
+		return Item{
+			Title: values["title"],
+			Notes: values["notes"],
+			Kind:  secret.KindCard,
+			Secret: secret.Card{
+				Number: values["number"],
+				Holder: values["holder"],
+				Expiry: values["expiry"],
+				CVV:    values["cvv"],
+			},
+		}
+	}
+	creds := secret.Credentials{
+		URL:      values["url"],
+		Username: values["username"],
+		Password: values["password"],
+		TOTPSeed: totpSeed(values["totp"]),
+	}
+	return newItem(values["title"], creds, values["notes"])
+}
+
+// lastPassNoteItem converts a secure note, notes of the credit card type
+// are lines of name:value pairs
+func lastPassNoteItem(title, note string) Item {
+	if !strings.HasPrefix(note, "NoteType:Credit Card") {
+		return newItem(title, secret.Credentials{}, note)
+	}
+	var (
+		card  secret.Card
+		notes []string
+	)
+	for _, line := range strings.Split(note, "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch name {
+		case "NoteType", "Type", "Start Date":
+		case "Name on Card":
+			card.Holder = value
+		case "Number":
+			card.Number = value
+		case "Security Code":
+			card.CVV = value
+		case "Expiration Date":
+			card.Expiry = lastPassExpiry(value)
+		case "Notes":
+			notes = append(notes, value)
+		default:
+			if value != "" {
+				notes = append(notes, line)
+			}
+		}
+	}
+	return Item{Title: title, Notes: strings.Join(notes, "\n"), Kind: secret.KindCard, Secret: card}
+}
+
+// lastPassExpiry converts "January,2025" to "01/25"
+func lastPassExpiry(value string) string {
+	month, year, ok := strings.Cut(value, ",")
+	if !ok || len(year) != 4 {
+		return value
+	}
+	parsed, err := time.Parse("January", strings.TrimSpace(month))
+	if err != nil {
+		return value
+	}
+	return fmt.Sprintf("%02d/%s", int(parsed.Month()), year[2:])
+}
@@ -0,0 +1,200 @@
+// Package importer converts the exports of other password managers into
+// typed secrets of the vault.
+//
+// Supported formats are KeePass KDBX 4 databases, unencrypted Bitwarden JSON
+// exports, 1Password and LastPass CSV exports and CSV files of any layout
+// with a mapping of columns to item fields. Parsing happens on the client,
+// the server only gets the items through the vault API.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// Format of an imported file
+type Format string
+
+const (
+	FormatKeePass     Format = "keepass"
+	FormatBitwarden   Format = "bitwarden"
+	FormatOnePassword Format = "1password"
+	FormatLastPass    Format = "lastpass"
+	FormatCSV         Format = "csv"
+)
+
+// Formats lists the supported formats
+var Formats = []Format{FormatKeePass, FormatBitwarden, FormatOnePassword, FormatLastPass, FormatCSV}
+
+var (
+	ErrFormat      = fmt.Errorf("unknown import format")
+	ErrMalformed   = fmt.Errorf("malformed import file")
+	ErrUnsupported = fmt.Errorf("unsupported import file")
+	ErrPassword    = fmt.Errorf("database password wrong")
+	ErrMapping     = fmt.Errorf("bad column mapping")
+)
+
+// Item is an entry of another password manager converted to a secret of
+// the vault with its organisation and attachments
+type Item struct {
+	Title       string
+	Folder      []string     // Folder path from the root of the vault, empty for the root.
+	Tags        []string     // Tags of the item.
+	URLs        []string     // URLs of the item, absolute.
+	Fields      []Field      // Fields are visible custom fields.
+	Hidden      []Field      // Hidden are protected custom fields.
+	Notes       string       // Notes of credentials and cards, notes of text items are the text.
+	Kind        secret.Kind  // Kind of the secret, empty for items of attachments only.
+	Secret      any          // Secret is secret.Credentials, secret.Card or secret.Text of the kind.
+	Attachments []Attachment // Attachments become blobs.
+}
+
+// Field is a named custom value of an item
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Attachment is a file attached to an item
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// Options of parsing
+type Options struct {
+	Password string            // Password of a KeePass database.
+	Mapping  map[string]string // Mapping of item fields to CSV columns, see CSVFields.
+}
+
+// Parse reads the items of the file in the format
+func Parse(format Format, r io.Reader, opts Options) ([]Item, error) {
+	switch format {
+	case FormatKeePass:
+		return parseKeePass(r, opts.Password)
+	case FormatBitwarden:
+		return parseBitwarden(r)
+	case FormatOnePassword, FormatLastPass, FormatCSV:
+		return parseCSV(r, format, opts.Mapping)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrFormat, format)
+}
+
+// Private returns the notes and hidden fields of credentials and cards as
+// text. Like the secret itself it belongs to encrypted content rather than
+// to the details of the item, which are stored unencrypted.
+func (i Item) Private() string {
+	var b strings.Builder
+	if i.Kind != secret.KindText {
+		b.WriteString(i.Notes)
+	}
+	for _, f := range i.Hidden {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s: %s", f.Name, f.Value)
+	}
+	return b.String()
+}
+
+// newItem returns the item of the content, credentials if there is a
+// username or a password, text if there are notes only
+func newItem(title string, creds secret.Credentials, notes string) Item {
+	var item = Item{Title: strings.TrimSpace(title)}
+	switch {
+	case creds.Username != "" || creds.Password != "":
+		item.Kind, item.Secret, item.Notes = secret.KindCredentials, creds, notes
+	case notes != "":
+		item.Kind, item.Secret = secret.KindText, secret.Text{Text: notes}
+	}
+	if creds.URL != "" {
+		item.addURL(creds.URL)
+	}
+	if item.Title == "" {
+		item.Title = untitled(creds)
+	}
+	return item
+}
+
+// addURL adds the url to the item, urls without a scheme are taken for
+// https
+func (i *Item) addURL(u string) {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return
+	}
+	if !strings.Contains(u, "://") {
+		u = "https://" + u
+	}
+	if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+		i.Fields = append(i.Fields, Field{Name: "url", Value: u})
+		return
+	}
+	i.URLs = append(i.URLs, u)
+}
+
+// addField adds a custom field, empty values are left out
+func (i *Item) addField(name, value string, hidden bool) {
+	if value == "" {
+		return
+	}
+	if hidden {
+		i.Hidden = append(i.Hidden, Field{Name: name, Value: value})
+		return
+	}
+	i.Fields = append(i.Fields, Field{Name: name, Value: value})
+}
+
+// empty reports whether the item has nothing to import
+func (i Item) empty() bool {
+	return i.Kind == "" && len(i.Attachments) == 0
+}
+
+func untitled(creds secret.Credentials) string {
+	if creds.URL != "" {
+		return creds.URL
+	}
+	if creds.Username != "" {
+		return creds.Username
+	}
+	return "untitled"
+}
+
+// totpSeed returns the seed of an otpauth:// URI or the value itself
+func totpSeed(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "otpauth://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("secret")
+}
+
+// splitTags splits tags separated by commas or semicolons
+func splitTags(tags string) []string {
+	var result []string
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ';' }) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// splitPath splits a folder path at the separator, empty names are left out
+func splitPath(path, separator string) []string {
+	var result []string
+	for _, name := range strings.Split(path, separator) {
+		if name = strings.TrimSpace(name); name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,352 @@
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// kdbxOptions select the algorithms of a test database
+type kdbxOptions struct {
+	argon2   bool
+	chacha20 bool
+	gzip     bool
+	salsa20  bool
+}
+
+// testKDBX writes a KDBX 4 database the way KeePass does with a cheap key
+// derivation
+func testKDBX(t *testing.T, password string, opts kdbxOptions) []byte {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		_, err := rand.Read(b)
+		require.NoError(t, err)
+		return b
+	}
+	field := func(b *bytes.Buffer, id byte, value []byte) {
+		b.WriteByte(id)
+		b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(value))))
+		b.Write(value)
+	}
+	variant := func(entries ...[]byte) []byte {
+		var b bytes.Buffer
+		b.Write([]byte{0, 1})
+		for i := 0; i < len(entries); i += 3 {
+			b.WriteByte(entries[i][0])
+			for _, data := range entries[i+1 : i+3] {
+				b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+				b.Write(data)
+			}
+		}
+		b.WriteByte(0)
+		return b.Bytes()
+	}
+
+	composite := sha256.Sum256([]byte(password))
+	composite = sha256.Sum256(composite[:])
+	var kdf, transformed []byte
+	if opts.argon2 {
+		salt := random(32)
+		kdf = variant(
+			[]byte{0x42}, []byte("$UUID"), kdbxKDFArgon2id,
+			[]byte{0x42}, []byte("S"), salt,
+			[]byte{0x04}, []byte("P"), binary.LittleEndian.AppendUint32(nil, 1),
+			[]byte{0x05}, []byte("M"), binary.LittleEndian.AppendUint64(nil, 8<<10),
+			[]byte{0x05}, []byte("I"), binary.LittleEndian.AppendUint64(nil, 1),
+			[]byte{0x04}, []byte("V"), binary.LittleEndian.AppendUint32(nil, 0x13),
+		)
+		transformed = argon2.IDKey(composite[:], salt, 1, 8, 1, 32)
+	} else {
+		seed := random(32)
+		kdf = variant(
+			[]byte{0x42}, []byte("$UUID"), kdbxKDFAES,
+			[]byte{0x42}, []byte("S"), seed,
+			[]byte{0x05}, []byte("R"), binary.LittleEndian.AppendUint64(nil, 10),
+		)
+		block, err := aes.NewCipher(seed)
+		require.NoError(t, err)
+		key := composite
+		for i := 0; i < 10; i++ {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+		hash := sha256.Sum256(key[:])
+		transformed = hash[:]
+	}
+
+	var header bytes.Buffer
+	header.Write(binary.LittleEndian.AppendUint32(nil, kdbxSignature1))
+	header.Write(binary.LittleEndian.AppendUint32(nil, kdbxSignature2))
+	header.Write(binary.LittleEndian.AppendUint32(nil, kdbxVersion4<<16|1))
+	masterSeed, iv, cipherID := random(32), random(16), kdbxCipherAES256
+	if opts.chacha20 {
+		iv, cipherID = random(12), kdbxCipherChaCha20
+	}
+	compression := uint32(0)
+	if opts.gzip {
+		compression = 1
+	}
+	field(&header, kdbxCipherID, cipherID)
+	field(&header, kdbxCompression, binary.LittleEndian.AppendUint32(nil, compression))
+	field(&header, kdbxMasterSeed, masterSeed)
+	field(&header, kdbxEncryptionIV, iv)
+	field(&header, kdbxKDFParams, kdf)
+	field(&header, kdbxEndOfHeader, []byte("\r\n\r\n"))
+
+	cipherKey := sha256.Sum256(concat(masterSeed, transformed))
+	hmacBase := sha512.Sum512(concat(masterSeed, transformed, []byte{1}))
+	headerHash := sha256.Sum256(header.Bytes())
+	out := bytes.NewBuffer(bytes.Clone(header.Bytes()))
+	out.Write(headerHash[:])
+	out.Write(kdbxMAC(hmacBase[:], ^uint64(0), header.Bytes()))
+
+	var inner bytes.Buffer
+	streamID, streamKey := uint32(kdbxStreamChaCha20), random(64)
+	if opts.salsa20 {
+		streamID, streamKey = kdbxStreamSalsa20, random(32)
+	}
+	field(&inner, kdbxInnerStreamID, binary.LittleEndian.AppendUint32(nil, streamID))
+	field(&inner, kdbxInnerStreamKey, streamKey)
+	field(&inner, kdbxInnerBinary, append([]byte{1}, "attached"...))
+	field(&inner, kdbxEndOfHeader, nil)
+	stream, err := newInnerStream(streamID, streamKey)
+	require.NoError(t, err)
+	protect := func(s string) string {
+		value := []byte(s)
+		stream.XORKeyStream(value, value)
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	fmt.Fprintf(&inner, `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Meta><RecycleBinUUID>YmluYmluYmluYmluYmluYg==</RecycleBinUUID></Meta>
+	<Root><Group>
+		<UUID>cm9vdHJvb3Ryb290cm9vdA==</UUID><Name>Database</Name>
+		<Entry>
+			<String><Key>Title</Key><Value>Mail</Value></String>
+			<String><Key>UserName</Key><Value>alice</Value></String>
+			<String><Key>Password</Key><Value Protected="True">%s</Value></String>
+			<String><Key>URL</Key><Value>mail.example.com</Value></String>
+			<String><Key>otp</Key><Value Protected="True">%s</Value></String>
+			<String><Key>Recovery</Key><Value Protected="True">%s</Value></String>
+			<String><Key>Plan</Key><Value>free &amp; basic</Value></String>
+			<String><Key>Notes</Key><Value>personal</Value></String>
+			<Tags>mail;personal</Tags>
+			<Binary><Key>key.txt</Key><Value Ref="0"/></Binary>
+		</Entry>
+		<Group>
+			<UUID>d29ya3dvcmt3b3Jrd29yaw==</UUID><Name>Work</Name>
+			<Group>
+				<UUID>ZGV2ZGV2ZGV2ZGV2ZGV2ZA==</UUID><Name>Dev</Name>
+				<Entry>
+					<String><Key>Title</Key><Value>Runbook</Value></String>
+					<String><Key>Password</Key><Value Protected="True"></Value></String>
+					<String><Key>Notes</Key><Value>restart it</Value></String>
+				</Entry>
+			</Group>
+		</Group>
+		<Group>
+			<UUID>YmluYmluYmluYmluYmluYg==</UUID><Name>Recycle Bin</Name>
+			<Entry><String><Key>Title</Key><Value>deleted</Value></String><String><Key>UserName</Key><Value>bob</Value></String></Entry>
+		</Group>
+	</Group></Root>
+</KeePassFile>`, protect("s3cret"), protect("otpauth://totp/mail?secret=JBSWY3DPEHPK3PXP"), protect("codes 1 2 3"))
+
+	plain := inner.Bytes()
+	if opts.gzip {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		_, err := gz.Write(plain)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		plain = b.Bytes()
+	}
+	var payload []byte
+	if opts.chacha20 {
+		c, err := chacha20.NewUnauthenticatedCipher(cipherKey[:], iv)
+		require.NoError(t, err)
+		payload = make([]byte, len(plain))
+		c.XORKeyStream(payload, plain)
+	} else {
+		block, err := aes.NewCipher(cipherKey[:])
+		require.NoError(t, err)
+		padding := aes.BlockSize - len(plain)%aes.BlockSize
+		plain = append(bytes.Clone(plain), bytes.Repeat([]byte{byte(padding)}, padding)...)
+		payload = make([]byte, len(plain))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, plain)
+	}
+
+	// two blocks of data and the empty block ending them
+	half := len(payload) / 2
+	for index, block := range [][]byte{payload[:half], payload[half:], nil} {
+		size := binary.LittleEndian.AppendUint32(nil, uint32(len(block)))
+		out.Write(kdbxMAC(hmacBase[:], uint64(index), size, block))
+		out.Write(size)
+		out.Write(block)
+	}
+	return out.Bytes()
+}
+
+func TestParse_KeePass(t *testing.T) {
+	tests := []struct {
+		name string
+		opts kdbxOptions
+	}{
+		{name: "aes-kdf chacha20", opts: kdbxOptions{chacha20: true}},
+		{name: "argon2id aes gzip", opts: kdbxOptions{argon2: true, gzip: true}},
+		{name: "salsa20 inner stream", opts: kdbxOptions{salsa20: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testKDBX(t, "master", tt.opts)
+			items, err := Parse(FormatKeePass, bytes.NewReader(data), Options{Password: "master"})
+			require.NoError(t, err)
+			require.Len(t, items, 2)
+
+			mail := items[0]
+			assert.Equal(t, "Mail", mail.Title)
+			assert.Empty(t, mail.Folder)
+			assert.Equal(t, secret.KindCredentials, mail.Kind)
+			assert.Equal(t, secret.Credentials{
+				URL:      "mail.example.com",
+				Username: "alice",
+				Password: "s3cret",
+				TOTPSeed: "JBSWY3DPEHPK3PXP",
+			}, mail.Secret)
+			assert.Equal(t, []string{"https://mail.example.com"}, mail.URLs)
+			assert.Equal(t, []string{"mail", "personal"}, mail.Tags)
+			assert.Equal(t, []Field{{Name: "Plan", Value: "free & basic"}}, mail.Fields)
+			assert.Equal(t, []Field{{Name: "Recovery", Value: "codes 1 2 3"}}, mail.Hidden)
+			assert.Equal(t, "personal\nRecovery: codes 1 2 3", mail.Private())
+			assert.Equal(t, []Attachment{{Name: "key.txt", Data: []byte("attached")}}, mail.Attachments)
+
+			runbook := items[1]
+			assert.Equal(t, []string{"Work", "Dev"}, runbook.Folder)
+			assert.Equal(t, secret.KindText, runbook.Kind)
+			assert.Equal(t, secret.Text{Text: "restart it"}, runbook.Secret)
+			assert.Empty(t, runbook.Private())
+		})
+	}
+
+	data := testKDBX(t, "master", kdbxOptions{})
+	_, err := Parse(FormatKeePass, bytes.NewReader(data), Options{Password: "wrong"})
+	assert.ErrorIs(t, err, ErrPassword)
+
+	data[len(data)-40] ^= 1
+	_, err = Parse(FormatKeePass, bytes.NewReader(data), Options{Password: "master"})
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	_, err = Parse(FormatKeePass, strings.NewReader("not a database"), Options{})
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestParse_Bitwarden(t *testing.T) {
+	export := `{
+		"encrypted": false,
+		"folders": [{"id": "f1", "name": "Banking/Cards"}],
+		"items": [
+			{"type": 1, "name": "Forum", "notes": "old account", "folderId": null,
+			 "login": {"uris": [{"uri": "https://forum.example.com"}, {"uri": "forum.example.org"}], "username": "bob", "password": "pw", "totp": null},
+			 "fields": [{"name": "pin", "value": "1234", "type": 1}, {"name": "plan", "value": "gold", "type": 0}]},
+			{"type": 3, "name": "Visa", "folderId": "f1",
+			 "card": {"cardholderName": "BOB", "number": "4111111111111111", "expMonth": "3", "expYear": "2030", "code": "123"}},
+			{"type": 2, "name": "Wifi", "notes": "password is on the router"},
+			{"type": 4, "name": "Me", "identity": {"firstName": "Bob", "lastName": "Smith", "email": "bob@example.com"}},
+			{"type": 2, "name": "Empty"}
+		]
+	}`
+	items, err := Parse(FormatBitwarden, strings.NewReader(export), Options{})
+	require.NoError(t, err)
+	require.Len(t, items, 4)
+
+	assert.Equal(t, secret.Credentials{URL: "https://forum.example.com", Username: "bob", Password: "pw"}, items[0].Secret)
+	assert.Equal(t, []string{"https://forum.example.com", "https://forum.example.org"}, items[0].URLs)
+	assert.Equal(t, []Field{{Name: "plan", Value: "gold"}}, items[0].Fields)
+	assert.Equal(t, "old account\npin: 1234", items[0].Private())
+
+	assert.Equal(t, []string{"Banking", "Cards"}, items[1].Folder)
+	assert.Equal(t, secret.Card{Number: "4111111111111111", Holder: "BOB", Expiry: "03/30", CVV: "123"}, items[1].Secret)
+
+	assert.Equal(t, secret.Text{Text: "password is on the router"}, items[2].Secret)
+	assert.Equal(t, secret.Text{Text: "firstName: Bob\nlastName: Smith\nemail: bob@example.com"}, items[3].Secret)
+
+	_, err = Parse(FormatBitwarden, strings.NewReader(`{"encrypted": true, "items": []}`), Options{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+	_, err = Parse(FormatBitwarden, strings.NewReader(`[`), Options{})
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestParse_CSV(t *testing.T) {
+	t.Run("1password", func(t *testing.T) {
+		export := "Title,Website,Username,Password,OTPAuth,Favorite,Archived,Tags,Notes\n" +
+			"Shop,shop.example.com,bob,pw,otpauth://totp/shop?secret=JBSWY3DPEHPK3PXP,false,false,\"shopping,home\",gift cards\n" +
+			"Empty,,,,,false,false,,\n"
+		items, err := Parse(FormatOnePassword, strings.NewReader(export), Options{})
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, secret.Credentials{URL: "shop.example.com", Username: "bob", Password: "pw", TOTPSeed: "JBSWY3DPEHPK3PXP"}, items[0].Secret)
+		assert.Equal(t, []string{"shopping", "home"}, items[0].Tags)
+		assert.Equal(t, "gift cards", items[0].Notes)
+		assert.Empty(t, items[0].Fields)
+	})
+
+	t.Run("lastpass", func(t *testing.T) {
+		export := "url,username,password,totp,extra,name,grouping,fav\n" +
+			"https://git.example.com,bob,pw,,,Git,Work\\Dev,0\n" +
+			"http://sn,,,,\"NoteType:Credit Card\nName on Card:BOB\nType:\nNumber:4111111111111111\nSecurity Code:123\nStart Date:,\nExpiration Date:March,2030\nNotes:backup card\",Visa,,0\n" +
+			"http://sn,,,,door code 42,Door,,0\n"
+		items, err := Parse(FormatLastPass, strings.NewReader(export), Options{})
+		require.NoError(t, err)
+		require.Len(t, items, 3)
+		assert.Equal(t, []string{"Work", "Dev"}, items[0].Folder)
+		assert.Equal(t, secret.KindCredentials, items[0].Kind)
+		assert.Equal(t, secret.Card{Number: "4111111111111111", Holder: "BOB", Expiry: "03/30", CVV: "123"}, items[1].Secret)
+		assert.Equal(t, "backup card", items[1].Notes)
+		assert.Equal(t, secret.Text{Text: "door code 42"}, items[2].Secret)
+		assert.Empty(t, items[2].URLs)
+	})
+
+	t.Run("generic with mapping", func(t *testing.T) {
+		export := "Service,Login,Secret,Folder,Owner\n" +
+			"VPN,bob,pw,Work/Net,ops\n"
+		mapping := map[string]string{"title": "service", "username": "Login", "password": "Secret"}
+		items, err := Parse(FormatCSV, strings.NewReader(export), Options{Mapping: mapping})
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "VPN", items[0].Title)
+		assert.Equal(t, []string{"Work", "Net"}, items[0].Folder)
+		assert.Equal(t, secret.Credentials{Username: "bob", Password: "pw"}, items[0].Secret)
+		assert.Equal(t, []Field{{Name: "Owner", Value: "ops"}}, items[0].Fields)
+
+		_, err = Parse(FormatCSV, strings.NewReader(export), Options{Mapping: map[string]string{"login": "Login"}})
+		assert.ErrorIs(t, err, ErrMapping)
+		_, err = Parse(FormatCSV, strings.NewReader(export), Options{Mapping: map[string]string{"username": "User"}})
+		assert.ErrorIs(t, err, ErrMapping)
+	})
+
+	t.Run("generic card", func(t *testing.T) {
+		export := "title,number,holder,expiry,cvv\nVisa,4111111111111111,BOB,03/30,123\n"
+		items, err := Parse(FormatCSV, strings.NewReader(export), Options{})
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, secret.KindCard, items[0].Kind)
+	})
+
+	_, err := Parse("unknown", strings.NewReader(""), Options{})
+	assert.ErrorIs(t, err, ErrFormat)
+}
@@ -0,0 +1,569 @@
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/salsa20/salsa"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// KDBX 4 layout, all integers are little endian:
+//
+//	signature  uint32 0x9AA2D903, uint32 0xB54BFB67
+//	version    uint32, major version in the high 16 bits
+//	header     fields of uint8 id, uint32 size and data up to the end field
+//	sha256     of the header
+//	hmac       HMAC-SHA256 of the header
+//	blocks     of HMAC-SHA256, uint32 size and data up to an empty block
+//
+// The blocks hold the encrypted and optionally gzipped inner header, with
+// the attachments and the key of the stream protecting values, and the XML
+// document.
+
+const (
+	kdbxSignature1 = 0x9AA2D903
+	kdbxSignature2 = 0xB54BFB67
+	kdbxVersion4   = 4
+
+	kdbxEndOfHeader  = 0
+	kdbxCipherID     = 2
+	kdbxCompression  = 3
+	kdbxMasterSeed   = 4
+	kdbxEncryptionIV = 7
+	kdbxKDFParams    = 11
+
+	kdbxInnerStreamID  = 1
+	kdbxInnerStreamKey = 2
+	kdbxInnerBinary    = 3
+
+	kdbxStreamSalsa20  = 2
+	kdbxStreamChaCha20 = 3
+
+	// limits protect from databases demanding unreasonable KDF work
+	maxArgon2Memory = 4 << 30
+	maxArgon2Time   = 1 << 16
+)
+
+var (
+	kdbxCipherAES256   = mustUUID("31c1f2e6bf714350be5805216afc5aff")
+	kdbxCipherChaCha20 = mustUUID("d6038a2b8b6f4cb5a524339a31dbb59a")
+	kdbxKDFAES         = mustUUID("c9d9f39a628a4460bf740d08c18a4fea")
+	kdbxKDFArgon2d     = mustUUID("ef636ddf8c29444b91f7a9a403e30a0c")
+	kdbxKDFArgon2id    = mustUUID("9e298b1956db4773b23dfc3ec6f0a1e6")
+
+	kdbxSalsa20Nonce = []byte{0xE8, 0x30, 0x09, 0x4B, 0x97, 0x20, 0x5D, 0x2A}
+)
+
+type kdbxHeader struct {
+	cipher     []byte
+	compressed bool
+	seed       []byte
+	iv         []byte
+	kdf        map[string][]byte
+}
+
+func parseKeePass(r io.Reader, password string) ([]Item, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || binary.LittleEndian.Uint32(data) != kdbxSignature1 || binary.LittleEndian.Uint32(data[4:]) != kdbxSignature2 {
+		return nil, fmt.Errorf("%w: not a KeePass database", ErrMalformed)
+	}
+	if major := binary.LittleEndian.Uint32(data[8:]) >> 16; major != kdbxVersion4 {
+		return nil, fmt.Errorf("%w: KDBX %d, save the database as KDBX 4", ErrUnsupported, major)
+	}
+
+	header, pos, err := parseKDBXHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if pos+64 > len(data) {
+		return nil, fmt.Errorf("%w: truncated header", ErrMalformed)
+	}
+	headerHash := sha256.Sum256(data[:pos])
+	if !hmac.Equal(headerHash[:], data[pos:pos+32]) {
+		return nil, fmt.Errorf("%w: header corrupted", ErrMalformed)
+	}
+
+	composite := sha256.Sum256([]byte(password))
+	composite = sha256.Sum256(composite[:])
+	transformed, err := transformKey(composite[:], header.kdf)
+	if err != nil {
+		return nil, err
+	}
+	cipherKey := sha256.Sum256(concat(header.seed, transformed))
+	hmacBase := sha512.Sum512(concat(header.seed, transformed, []byte{1}))
+	if !hmac.Equal(kdbxMAC(hmacBase[:], ^uint64(0), data[:pos]), data[pos+32:pos+64]) {
+		return nil, ErrPassword
+	}
+
+	payload, err := readKDBXBlocks(data[pos+64:], hmacBase[:])
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptKDBX(header, cipherKey[:], payload)
+	if err != nil {
+		return nil, err
+	}
+	if header.compressed {
+		gz, err := gzip.NewReader(bytes.NewReader(plain))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		if plain, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+	}
+
+	stream, binaries, document, err := parseKDBXInner(plain)
+	if err != nil {
+		return nil, err
+	}
+	root, err := decodeKDBXDocument(document, stream)
+	if err != nil {
+		return nil, err
+	}
+	return keePassItems(root, binaries)
+}
+
+// parseKDBXHeader parses the outer header and returns the position of its end
+func parseKDBXHeader(data []byte) (kdbxHeader, int, error) {
+	var header kdbxHeader
+	pos := 12
+	for {
+		if pos+5 > len(data) {
+			return header, 0, fmt.Errorf("%w: truncated header", ErrMalformed)
+		}
+		id, size := data[pos], int(binary.LittleEndian.Uint32(data[pos+1:]))
+		pos += 5
+		if size < 0 || pos+size > len(data) {
+			return header, 0, fmt.Errorf("%w: truncated header", ErrMalformed)
+		}
+		value := data[pos : pos+size]
+		pos += size
+		switch id {
+		case kdbxEndOfHeader:
+			if header.cipher == nil || header.seed == nil || header.iv == nil || header.kdf == nil {
+				return header, 0, fmt.Errorf("%w: incomplete header", ErrMalformed)
+			}
+			return header, pos, nil
+		case kdbxCipherID:
+			header.cipher = value
+		case kdbxCompression:
+			header.compressed = len(value) == 4 && binary.LittleEndian.Uint32(value) == 1
+		case kdbxMasterSeed:
+			header.seed = value
+		case kdbxEncryptionIV:
+			header.iv = value
+		case kdbxKDFParams:
+			kdf, err := parseVariantDictionary(value)
+			if err != nil {
+				return header, 0, err
+			}
+			header.kdf = kdf
+		}
+	}
+}
+
+// parseVariantDictionary returns the raw values of a KDBX 4 variant
+// dictionary by their keys
+func parseVariantDictionary(data []byte) (map[string][]byte, error) {
+	if len(data) < 2 || data[1] != 1 {
+		return nil, fmt.Errorf("%w: unknown variant dictionary version", ErrUnsupported)
+	}
+	dictionary := map[string][]byte{}
+	for pos := 2; ; {
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: truncated variant dictionary", ErrMalformed)
+		}
+		kind := data[pos]
+		pos++
+		if kind == 0 {
+			return dictionary, nil
+		}
+		var key, value []byte
+		for _, field := range []*[]byte{&key, &value} {
+			if pos+4 > len(data) {
+				return nil, fmt.Errorf("%w: truncated variant dictionary", ErrMalformed)
+			}
+			size := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if size < 0 || pos+size > len(data) {
+				return nil, fmt.Errorf("%w: truncated variant dictionary", ErrMalformed)
+			}
+			*field = data[pos : pos+size]
+			pos += size
+		}
+		dictionary[string(key)] = value
+	}
+}
+
+// transformKey derives the transformed key of the composite key with the
+// key derivation of the database. Argon2d is not implemented by x/crypto.
+func transformKey(composite []byte, kdf map[string][]byte) ([]byte, error) {
+	uuid := kdf["$UUID"]
+	switch {
+	case bytes.Equal(uuid, kdbxKDFAES):
+		seed, rounds := kdf["S"], kdf["R"]
+		if len(seed) != 32 || len(rounds) != 8 {
+			return nil, fmt.Errorf("%w: bad AES-KDF parameters", ErrMalformed)
+		}
+		block, err := aes.NewCipher(seed)
+		if err != nil {
+			return nil, err
+		}
+		key := bytes.Clone(composite)
+		for i := binary.LittleEndian.Uint64(rounds); i > 0; i-- {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+		transformed := sha256.Sum256(key)
+		return transformed[:], nil
+	case bytes.Equal(uuid, kdbxKDFArgon2id):
+		salt, parallelism, memory, iterations := kdf["S"], kdf["P"], kdf["M"], kdf["I"]
+		if len(salt) == 0 || len(parallelism) != 4 || len(memory) != 8 || len(iterations) != 8 {
+			return nil, fmt.Errorf("%w: bad Argon2 parameters", ErrMalformed)
+		}
+		p, m, t := binary.LittleEndian.Uint32(parallelism), binary.LittleEndian.Uint64(memory), binary.LittleEndian.Uint64(iterations)
+		if p == 0 || p > 255 || m < 8<<10 || m > maxArgon2Memory || t == 0 || t > maxArgon2Time {
+			return nil, fmt.Errorf("%w: Argon2 parameters out of range", ErrUnsupported)
+		}
+		return argon2.IDKey(composite, salt, uint32(t), uint32(m>>10), uint8(p), 32), nil
+	case bytes.Equal(uuid, kdbxKDFArgon2d):
+		return nil, fmt.Errorf("%w: Argon2d key derivation, switch the database to Argon2id or AES-KDF", ErrUnsupported)
+	}
+	return nil, fmt.Errorf("%w: unknown key derivation", ErrUnsupported)
+}
+
+// readKDBXBlocks verifies the HMAC of every block and returns their data
+func readKDBXBlocks(data, hmacBase []byte) ([]byte, error) {
+	var payload bytes.Buffer
+	for index, pos := uint64(0), 0; ; index++ {
+		if pos+36 > len(data) {
+			return nil, fmt.Errorf("%w: truncated block %d", ErrMalformed, index)
+		}
+		mac, size := data[pos:pos+32], int(binary.LittleEndian.Uint32(data[pos+32:]))
+		pos += 36
+		if size < 0 || pos+size > len(data) {
+			return nil, fmt.Errorf("%w: truncated block %d", ErrMalformed, index)
+		}
+		block := data[pos : pos+size]
+		pos += size
+		if !hmac.Equal(kdbxMAC(hmacBase, index, binary.LittleEndian.AppendUint32(nil, uint32(size)), block), mac) {
+			return nil, fmt.Errorf("%w: block %d corrupted", ErrMalformed, index)
+		}
+		if size == 0 {
+			return payload.Bytes(), nil
+		}
+		payload.Write(block)
+	}
+}
+
+// kdbxMAC returns HMAC-SHA256 of the index and the data with the key of
+// the index, the header uses the largest index
+func kdbxMAC(hmacBase []byte, index uint64, data ...[]byte) []byte {
+	indexBytes := binary.LittleEndian.AppendUint64(nil, index)
+	key := sha512.Sum512(concat(indexBytes, hmacBase))
+	mac := hmac.New(sha256.New, key[:])
+	if index != ^uint64(0) {
+		mac.Write(indexBytes)
+	}
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func decryptKDBX(header kdbxHeader, key, payload []byte) ([]byte, error) {
+	switch {
+	case bytes.Equal(header.cipher, kdbxCipherAES256):
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(header.iv) != aes.BlockSize || len(payload) == 0 || len(payload)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("%w: bad AES payload", ErrMalformed)
+		}
+		plain := make([]byte, len(payload))
+		cipher.NewCBCDecrypter(block, header.iv).CryptBlocks(plain, payload)
+		padding := int(plain[len(plain)-1])
+		if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+			return nil, fmt.Errorf("%w: bad AES padding", ErrMalformed)
+		}
+		return plain[:len(plain)-padding], nil
+	case bytes.Equal(header.cipher, kdbxCipherChaCha20):
+		stream, err := chacha20.NewUnauthenticatedCipher(key, header.iv)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		plain := make([]byte, len(payload))
+		stream.XORKeyStream(plain, payload)
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w: unknown cipher, use AES-256 or ChaCha20", ErrUnsupported)
+}
+
+// parseKDBXInner parses the inner header and returns the stream protecting
+// values, the attachments and the XML document following the header
+func parseKDBXInner(data []byte) (cipher.Stream, [][]byte, []byte, error) {
+	var (
+		streamID  uint32
+		streamKey []byte
+		binaries  [][]byte
+	)
+	for pos := 0; ; {
+		if pos+5 > len(data) {
+			return nil, nil, nil, fmt.Errorf("%w: truncated inner header", ErrMalformed)
+		}
+		id, size := data[pos], int(binary.LittleEndian.Uint32(data[pos+1:]))
+		pos += 5
+		if size < 0 || pos+size > len(data) {
+			return nil, nil, nil, fmt.Errorf("%w: truncated inner header", ErrMalformed)
+		}
+		value := data[pos : pos+size]
+		pos += size
+		switch id {
+		case kdbxEndOfHeader:
+			stream, err := newInnerStream(streamID, streamKey)
+			return stream, binaries, data[pos:], err
+		case kdbxInnerStreamID:
+			if len(value) == 4 {
+				streamID = binary.LittleEndian.Uint32(value)
+			}
+		case kdbxInnerStreamKey:
+			streamKey = value
+		case kdbxInnerBinary:
+			if len(value) == 0 {
+				return nil, nil, nil, fmt.Errorf("%w: empty attachment", ErrMalformed)
+			}
+			// the first byte holds flags, the protection flag only
+			// concerns memory of KeePass
+			binaries = append(binaries, value[1:])
+		}
+	}
+}
+
+func newInnerStream(id uint32, key []byte) (cipher.Stream, error) {
+	switch id {
+	case kdbxStreamChaCha20:
+		hash := sha512.Sum512(key)
+		return chacha20.NewUnauthenticatedCipher(hash[:32], hash[32:44])
+	case kdbxStreamSalsa20:
+		s := &salsaStream{key: sha256.Sum256(key)}
+		copy(s.counter[:8], kdbxSalsa20Nonce)
+		return s, nil
+	}
+	return nil, fmt.Errorf("%w: unknown inner stream %d", ErrUnsupported, id)
+}
+
+// salsaStream is the Salsa20 key stream continued across values, salsa
+// only exposes whole blocks of a given counter
+type salsaStream struct {
+	key     [32]byte
+	counter [16]byte
+	block   uint64
+	buf     [64]byte
+	used    int
+}
+
+func (s *salsaStream) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if s.used == 0 || s.used == len(s.buf) {
+			binary.LittleEndian.PutUint64(s.counter[8:], s.block)
+			s.buf = [64]byte{}
+			salsa.XORKeyStream(s.buf[:], s.buf[:], &s.counter, &s.key)
+			s.block++
+			s.used = 0
+		}
+		dst[i] = src[i] ^ s.buf[s.used]
+		s.used++
+	}
+}
+
+// xmlNode is an element of the XML document
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	text     string
+	children []*xmlNode
+}
+
+func (n *xmlNode) child(name string) *xmlNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return &xmlNode{}
+}
+
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// decodeKDBXDocument decodes the XML document into a tree. Protected values
+// are decrypted in document order as the stream requires.
+func decodeKDBXDocument(document []byte, stream cipher.Stream) (*xmlNode, error) {
+	var (
+		decoder = xml.NewDecoder(bytes.NewReader(document))
+		root    = &xmlNode{}
+		stack   = []*xmlNode{root}
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		top := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			top.children = append(top.children, node)
+			stack = append(stack, node)
+		case xml.CharData:
+			top.text += string(t)
+		case xml.EndElement:
+			if strings.EqualFold(top.attr("Protected"), "true") {
+				value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(top.text))
+				if err != nil {
+					return nil, fmt.Errorf("%w: protected value", ErrMalformed)
+				}
+				stream.XORKeyStream(value, value)
+				top.text = string(value)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// keePassItems converts the entries of the groups to items, groups become
+// folders below the root group and the recycle bin is left out
+func keePassItems(document *xmlNode, binaries [][]byte) ([]Item, error) {
+	file := document.child("KeePassFile")
+	rootGroup := file.child("Root").child("Group")
+	if rootGroup.name == "" {
+		return nil, fmt.Errorf("%w: no root group", ErrMalformed)
+	}
+	recycleBin := file.child("Meta").child("RecycleBinUUID").text
+
+	var (
+		items []Item
+		walk  func(group *xmlNode, path []string) error
+	)
+	walk = func(group *xmlNode, path []string) error {
+		for _, c := range group.children {
+			switch c.name {
+			case "Group":
+				if c.child("UUID").text == recycleBin && recycleBin != "" {
+					continue
+				}
+				if err := walk(c, append(path[:len(path):len(path)], c.child("Name").text)); err != nil {
+					return err
+				}
+			case "Entry":
+				item, err := keePassItem(c, binaries)
+				if err != nil {
+					return err
+				}
+				if !item.empty() {
+					item.Folder = path
+					items = append(items, item)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(rootGroup, nil); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func keePassItem(entry *xmlNode, binaries [][]byte) (Item, error) {
+	type value struct {
+		text      string
+		protected bool
+	}
+	var (
+		values = map[string]value{}
+		keys   []string
+	)
+	for _, c := range entry.children {
+		if c.name != "String" {
+			continue
+		}
+		key, v := c.child("Key").text, c.child("Value")
+		values[key] = value{text: v.text, protected: strings.EqualFold(v.attr("Protected"), "true")}
+		keys = append(keys, key)
+	}
+
+	creds := secret.Credentials{
+		URL:      values["URL"].text,
+		Username: values["UserName"].text,
+		Password: values["Password"].text,
+	}
+	if otp := values["otp"].text; otp != "" {
+		creds.TOTPSeed = totpSeed(otp)
+	} else {
+		creds.TOTPSeed = values["TOTP Seed"].text
+	}
+	item := newItem(values["Title"].text, creds, values["Notes"].text)
+	item.Tags = splitTags(entry.child("Tags").text)
+	for _, key := range keys {
+		switch key {
+		case "Title", "URL", "UserName", "Password", "Notes", "otp", "TOTP Seed", "TOTP Settings":
+			continue
+		}
+		item.addField(key, values[key].text, values[key].protected)
+	}
+
+	for _, c := range entry.children {
+		if c.name != "Binary" {
+			continue
+		}
+		ref, err := strconv.Atoi(c.child("Value").attr("Ref"))
+		if err != nil || ref < 0 || ref >= len(binaries) {
+			return Item{}, fmt.Errorf("%w: attachment reference of %q", ErrMalformed, item.Title)
+		}
+		item.Attachments = append(item.Attachments, Attachment{Name: c.child("Key").text, Data: binaries[ref]})
+	}
+	return item, nil
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func mustUUID(s string) []byte {
+	uuid, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return uuid
+}
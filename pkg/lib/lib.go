@@ -2,56 +2,10 @@ package lib
 
 import (
 	"context"
-	"fmt"
-	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var secret = "PaBjK!7K$&qMUMTb"
-
-type JWTClaims struct {
-	jwt.RegisteredClaims
-	UserID uuid.UUID `json:"user_id"`
-}
-
-func CreateJWT(userUUID uuid.UUID) (string, error) {
-	claims := JWTClaims{
-		UserID: userUUID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwtString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return "", err
-	}
-
-	return jwtString, nil
-}
-
-func CheckJWT(tokenString string) (uuid.UUID, error) {
-	claims := JWTClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
-	if err != nil {
-		return uuid.Nil, err
-	}
-
-	if !token.Valid {
-		return uuid.Nil, err
-	}
-
-	return claims.UserID, nil
-}
-
 func IsTableExist(p *pgxpool.Pool, table string) bool {
 	var n int
 
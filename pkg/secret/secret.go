@@ -0,0 +1,202 @@
+// Package secret contains typed secret kinds and their validation
+package secret
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid     = fmt.Errorf("invalid secret")
+	ErrUnknownKind = fmt.Errorf("unknown secret kind")
+)
+
+// Kind is a type of secret stored in the vault
+type Kind string
+
+const (
+	KindCredentials Kind = "credentials"
+	KindText        Kind = "text"
+	KindCard        Kind = "card"
+	KindBinary      Kind = "binary"
+)
+
+// Kinds lists all kinds stored as pieces, binary secrets are stored as blobs
+var Kinds = []Kind{KindCredentials, KindText, KindCard}
+
+// Secret is a typed secret with its kind specific payload in Data.
+// Data of an opaque secret is a base64 string of the client side envelope.
+type Secret struct {
+	Kind   Kind            `json:"kind"`
+	Meta   string          `json:"meta"`
+	Data   json.RawMessage `json:"data"`
+	Opaque bool            `json:"opaque,omitempty"`
+}
+
+// Credentials is a login/password pair with an optional TOTP seed
+type Credentials struct {
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TOTPSeed string `json:"totp_seed,omitempty"`
+}
+
+// Text is a free form text note
+type Text struct {
+	Text string `json:"text"`
+}
+
+// Card is a bank card
+type Card struct {
+	Number string `json:"number"`
+	Holder string `json:"holder"`
+	Expiry string `json:"expiry"` // MM/YY
+	CVV    string `json:"cvv"`
+}
+
+// Validator is implemented by every secret payload
+type Validator interface {
+	Validate(now time.Time) error
+}
+
+// New returns an empty payload for the given kind
+func New(kind Kind) (Validator, error) {
+	switch kind {
+	case KindCredentials:
+		return &Credentials{}, nil
+	case KindText:
+		return &Text{}, nil
+	case KindCard:
+		return &Card{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKind, kind)
+}
+
+// Normalize decodes Data strictly according to Kind, validates it and
+// replaces Data with its canonical encoding.
+func (s *Secret) Normalize(now time.Time) error {
+	payload, err := New(s.Kind)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(s.Data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+	if err := payload.Validate(now); err != nil {
+		return err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.Data = data
+	return nil
+}
+
+// Validate checks that credentials contain a username or a password and
+// that optional url and TOTP seed are well formed.
+func (c *Credentials) Validate(_ time.Time) error {
+	if c.Username == "" && c.Password == "" {
+		return fmt.Errorf("%w: username or password required", ErrInvalid)
+	}
+	if c.URL != "" {
+		if _, err := url.Parse(c.URL); err != nil {
+			return fmt.Errorf("%w: bad url: %s", ErrInvalid, err.Error())
+		}
+	}
+	if c.TOTPSeed != "" {
+		seed := strings.ToUpper(strings.ReplaceAll(c.TOTPSeed, " ", ""))
+		if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(seed, "=")); err != nil {
+			return fmt.Errorf("%w: totp seed is not base32", ErrInvalid)
+		}
+		c.TOTPSeed = seed
+	}
+	return nil
+}
+
+// Validate checks that text is not empty
+func (t *Text) Validate(_ time.Time) error {
+	if t.Text == "" {
+		return fmt.Errorf("%w: empty text", ErrInvalid)
+	}
+	return nil
+}
+
+// Validate checks card number with Luhn algorithm, expiry date is not in
+// the past and CVV has 3 or 4 digits.
+func (c *Card) Validate(now time.Time) error {
+	c.Number = strings.NewReplacer(" ", "", "-", "").Replace(c.Number)
+	if len(c.Number) < 12 || len(c.Number) > 19 || !isDigits(c.Number) {
+		return fmt.Errorf("%w: card number must contain 12-19 digits", ErrInvalid)
+	}
+	if !Luhn(c.Number) {
+		return fmt.Errorf("%w: card number checksum mismatch", ErrInvalid)
+	}
+	if strings.TrimSpace(c.Holder) == "" {
+		return fmt.Errorf("%w: card holder required", ErrInvalid)
+	}
+	expiry, err := ParseExpiry(c.Expiry)
+	if err != nil {
+		return err
+	}
+	if !expiry.After(now) {
+		return fmt.Errorf("%w: card expired", ErrInvalid)
+	}
+	if c.CVV != "" && (len(c.CVV) < 3 || len(c.CVV) > 4 || !isDigits(c.CVV)) {
+		return fmt.Errorf("%w: cvv must contain 3 or 4 digits", ErrInvalid)
+	}
+	return nil
+}
+
+// ParseExpiry parses MM/YY card expiry and returns the first moment after
+// the card expires.
+func ParseExpiry(expiry string) (time.Time, error) {
+	month, year, ok := strings.Cut(expiry, "/")
+	if !ok || len(month) != 2 || len(year) != 2 {
+		return time.Time{}, fmt.Errorf("%w: expiry must be in MM/YY format", ErrInvalid)
+	}
+	m, err := strconv.Atoi(month)
+	if err != nil || m < 1 || m > 12 {
+		return time.Time{}, fmt.Errorf("%w: bad expiry month", ErrInvalid)
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: bad expiry year", ErrInvalid)
+	}
+	return time.Date(2000+y, time.Month(m)+1, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// Luhn reports whether the digit string passes the Luhn checksum
+func Luhn(number string) bool {
+	var sum int
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package secret
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+
+func TestLuhn(t *testing.T) {
+	assert.True(t, Luhn("4111111111111111"))
+	assert.True(t, Luhn("5500005555555559"))
+	assert.True(t, Luhn("79927398713"))
+	assert.False(t, Luhn("4111111111111112"))
+	assert.False(t, Luhn("79927398710"))
+}
+
+func TestCard_Validate(t *testing.T) {
+	tbl := []struct {
+		name string
+		card Card
+		ok   bool
+	}{
+		{"valid", Card{Number: "4111 1111 1111 1111", Holder: "JOHN DOE", Expiry: "12/30", CVV: "123"}, true},
+		{"expires this month", Card{Number: "4111111111111111", Holder: "JOHN DOE", Expiry: "06/24"}, true},
+		{"expired", Card{Number: "4111111111111111", Holder: "JOHN DOE", Expiry: "05/24"}, false},
+		{"bad checksum", Card{Number: "4111111111111112", Holder: "JOHN DOE", Expiry: "12/30"}, false},
+		{"letters", Card{Number: "4111a11111111111", Holder: "JOHN DOE", Expiry: "12/30"}, false},
+		{"no holder", Card{Number: "4111111111111111", Expiry: "12/30"}, false},
+		{"bad month", Card{Number: "4111111111111111", Holder: "JOHN DOE", Expiry: "13/30"}, false},
+		{"bad format", Card{Number: "4111111111111111", Holder: "JOHN DOE", Expiry: "2030-12"}, false},
+		{"bad cvv", Card{Number: "4111111111111111", Holder: "JOHN DOE", Expiry: "12/30", CVV: "12"}, false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.card.Validate(now)
+			if tt.ok {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalid)
+		})
+	}
+}
+
+func TestCredentials_Validate(t *testing.T) {
+	assert.NoError(t, (&Credentials{Username: "user"}).Validate(now))
+	assert.ErrorIs(t, (&Credentials{URL: "https://example.com"}).Validate(now), ErrInvalid)
+	assert.ErrorIs(t, (&Credentials{Username: "user", TOTPSeed: "not base32!"}).Validate(now), ErrInvalid)
+
+	c := Credentials{Username: "user", TOTPSeed: "jbsw y3dp ehpk 3pxp"}
+	require.NoError(t, c.Validate(now))
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", c.TOTPSeed)
+}
+
+func TestSecret_Normalize(t *testing.T) {
+	s := Secret{Kind: KindCard, Data: json.RawMessage(`{"number":"4111-1111-1111-1111","holder":"JOHN DOE","expiry":"12/30"}`)}
+	require.NoError(t, s.Normalize(now))
+	assert.JSONEq(t, `{"number":"4111111111111111","holder":"JOHN DOE","expiry":"12/30","cvv":""}`, string(s.Data))
+
+	s = Secret{Kind: KindText, Data: json.RawMessage(`{"text":"note","extra":1}`)}
+	assert.ErrorIs(t, s.Normalize(now), ErrInvalid)
+
+	s = Secret{Kind: "pgp", Data: json.RawMessage(`{}`)}
+	assert.ErrorIs(t, s.Normalize(now), ErrUnknownKind)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+type passwordRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+type usageResponse struct {
+	Org       int64         `json:"org,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Resources int64         `json:"resources"`
+	Bytes     int64         `json:"bytes"`
+	Uploads   int64         `json:"uploads"`
+	Quota     quotaResponse `json:"quota"`
+}
+
+type quotaResponse struct {
+	Resources int64 `json:"resources"`
+	Bytes     int64 `json:"bytes"`
+	BlobSize  int64 `json:"blob_size"`
+}
+
+// AccountRoute returns the router of the authorized user account
+func (s *Rest) AccountRoute() http.Handler {
+	router := chi.NewRouter()
+	router.Post("/password", s.AccountPassword)
+	router.Get("/totp", s.TOTPStatus)
+	router.Post("/totp", s.TOTPEnroll)
+	router.Post("/totp/enable", s.TOTPEnable)
+	router.Post("/totp/disable", s.TOTPDisable)
+	router.Post("/totp/recovery-codes", s.RecoveryCodes)
+	router.Get("/usage", s.AccountUsage)
+	return router
+}
+
+// AccountPassword handles the HTTP POST request changing the password of
+// the user. The current password must be given and the new one satisfy the
+// password policy, only the data key of the user is rewrapped, stored
+// resources are not touched.
+func (s *Rest) AccountPassword(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s AccountPasswordHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if request.Password == "" || request.NewPassword == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	creds.Passw = request.Password
+
+	if err := s.Store.ChangePassword(r.Context(), creds, request.NewPassword); err != nil {
+		switch {
+		case errors.Is(err, postgres.ErrUserUnauthorized):
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		case errors.Is(err, postgres.ErrPasswordEmpty), errors.Is(err, postgres.ErrPasswordWeak):
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		default:
+			log.Printf("[ERROR] reqID %s failed to change password: %s", reqID, err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("[INFO] login %s changed password AccountPasswordHook", creds.Login)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AccountUsage handles the HTTP GET request returning the usage of the
+// vault of the user and of the team vaults of the organisations of the
+// user with their quotas, zero limits are unlimited:
+// [{"org", "name", "resources", "bytes", "uploads", "quota": {"resources",
+// "bytes", "blob_size"}}], the vault of the user first and without org.
+func (s *Rest) AccountUsage(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s AccountUsageHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	vaults, err := s.Store.AccountUsage(r.Context(), creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	var response = make([]usageResponse, 0, len(vaults))
+	for _, v := range vaults {
+		response = append(response, usageResponse{
+			Org:       (int64)(v.Org),
+			Name:      v.Name,
+			Resources: v.Resources,
+			Bytes:     v.Bytes,
+			Uploads:   v.Uploads,
+			Quota:     quotaResponse{Resources: v.Quota.Resources, Bytes: v.Quota.Bytes, BlobSize: v.Quota.BlobSize},
+		})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, response)
+}
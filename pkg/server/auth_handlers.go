@@ -3,9 +3,11 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
 	"github.com/pkg/errors"
 
 	postgres "github.com/stsg/gophkeeper/pkg/store"
@@ -34,15 +36,15 @@ func (s *Rest) Register(w http.ResponseWriter, r *http.Request) {
 	err := s.Store.Register(r.Context(), cr)
 
 	if err != nil {
-		if errors.Is(err, postgres.ErrUniqueViolation) {
+		switch {
+		case errors.Is(err, postgres.ErrUniqueViolation):
 			w.WriteHeader(http.StatusConflict)
-			return
-		}
-		if errors.Is(err, postgres.ErrNoExists) {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		case errors.Is(err, postgres.ErrPasswordWeak), errors.Is(err, postgres.ErrPasswordEmpty), errors.Is(err, postgres.ErrUserWrong):
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		default:
+			log.Printf("[ERROR] reqID %s failed to register: %s", reqID, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
 		}
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
@@ -50,13 +52,23 @@ func (s *Rest) Register(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// loginRequest are the credentials of the login, in zero knowledge mode the
+// session keeps no data key and only content encrypted by the client is
+// accepted.
+type loginRequest struct {
+	postgres.Creds
+	ZeroKnowledge bool `json:"zero_knowledge"`
+}
+
 func (s *Rest) Login(w http.ResponseWriter, r *http.Request) {
-	var cr postgres.Creds
-	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+	var request loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
+	cr := request.Creds
+
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] reqID %s LoginHook", reqID)
 
@@ -70,17 +82,127 @@ func (s *Rest) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := s.Store.Authenticate(r.Context(), cr)
+	tokens, err := s.Store.Authenticate(r.Context(), cr, request.ZeroKnowledge, requestDevice(r))
 	if err != nil {
-		if errors.Is(err, postgres.ErrUniqueViolation) {
-			w.WriteHeader(http.StatusConflict)
+		if errors.Is(err, postgres.ErrUserUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		log.Printf("[ERROR] reqID %s failed to login: %s", reqID, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if tokens.Challenge != "" {
+		log.Printf("[INFO] login %s second factor required LoginHook", cr.Login)
+		writeChallenge(w, tokens)
+		return
+	}
 	log.Printf("[INFO] login %s logged LoginHook", cr.Login)
-	w.Header().Set("Authorization", token)
+	writeTokens(w, tokens)
+}
+
+// verifyRequest is the second step of the login, the code is a TOTP of the
+// authenticator app or a recovery code
+type verifyRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// challengeResponse is returned by the login of users with a second factor
+type challengeResponse struct {
+	ChallengeToken string    `json:"challenge_token"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// LoginVerify handles the HTTP POST request completing the login of users
+// with a second factor. The challenge is closed after too many wrong codes.
+func (s *Rest) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s LoginVerifyHook", reqID)
+
+	var request verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ChallengeToken == "" || request.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.Store.VerifyLogin(r.Context(), request.ChallengeToken, request.Code, requestDevice(r))
+	if err != nil {
+		if errors.Is(err, postgres.ErrSecondFactorWrong) {
+			log.Printf("[WARN] reqID %s wrong second factor", reqID)
+		}
+		if errors.Is(err, postgres.ErrSecondFactorLocked) {
+			log.Printf("[WARN] reqID %s second factor locked", reqID)
+		}
+		if errors.Is(err, postgres.ErrUserUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		log.Printf("[ERROR] reqID %s failed to verify login: %s", reqID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenResponse are the tokens of the session, the access token is set in
+// the Authorization header too
+type tokenResponse struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Refresh handles the HTTP POST request replacing the refresh token of the
+// session by a new one along with a new access token. A refresh token used
+// before closes the session.
+func (s *Rest) Refresh(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s RefreshHook", reqID)
+
+	var request refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.Store.Refresh(r.Context(), request.RefreshToken, requestDevice(r))
+	if err != nil {
+		if errors.Is(err, postgres.ErrRefreshReused) {
+			log.Printf("[WARN] reqID %s refresh token reused, session closed", reqID)
+		}
+		if errors.Is(err, postgres.ErrUserUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+func writeTokens(w http.ResponseWriter, tokens postgres.SessionTokens) {
+	w.Header().Set("Authorization", tokens.Access)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	response := tokenResponse{AccessToken: tokens.Access, RefreshToken: tokens.Refresh, ExpiresAt: tokens.Expires}
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// writeChallenge answers the login with the challenge of the second factor,
+// no tokens are issued yet
+func writeChallenge(w http.ResponseWriter, tokens postgres.SessionTokens) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	response := challengeResponse{ChallengeToken: tokens.Challenge, ExpiresAt: tokens.Expires}
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
 }
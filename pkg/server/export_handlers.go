@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/stsg/gophkeeper/pkg/archive"
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+// exportPassphraseHeader carries the passphrase of exported archives, it is
+// never stored
+const exportPassphraseHeader = "X-Export-Passphrase"
+
+type importedResponse struct {
+	ID        postgres.ResourceID `json:"id"`
+	RID       postgres.ResourceID `json:"rid"`
+	Duplicate bool                `json:"duplicate,omitempty"`
+}
+
+type importResponse struct {
+	Folders   map[postgres.FolderID]postgres.FolderID `json:"folders"`
+	Resources []importedResponse                      `json:"resources"`
+}
+
+// writtenWriter tells whether the response was started
+type writtenWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *writtenWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// VaultExport handles the HTTP GET request exporting the vault of the user,
+// or of the team of the "team" query parameter, as an archive encrypted with
+// the passphrase of the "X-Export-Passphrase" header. Errors after the
+// archive started cut it short, such archives fail to import.
+func (s *Rest) VaultExport(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultExportHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	team, err := requestTeam(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="vault.gpkx"`)
+	var ww = &writtenWriter{ResponseWriter: w}
+	if err := s.Store.Export(r.Context(), team, r.Header.Get(exportPassphraseHeader), ww, creds); err != nil {
+		if ww.written {
+			log.Printf("[ERROR] reqID %s failed to export vault: %s", reqID, err.Error())
+			return
+		}
+		w.Header().Del("Content-Disposition")
+		sendArchiveError(w, r, err)
+	}
+}
+
+// VaultImport handles the HTTP POST request importing the archive of the
+// body, encrypted with the passphrase of the "X-Export-Passphrase" header,
+// into the vault of the user or of the team of the "team" query parameter.
+// The response maps the folders and resources of the archive to the vault,
+// {"folders": {archive id: id}, "resources": [{"id", "rid", "duplicate"}]}.
+func (s *Rest) VaultImport(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultImportHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	team, err := requestTeam(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+
+	report, err := s.Store.Import(r.Context(), team, r.Header.Get(exportPassphraseHeader), r.Body, creds)
+	if err != nil {
+		if len(report.Resources) > 0 {
+			log.Printf("[WARN] reqID %s import failed after %d resources", reqID, len(report.Resources))
+		}
+		sendArchiveError(w, r, err)
+		return
+	}
+	var response = importResponse{Folders: report.Folders, Resources: make([]importedResponse, 0, len(report.Resources))}
+	for _, imported := range report.Resources {
+		response.Resources = append(response.Resources, importedResponse{ID: imported.ID, RID: imported.RID, Duplicate: imported.Duplicate})
+	}
+	writeJSON(w, response)
+}
+
+func sendArchiveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, archive.ErrInvalid), errors.Is(err, archive.ErrPassphrase),
+		errors.Is(err, postgres.ErrPasswordEmpty), errors.Is(err, postgres.ErrPasswordWeak):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	default:
+		sendUpdateError(w, r, err)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+type folderRequest struct {
+	Name   *string            `json:"name"`
+	Parent *postgres.FolderID `json:"parent"`
+}
+
+type folderResponse struct {
+	ID     postgres.FolderID `json:"id"`
+	Parent postgres.FolderID `json:"parent"`
+	Name   string            `json:"name"`
+	Team   postgres.TeamID   `json:"team,omitempty"`
+}
+
+type moveRequest struct {
+	Folder postgres.FolderID `json:"folder"`
+}
+
+// VaultFolders handles the HTTP GET request listing the folders of the
+// vault of the user, or of the team of the "team" query parameter.
+func (s *Rest) VaultFolders(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultFoldersHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	team, err := requestTeam(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+	folders, err := s.Store.Folders(r.Context(), team, creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	var response = make([]folderResponse, 0, len(folders))
+	for _, folder := range folders {
+		response = append(response, folderResponse{ID: folder.ID, Parent: folder.Parent, Name: folder.Name, Team: folder.Team})
+	}
+	writeJSON(w, response)
+}
+
+// VaultFolderCreate handles the HTTP POST request creating the folder
+// {"name": ..., "parent": ...}, absent or zero parent is the root.
+func (s *Rest) VaultFolderCreate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultFolderCreateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	team, err := requestTeam(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+	var request folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var parent postgres.FolderID
+	if request.Parent != nil {
+		parent = *request.Parent
+	}
+	folder, err := s.Store.CreateFolder(r.Context(), team, parent, *request.Name, creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	writeCreated(w, (int64)(folder))
+}
+
+// VaultFolderUpdate handles the HTTP PATCH request renaming the folder or
+// moving it to another parent, absent fields are kept.
+func (s *Rest) VaultFolderUpdate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultFolderUpdateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	folder, err := strconv.ParseInt(chi.URLParam(r, "folder"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var request folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	update := postgres.FolderUpdate{Name: request.Name, Parent: request.Parent}
+	if err := s.Store.UpdateFolder(r.Context(), (postgres.FolderID)(folder), update, creds); err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VaultFolderDelete handles the HTTP DELETE request removing the folder
+// without subfolders, its resources move to the root.
+func (s *Rest) VaultFolderDelete(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultFolderDeleteHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	folder, err := strconv.ParseInt(chi.URLParam(r, "folder"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := s.Store.DeleteFolder(r.Context(), (postgres.FolderID)(folder), creds); err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VaultMove handles the HTTP PUT request moving the resource to the folder
+// {"folder": ...}, zero is the root. The new version is returned.
+func (s *Rest) VaultMove(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultMoveHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var request moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	version, err := s.Store.MoveResource(r.Context(), (postgres.ResourceID)(rid), request.Folder, creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), version)
+}
+
+// VaultTag handles the HTTP PUT and DELETE requests adding the tag of the
+// path to the resource or removing it. The new version is returned.
+func (s *Rest) VaultTag(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultTagHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var (
+		tag     = chi.URLParam(r, "tag")
+		version int64
+	)
+	if r.Method == http.MethodDelete {
+		version, err = s.Store.UntagResource(r.Context(), (postgres.ResourceID)(rid), tag, creds)
+	} else {
+		version, err = s.Store.TagResource(r.Context(), (postgres.ResourceID)(rid), tag, creds)
+	}
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), version)
+}
+
+// VaultDetails handles the HTTP PUT request replacing the structured meta
+// of the resource, {"title", "notes", "urls", "fields": [{"name", "value"}]}.
+// Versions are checked as in VaultPieceUpdate.
+func (s *Rest) VaultDetails(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultDetailsHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var details postgres.Details
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	newVersion, err := s.Store.SetDetails(r.Context(), (postgres.ResourceID)(rid), version, details, creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), newVersion)
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -132,20 +133,12 @@ func Decompress() func(http.Handler) http.Handler {
 	return f
 }
 
-// Authorization middleware
-func Authorization() func(http.Handler) http.Handler {
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Header.Get("X-Password") == "" {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			h.ServeHTTP(w, r)
-		})
-	}
-}
+// credsKey is the context key of the credentials set by AuthRequired
+type credsKey struct{}
 
-// Authorization middleware
+// AuthRequired verifies the token of the request against the sessions of
+// the store, closed sessions are rejected. The credentials of the session
+// are kept in the request context, see requestCreds.
 func AuthRequired(s *Rest) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -164,9 +157,10 @@ func AuthRequired(s *Rest) func(http.Handler) http.Handler {
 				return
 			}
 
-			r.Header.Set("X-Password", creds.Passw)
-			h.ServeHTTP(w, r)
-
+			if err := s.Store.SeenSession(r.Context(), creds, requestDevice(r)); err != nil {
+				log.Printf("[WARN] failed to update session: %s", err.Error())
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), credsKey{}, creds)))
 		})
 	}
 }
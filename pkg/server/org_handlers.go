@@ -0,0 +1,408 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+type nameRequest struct {
+	Name string `json:"name"`
+}
+
+type roleRequest struct {
+	Role postgres.Role `json:"role"`
+}
+
+type idResponse struct {
+	ID int64 `json:"id"`
+}
+
+type orgResponse struct {
+	ID   postgres.OrgID `json:"id"`
+	Name string         `json:"name"`
+	Role postgres.Role  `json:"role"`
+}
+
+type teamResponse struct {
+	ID     postgres.TeamID `json:"id"`
+	Name   string          `json:"name"`
+	Member bool            `json:"member"`
+}
+
+type memberResponse struct {
+	Login string        `json:"login"`
+	Role  postgres.Role `json:"role"`
+}
+
+// OrgRoute manages organisations, their members and teams. Team vaults are
+// accessed by the vault routes with the "team" query parameter.
+func (s *Rest) OrgRoute() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", s.Orgs)
+	router.Post("/", s.OrgCreate)
+	router.Get("/{org}/members", s.OrgMembers)
+	router.Put("/{org}/members/{login}", s.OrgMemberSet)
+	router.Delete("/{org}/members/{login}", s.OrgMemberRemove)
+	router.Get("/{org}/teams", s.Teams)
+	router.Post("/{org}/teams", s.TeamCreate)
+	router.Delete("/{org}/teams/{team}", s.TeamDelete)
+	router.Get("/{org}/teams/{team}/members", s.TeamMembers)
+	router.Put("/{org}/teams/{team}/members/{login}", s.TeamMemberAdd)
+	router.Delete("/{org}/teams/{team}/members/{login}", s.TeamMemberRemove)
+	return router
+}
+
+// Orgs handles the HTTP GET request listing the organisations of the user
+func (s *Rest) Orgs(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s OrgsHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	orgs, err := s.Store.Orgs(r.Context(), creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	var response = make([]orgResponse, 0, len(orgs))
+	for _, org := range orgs {
+		response = append(response, orgResponse{ID: org.ID, Name: org.Name, Role: org.Role})
+	}
+	writeJSON(w, response)
+}
+
+// OrgCreate handles the HTTP POST request creating the organisation
+// {"name": ...}, the user becomes its owner.
+func (s *Rest) OrgCreate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s OrgCreateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var request nameRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	org, err := s.Store.CreateOrg(r.Context(), request.Name, creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s created organisation %d OrgCreateHook", creds.Login, org)
+	writeCreated(w, (int64)(org))
+}
+
+// OrgMembers handles the HTTP GET request listing the members of the
+// organisation, any member may list them.
+func (s *Rest) OrgMembers(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s OrgMembersHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, err := orgParam(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	members, err := s.Store.OrgMembers(r.Context(), org, creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	writeJSON(w, memberList(members))
+}
+
+// OrgMemberSet handles the HTTP PUT request adding the login to the
+// organisation or changing its role, {"role": "owner"}, "admin", "editor"
+// or "viewer".
+func (s *Rest) OrgMemberSet(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s OrgMemberSetHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, err := orgParam(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var request roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var login = chi.URLParam(r, "login")
+	if err := s.Store.SetOrgMember(r.Context(), org, login, request.Role, creds); err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s set %s of %d to %s OrgMemberSetHook", creds.Login, login, org, request.Role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OrgMemberRemove handles the HTTP DELETE request removing the login from
+// the organisation and its teams, members may leave by themselves.
+func (s *Rest) OrgMemberRemove(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s OrgMemberRemoveHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, err := orgParam(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var login = chi.URLParam(r, "login")
+	if err := s.Store.RemoveOrgMember(r.Context(), org, login, creds); err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s removed %s from %d OrgMemberRemoveHook", creds.Login, login, org)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Teams handles the HTTP GET request listing the teams of the organisation
+func (s *Rest) Teams(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamsHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, err := orgParam(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	teams, err := s.Store.Teams(r.Context(), org, creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	var response = make([]teamResponse, 0, len(teams))
+	for _, team := range teams {
+		response = append(response, teamResponse{ID: team.ID, Name: team.Name, Member: team.Member})
+	}
+	writeJSON(w, response)
+}
+
+// TeamCreate handles the HTTP POST request creating the team {"name": ...}
+// of the organisation, the user becomes its first member.
+func (s *Rest) TeamCreate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamCreateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, err := orgParam(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var request nameRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	team, err := s.Store.CreateTeam(r.Context(), org, request.Name, creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s created team %d of %d TeamCreateHook", creds.Login, team, org)
+	writeCreated(w, (int64)(team))
+}
+
+// TeamDelete handles the HTTP DELETE request removing the team, its vault
+// must be empty.
+func (s *Rest) TeamDelete(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamDeleteHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, team, err := teamParams(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := s.Store.DeleteTeam(r.Context(), org, team, creds); err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s deleted team %d of %d TeamDeleteHook", creds.Login, team, org)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TeamMembers handles the HTTP GET request listing the members of the team
+func (s *Rest) TeamMembers(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamMembersHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, team, err := teamParams(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	members, err := s.Store.TeamMembers(r.Context(), org, team, creds)
+	if err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	writeJSON(w, memberList(members))
+}
+
+// TeamMemberAdd handles the HTTP PUT request adding the organisation member
+// to the team. The team key is wrapped to the public key of the login, so
+// only managers who are team members themselves add members.
+func (s *Rest) TeamMemberAdd(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamMemberAddHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, team, err := teamParams(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var login = chi.URLParam(r, "login")
+	if err := s.Store.AddTeamMember(r.Context(), org, team, login, creds); err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s added %s to team %d TeamMemberAddHook", creds.Login, login, team)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TeamMemberRemove handles the HTTP DELETE request removing the login from
+// the team, members may leave by themselves.
+func (s *Rest) TeamMemberRemove(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TeamMemberRemoveHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	org, team, err := teamParams(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var login = chi.URLParam(r, "login")
+	if err := s.Store.RemoveTeamMember(r.Context(), org, team, login, creds); err != nil {
+		writeOrgError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s removed %s from team %d TeamMemberRemoveHook", creds.Login, login, team)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestTeam returns the team of the "team" query parameter, zero for the
+// vault of the user
+func requestTeam(r *http.Request) (postgres.TeamID, error) {
+	var value = r.URL.Query().Get("team")
+	if value == "" {
+		return 0, nil
+	}
+	team, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || team <= 0 {
+		return 0, errors.New("bad team")
+	}
+	return (postgres.TeamID)(team), nil
+}
+
+func orgParam(r *http.Request) (postgres.OrgID, error) {
+	org, err := strconv.ParseInt(chi.URLParam(r, "org"), 10, 64)
+	return (postgres.OrgID)(org), err
+}
+
+func teamParams(r *http.Request) (postgres.OrgID, postgres.TeamID, error) {
+	org, err := orgParam(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	team, err := strconv.ParseInt(chi.URLParam(r, "team"), 10, 64)
+	return org, (postgres.TeamID)(team), err
+}
+
+func memberList(members []postgres.Member) []memberResponse {
+	var response = make([]memberResponse, 0, len(members))
+	for _, member := range members {
+		response = append(response, memberResponse{Login: member.Login, Role: member.Role})
+	}
+	return response
+}
+
+func writeCreated(w http.ResponseWriter, id int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(idResponse{ID: id}); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+func writeOrgError(w http.ResponseWriter, r *http.Request, reqID string, err error) {
+	switch {
+	case errors.Is(err, postgres.ErrUserUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, postgres.ErrOrgNotFound), errors.Is(err, postgres.ErrTeamNotFound),
+		errors.Is(err, postgres.ErrMemberNotFound), errors.Is(err, postgres.ErrUserNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, postgres.ErrPermissionDenied):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, postgres.ErrOrgInvalid):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	case errors.Is(err, postgres.ErrOrgExists), errors.Is(err, postgres.ErrTeamNotEmpty),
+		errors.Is(err, postgres.ErrLastOwner), errors.Is(err, postgres.ErrGranteeKeyless):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	default:
+		log.Printf("[ERROR] reqID %s failed to manage organisations: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+// VaultVersions handles the HTTP GET request listing the versions of the
+// resource, the current one first followed by kept revisions, newest first.
+func (s *Rest) VaultVersions(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultVersionsHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := s.Store.Revisions(r.Context(), (postgres.ResourceID)(rid), creds)
+	if err != nil {
+		if errors.Is(err, postgres.ErrResourceNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, postgres.ErrPermissionDenied) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		log.Printf("[ERROR] reqID %s failed to list revisions: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(revisions[0].Version))
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(&revisions); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// VaultRestoreVersion handles the HTTP POST request restoring the resource
+// to the given version. The restore is an update, so the current state is
+// kept as a revision, If-Match is checked and the new version is returned.
+func (s *Rest) VaultRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultRestoreVersionHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.ParseInt(chi.URLParam(r, "version"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	newVersion, err := s.Store.RestoreRevision(r.Context(), (postgres.ResourceID)(rid), revision, version, creds)
+	if err != nil {
+		if errors.Is(err, postgres.ErrRevisionNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), newVersion)
+}
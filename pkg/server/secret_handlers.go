@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+// secretRequest is a body of the typed secret store request, kind is taken from the route.
+// Opaque requests carry a client side envelope as a base64 string in Data.
+type secretRequest struct {
+	Meta   string          `json:"meta"`
+	Data   json.RawMessage `json:"data"`
+	Opaque bool            `json:"opaque"`
+}
+
+// secretResponse is a body of the typed secret restore response
+type secretResponse struct {
+	RID    int64           `json:"rid"`
+	Kind   secret.Kind     `json:"kind"`
+	Meta   string          `json:"meta"`
+	Data   json.RawMessage `json:"data"`
+	Opaque bool            `json:"opaque,omitempty"`
+}
+
+// VaultSecretRoute returns an http.Handler for typed secrets of the given kind.
+//
+// PUT "/" validates and stores a secret, GET "/{rid}" restores it and
+// PUT "/{rid}" replaces it.
+func (s *Rest) VaultSecretRoute(kind secret.Kind) http.Handler {
+	router := chi.NewRouter()
+	router.Put("/", s.VaultSecretStore(kind))
+	router.Get("/{rid}", s.VaultSecretRestore(kind))
+	router.Put("/{rid}", s.VaultSecretUpdate(kind))
+	return router
+}
+
+// VaultSecretStore returns a handler that validates a secret of the given kind
+// and stores it encrypted. Validation errors are reported with 400 and a
+// JSON body describing the problem.
+func (s *Rest) VaultSecretStore(kind secret.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqID := middleware.GetReqID(r.Context())
+		log.Printf("[INFO] reqID %s VaultSecretStoreHook %s", reqID, kind)
+
+		creds, err := s.requestCreds(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		team, err := requestTeam(r)
+		if err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+			return
+		}
+		var request secretRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "malformed request")
+			return
+		}
+
+		rid, err := s.Store.StoreSecret(
+			r.Context(),
+			secret.Secret{Kind: kind, Meta: request.Meta, Data: request.Data, Opaque: request.Opaque},
+			team,
+			creds,
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, secret.ErrInvalid), errors.Is(err, envelope.ErrMalformed), errors.Is(err, envelope.ErrUnsupported):
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+			case errors.Is(err, postgres.ErrUserUnauthorized):
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			case errors.Is(err, postgres.ErrTeamNotFound):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			case errors.Is(err, postgres.ErrPermissionDenied):
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			case errors.Is(err, postgres.ErrQuotaExceeded), errors.Is(err, postgres.ErrBlobTooLarge):
+				sendQuotaError(w, r, err)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		var response struct {
+			RID int64 `json:"rid"`
+		}
+		response.RID = (int64)(rid)
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			log.Printf("[ERROR] failed to write response: %s", err.Error())
+		}
+	}
+}
+
+// VaultSecretRestore returns a handler that restores a secret of the given kind.
+// Resources of other kinds are reported as not found.
+func (s *Rest) VaultSecretRestore(kind secret.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqID := middleware.GetReqID(r.Context())
+		log.Printf("[INFO] reqID %s VaultSecretRestoreHook %s", reqID, kind)
+
+		creds, err := s.requestCreds(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		sec, version, err := s.Store.RestoreSecret(r.Context(), kind, (postgres.ResourceID)(rid), creds)
+		if err != nil {
+			switch {
+			case errors.Is(err, postgres.ErrResourceNotFound), errors.Is(err, postgres.ErrSecretKindMismatch):
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			case errors.Is(err, postgres.ErrUserUnauthorized):
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		response := secretResponse{RID: (int64)(rid), Kind: sec.Kind, Meta: sec.Meta, Data: sec.Data, Opaque: sec.Opaque}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(version))
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			log.Printf("[ERROR] failed to write response: %s", err.Error())
+		}
+	}
+}
+
+// VaultSecretUpdate returns a handler that validates a secret of the given
+// kind and replaces the stored one keeping its id. The write is rejected with
+// 412 if the If-Match version is stale, the new version is returned in ETag.
+func (s *Rest) VaultSecretUpdate(kind secret.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqID := middleware.GetReqID(r.Context())
+		log.Printf("[INFO] reqID %s VaultSecretUpdateHook %s", reqID, kind)
+
+		creds, err := s.requestCreds(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		var request secretRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "malformed request")
+			return
+		}
+
+		newVersion, err := s.Store.UpdateSecret(
+			r.Context(),
+			(postgres.ResourceID)(rid),
+			version,
+			secret.Secret{Kind: kind, Meta: request.Meta, Data: request.Data, Opaque: request.Opaque},
+			creds,
+		)
+		if err != nil {
+			sendUpdateError(w, r, err)
+			return
+		}
+		sendVersion(w, (postgres.ResourceID)(rid), newVersion)
+	}
+}
@@ -19,14 +19,12 @@ import (
 )
 
 type Rest struct {
-	Listen   string
-	Version  string
-	Status   Status
-	Config   *config.Parameters
-	Timeout  time.Duration
-	Store    *postgres.Storage
-	Secret   []byte
-	LifeSpan time.Duration
+	Listen  string
+	Version string
+	Status  Status
+	Config  *config.Parameters
+	Timeout time.Duration
+	Store   *postgres.Storage
 }
 
 type Status interface {
@@ -66,18 +64,26 @@ func (s *Rest) router() http.Handler {
 	router.Use(rest.Throttle(100), middleware.Timeout(60*time.Second))
 	router.Use(rest.AppInfo("gophkeeper", "sartorus", s.Version))
 	router.Use(rest.Ping)
-	router.Use(logger.New(logger.Log(log.Default()), logger.WithBody, logger.Prefix("[DEBUG]")).Handler)
+	router.Use(logger.New(logger.Log(log.Default()), logger.Prefix("[DEBUG]")).Handler)
 	router.Use(middleware.Timeout(s.Timeout))
 	router.Use(rest.Gzip("application/json", "text/html"))
 	router.Use(middleware.Compress(5, "application/json", "text/html"))
-	router.Use(rest.BasicAuth(s.Auth))
 
 	router.Route("/", func(r chi.Router) {
 		r.Get("/echo", s.echo)
 		r.Get("/status", s.status)
 		r.Post("/register", s.Register)
 		r.Post("/login", s.Login)
-		r.Mount("/vault", s.VaultRoute())
+		r.Post("/login/verify", s.LoginVerify)
+		r.Post("/refresh", s.Refresh)
+		r.Group(func(r chi.Router) {
+			r.Use(AuthRequired(s))
+			r.Post("/logout", s.Logout)
+			r.Mount("/sessions", s.SessionsRoute())
+			r.Mount("/vault", s.VaultRoute())
+			r.Mount("/account", s.AccountRoute())
+			r.Mount("/orgs", s.OrgRoute())
+		})
 	})
 
 	return router
@@ -113,21 +119,3 @@ func (s *Rest) status(w http.ResponseWriter, r *http.Request) {
 	}
 	rest.RenderJSON(w, info)
 }
-
-func (s *Rest) Auth(login string, password string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-
-	user, error := s.Store.GetIdentity(ctx, login)
-	if error != nil {
-		log.Printf("[ERROR] failed to get user: %v", error)
-		return false
-	}
-
-	if user.Passw != password {
-		log.Printf("[ERROR] wrong password: %v", error)
-		return false
-	}
-
-	return true
-}
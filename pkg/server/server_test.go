@@ -1,7 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -12,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/stsg/gophkeeper/pkg/status"
+	postgres "github.com/stsg/gophkeeper/pkg/store"
 )
 
 func TestRest_Run(t *testing.T) {
@@ -47,3 +53,195 @@ func TestStatusCtrl(t *testing.T) {
 	assert.Contains(t, string(body), `"load_average":`, string(body))
 	assert.Equal(t, 1, len(sts.GetCalls()))
 }
+
+func TestIfMatchVersion(t *testing.T) {
+	tbl := []struct {
+		header  string
+		version int64
+		err     bool
+	}{
+		{"", 0, false},
+		{etag(42), 42, false},
+		{"42", 42, false},
+		{`"abc"`, 0, true},
+		{`"0"`, 0, true},
+		{`"-1"`, 0, true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/vault/piece/1", http.NoBody)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+			version, err := ifMatchVersion(r)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.version, version)
+		})
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	digest := sha256.Sum256([]byte("content"))
+	encoded := base64.StdEncoding.EncodeToString(digest[:])
+	tbl := []struct {
+		header string
+		err    bool
+	}{
+		{"sha256 " + encoded, false},
+		{"SHA256 " + encoded, false},
+		{"", true},
+		{"md5 " + encoded, true},
+		{"sha256 !!!", true},
+		{"sha256 " + base64.StdEncoding.EncodeToString(digest[:16]), true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.header, func(t *testing.T) {
+			checksum, err := uploadChecksum(tt.header)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, digest[:], checksum)
+		})
+	}
+}
+
+func TestBlobFile(t *testing.T) {
+	tbl := []struct {
+		contentType, disposition string
+		wantType, wantName       string
+	}{
+		{"", "", "", ""},
+		{"text/plain; charset=UTF-8", `attachment; filename="notes.txt"`, "text/plain; charset=UTF-8", "notes.txt"},
+		{"bad type;", `attachment; filename="../../etc/passwd"`, "", "passwd"},
+		{"image/png", `attachment; filename="C:\\photos\\cat.png"`, "image/png", "cat.png"},
+		{"", `attachment; filename*=UTF-8''%D0%BA%D0%BE%D1%82.png`, "", "кот.png"},
+		{"", "attachment", "", ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.contentType+tt.disposition, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/vault/blob/", http.NoBody)
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Content-Disposition", tt.disposition)
+			contentType, filename := blobFile(r)
+			assert.Equal(t, tt.wantType, contentType)
+			assert.Equal(t, tt.wantName, filename)
+		})
+	}
+}
+
+// corruptedContent fails the read reaching its end as a blob failing its
+// digest
+type corruptedContent struct {
+	*bytes.Reader
+}
+
+func (c corruptedContent) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if c.Reader.Len() == 0 && n > 0 {
+		return 0, postgres.ErrBlobCorrupted
+	}
+	return n, err
+}
+
+func TestServeBlob(t *testing.T) {
+	content := bytes.Repeat([]byte("blob"), 64*1024)
+	corrupted := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if corrupted {
+			serveBlob(w, r, corruptedContent{bytes.NewReader(content)})
+			return
+		}
+		serveBlob(w, r, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, content, got)
+
+	corrupted = true
+	resp, err = http.Get(ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+	got, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, len(got), len(content))
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestSendReadError(t *testing.T) {
+	tbl := []struct {
+		err  error
+		code int
+	}{
+		{postgres.ErrUserUnauthorized, http.StatusUnauthorized},
+		{postgres.ErrResourceNotFound, http.StatusNotFound},
+		{fmt.Errorf("vault: %w", postgres.ErrTeamNotFound), http.StatusNotFound},
+		{postgres.ErrPermissionDenied, http.StatusForbidden},
+		{postgres.ErrBlobCorrupted, http.StatusInternalServerError},
+		{errors.New("connection lost"), http.StatusInternalServerError},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sendReadError(w, httptest.NewRequest(http.MethodGet, "/vault/binary/1", http.NoBody), tt.err)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestSendUpdateError(t *testing.T) {
+	tbl := []struct {
+		err  error
+		code int
+	}{
+		{postgres.ErrResourceNotFound, http.StatusNotFound},
+		{postgres.ErrTeamNotFound, http.StatusNotFound},
+		{postgres.ErrPermissionDenied, http.StatusForbidden},
+		{postgres.ErrVersionMismatch, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sendUpdateError(w, httptest.NewRequest(http.MethodPut, "/vault/binary/1", http.NoBody), tt.err)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestSendQuotaError(t *testing.T) {
+	tbl := []struct {
+		err  error
+		code int
+		body string
+	}{
+		{
+			&postgres.QuotaError{Quota: postgres.QuotaBlobSize, Limit: 1024},
+			http.StatusRequestEntityTooLarge,
+			`{"error":"blob too large: limit of 1024 bytes","quota":"blob_size","limit":1024,"used":0}`,
+		},
+		{
+			fmt.Errorf("import: %w", &postgres.QuotaError{Quota: postgres.QuotaResources, Limit: 10, Used: 10, Org: 2}),
+			http.StatusInsufficientStorage,
+			`{"error":"import: quota exceeded: resources 10 of 10 used","quota":"resources","limit":10,"used":10,"org":2}`,
+		},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sendUpdateError(w, httptest.NewRequest(http.MethodPut, "/vault/binary/", http.NoBody), tt.err)
+			assert.Equal(t, tt.code, w.Code)
+			assert.JSONEq(t, tt.body, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+// SessionsRoute returns the router of the open sessions of the user
+func (s *Rest) SessionsRoute() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/", s.SessionsList)
+	router.Delete("/{id}", s.SessionRevoke)
+	return router
+}
+
+// Logout handles the HTTP POST request closing the session of the request
+func (s *Rest) Logout(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s LogoutHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := s.Store.Logout(r.Context(), creds); err != nil && !errors.Is(err, postgres.ErrSessionNotFound) {
+		log.Printf("[ERROR] reqID %s failed to logout: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionsList handles the HTTP GET request listing the open sessions of
+// the user with their devices, the session of the request is marked current.
+func (s *Rest) SessionsList(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s SessionsListHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	sessions, err := s.Store.Sessions(r.Context(), creds)
+	if err != nil {
+		log.Printf("[ERROR] reqID %s failed to list sessions: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// SessionRevoke handles the HTTP DELETE request closing a session of the
+// user, its tokens are rejected from now on.
+func (s *Rest) SessionRevoke(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s SessionRevokeHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := s.Store.RevokeSession(r.Context(), chi.URLParam(r, "id"), creds); err != nil {
+		if errors.Is(err, postgres.ErrSessionNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		log.Printf("[ERROR] reqID %s failed to revoke session: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestDevice describes the client of the request, the address is set by
+// the RealIP middleware
+func requestDevice(r *http.Request) postgres.Device {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	return postgres.Device{UserAgent: r.UserAgent(), IP: ip}
+}
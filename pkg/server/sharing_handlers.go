@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+type grantRequest struct {
+	Permission postgres.Permission `json:"permission"`
+}
+
+type grantResponse struct {
+	Grantee    string              `json:"grantee"`
+	Permission postgres.Permission `json:"permission"`
+	GrantedBy  string              `json:"granted_by"`
+	CreatedAt  time.Time           `json:"created_at"`
+}
+
+type sharedResponse struct {
+	postgres.Resource
+	Owner      string              `json:"owner"`
+	Permission postgres.Permission `json:"permission"`
+}
+
+// VaultShared handles the HTTP GET request listing the resources other
+// users shared with the user. They are read and updated by the usual vault
+// routes.
+func (s *Rest) VaultShared(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultSharedHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	shared, err := s.Store.SharedWithMe(r.Context(), creds)
+	if err != nil {
+		writeGrantError(w, r, reqID, err)
+		return
+	}
+	var response = make([]sharedResponse, 0, len(shared))
+	for _, resource := range shared {
+		response = append(response, sharedResponse{
+			Resource:   resource.Resource,
+			Owner:      resource.Owner,
+			Permission: resource.Permission,
+		})
+	}
+	writeJSON(w, response)
+}
+
+// VaultGrants handles the HTTP GET request listing the grants of the
+// resource, only its owner may list them.
+func (s *Rest) VaultGrants(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultGrantsHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	grants, err := s.Store.Grants(r.Context(), (postgres.ResourceID)(rid), creds)
+	if err != nil {
+		writeGrantError(w, r, reqID, err)
+		return
+	}
+	var response = make([]grantResponse, 0, len(grants))
+	for _, grant := range grants {
+		response = append(response, grantResponse{
+			Grantee:    grant.Grantee,
+			Permission: grant.Permission,
+			GrantedBy:  grant.GrantedBy,
+			CreatedAt:  grant.CreatedAt,
+		})
+	}
+	writeJSON(w, response)
+}
+
+// VaultGrant handles the HTTP PUT request sharing the resource with the
+// grantee of the path, {"permission": "read"} or "write". The resource key
+// is wrapped to the public key of the grantee.
+func (s *Rest) VaultGrant(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultGrantHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var request grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var grantee = chi.URLParam(r, "grantee")
+	if err := s.Store.Share(r.Context(), (postgres.ResourceID)(rid), grantee, request.Permission, creds); err != nil {
+		writeGrantError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s shared %d with %s VaultGrantHook", creds.Login, rid, grantee)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VaultRevoke handles the HTTP DELETE request revoking the grant of the
+// grantee, grantees may revoke their own grant.
+func (s *Rest) VaultRevoke(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultRevokeHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var grantee = chi.URLParam(r, "grantee")
+	if err := s.Store.Revoke(r.Context(), (postgres.ResourceID)(rid), grantee, creds); err != nil {
+		writeGrantError(w, r, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s revoked %d of %s VaultRevokeHook", creds.Login, rid, grantee)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeGrantError(w http.ResponseWriter, r *http.Request, reqID string, err error) {
+	switch {
+	case errors.Is(err, postgres.ErrUserUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, postgres.ErrResourceNotFound), errors.Is(err, postgres.ErrGranteeNotFound),
+		errors.Is(err, postgres.ErrGrantNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, postgres.ErrGrantInvalid):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	case errors.Is(err, postgres.ErrGranteeKeyless):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	default:
+		log.Printf("[ERROR] reqID %s failed to manage grants: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+type totpRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpStatusResponse struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recovery_codes"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TOTPStatus handles the HTTP GET request telling if the second factor of
+// the user is enabled and how many recovery codes are left
+func (s *Rest) TOTPStatus(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TOTPStatusHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	status, err := s.Store.TOTPStatus(r.Context(), creds)
+	if err != nil {
+		writeTOTPError(w, reqID, err)
+		return
+	}
+	writeJSON(w, totpStatusResponse{Enabled: status.Enabled, RecoveryCodes: status.RecoveryCodes})
+}
+
+// TOTPEnroll handles the HTTP POST request generating a new TOTP secret, the
+// otpauth:// URI is the payload of the QR code for the authenticator app.
+// The second factor is not required until enabled. Servers without a master
+// key answer 501.
+func (s *Rest) TOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TOTPEnrollHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	enrollment, err := s.Store.EnrollTOTP(r.Context(), creds)
+	if err != nil {
+		writeTOTPError(w, reqID, err)
+		return
+	}
+	writeJSON(w, totpEnrollResponse{Secret: enrollment.Secret, URI: enrollment.URI})
+}
+
+// TOTPEnable handles the HTTP POST request enabling the second factor with
+// the first code of the app, the recovery codes are returned once.
+func (s *Rest) TOTPEnable(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TOTPEnableHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var request totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	codes, err := s.Store.EnableTOTP(r.Context(), creds, request.Code)
+	if err != nil {
+		writeTOTPError(w, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s enabled second factor TOTPEnableHook", creds.Login)
+	writeJSON(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// TOTPDisable handles the HTTP POST request disabling the second factor,
+// the password of the user is required.
+func (s *Rest) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s TOTPDisableHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var request totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	creds.Passw = request.Password
+	if err := s.Store.DisableTOTP(r.Context(), creds); err != nil {
+		writeTOTPError(w, reqID, err)
+		return
+	}
+	log.Printf("[INFO] login %s disabled second factor TOTPDisableHook", creds.Login)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RecoveryCodes handles the HTTP POST request replacing the recovery codes
+// of the user, the password of the user is required.
+func (s *Rest) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s RecoveryCodesHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var request totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	creds.Passw = request.Password
+	codes, err := s.Store.RegenerateRecoveryCodes(r.Context(), creds)
+	if err != nil {
+		writeTOTPError(w, reqID, err)
+		return
+	}
+	writeJSON(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func writeTOTPError(w http.ResponseWriter, reqID string, err error) {
+	switch {
+	case errors.Is(err, postgres.ErrUserUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, postgres.ErrTOTPEnabled), errors.Is(err, postgres.ErrTOTPNotEnrolled):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case errors.Is(err, postgres.ErrNoMasterKey):
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+	default:
+		log.Printf("[ERROR] reqID %s failed to manage second factor: %s", reqID, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
+
+	postgres "github.com/stsg/gophkeeper/pkg/store"
+)
+
+// Upload headers, named after the tus protocol. The checksum is
+// "sha256 <base64 digest>" of the whole content.
+const (
+	uploadLengthHeader   = "Upload-Length"
+	uploadOffsetHeader   = "Upload-Offset"
+	uploadChecksumHeader = "Upload-Checksum"
+	uploadExpiresHeader  = "Upload-Expires"
+)
+
+type uploadResponse struct {
+	ID        string    `json:"id"`
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// VaultUploadRoute returns the routes of upload sessions of new blobs:
+// POST "/" starts an upload, HEAD "/{id}" returns its offset, PUT "/{id}"
+// stores the chunk of the body at the "Upload-Offset" header, POST
+// "/{id}/commit" stores the blob and DELETE "/{id}" aborts the upload.
+func (s *Rest) VaultUploadRoute() http.Handler {
+	router := chi.NewRouter()
+	router.Post("/", s.VaultUploadCreate)
+	router.Head("/{id}", s.VaultUploadOffset)
+	router.Get("/{id}", s.VaultUploadOffset)
+	router.Put("/{id}", s.VaultUploadWrite)
+	router.Patch("/{id}", s.VaultUploadWrite)
+	router.Post("/{id}/commit", s.VaultUploadCommit)
+	router.Delete("/{id}", s.VaultUploadAbort)
+	return router
+}
+
+// VaultUploadCreate handles the HTTP POST request starting the upload of a
+// blob to the vault of the user, or of the team of the "team" query
+// parameter. The headers are those of VaultBLobEncrypt and "Upload-Length",
+// the length of the content, which only opaque content may omit. The
+// response is 201 with the upload {"id", "offset", "length", "expires_at"}
+// and its URL in the Location header. A length exceeding the quota of the
+// vault is rejected as by sendQuotaError, as are chunks and commits.
+func (s *Rest) VaultUploadCreate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultUploadCreateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	team, err := requestTeam(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+	var length int64 = -1
+	if value := r.Header.Get(uploadLengthHeader); value != "" {
+		if length, err = strconv.ParseInt(value, 10, 64); err != nil || length < 0 {
+			http.Error(w, "bad "+uploadLengthHeader, http.StatusBadRequest)
+			return
+		}
+	}
+	contentType, filename := blobFile(r)
+	upload, err := s.Store.CreateUpload(r.Context(), postgres.Upload{
+		Meta:        r.Header.Get("X-Meta"),
+		Opaque:      r.Header.Get(encryptionHeader) == encryptionEnvelope,
+		Team:        team,
+		Length:      length,
+		ContentType: contentType,
+		Filename:    filename,
+	}, creds)
+	if err != nil {
+		sendUploadError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+upload.ID)
+	w.Header().Set(uploadOffsetHeader, "0")
+	w.Header().Set(uploadExpiresHeader, upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(uploadResponse{
+		ID:        upload.ID,
+		Length:    upload.Length,
+		ExpiresAt: upload.ExpiresAt,
+	}); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// VaultUploadOffset handles HEAD and GET requests of the upload, the
+// "Upload-Offset" header is the offset to resume it from and
+// "Upload-Length" its length unless unknown. GET returns the upload as
+// VaultUploadCreate does.
+func (s *Rest) VaultUploadOffset(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultUploadOffsetHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	upload, err := s.Store.GetUpload(r.Context(), chi.URLParam(r, "id"), creds)
+	if err != nil {
+		sendUploadError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	if upload.Length >= 0 {
+		w.Header().Set(uploadLengthHeader, strconv.FormatInt(upload.Length, 10))
+	}
+	w.Header().Set(uploadExpiresHeader, upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	writeJSON(w, uploadResponse{ID: upload.ID, Offset: upload.Offset, Length: upload.Length, ExpiresAt: upload.ExpiresAt})
+}
+
+// VaultUploadWrite handles PUT and PATCH requests storing the body as the
+// chunk of the upload at the "Upload-Offset" header. Chunks of content
+// encrypted by the server but the last one must be multiples of 64 KiB.
+// The response is 204 with the new offset in the "Upload-Offset" header,
+// 409 if the offset is not the one of the upload.
+func (s *Rest) VaultUploadWrite(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultUploadWriteHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "bad "+uploadOffsetHeader, http.StatusBadRequest)
+		return
+	}
+	offset, err = s.Store.WriteUpload(r.Context(), chi.URLParam(r, "id"), offset, r.Body, creds)
+	if err != nil {
+		sendUploadError(w, r, err)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VaultUploadCommit handles the HTTP POST request storing the complete
+// content of the upload as a blob, the "Upload-Checksum" header must match
+// the content. The response is 201 with the rid of the blob as
+// VaultBLobEncrypt returns it, 409 if content is missing and 422 if the
+// checksum does not match.
+func (s *Rest) VaultUploadCommit(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultUploadCommitHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	checksum, err := uploadChecksum(r.Header.Get(uploadChecksumHeader))
+	if err != nil {
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+		return
+	}
+	rid, err := s.Store.CommitUpload(r.Context(), chi.URLParam(r, "id"), checksum, creds)
+	if err != nil {
+		sendUploadError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	var response struct {
+		RID int64 `json:"rid"`
+	}
+	response.RID = (int64)(rid)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// VaultUploadAbort handles the HTTP DELETE request removing the upload
+func (s *Rest) VaultUploadAbort(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultUploadAbortHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := s.Store.AbortUpload(r.Context(), chi.URLParam(r, "id"), creds); err != nil {
+		sendUploadError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadChecksum parses the "Upload-Checksum" header, only SHA-256 is
+// supported
+func uploadChecksum(header string) ([]byte, error) {
+	algorithm, value, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(algorithm, "sha256") {
+		return nil, errors.New("bad " + uploadChecksumHeader + ", sha256 required")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(checksum) != 32 {
+		return nil, errors.New("bad " + uploadChecksumHeader + " digest")
+	}
+	return checksum, nil
+}
+
+// sendUploadError reports a failed upload request, errors of the vault are
+// reported as by sendUpdateError
+func sendUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, postgres.ErrUploadNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, postgres.ErrUploadOffset), errors.Is(err, postgres.ErrUploadIncomplete):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusConflict, err, err.Error())
+	case errors.Is(err, postgres.ErrUploadInvalid):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	case errors.Is(err, postgres.ErrUploadChecksum):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusUnprocessableEntity, err, err.Error())
+	default:
+		sendUpdateError(w, r, err)
+	}
+}
@@ -1,27 +1,49 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest"
 
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
 	postgres "github.com/stsg/gophkeeper/pkg/store"
 )
 
+// encryptionHeader marks raw blob bodies encrypted by the client, see package envelope
+const (
+	encryptionHeader   = "X-Encryption"
+	encryptionEnvelope = "envelope"
+)
+
 // VaultRoute returns an http.Handler that handles the routing for the vault API.
 //
 // It mounts the "/piece" and "/blob" routes to their respective handlers,
+// the typed secret routes "/credentials", "/text", "/card" and "/binary",
 // and defines GET and DELETE routes for "/" and "/{rid}" respectively.
+// GET "/changes" returns the change feed used by the client sync,
+// GET "/{rid}/versions" lists kept revisions of a resource and
+// POST "/{rid}/versions/{version}/restore" restores one of them.
+// GET "/shared" lists resources shared with the user, "/{rid}/grants"
+// lists, grants and revokes access of other users. GET "/export" and
+// POST "/import" move the whole vault as an encrypted archive.
+// "/uploads" stores large blobs in resumable chunks, see VaultUploadRoute.
 // The handlers for these routes are defined in the VaultPieceRoute, VaultBlobRoute,
-// VaultList, and VaultDelete methods of the Rest struct.
+// VaultUploadRoute, VaultList, VaultChanges, VaultShared, VaultDelete, VaultVersions,
+// VaultRestoreVersion, VaultGrants, VaultGrant and VaultRevoke methods of the
+// Rest struct.
 //
 // Returns:
 // - http.Handler: The router that handles the vault API routing.
@@ -29,8 +51,30 @@ func (s *Rest) VaultRoute() http.Handler {
 	router := chi.NewRouter()
 	router.Mount("/piece", s.VaultPieceRoute())
 	router.Mount("/blob", s.VaultBlobRoute())
+	for _, kind := range secret.Kinds {
+		router.Mount("/"+string(kind), s.VaultSecretRoute(kind))
+	}
+	router.Mount("/"+string(secret.KindBinary), s.VaultBlobRoute())
+	router.Mount("/uploads", s.VaultUploadRoute())
 	router.Get("/", s.VaultList)
+	router.Get("/changes", s.VaultChanges)
+	router.Get("/shared", s.VaultShared)
+	router.Get("/export", s.VaultExport)
+	router.Post("/import", s.VaultImport)
+	router.Get("/folders", s.VaultFolders)
+	router.Post("/folders", s.VaultFolderCreate)
+	router.Patch("/folders/{folder}", s.VaultFolderUpdate)
+	router.Delete("/folders/{folder}", s.VaultFolderDelete)
 	router.Delete("/{rid}", s.VaultDelete)
+	router.Get("/{rid}/versions", s.VaultVersions)
+	router.Post("/{rid}/versions/{version}/restore", s.VaultRestoreVersion)
+	router.Get("/{rid}/grants", s.VaultGrants)
+	router.Put("/{rid}/grants/{grantee}", s.VaultGrant)
+	router.Delete("/{rid}/grants/{grantee}", s.VaultRevoke)
+	router.Put("/{rid}/folder", s.VaultMove)
+	router.Put("/{rid}/tags/{tag}", s.VaultTag)
+	router.Delete("/{rid}/tags/{tag}", s.VaultTag)
+	router.Put("/{rid}/details", s.VaultDetails)
 	return router
 }
 
@@ -40,68 +84,109 @@ func (s *Rest) VaultRoute() http.Handler {
 // The function retrieves the credentials from the store using the token.
 // If the credentials are not found or there is an error, it returns an appropriate HTTP error response.
 //
-// The function then retrieves the list of resources from the store using the credentials.
-// If there is an error, it returns an HTTP internal server error response.
-//
-// The function constructs the response by creating a slice of postgres.Resource structs,
-// with each struct containing the ID, meta, and type of a resource from the list.
+// The query parameters select the resources: "type" (piece or blob), "kind",
+// "team" (zero for the vault of the user), "folder" (zero for the root),
+// repeated "tag", "q" searching titles and meta, "sort" (id, name, created or
+// updated, prefixed with "-" for the descending order), "limit" and "cursor".
+// Invalid parameters return 400.
 //
-// Finally, the function writes the response as JSON to the HTTP response writer with a status code of 200.
-// If there is an error encoding the response, it logs an error message.
+// The response holds a page of the resources with their team, folder, tags
+// and details. The "X-Next-Cursor" header holds the cursor of the next page
+// and is absent on the last page.
 func (s *Rest) VaultList(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] reqID %s VaultListHook", reqID)
 
-	// TODO: add auth as middleware
-	// https://github.com/stsg/gophkeeper/pull/1#discussion_r1618437264
-	token := r.Header.Get("Authorization")
-	creds, err := s.Store.Identity(r.Context(), token)
+	creds, err := s.requestCreds(r)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
-	resources, err := s.Store.List(r.Context(), creds)
+	query, err := listQuery(r)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
 		return
 	}
 
-	var response []postgres.Resource
-
-	for _, resource := range resources {
-		response = append(
-			response,
-			postgres.Resource{
-				ID:   resource.ID,
-				Meta: resource.Meta,
-				Type: resource.Type,
-			},
-		)
+	page, err := s.Store.List(r.Context(), query, creds)
+	if err != nil {
+		if errors.Is(err, postgres.ErrQueryInvalid) {
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+			return
+		}
+		log.Printf("[ERROR] failed to list resources: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
+	if page.Next != "" {
+		w.Header().Set("X-Next-Cursor", page.Next)
+	}
+	var resources = page.Resources
+	if resources == nil {
+		resources = []postgres.Resource{}
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&response); err != nil {
+	if err := json.NewEncoder(w).Encode(&resources); err != nil {
 		log.Printf("[ERROR] failed to write response: %s\n", err.Error())
 	}
 }
 
+// listQuery parses the query parameters of VaultList
+func listQuery(r *http.Request) (postgres.ListQuery, error) {
+	var (
+		values = r.URL.Query()
+		query  = postgres.ListQuery{
+			Kind:   (secret.Kind)(values.Get("kind")),
+			Tags:   values["tag"],
+			Search: values.Get("q"),
+			Cursor: values.Get("cursor"),
+		}
+		err error
+	)
+	switch values.Get("type") {
+	case "":
+	case "piece":
+		query.Type = postgres.ResourceTypePiece
+	case "blob":
+		query.Type = postgres.ResourceTypeBlob
+	default:
+		return query, errors.New("bad type")
+	}
+	if values.Has("team") {
+		team, err := strconv.ParseInt(values.Get("team"), 10, 64)
+		if err != nil || team < 0 {
+			return query, errors.New("bad team")
+		}
+		query.Team = (*postgres.TeamID)(&team)
+	}
+	if values.Has("folder") {
+		folder, err := strconv.ParseInt(values.Get("folder"), 10, 64)
+		if err != nil || folder < 0 {
+			return query, errors.New("bad folder")
+		}
+		query.Folder = (*postgres.FolderID)(&folder)
+	}
+	if values.Has("limit") {
+		if query.Limit, err = strconv.Atoi(values.Get("limit")); err != nil || query.Limit <= 0 {
+			return query, errors.New("bad limit")
+		}
+	}
+	if query.Sort, query.Desc, err = postgres.ParseListSort(values.Get("sort")); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
 func (s *Rest) VaultDelete(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] reqID %s VaultDeleteHook", reqID)
 
-	token := r.Header.Get("Authorization")
-	creds, err := s.Store.Identity(r.Context(), token)
+	creds, err := s.requestCreds(r)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -111,22 +196,92 @@ func (s *Rest) VaultDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.Store.Delete(r.Context(), postgres.ResourceID(rid), creds); err != nil {
-		if errors.Is(err, postgres.ErrResourceNotFound) {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Store.DeleteVersion(r.Context(), postgres.ResourceID(rid), version, creds); err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// VaultChanges handles the HTTP GET request for the vault changes after the
+// version given in the "since" query parameter, zero or absent since returns
+// the whole vault. The response holds changed resources, tombstones of
+// deleted ones and the cursor to pass as since next time.
+func (s *Rest) VaultChanges(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultChangesHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil || since < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+	}
+
+	changes, err := s.Store.Changes(r.Context(), since, creds)
+	if err != nil {
+		log.Printf("[ERROR] reqID %s failed to get changes: %s", reqID, err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(&changes); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
+
+// ifMatchVersion returns the resource version from the If-Match header,
+// versions are sent as quoted ETags. Zero means the header is absent.
+func ifMatchVersion(r *http.Request) (int64, error) {
+	value := r.Header.Get("If-Match")
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errors.New("bad If-Match version")
+	}
+	return version, nil
+}
+
+// pieceUpdateRequest is a body of the piece update, PATCH keeps absent fields
+type pieceUpdateRequest struct {
+	Content []byte
+	Meta    *string
+	Opaque  bool
+}
+
+// quotaErrorResponse is the body of a write exceeding a quota
+type quotaErrorResponse struct {
+	Error string `json:"error"`
+	Quota string `json:"quota,omitempty"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`
+	Org   int64  `json:"org,omitempty"`
 }
 
 func (s *Rest) VaultPieceRoute() http.Handler {
 	router := chi.NewRouter()
 	router.Put("/", s.VaultPieceEncrypt)
 	router.Get("/{rid}", s.VaultPieceDecrypt)
+	router.Put("/{rid}", s.VaultPieceUpdate)
+	router.Patch("/{rid}", s.VaultPieceUpdate)
 	return router
 }
 
@@ -134,14 +289,9 @@ func (s *Rest) VaultPieceEncrypt(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] reqID %s VaultDeleteHook", reqID)
 
-	token := r.Header.Get("Authorization")
-	creds, err := s.Store.Identity(r.Context(), token)
+	creds, err := s.requestCreds(r)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -150,24 +300,32 @@ func (s *Rest) VaultPieceEncrypt(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	var content = make([]byte, len(piece.Content))
-	if _, err := base64.RawStdEncoding.Decode(content, ([]byte)(piece.Content)); err != nil {
-		var status = http.StatusBadRequest
-		http.Error(w, http.StatusText(status), status)
-		return
-	}
-
-	password := r.Header.Get("X-Password")
-	if password == "" {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if piece.Team, err = requestTeam(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	rid, err := s.Store.StorePiece(r.Context(), piece, creds)
 	if err != nil {
+		if errors.Is(err, envelope.ErrMalformed) || errors.Is(err, envelope.ErrUnsupported) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if errors.Is(err, postgres.ErrUserUnauthorized) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
+		if errors.Is(err, postgres.ErrTeamNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, postgres.ErrPermissionDenied) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, postgres.ErrQuotaExceeded) || errors.Is(err, postgres.ErrBlobTooLarge) {
+			sendQuotaError(w, r, err)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -186,19 +344,8 @@ func (s *Rest) VaultPieceDecrypt(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] reqID %s VaultPieceDecryptHook", reqID)
 
-	token := r.Header.Get("Authorization")
-	creds, err := s.Store.Identity(r.Context(), token)
+	creds, err := s.requestCreds(r)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-
-	creds.Passw = r.Header.Get("X-Password")
-	if creds.Passw == "" {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -211,23 +358,16 @@ func (s *Rest) VaultPieceDecrypt(w http.ResponseWriter, r *http.Request) {
 
 	piece, err := s.Store.RestorePiece(r.Context(), (postgres.ResourceID)(rid), creds)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		sendReadError(w, r, err)
 		return
 	}
 
 	var response postgres.Piece
 	response.Meta = piece.Meta
-	response.Content = []byte(base64.RawStdEncoding.EncodeToString(
-		bytes.ReplaceAll(
-			piece.Content,
-			[]byte{'\x00'},
-			[]byte{},
-		),
-	))
+	response.Content = piece.Content
+	response.Opaque = piece.Opaque
+	response.Version = piece.Version
+	w.Header().Set("ETag", etag(piece.Version))
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("[ERROR] failed to write response: %s", err.Error())
@@ -238,27 +378,58 @@ func (s *Rest) VaultBlobRoute() http.Handler {
 	router := chi.NewRouter()
 	router.Put("/", s.VaultBLobEncrypt)
 	router.Get("/{rid}", s.VaultBLobDecrypt)
+	router.Put("/{rid}", s.VaultBlobUpdate)
+	router.Patch("/{rid}", s.VaultBlobUpdate)
 	return router
 }
 
+// VaultBLobEncrypt handles the HTTP PUT request storing the body as a new
+// blob. The Content-Type header and the filename of the Content-Disposition
+// header are recorded with the blob and returned on download. A blob
+// exceeding the quota of the vault is rejected as by sendQuotaError.
 func (s *Rest) VaultBLobEncrypt(w http.ResponseWriter, r *http.Request) {
-	var creds postgres.Creds
-	creds.Passw = r.Header.Get("X-Password")
-	if creds.Passw == "" {
+	creds, err := s.requestCreds(r)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
+	team, err := requestTeam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType, filename := blobFile(r)
 	blob := postgres.Blob{
-		Meta:    r.Header.Get("X-Meta"),
-		Content: r.Body,
+		Meta:        r.Header.Get("X-Meta"),
+		Content:     r.Body,
+		Opaque:      r.Header.Get(encryptionHeader) == encryptionEnvelope,
+		Team:        team,
+		ContentType: contentType,
+		Filename:    filename,
 	}
 	rid, err := s.Store.StoreBlob(r.Context(), blob, creds)
 	if err != nil {
+		if errors.Is(err, envelope.ErrMalformed) || errors.Is(err, envelope.ErrUnsupported) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if errors.Is(err, postgres.ErrUserUnauthorized) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
+		if errors.Is(err, postgres.ErrTeamNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, postgres.ErrPermissionDenied) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, postgres.ErrQuotaExceeded) || errors.Is(err, postgres.ErrBlobTooLarge) {
+			sendQuotaError(w, r, err)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -273,15 +444,17 @@ func (s *Rest) VaultBLobEncrypt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// VaultBLobDecrypt handles the HTTP GET request returning the content of
+// the blob. Ranges are supported, "If-Range" with the ETag of the blob
+// resumes an interrupted download unless the blob changed meanwhile. The
+// "Digest" header is the SHA-256 of the whole content, blobs stored before
+// digests were recorded have none. A blob whose size does not match is
+// reported with 500 instead of being sent, one whose digest does not is
+// cut short as by serveBlob.
 func (s *Rest) VaultBLobDecrypt(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-	creds, err := s.Store.Identity(r.Context(), token)
+	creds, err := s.requestCreds(r)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
@@ -291,33 +464,276 @@ func (s *Rest) VaultBLobDecrypt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	creds.Passw = r.Header.Get("X-Password")
-	if creds.Passw == "" {
+	blob, err := s.Store.RestoreBlob(r.Context(), (postgres.ResourceID)(rid), creds)
+	if err != nil {
+		sendReadError(w, r, err)
+		return
+	}
+	defer blob.Content.Close()
+
+	// the content of opaque blobs is the envelope, not the recorded type
+	contentType := blob.ContentType
+	if contentType == "" || blob.Opaque {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if blob.Filename != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": blob.Filename})
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Meta", blob.Meta)
+	w.Header().Set("ETag", etag(blob.Version))
+	if blob.Digest != nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(blob.Digest))
+	}
+	if blob.Opaque {
+		w.Header().Set(encryptionHeader, encryptionEnvelope)
+	}
+	serveBlob(w, r, blob.Content.(io.ReadSeeker))
+}
+
+// serveBlob sends the content as by http.ServeContent, which answers Range
+// and If-Range requests reading the segments of the ranges only. The
+// digest of the whole content is checked while streaming, the last read
+// fails on a mismatch before its bytes are sent. The response is cut
+// short then, the client sees fewer bytes than the Content-Length
+// announced and the connection closed. Tampered segments of ranges fail
+// the same way.
+func serveBlob(w http.ResponseWriter, r *http.Request, content io.ReadSeeker) {
+	reader := &failedReader{ReadSeeker: content}
+	http.ServeContent(w, r, "", time.Time{}, reader)
+	if reader.err != nil {
+		log.Printf("[ERROR] reqID %s blob download aborted: %s", middleware.GetReqID(r.Context()), reader.err.Error())
+	}
+}
+
+// failedReader keeps the error of the content other than io.EOF
+type failedReader struct {
+	io.ReadSeeker
+	err error
+}
+
+func (fr *failedReader) Read(p []byte) (int, error) {
+	n, err := fr.ReadSeeker.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		fr.err = err
+	}
+	return n, err
+}
+
+// VaultPieceUpdate handles PUT and PATCH requests changing the piece in
+// place. PUT replaces both content and meta, PATCH changes the fields
+// present in the body. The write is rejected with 412 if the If-Match
+// version is stale, the new version is returned in the ETag header.
+func (s *Rest) VaultPieceUpdate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultPieceUpdateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	blob, err := s.Store.RestoreBlob(r.Context(), (postgres.ResourceID)(rid), creds)
+	var request pieceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPut && (request.Content == nil || request.Meta == nil) {
+		http.Error(w, "content and meta required", http.StatusBadRequest)
+		return
+	}
+
+	newVersion, err := s.Store.UpdatePiece(
+		r.Context(),
+		(postgres.ResourceID)(rid),
+		version,
+		postgres.PieceUpdate{Meta: request.Meta, Content: request.Content, Opaque: request.Opaque},
+		creds,
+	)
 	if err != nil {
-		if errors.Is(err, postgres.ErrUserUnauthorized) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), newVersion)
+}
+
+// VaultBlobUpdate handles PUT and PATCH requests changing the blob in place.
+// The request body is the new content and the X-Meta header is the new meta.
+// PUT replaces both, PATCH changes the content if the body is not empty and
+// the meta if the header is present. Content type and filename are taken as
+// in VaultBLobEncrypt, those absent are kept. Versions are checked as in
+// VaultPieceUpdate.
+func (s *Rest) VaultBlobUpdate(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	log.Printf("[INFO] reqID %s VaultBlobUpdateHook", reqID)
+
+	creds, err := s.requestCreds(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	rid, err := strconv.Atoi(chi.URLParam(r, "rid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	update := postgres.BlobUpdate{Opaque: r.Header.Get(encryptionHeader) == encryptionEnvelope}
+	if r.Method == http.MethodPut || r.ContentLength != 0 {
+		update.Content = r.Body
+	}
+	if values := r.Header.Values("X-Meta"); r.Method == http.MethodPut || len(values) > 0 {
+		meta := r.Header.Get("X-Meta")
+		update.Meta = &meta
+	}
+	if update.Content != nil {
+		update.ContentType, update.Filename = blobFile(r)
+	}
+
+	newVersion, err := s.Store.UpdateBlob(r.Context(), (postgres.ResourceID)(rid), version, update, creds)
+	if err != nil {
+		sendUpdateError(w, r, err)
+		return
+	}
+	sendVersion(w, (postgres.ResourceID)(rid), newVersion)
+}
+
+// blobFile returns the content type and the filename of the blob in the
+// request, the filename of the Content-Disposition header is stripped of
+// its directories
+func blobFile(r *http.Request) (contentType, filename string) {
+	if value := r.Header.Get("Content-Type"); value != "" {
+		if mediaType, params, err := mime.ParseMediaType(value); err == nil {
+			contentType = mime.FormatMediaType(mediaType, params)
 		}
+	}
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		filename = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+		if filename == "." || filename == "/" {
+			filename = ""
+		}
+	}
+	return contentType, filename
+}
+
+// sendUpdateError reports a failed update or delete of a resource or of
+// its organisation in folders
+// sendReadError reports a failed read of a piece or a blob, corrupted blobs
+// with 500 and the error in the body
+func sendReadError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, postgres.ErrUserUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, postgres.ErrResourceNotFound), errors.Is(err, postgres.ErrTeamNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, postgres.ErrPermissionDenied):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, postgres.ErrBlobCorrupted):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, err.Error())
+	default:
+		log.Printf("[ERROR] failed to read resource: %s", err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
 	}
-	defer blob.Content.Close()
+}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment")
-	w.Header().Set("X-Meta", blob.Meta)
-	w.WriteHeader(http.StatusOK)
+func sendUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, secret.ErrInvalid), errors.Is(err, envelope.ErrMalformed), errors.Is(err, envelope.ErrUnsupported),
+		errors.Is(err, postgres.ErrFolderInvalid), errors.Is(err, postgres.ErrTagInvalid), errors.Is(err, postgres.ErrDetailsInvalid):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	case errors.Is(err, postgres.ErrUserUnauthorized):
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case errors.Is(err, postgres.ErrResourceNotFound), errors.Is(err, postgres.ErrSecretKindMismatch),
+		errors.Is(err, postgres.ErrFolderNotFound), errors.Is(err, postgres.ErrTeamNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, postgres.ErrFolderExists), errors.Is(err, postgres.ErrFolderNotEmpty):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case errors.Is(err, postgres.ErrVersionMismatch):
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+	case errors.Is(err, postgres.ErrPermissionDenied):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, postgres.ErrGrantInvalid):
+		rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, err.Error())
+	case errors.Is(err, postgres.ErrGrantStale):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case errors.Is(err, postgres.ErrQuotaExceeded), errors.Is(err, postgres.ErrBlobTooLarge):
+		sendQuotaError(w, r, err)
+	default:
+		log.Printf("[ERROR] failed to update resource: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// sendQuotaError reports a write exceeding a quota of the vault, 413 for a
+// blob exceeding the size of a blob and 507 otherwise, the body is
+// {"error", "quota", "limit", "used", "org"} with the quota of the error
+func sendQuotaError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInsufficientStorage
+	if errors.Is(err, postgres.ErrBlobTooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	response := quotaErrorResponse{Error: err.Error()}
+	var quotaErr *postgres.QuotaError
+	if errors.As(err, &quotaErr) {
+		response.Quota = quotaErr.Quota
+		response.Limit = quotaErr.Limit
+		response.Used = quotaErr.Used
+		response.Org = (int64)(quotaErr.Org)
+	}
+	log.Printf("[WARN] reqID %s %s", middleware.GetReqID(r.Context()), err.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
+	}
+}
 
-	output := bufio.NewWriter(w)
-	if _, err := output.ReadFrom(blob.Content); err != nil {
-		log.Printf("[ERROR] failed to write content: %s", err.Error())
+// sendVersion responds with the new version of the changed resource
+func sendVersion(w http.ResponseWriter, rid postgres.ResourceID, version int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusOK)
+	var response struct {
+		RID     int64 `json:"rid"`
+		Version int64 `json:"version"`
+	}
+	response.RID = (int64)(rid)
+	response.Version = version
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		log.Printf("[ERROR] failed to write response: %s", err.Error())
 	}
-	if err := output.Flush(); err != nil {
-		log.Printf("[ERROR] failed to flush content: %s", err.Error())
+}
+
+// etag formats the resource version as an entity tag, see ifMatchVersion
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// requestCreds returns the credentials of the session set by AuthRequired
+func (s *Rest) requestCreds(r *http.Request) (postgres.Creds, error) {
+	creds, ok := r.Context().Value(credsKey{}).(postgres.Creds)
+	if !ok {
+		return postgres.Creds{}, postgres.ErrUserUnauthorized
 	}
+	return creds, nil
 }
@@ -0,0 +1,132 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// queryRower is a pool or a transaction
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// access of the user to a resource, either of the vault of the owner or of
+// the vault of the team
+type access struct {
+	owner      string     // owner of a personal resource
+	team       TeamID     // team of a team resource
+	permission Permission // permission of the user
+}
+
+// resourceAccess evaluates the access of the user to the resource: owners
+// write their resources, grantees have the permission of the grant and
+// team members the permission of their role. ErrResourceNotFound is
+// returned without access.
+func resourceAccess(ctx context.Context, q queryRower, rid ResourceID, c Creds) (access, error) {
+	var (
+		a     access
+		grant *Permission
+		role  *Role
+	)
+	if err := q.QueryRow(
+		ctx,
+		`SELECT COALESCE(r.owner, ''), COALESCE(r.team_id, 0), g.permission, o.role FROM resources r
+		LEFT JOIN resource_grants g ON g.rid = r.id AND g.grantee = $2
+		LEFT JOIN team_members m ON m.team_id = r.team_id AND m.login = $2
+		LEFT JOIN teams t ON t.id = m.team_id
+		LEFT JOIN org_members o ON o.org_id = t.org_id AND o.login = m.login
+		WHERE r.id = $1`,
+		(int64)(rid), c.Login,
+	).Scan(&a.owner, &a.team, &grant, &role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return access{}, ErrResourceNotFound
+		}
+		return access{}, err
+	}
+	switch {
+	case a.team == 0 && a.owner == c.Login:
+		a.permission = PermissionWrite
+	case a.team != 0 && role != nil:
+		a.permission = role.permission()
+	case a.team == 0 && grant != nil:
+		a.permission = *grant
+	default:
+		return access{}, ErrResourceNotFound
+	}
+	return a, nil
+}
+
+// vaultAccess evaluates the access of the user to the vault of the team,
+// or to the own vault for zero team
+func vaultAccess(ctx context.Context, q queryRower, team TeamID, c Creds) (access, error) {
+	if team == 0 {
+		return access{owner: c.Login, permission: PermissionWrite}, nil
+	}
+	var role Role
+	if err := q.QueryRow(
+		ctx,
+		`SELECT o.role FROM team_members m
+		JOIN teams t ON t.id = m.team_id
+		JOIN org_members o ON o.org_id = t.org_id AND o.login = m.login
+		WHERE m.team_id = $1 AND m.login = $2`,
+		team, c.Login,
+	).Scan(&role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return access{}, ErrTeamNotFound
+		}
+		return access{}, err
+	}
+	return access{team: team, permission: role.permission()}, nil
+}
+
+// writable returns ErrPermissionDenied unless the user may change the resource
+func (a access) writable() error {
+	if a.permission != PermissionWrite {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// granted tells if the access is given by a grant of the owner
+func (a access) granted(c Creds) bool {
+	return a.team == 0 && a.owner != c.Login
+}
+
+// lockKey is the lockOwner key of the vault of the resource
+func (a access) lockKey() string {
+	if a.team != 0 {
+		return teamLock(a.team)
+	}
+	return a.owner
+}
+
+// readKey returns the key of the resource content for the access
+func (p *Storage) readKey(ctx context.Context, rid ResourceID, a access, wrapped []byte, keyID *string, salt []byte, c Creds) ([]byte, error) {
+	switch {
+	case a.team != 0:
+		var teamKey, keyError = p.teamKey(ctx, a.team, c)
+		if keyError != nil {
+			return nil, keyError
+		}
+		var teamWrapped, masterError = p.Master.unwrap(wrapped, keyID)
+		if masterError != nil {
+			return nil, masterError
+		}
+		return unwrapKey(teamKey, teamWrapped)
+	case a.granted(c):
+		return p.grantKey(ctx, rid, c)
+	default:
+		return p.resourceKey(ctx, wrapped, keyID, salt, c)
+	}
+}
+
+// vaultKey returns the key wrapping new resource keys of the vault, the
+// data key of the user or the team key
+func (p *Storage) vaultKey(ctx context.Context, a access, c Creds) ([]byte, error) {
+	if a.team != 0 {
+		return p.teamKey(ctx, a.team, c)
+	}
+	return p.userKey(ctx, c)
+}
@@ -0,0 +1,462 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/blobstore"
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/stream"
+)
+
+// BlobBackend keeps encrypted blob contents by key, the blob location
+// stored in the database is the key. Implementations are in blobstore.
+type BlobBackend interface {
+	// Put stores the content under the key and returns its size.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the content, blobstore.ErrNotFound is returned if missing.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetFrom opens the content from the offset to its end.
+	GetFrom(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Delete removes the content, a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat describes the content, blobstore.ErrNotFound is returned if missing.
+	Stat(ctx context.Context, key string) (blobstore.Info, error)
+	// List calls fn for every content until it returns an error.
+	List(ctx context.Context, fn func(blobstore.Info) error) error
+}
+
+// blobFormat is the encryption of a blob content done by the server
+type blobFormat int16
+
+const (
+	// blobFormatCTR is AES-CTR without authentication, only read and
+	// rewritten as blobFormatAEAD on the first read.
+	blobFormatCTR blobFormat = iota
+	// blobFormatAEAD is the chunked AES-GCM stream of package stream, the iv
+	// is its nonce prefix and the location is authenticated with every segment.
+	blobFormatAEAD
+)
+
+var (
+	// ErrBlobCorrupted is returned when the content of a blob does not match
+	// its size or digest
+	ErrBlobCorrupted = fmt.Errorf("blob corrupted")
+)
+
+// storedBlob is a row of the blobs table
+type storedBlob struct {
+	id          int
+	location    string
+	salt        []byte
+	iv          []byte
+	wrappedKey  []byte
+	keyID       *string
+	opaque      bool
+	format      blobFormat
+	size        *int64 // size of the plaintext, nil if unknown
+	digest      []byte // SHA-256 of the plaintext sealed by the key, plain for opaque content
+	contentType string
+	filename    string
+}
+
+func (p *Storage) selectBlob(ctx context.Context, id int) (storedBlob, error) {
+	var b = storedBlob{id: id}
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT location, salt, iv, wrapped_key, key_id, opaque, format, size, digest, content_type, filename FROM blobs WHERE id = $1`,
+		id,
+	).Scan(&b.location, &b.salt, &b.iv, &b.wrappedKey, &b.keyID, &b.opaque, &b.format, &b.size, &b.digest, &b.contentType, &b.filename); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storedBlob{}, ErrResourceNotFound
+		}
+		return storedBlob{}, err
+	}
+	return b, nil
+}
+
+// writeBlob encrypts the blob content with a new key wrapped by the data
+// key into a new blob of the backend. Opaque content is encrypted by the
+// client and written as is after checking it starts with an envelope
+// header, no data key is needed then. The content is streamed, only one
+// segment is kept in memory.
+func (p *Storage) writeBlob(ctx context.Context, content io.Reader, opaque bool, dek []byte) (storedBlob, error) {
+	var (
+		b   = storedBlob{location: uuid.New().String(), opaque: opaque, format: blobFormatAEAD}
+		key []byte
+	)
+	if !opaque {
+		var err error
+		if key, b.wrappedKey, b.keyID, err = p.newResourceKey(dek); err != nil {
+			return storedBlob{}, err
+		}
+	}
+	return p.putBlob(ctx, b, content, key)
+}
+
+// writeSharedBlob encrypts new blob content of a grantee with the key of
+// the resource into a new blob, the wrapped key of the resource is kept.
+func (p *Storage) writeSharedBlob(ctx context.Context, content io.Reader, key []byte) (storedBlob, error) {
+	return p.putBlob(ctx, storedBlob{location: uuid.New().String(), format: blobFormatAEAD}, content, key)
+}
+
+// putBlob writes the content of the new blob to the backend, encrypted with
+// the key unless opaque, and sets its size and digest
+func (p *Storage) putBlob(ctx context.Context, b storedBlob, content io.Reader, key []byte) (storedBlob, error) {
+	var (
+		buffered = bufio.NewReader(content)
+		reader   = &digestReader{r: buffered, hash: sha256.New()}
+		source   io.Reader
+	)
+	if b.opaque {
+		var header, peekError = buffered.Peek(envelope.MaxHeaderSize)
+		if peekError != nil {
+			return storedBlob{}, envelope.ErrMalformed
+		}
+		if _, err := envelope.ParseHeader(header); err != nil {
+			return storedBlob{}, err
+		}
+		source = reader
+	} else {
+		b.iv = make([]byte, stream.NoncePrefixSize)
+		if _, err := rand.Read(b.iv); err != nil {
+			return storedBlob{}, err
+		}
+		var aead, aeadError = stream.NewAEAD(key)
+		if aeadError != nil {
+			return storedBlob{}, aeadError
+		}
+
+		var pipeReader, pipeWriter = io.Pipe()
+		defer pipeReader.Close() // stops the encryption if Put fails early
+		go func() {
+			var sw, err = stream.NewWriter(pipeWriter, aead, b.iv, []byte(b.location))
+			if err == nil {
+				if _, err = io.Copy(sw, reader); err == nil {
+					err = sw.Close()
+				}
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+		source = pipeReader
+	}
+
+	if _, err := p.Blobs.Put(ctx, b.location, source); err != nil {
+		log.Printf("failed to write blob: %s\n", err.Error())
+		// the backend may keep a partial upload
+		if err := p.Blobs.Delete(ctx, b.location); err != nil {
+			log.Printf("failed to remove blob: %s\n", err.Error())
+		}
+		return storedBlob{}, err
+	}
+	var digestError error
+	if b.size, b.digest, digestError = reader.sum(key); digestError != nil {
+		p.removeBlobs(ctx, []string{b.location})
+		return storedBlob{}, digestError
+	}
+	return b, nil
+}
+
+// digestReader counts and hashes the content read
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	var n, err = dr.r.Read(p)
+	dr.hash.Write(p[:n])
+	dr.n += int64(n)
+	return n, err
+}
+
+// sum returns the size and the digest of the content read, the digest is
+// sealed by the key of the blob unless nil
+func (dr *digestReader) sum(key []byte) (*int64, []byte, error) {
+	var size, digest = dr.n, dr.hash.Sum(nil)
+	if key == nil {
+		return &size, digest, nil
+	}
+	var sealed, err = wrapKey(key, digest)
+	return &size, sealed, err
+}
+
+// openBlob returns the content of the blob decrypted with the key and its
+// size. The content is seekable, reading from an offset fetches the
+// content of the backend from the segment holding the offset only. Reading
+// a tampered or truncated AEAD blob fails with stream.ErrAuth or
+// stream.ErrTruncated. Content of another size than recorded fails with
+// ErrBlobCorrupted, as does the last read of content read from the start
+// if it does not match the digest.
+func (p *Storage) openBlob(ctx context.Context, b storedBlob, key []byte) (*blobReader, int64, error) {
+	var reader, readerError = p.blobReader(ctx, b, key)
+	if readerError != nil {
+		return nil, 0, readerError
+	}
+	if b.size != nil && *b.size != reader.size {
+		log.Printf("blob %s of %d bytes, %d expected\n", b.location, reader.size, *b.size)
+		return nil, 0, ErrBlobCorrupted
+	}
+	if b.digest != nil {
+		var digest = b.digest
+		if !b.opaque {
+			var err error
+			if digest, err = unwrapKey(key, b.digest); err != nil {
+				return nil, 0, err
+			}
+		}
+		reader.digest, reader.hash = digest, sha256.New()
+	}
+	reader.location = b.location
+	return reader, reader.size, nil
+}
+
+// blobReader returns the reader of the content of the blob
+func (p *Storage) blobReader(ctx context.Context, b storedBlob, key []byte) (*blobReader, error) {
+	var info, statError = p.Blobs.Stat(ctx, b.location)
+	if statError != nil {
+		return nil, statError
+	}
+	if b.opaque {
+		return &blobReader{size: info.Size, open: func(offset int64) (io.ReadCloser, error) {
+			return p.Blobs.GetFrom(ctx, b.location, offset)
+		}}, nil
+	}
+
+	if b.format == blobFormatCTR {
+		var block, blockError = aes.NewCipher(key)
+		if blockError != nil {
+			return nil, blockError
+		}
+		return &blobReader{size: info.Size, open: func(offset int64) (io.ReadCloser, error) {
+			var file, err = p.Blobs.GetFrom(ctx, b.location, offset-offset%aes.BlockSize)
+			if err != nil {
+				return nil, err
+			}
+			var reader = cipher.StreamReader{S: cipher.NewCTR(block, ctrCounter(b.iv, offset/aes.BlockSize)), R: file}
+			if _, err := io.CopyN(io.Discard, reader, offset%aes.BlockSize); err != nil {
+				file.Close()
+				return nil, err
+			}
+			return &ComposedReadCloser{Reader: reader, Closer: file}, nil
+		}}, nil
+	}
+
+	var aead, aeadError = stream.NewAEAD(key)
+	if aeadError != nil {
+		return nil, aeadError
+	}
+	var size = stream.PlaintextSize(info.Size, aead.Overhead())
+	return &blobReader{size: size, open: func(offset int64) (io.ReadCloser, error) {
+		var file, err = p.Blobs.GetFrom(ctx, b.location, stream.SealedOffset(offset, aead.Overhead()))
+		if err != nil {
+			return nil, err
+		}
+		var reader, readerError = stream.NewReaderAt(file, aead, b.iv, []byte(b.location), offset)
+		if readerError != nil {
+			file.Close()
+			return nil, readerError
+		}
+		return &ComposedReadCloser{Reader: reader, Closer: file}, nil
+	}}, nil
+}
+
+// blobReader reads the content of a blob of the size from any offset. The
+// content is opened at the offset on the first read after a seek. With the
+// digest the content read from the start is hashed, the read reaching the
+// size fails unless the hash matches.
+type blobReader struct {
+	open     func(offset int64) (io.ReadCloser, error)
+	size     int64
+	offset   int64
+	reader   io.ReadCloser
+	location string
+	digest   []byte
+	hash     hash.Hash
+	hashed   int64 // hashed is the length of the content hashed from the start
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	if br.reader == nil {
+		if br.offset >= br.size && br.offset > 0 {
+			// an empty blob is still opened, its final segment is checked
+			return 0, io.EOF
+		}
+		var reader, err = br.open(br.offset)
+		if err != nil {
+			return 0, err
+		}
+		br.reader = reader
+	}
+	var n, err = br.reader.Read(p)
+	if br.hash != nil && br.offset == br.hashed {
+		br.hash.Write(p[:n])
+		br.hashed += int64(n)
+		if n > 0 && br.hashed == br.size && !bytes.Equal(br.hash.Sum(nil), br.digest) {
+			log.Printf("blob %s does not match its digest\n", br.location)
+			return 0, ErrBlobCorrupted
+		}
+	}
+	br.offset += int64(n)
+	return n, err
+}
+
+func (br *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative blob offset")
+	}
+	if offset != br.offset && br.reader != nil {
+		br.reader.Close()
+		br.reader = nil
+	}
+	br.offset = offset
+	return offset, nil
+}
+
+func (br *blobReader) Close() error {
+	if br.reader == nil {
+		return nil
+	}
+	return br.reader.Close()
+}
+
+// ctrCounter returns the AES-CTR counter of the block, the iv is the counter
+// of the first block
+func ctrCounter(iv []byte, block int64) []byte {
+	var counter = bytes.Clone(iv)
+	var carry = uint64(block)
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		var sum = uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return counter
+}
+
+// upgradeBlob rewrites the AES-CTR blob in the AEAD format. The blob row
+// is switched to the new content only if nobody changed it meanwhile, the
+// old content is removed unless a revision still refers to it.
+func (p *Storage) upgradeBlob(ctx context.Context, b storedBlob, c Creds) error {
+	var key, keyError = p.resourceKey(ctx, b.wrappedKey, b.keyID, b.salt, c)
+	if keyError != nil {
+		return keyError
+	}
+	var dek, dekError = p.userKey(ctx, c)
+	if dekError != nil {
+		return dekError
+	}
+	var content, _, openError = p.openBlob(ctx, b, key)
+	if openError != nil {
+		return openError
+	}
+	var upgraded, writeError = p.writeBlob(ctx, content, false, dek)
+	content.Close()
+	if writeError != nil {
+		return writeError
+	}
+
+	// removed on any failure below, cleared once the blob points to it
+	var orphan = upgraded.location
+	defer func() {
+		if orphan != "" {
+			p.removeBlobs(ctx, []string{orphan})
+		}
+	}()
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, c.Login); err != nil {
+		return err
+	}
+	var tag, updateError = transaction.Exec(
+		ctx,
+		`UPDATE blobs SET location = $2, salt = NULL, iv = $3, wrapped_key = $4, key_id = $5, format = $6, size = $9, digest = $10
+		WHERE id = $1 AND location = $7 AND format = $8`,
+		b.id, upgraded.location, upgraded.iv, upgraded.wrappedKey, upgraded.keyID, upgraded.format, b.location, blobFormatCTR,
+		upgraded.size, upgraded.digest,
+	)
+	if updateError != nil {
+		return updateError
+	}
+	if tag.RowsAffected() == 0 {
+		// changed or upgraded by another request meanwhile
+		return nil
+	}
+	var rid ResourceID
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT id FROM resources WHERE type = $1 AND resource = $2`,
+		(int)(ResourceTypeBlob), b.id,
+	).Scan(&rid); err != nil {
+		return err
+	}
+	if err := p.rewrapGrants(ctx, transaction, rid, false, func() ([]byte, error) {
+		return p.resourceKey(ctx, upgraded.wrappedKey, upgraded.keyID, nil, c)
+	}); err != nil {
+		return err
+	}
+	var unused, unusedError = scheduleUnused(ctx, transaction, []string{b.location})
+	if unusedError != nil {
+		return unusedError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return err
+	}
+	orphan = ""
+	p.removeBlobs(ctx, unused)
+	return nil
+}
+
+// blobDataKey returns the key of the vault for writing a new blob, nil for
+// opaque content which needs no key.
+func (p *Storage) blobDataKey(ctx context.Context, opaque bool, vault access, c Creds) ([]byte, error) {
+	if opaque {
+		return nil, nil
+	}
+	return p.vaultKey(ctx, vault, c)
+}
+
+// removeBlobs deletes the blobs nothing refers to anymore and unschedules
+// their removal, failures are only logged since the database change is
+// committed already, CollectGarbage retries scheduled removals. It returns
+// the number of blobs removed.
+func (p *Storage) removeBlobs(ctx context.Context, locations []string) int {
+	var removed []string
+	for _, location := range locations {
+		if err := p.Blobs.Delete(ctx, location); err != nil {
+			log.Printf("failed to remove blob %s: %s\n", location, err.Error())
+			continue
+		}
+		removed = append(removed, location)
+	}
+	if len(removed) > 0 {
+		if _, err := p.db.Exec(ctx, `DELETE FROM blob_removals WHERE location = ANY($1)`, removed); err != nil {
+			log.Printf("failed to unschedule blob removal: %s\n", err.Error())
+		}
+	}
+	return len(removed)
+}
@@ -0,0 +1,172 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Tombstone records a deleted resource for the change feed
+type Tombstone struct {
+	ID        ResourceID
+	Version   int64
+	DeletedAt time.Time
+}
+
+// Changes is a delta of the vault since a cursor. Cursor is the highest
+// version in the delta, or the requested one if nothing changed, and is
+// used as since of the next request.
+type Changes struct {
+	Resources []Resource
+	Deleted   []Tombstone
+	Cursor    int64
+}
+
+// Changes returns resources created or changed and resources deleted after
+// the since version. Zero since returns the whole vault. Team vaults of the
+// user are included, all their resources if the user joined after since.
+//
+// Versions come from a single sequence, so without locking a transaction
+// committed after a concurrent one could carry a lower version and be
+// skipped by the cursor. Writers of the owner and of the teams hold their
+// lockOwner key exclusively. Changes takes all of them shared in a read
+// committed transaction first and reads the delta in a snapshot taken once
+// they are held, so the delta never misses an in-flight change. Joining a
+// team locks the user too, the teams looked up stay the teams of the user.
+func (p *Storage) Changes(ctx context.Context, since int64, c Creds) (Changes, error) {
+	var changes = Changes{Cursor: since}
+
+	var locks, locksError = p.db.Begin(ctx)
+	if locksError != nil {
+		return Changes{}, locksError
+	}
+	defer locks.Rollback(ctx)
+	if err := lockShared(ctx, locks, c.Login); err != nil {
+		return Changes{}, err
+	}
+	var teams, joined, teamsError = memberTeams(ctx, locks, c)
+	if teamsError != nil {
+		return Changes{}, teamsError
+	}
+	for _, team := range teams {
+		if err := lockShared(ctx, locks, teamLock(team)); err != nil {
+			return Changes{}, err
+		}
+		if joined[team] > since {
+			changes.Cursor = max(changes.Cursor, joined[team])
+		}
+	}
+
+	var transaction, transactionError = p.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly, IsoLevel: pgx.RepeatableRead})
+	if transactionError != nil {
+		return Changes{}, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var resourcesResult, resourcesError = transaction.Query(
+		ctx,
+		`SELECT `+resourceColumns+` FROM resources r
+		LEFT JOIN team_members m ON m.team_id = r.team_id AND m.login = $1
+		WHERE (r.owner = $1 AND r.version > $2) OR (m.login IS NOT NULL AND (r.version > $2 OR m.joined_version > $2))
+		ORDER BY r.version`,
+		c.Login, since,
+	)
+	if resourcesError != nil {
+		return Changes{}, resourcesError
+	}
+	for resourcesResult.Next() {
+		var resource Resource
+		if err := resourcesResult.Scan(resource.fields()...); err != nil {
+			resourcesResult.Close()
+			return Changes{}, err
+		}
+		changes.Resources = append(changes.Resources, resource)
+		changes.Cursor = max(changes.Cursor, resource.Version)
+	}
+	resourcesResult.Close()
+	if err := resourcesResult.Err(); err != nil {
+		return Changes{}, err
+	}
+
+	var tombstonesResult, tombstonesError = transaction.Query(
+		ctx,
+		`SELECT id, version, deleted_at FROM tombstones
+		WHERE (owner = $1 OR team_id IN (SELECT team_id FROM team_members WHERE login = $1)) AND version > $2
+		ORDER BY version`,
+		c.Login, since,
+	)
+	if tombstonesError != nil {
+		return Changes{}, tombstonesError
+	}
+	defer tombstonesResult.Close()
+	for tombstonesResult.Next() {
+		var tombstone Tombstone
+		if err := tombstonesResult.Scan(&tombstone.ID, &tombstone.Version, &tombstone.DeletedAt); err != nil {
+			return Changes{}, err
+		}
+		changes.Deleted = append(changes.Deleted, tombstone)
+		changes.Cursor = max(changes.Cursor, tombstone.Version)
+	}
+	if err := tombstonesResult.Err(); err != nil {
+		return Changes{}, err
+	}
+	return changes, nil
+}
+
+// memberTeams returns the teams of the user with the versions the user
+// joined them at
+func memberTeams(ctx context.Context, tx pgx.Tx, c Creds) ([]TeamID, map[TeamID]int64, error) {
+	var rows, queryError = tx.Query(ctx, `SELECT team_id, joined_version FROM team_members WHERE login = $1 ORDER BY team_id`, c.Login)
+	if queryError != nil {
+		return nil, nil, queryError
+	}
+	defer rows.Close()
+	var (
+		teams  = []TeamID{}
+		joined = map[TeamID]int64{}
+	)
+	for rows.Next() {
+		var (
+			team    TeamID
+			version int64
+		)
+		if err := rows.Scan(&team, &version); err != nil {
+			return nil, nil, err
+		}
+		teams = append(teams, team)
+		joined[team] = version
+	}
+	return teams, joined, rows.Err()
+}
+
+// missingOrChanged tells why a conditional change of the resource matched no
+// rows, the access to the resource is checked already
+func (p *Storage) missingOrChanged(ctx context.Context, tx pgx.Tx, rid ResourceID) error {
+	var exists bool
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM resources WHERE id = $1)`,
+		(int64)(rid),
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return ErrResourceNotFound
+}
+
+// lockShared waits for the writers holding the lockOwner key and keeps new
+// ones out until the end of the transaction
+func lockShared(ctx context.Context, tx pgx.Tx, key string) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock_shared(hashtext($1))`, key)
+	return err
+}
+
+// lockOwner serializes changes of the owner resources until the end of the
+// transaction, see Changes.
+func lockOwner(ctx context.Context, tx pgx.Tx, login string) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, login)
+	return err
+}
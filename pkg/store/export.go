@@ -0,0 +1,425 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/archive"
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// Exports are archives of a whole vault encrypted with an export passphrase,
+// see package archive. Content is exported decrypted, opaque content as the
+// envelope of the client, which only opens with the passphrase and login of
+// its client side encryption. Imports keep folders, tags and details of the
+// resources under new ids. Resources equal to one of the vault are reported
+// as duplicates and skipped, so an interrupted import is completed by
+// importing the archive again.
+
+// maxImportedPiece bounds pieces read into memory by imports
+const maxImportedPiece = 16 << 20
+
+var archiveTypes = map[ResourceType]string{
+	ResourceTypePiece: "piece",
+	ResourceTypeBlob:  "blob",
+}
+
+// ImportReport maps the folders and resources of an archive to the vault
+type ImportReport struct {
+	Folders   map[FolderID]FolderID // Folders maps archive ids to ids of the vault.
+	Resources []ImportedResource
+}
+
+// ImportedResource is a resource of an archive in the vault
+type ImportedResource struct {
+	ID        ResourceID // ID of the resource in the archive.
+	RID       ResourceID // RID of the resource in the vault, of the equal one for duplicates.
+	Duplicate bool       // Duplicate resources are not imported.
+}
+
+// Export writes the vault of the user, or of the team if not zero, as an
+// archive encrypted with the passphrase. The passphrase is checked against
+// the password policy. Resources deleted while exporting are left out.
+func (p *Storage) Export(ctx context.Context, team TeamID, passphrase string, w io.Writer, c Creds) error {
+	if err := p.policy().Validate(c.Login, passphrase); err != nil {
+		return err
+	}
+	var folders, foldersError = p.Folders(ctx, team, c)
+	if foldersError != nil {
+		return foldersError
+	}
+	var resources, resourcesError = p.vaultResources(ctx, team, c)
+	if resourcesError != nil {
+		return resourcesError
+	}
+
+	var manifest = archive.Manifest{
+		CreatedAt: time.Now().UTC(),
+		Folders:   make([]archive.Folder, 0, len(folders)),
+		Resources: make([]archive.Resource, 0, len(resources)),
+	}
+	for _, folder := range folders {
+		manifest.Folders = append(manifest.Folders, archive.Folder{ID: (int64)(folder.ID), Parent: (int64)(folder.Parent), Name: folder.Name})
+	}
+	for _, resource := range resources {
+		var exported = archive.Resource{
+			ID:     (int64)(resource.ID),
+			Type:   archiveTypes[resource.Type],
+			Kind:   (string)(resource.Kind),
+			Meta:   resource.Meta,
+			Folder: (int64)(resource.Folder),
+			Tags:   resource.Tags,
+		}
+		if resource.Blob != nil {
+			exported.ContentType, exported.Filename = resource.Blob.ContentType, resource.Blob.Filename
+		}
+		if !resource.Details.empty() {
+			var err error
+			if exported.Details, err = json.Marshal(resource.Details); err != nil {
+				return err
+			}
+		}
+		manifest.Resources = append(manifest.Resources, exported)
+	}
+
+	var writer, writerError = archive.NewWriter(w, passphrase, envelope.DefaultKDF, manifest)
+	if writerError != nil {
+		return writerError
+	}
+	for _, resource := range resources {
+		if err := p.exportResource(ctx, writer, resource, c); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func (p *Storage) exportResource(ctx context.Context, w *archive.Writer, resource Resource, c Creds) error {
+	switch resource.Type {
+	case ResourceTypePiece:
+		var piece, err = p.RestorePiece(ctx, resource.ID, c)
+		if errors.Is(err, ErrResourceNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var entry = archive.Entry{ID: (int64)(resource.ID), Size: int64(len(piece.Content)), Opaque: piece.Opaque}
+		return w.WriteEntry(entry, bytes.NewReader(piece.Content))
+	case ResourceTypeBlob:
+		var blob, err = p.RestoreBlob(ctx, resource.ID, c)
+		if errors.Is(err, ErrResourceNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer blob.Content.Close()
+		var entry = archive.Entry{ID: (int64)(resource.ID), Size: blob.Size, Opaque: blob.Opaque}
+		return w.WriteEntry(entry, blob.Content)
+	}
+	return fmt.Errorf("unknown resource type: %d", resource.Type)
+}
+
+// Import restores the archive encrypted with the passphrase into the vault
+// of the user, or of the team if not zero. Archive errors wrap
+// archive.ErrInvalid or archive.ErrPassphrase. Resources imported before an
+// error are kept, the report holds them.
+func (p *Storage) Import(ctx context.Context, team TeamID, passphrase string, r io.Reader, c Creds) (ImportReport, error) {
+	var report = ImportReport{Folders: map[FolderID]FolderID{}}
+	var vault, accessError = vaultAccess(ctx, p.db, team, c)
+	if accessError != nil {
+		return report, accessError
+	}
+	if err := vault.writable(); err != nil {
+		return report, err
+	}
+	var reader, readerError = archive.NewReader(r, passphrase)
+	if readerError != nil {
+		return report, readerError
+	}
+
+	if err := p.importFolders(ctx, team, reader.Manifest.Folders, report.Folders, c); err != nil {
+		return report, err
+	}
+	var existing, existingError = p.vaultResources(ctx, team, c)
+	if existingError != nil {
+		return report, existingError
+	}
+	var manifest = make(map[int64]archive.Resource, len(reader.Manifest.Resources))
+	for _, resource := range reader.Manifest.Resources {
+		manifest[resource.ID] = resource
+	}
+
+	for {
+		var entry, content, err = reader.Next()
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		var resource, ok = manifest[entry.ID]
+		if !ok {
+			return report, fmt.Errorf("%w: resource %d not in the manifest", archive.ErrInvalid, entry.ID)
+		}
+		var imported, importError = p.importResource(ctx, team, resource, entry, content, existing, report.Folders, c)
+		if importError != nil {
+			return report, importError
+		}
+		report.Resources = append(report.Resources, imported)
+	}
+}
+
+// importFolders creates the folders of the archive missing in the vault,
+// parents first, and maps them to the folders of the vault
+func (p *Storage) importFolders(ctx context.Context, team TeamID, folders []archive.Folder, mapped map[FolderID]FolderID, c Creds) error {
+	var existing, existingError = p.Folders(ctx, team, c)
+	if existingError != nil {
+		return existingError
+	}
+	type folderKey struct {
+		parent FolderID
+		name   string
+	}
+	var byName = make(map[folderKey]FolderID, len(existing))
+	for _, folder := range existing {
+		byName[folderKey{folder.Parent, folder.Name}] = folder.ID
+	}
+
+	for pending := folders; len(pending) > 0; {
+		var rest []archive.Folder
+		for _, folder := range pending {
+			var parent FolderID
+			if folder.Parent != 0 {
+				var ok bool
+				if parent, ok = mapped[(FolderID)(folder.Parent)]; !ok {
+					rest = append(rest, folder)
+					continue
+				}
+			}
+			var key = folderKey{parent, folder.Name}
+			if id, ok := byName[key]; ok {
+				mapped[(FolderID)(folder.ID)] = id
+				continue
+			}
+			var id, err = p.CreateFolder(ctx, team, parent, folder.Name, c)
+			if err != nil {
+				return err
+			}
+			byName[key] = id
+			mapped[(FolderID)(folder.ID)] = id
+		}
+		if len(rest) == len(pending) {
+			return fmt.Errorf("%w: folders without parents", archive.ErrInvalid)
+		}
+		pending = rest
+	}
+	return nil
+}
+
+// importResource stores the resource of the archive unless the vault has an
+// equal one and organises it as in the archive
+func (p *Storage) importResource(ctx context.Context, team TeamID, resource archive.Resource, entry archive.Entry, content io.Reader, existing []Resource, folders map[FolderID]FolderID, c Creds) (ImportedResource, error) {
+	var imported = ImportedResource{ID: (ResourceID)(entry.ID)}
+	var details Details
+	if len(resource.Details) > 0 {
+		if err := json.Unmarshal(resource.Details, &details); err != nil {
+			return imported, fmt.Errorf("%w: details of resource %d", archive.ErrInvalid, entry.ID)
+		}
+		if err := details.validate(); err != nil {
+			return imported, err
+		}
+	}
+	var tags = make([]string, 0, len(resource.Tags))
+	for _, tag := range resource.Tags {
+		var normalized, err = normalizeTag(tag)
+		if err != nil {
+			return imported, err
+		}
+		tags = append(tags, normalized)
+	}
+
+	var candidates []Resource
+	for _, r := range existing {
+		if archiveTypes[r.Type] == resource.Type && (string)(r.Kind) == resource.Kind && r.Meta == resource.Meta && sameDetails(r.Details, details) {
+			candidates = append(candidates, r)
+		}
+	}
+
+	var rid ResourceID
+	switch resource.Type {
+	case archiveTypes[ResourceTypePiece]:
+		if !slices.Contains(secret.Kinds, (secret.Kind)(resource.Kind)) {
+			return imported, fmt.Errorf("%w: kind of resource %d", archive.ErrInvalid, entry.ID)
+		}
+		if entry.Size > maxImportedPiece {
+			return imported, fmt.Errorf("%w: resource %d too large", archive.ErrInvalid, entry.ID)
+		}
+		var data, readError = io.ReadAll(content)
+		if readError != nil {
+			return imported, readError
+		}
+		for _, candidate := range candidates {
+			var piece, err = p.RestorePiece(ctx, candidate.ID, c)
+			if err != nil && !errors.Is(err, ErrResourceNotFound) {
+				return imported, err
+			}
+			if err == nil && piece.Opaque == entry.Opaque && bytes.Equal(piece.Content, data) {
+				imported.RID, imported.Duplicate = candidate.ID, true
+				return imported, nil
+			}
+		}
+		var err error
+		var piece = Piece{Content: data, Meta: resource.Meta, Kind: (secret.Kind)(resource.Kind), Opaque: entry.Opaque, Team: team}
+		if rid, err = p.StorePiece(ctx, piece, c); err != nil {
+			return imported, err
+		}
+	case archiveTypes[ResourceTypeBlob]:
+		if resource.Kind != (string)(secret.KindBinary) {
+			return imported, fmt.Errorf("%w: kind of resource %d", archive.ErrInvalid, entry.ID)
+		}
+		// blobs are not read twice, the content is compared by its digest
+		// once written as a new blob, which is dropped if a duplicate
+		var same []ResourceID
+		for _, candidate := range candidates {
+			var blob, err = p.RestoreBlob(ctx, candidate.ID, c)
+			if err != nil && !errors.Is(err, ErrResourceNotFound) {
+				return imported, err
+			}
+			if err == nil {
+				blob.Content.Close()
+				if blob.Opaque == entry.Opaque && blob.Size == entry.Size {
+					same = append(same, candidate.ID)
+				}
+			}
+		}
+		var (
+			hash      = sha256.New()
+			duplicate ResourceID
+			keep      func() (bool, error)
+		)
+		if len(same) > 0 {
+			keep = func() (bool, error) {
+				for _, candidate := range same {
+					var equal, err = p.blobDigestEqual(ctx, candidate, hash.Sum(nil), c)
+					if err != nil {
+						return false, err
+					}
+					if equal {
+						duplicate = candidate
+						return false, nil
+					}
+				}
+				return true, nil
+			}
+		}
+		var err error
+		var blob = Blob{
+			Content:     io.NopCloser(io.TeeReader(content, hash)),
+			Meta:        resource.Meta,
+			Opaque:      entry.Opaque,
+			Team:        team,
+			ContentType: resource.ContentType,
+			Filename:    resource.Filename,
+		}
+		if rid, err = p.storeBlob(ctx, blob, keep, c); err != nil {
+			return imported, err
+		}
+		if duplicate != 0 {
+			imported.RID, imported.Duplicate = duplicate, true
+			return imported, nil
+		}
+	default:
+		return imported, fmt.Errorf("%w: type of resource %d", archive.ErrInvalid, entry.ID)
+	}
+	imported.RID = rid
+
+	var folder = folders[(FolderID)(resource.Folder)]
+	if folder == 0 && len(tags) == 0 && details.empty() {
+		return imported, nil
+	}
+	_, err := p.organise(ctx, rid, 0, c, func(tx pgx.Tx, vault access) error {
+		if err := checkFolder(ctx, tx, folder, vault, c); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			ctx,
+			`UPDATE resources SET folder_id = NULLIF($2, 0), details = $3 WHERE id = $1`,
+			(int64)(rid), folder, details,
+		); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if _, err := tx.Exec(
+				ctx,
+				`INSERT INTO resource_tags(rid, tag) VALUES($1, $2) ON CONFLICT DO NOTHING`,
+				(int64)(rid), tag,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return imported, err
+}
+
+// blobDigestEqual tells if the SHA-256 of the content of the blob is the
+// digest, blobs stored before digests were recorded are read to hash them
+func (p *Storage) blobDigestEqual(ctx context.Context, rid ResourceID, digest []byte, c Creds) (bool, error) {
+	var blob, err = p.RestoreBlob(ctx, rid, c)
+	if errors.Is(err, ErrResourceNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer blob.Content.Close()
+	if blob.Digest == nil {
+		var hash = sha256.New()
+		if _, err := io.Copy(hash, blob.Content); err != nil {
+			return false, err
+		}
+		blob.Digest = hash.Sum(nil)
+	}
+	return bytes.Equal(blob.Digest, digest), nil
+}
+
+// vaultResources returns all resources of the vault of the user, or of the
+// team if not zero
+func (p *Storage) vaultResources(ctx context.Context, team TeamID, c Creds) ([]Resource, error) {
+	var (
+		resources []Resource
+		query     = ListQuery{Team: &team, Limit: MaxPageSize}
+	)
+	for {
+		var page, err = p.List(ctx, query, c)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, page.Resources...)
+		if page.Next == "" {
+			return resources, nil
+		}
+		query.Cursor = page.Next
+	}
+}
+
+func (d Details) empty() bool {
+	return d.Title == "" && d.Notes == "" && len(d.URLs) == 0 && len(d.Fields) == 0
+}
+
+// sameDetails compares details as stored, so nil and empty lists are equal
+func sameDetails(a, b Details) bool {
+	return a.Title == b.Title && a.Notes == b.Notes && slices.Equal(a.URLs, b.URLs) && slices.Equal(a.Fields, b.Fields)
+}
@@ -0,0 +1,441 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrFolderNotFound = fmt.Errorf("folder not found")
+	ErrFolderExists   = fmt.Errorf("folder exists")
+	ErrFolderNotEmpty = fmt.Errorf("folder has subfolders")
+	ErrFolderInvalid  = fmt.Errorf("folder invalid")
+	ErrTagInvalid     = fmt.Errorf("tag invalid")
+	ErrDetailsInvalid = fmt.Errorf("details invalid")
+)
+
+// Folders form a tree per vault, a resource is in a single folder or in
+// the root of its vault and has any number of tags. Details are the
+// structured meta of a resource. Like Meta they are stored unencrypted, so
+// secrets belong to the content. Moving, tagging and changing details of a
+// resource move it to the next version for the change feed but are not
+// kept as revisions.
+
+const (
+	maxNameLen    = 128
+	maxTagLen     = 64
+	maxTitleLen   = 256
+	maxNotesLen   = 64 << 10
+	maxURLs       = 32
+	maxFields     = 64
+	maxFieldValue = 4 << 10
+)
+
+type FolderID int64
+
+// Folder of a vault, zero Parent is the root
+type Folder struct {
+	ID     FolderID
+	Parent FolderID
+	Name   string
+	Team   TeamID // Team owning the folder, zero for the vault of the user.
+}
+
+// FolderUpdate renames or moves a folder, nil fields are left as is
+type FolderUpdate struct {
+	Name   *string
+	Parent *FolderID // New parent, zero moves the folder to the root.
+}
+
+// Details is the structured meta of a resource
+type Details struct {
+	Title  string   `json:"title,omitempty"`
+	Notes  string   `json:"notes,omitempty"`
+	URLs   []string `json:"urls,omitempty"`
+	Fields []Field  `json:"fields,omitempty"`
+}
+
+// Field is a custom named value of the details
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Folders returns the folders of the vault of the user, or of the team if
+// not zero, ordered by id so parents precede their subfolders created later.
+func (p *Storage) Folders(ctx context.Context, team TeamID, c Creds) ([]Folder, error) {
+	var vault, accessError = vaultAccess(ctx, p.db, team, c)
+	if accessError != nil {
+		return nil, accessError
+	}
+	var rows, queryError = p.db.Query(
+		ctx,
+		`SELECT id, COALESCE(parent_id, 0), name, COALESCE(team_id, 0) FROM folders
+		WHERE ($2 = 0 AND owner = $1) OR team_id = $2 ORDER BY id`,
+		vault.owner, vault.team,
+	)
+	if queryError != nil {
+		return nil, queryError
+	}
+	defer rows.Close()
+
+	var folders = []Folder{}
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.ID, &folder.Parent, &folder.Name, &folder.Team); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// CreateFolder creates a folder in the parent folder, or in the root for
+// zero parent, of the vault of the user or of the team if not zero.
+func (p *Storage) CreateFolder(ctx context.Context, team TeamID, parent FolderID, name string, c Creds) (FolderID, error) {
+	if err := checkFolderName(name); err != nil {
+		return 0, err
+	}
+	var vault, accessError = vaultAccess(ctx, p.db, team, c)
+	if accessError != nil {
+		return 0, accessError
+	}
+	if err := vault.writable(); err != nil {
+		return 0, err
+	}
+	if err := checkFolder(ctx, p.db, parent, vault, c); err != nil {
+		return 0, err
+	}
+
+	var id FolderID
+	if err := p.db.QueryRow(
+		ctx,
+		`INSERT INTO folders(owner, team_id, parent_id, name) VALUES(NULLIF($1, ''), NULLIF($2, 0), NULLIF($3, 0), $4) RETURNING id`,
+		vault.owner, vault.team, parent, name,
+	).Scan(&id); err != nil {
+		return 0, folderError(err)
+	}
+	return id, nil
+}
+
+// UpdateFolder renames the folder or moves it to another parent of the same
+// vault. A folder can't be moved into itself or its subfolders.
+func (p *Storage) UpdateFolder(ctx context.Context, folder FolderID, update FolderUpdate, c Creds) error {
+	if update.Name != nil {
+		if err := checkFolderName(*update.Name); err != nil {
+			return err
+		}
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var vault, accessError = folderAccess(ctx, transaction, folder, c)
+	if accessError != nil {
+		return accessError
+	}
+	if err := vault.writable(); err != nil {
+		return err
+	}
+	if err := lockOwner(ctx, transaction, vault.lockKey()); err != nil {
+		return err
+	}
+	if update.Parent != nil {
+		if err := checkFolder(ctx, transaction, *update.Parent, vault, c); err != nil {
+			return err
+		}
+		var cycle bool
+		if err := transaction.QueryRow(
+			ctx,
+			`WITH RECURSIVE ancestors(id, parent_id) AS (
+				SELECT id, parent_id FROM folders WHERE id = $2
+				UNION SELECT f.id, f.parent_id FROM folders f JOIN ancestors a ON f.id = a.parent_id
+			) SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = $1)`,
+			folder, *update.Parent,
+		).Scan(&cycle); err != nil {
+			return err
+		}
+		if cycle {
+			return fmt.Errorf("%w: folder moved into itself", ErrFolderInvalid)
+		}
+	}
+
+	if _, err := transaction.Exec(
+		ctx,
+		`UPDATE folders SET name = COALESCE($2, name), parent_id = CASE WHEN $3::bigint IS NULL THEN parent_id ELSE NULLIF($3, 0) END
+		WHERE id = $1`,
+		folder, update.Name, update.Parent,
+	); err != nil {
+		return folderError(err)
+	}
+	return transaction.Commit(ctx)
+}
+
+// DeleteFolder removes the folder without subfolders, its resources move
+// to the root of the vault.
+func (p *Storage) DeleteFolder(ctx context.Context, folder FolderID, c Creds) error {
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var vault, accessError = folderAccess(ctx, transaction, folder, c)
+	if accessError != nil {
+		return accessError
+	}
+	if err := vault.writable(); err != nil {
+		return err
+	}
+	if err := lockOwner(ctx, transaction, vault.lockKey()); err != nil {
+		return err
+	}
+	var nested bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM folders WHERE parent_id = $1)`,
+		folder,
+	).Scan(&nested); err != nil {
+		return err
+	}
+	if nested {
+		return ErrFolderNotEmpty
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`UPDATE resources SET folder_id = NULL, version = nextval('resource_version_seq'), updated_at = now(), updated_by = $2
+		WHERE folder_id = $1`,
+		folder, c.Login,
+	); err != nil {
+		return err
+	}
+	if _, err := transaction.Exec(ctx, `DELETE FROM folders WHERE id = $1`, folder); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// MoveResource moves the resource to the folder of its vault, zero folder
+// is the root. It returns the new version of the resource.
+func (p *Storage) MoveResource(ctx context.Context, rid ResourceID, folder FolderID, c Creds) (int64, error) {
+	return p.organise(ctx, rid, 0, c, func(tx pgx.Tx, resource access) error {
+		if err := checkFolder(ctx, tx, folder, resource, c); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `UPDATE resources SET folder_id = NULLIF($2, 0) WHERE id = $1`, (int64)(rid), folder)
+		return err
+	})
+}
+
+// TagResource adds the tag to the resource and returns its new version,
+// adding a tag twice changes nothing but the version
+func (p *Storage) TagResource(ctx context.Context, rid ResourceID, tag string, c Creds) (int64, error) {
+	var normalized, tagError = normalizeTag(tag)
+	if tagError != nil {
+		return -1, tagError
+	}
+	return p.organise(ctx, rid, 0, c, func(tx pgx.Tx, _ access) error {
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO resource_tags(rid, tag) VALUES($1, $2) ON CONFLICT DO NOTHING`,
+			(int64)(rid), normalized,
+		)
+		return err
+	})
+}
+
+// UntagResource removes the tag from the resource and returns its new
+// version. ErrTagInvalid is returned if the resource has no such tag.
+func (p *Storage) UntagResource(ctx context.Context, rid ResourceID, tag string, c Creds) (int64, error) {
+	var normalized, tagError = normalizeTag(tag)
+	if tagError != nil {
+		return -1, tagError
+	}
+	return p.organise(ctx, rid, 0, c, func(tx pgx.Tx, _ access) error {
+		var result, err = tx.Exec(ctx, `DELETE FROM resource_tags WHERE rid = $1 AND tag = $2`, (int64)(rid), normalized)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return fmt.Errorf("%w: resource has no tag %q", ErrTagInvalid, normalized)
+		}
+		return nil
+	})
+}
+
+// SetDetails replaces the structured meta of the resource. Versions are
+// checked as in UpdatePiece, the new version is returned.
+func (p *Storage) SetDetails(ctx context.Context, rid ResourceID, version int64, details Details, c Creds) (int64, error) {
+	if err := details.validate(); err != nil {
+		return -1, err
+	}
+	return p.organise(ctx, rid, version, c, func(tx pgx.Tx, _ access) error {
+		_, err := tx.Exec(ctx, `UPDATE resources SET details = $2 WHERE id = $1`, (int64)(rid), details)
+		return err
+	})
+}
+
+// organise applies the change of the resource organisation under the lock
+// of its vault and moves the resource to the next version. Owners and team
+// members who may write organise resources, grantees don't.
+func (p *Storage) organise(ctx context.Context, rid ResourceID, version int64, c Creds, change func(tx pgx.Tx, resource access) error) (int64, error) {
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return -1, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var resource, accessError = resourceAccess(ctx, transaction, rid, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := resource.writable(); err != nil || resource.granted(c) {
+		return -1, ErrPermissionDenied
+	}
+	if err := lockOwner(ctx, transaction, resource.lockKey()); err != nil {
+		return -1, err
+	}
+	var actual int64
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT version FROM resources WHERE id = $1 FOR UPDATE`,
+		(int64)(rid),
+	).Scan(&actual); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return -1, ErrResourceNotFound
+		}
+		return -1, err
+	}
+	if version != 0 && version != actual {
+		return -1, ErrVersionMismatch
+	}
+	if err := change(transaction, resource); err != nil {
+		return -1, err
+	}
+
+	var newVersion, bumpError = bumpResource(ctx, transaction, rid, nil, c)
+	if bumpError != nil {
+		return -1, bumpError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	return newVersion, nil
+}
+
+// folderAccess evaluates the access of the user to the vault of the folder,
+// ErrFolderNotFound is returned without access
+func folderAccess(ctx context.Context, q queryRower, folder FolderID, c Creds) (access, error) {
+	var (
+		owner string
+		team  TeamID
+	)
+	if err := q.QueryRow(
+		ctx,
+		`SELECT COALESCE(owner, ''), COALESCE(team_id, 0) FROM folders WHERE id = $1`,
+		folder,
+	).Scan(&owner, &team); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return access{}, ErrFolderNotFound
+		}
+		return access{}, err
+	}
+	if team == 0 && owner != c.Login {
+		return access{}, ErrFolderNotFound
+	}
+	var vault, err = vaultAccess(ctx, q, team, c)
+	if errors.Is(err, ErrTeamNotFound) {
+		return access{}, ErrFolderNotFound
+	}
+	return vault, err
+}
+
+// checkFolder returns ErrFolderNotFound unless the folder is in the vault,
+// zero folder is the root of any vault
+func checkFolder(ctx context.Context, q queryRower, folder FolderID, vault access, c Creds) error {
+	if folder == 0 {
+		return nil
+	}
+	var folderVault, err = folderAccess(ctx, q, folder, c)
+	if err != nil {
+		return err
+	}
+	if folderVault.owner != vault.owner || folderVault.team != vault.team {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// folderError reports a duplicate name in the parent folder as ErrFolderExists
+func folderError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return ErrFolderExists
+	}
+	return err
+}
+
+func checkFolderName(name string) error {
+	if strings.TrimSpace(name) == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: name must be non-empty and without /", ErrFolderInvalid)
+	}
+	if utf8.RuneCountInString(name) > maxNameLen {
+		return fmt.Errorf("%w: name longer than %d", ErrFolderInvalid, maxNameLen)
+	}
+	return nil
+}
+
+// normalizeTag trims and lowercases the tag, so "Work" and "work " match
+func normalizeTag(tag string) (string, error) {
+	var normalized = strings.ToLower(strings.TrimSpace(tag))
+	if normalized == "" || strings.ContainsAny(normalized, ",\n") {
+		return "", fmt.Errorf("%w: tag must be non-empty and without commas", ErrTagInvalid)
+	}
+	if utf8.RuneCountInString(normalized) > maxTagLen {
+		return "", fmt.Errorf("%w: tag longer than %d", ErrTagInvalid, maxTagLen)
+	}
+	return normalized, nil
+}
+
+func (d Details) validate() error {
+	switch {
+	case utf8.RuneCountInString(d.Title) > maxTitleLen:
+		return fmt.Errorf("%w: title longer than %d", ErrDetailsInvalid, maxTitleLen)
+	case len(d.Notes) > maxNotesLen:
+		return fmt.Errorf("%w: notes longer than %d bytes", ErrDetailsInvalid, maxNotesLen)
+	case len(d.URLs) > maxURLs:
+		return fmt.Errorf("%w: more than %d urls", ErrDetailsInvalid, maxURLs)
+	case len(d.Fields) > maxFields:
+		return fmt.Errorf("%w: more than %d fields", ErrDetailsInvalid, maxFields)
+	}
+	for _, raw := range d.URLs {
+		if u, err := url.Parse(raw); err != nil || u.Scheme == "" {
+			return fmt.Errorf("%w: url %q must be absolute", ErrDetailsInvalid, raw)
+		}
+	}
+	var names = map[string]bool{}
+	for _, field := range d.Fields {
+		if strings.TrimSpace(field.Name) == "" || utf8.RuneCountInString(field.Name) > maxNameLen {
+			return fmt.Errorf("%w: field name must be non-empty and up to %d", ErrDetailsInvalid, maxNameLen)
+		}
+		if names[field.Name] {
+			return fmt.Errorf("%w: duplicate field %q", ErrDetailsInvalid, field.Name)
+		}
+		names[field.Name] = true
+		if len(field.Value) > maxFieldValue {
+			return fmt.Errorf("%w: field %q longer than %d bytes", ErrDetailsInvalid, field.Name, maxFieldValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/blobstore"
+)
+
+// FsckOptions of the consistency check
+type FsckOptions struct {
+	Repair bool
+	// Grace is the age of a file nothing refers to before it is an orphan,
+	// younger files may belong to a write whose transaction is still open.
+	Grace time.Duration
+}
+
+// FsckReport lists the inconsistencies of the database and the blob files
+type FsckReport struct {
+	Files             int          // Files is the number of blob files.
+	DanglingResources []ResourceID // DanglingResources miss their piece or blob row.
+	OrphanPieces      []int        // OrphanPieces are piece rows of no resource.
+	OrphanBlobs       []int        // OrphanBlobs are blob rows of no resource.
+	MissingFiles      []string     // MissingFiles are locations of blobs and revisions without a file.
+	OrphanFiles       []string     // OrphanFiles are files nothing refers to.
+	PendingRemovals   int          // PendingRemovals are files of deleted blobs not removed yet.
+	Removed           int          // Removed is the number of files removed by the repair.
+}
+
+const (
+	// danglingFilter selects resources r without their content, $1 and $2
+	// are ResourceTypePiece and ResourceTypeBlob
+	danglingFilter = `((r.type = $1 AND NOT EXISTS(SELECT 1 FROM pieces p WHERE p.id = r.resource))
+		OR (r.type = $2 AND NOT EXISTS(SELECT 1 FROM blobs b WHERE b.id = r.resource)))`
+	// orphanPieceFilter selects pieces p of no resource, $1 is ResourceTypePiece
+	orphanPieceFilter = `NOT EXISTS(SELECT 1 FROM resources r WHERE r.type = $1 AND r.resource = p.id)`
+	// orphanBlobFilter selects blobs b of no resource, $1 is ResourceTypeBlob
+	orphanBlobFilter = `NOT EXISTS(SELECT 1 FROM resources r WHERE r.type = $1 AND r.resource = b.id)`
+)
+
+// Fsck cross-checks resources, pieces, blobs and the files of the blob
+// backend. With Repair dangling resources are deleted as by Delete, orphan
+// rows and files are removed and pending removals are done, the foreign
+// keys of resources to their content are validated then. Missing files are
+// only reported, their content is lost.
+func (p *Storage) Fsck(ctx context.Context, opts FsckOptions) (FsckReport, error) {
+	var report FsckReport
+	if err := p.checkRows(ctx, &report); err != nil {
+		return report, err
+	}
+	if opts.Repair {
+		if err := p.repairRows(ctx, report); err != nil {
+			return report, err
+		}
+		if err := p.validateContentKeys(ctx); err != nil {
+			return report, err
+		}
+		var removed, err = p.CollectGarbage(ctx)
+		if err != nil {
+			return report, err
+		}
+		report.Removed += removed
+	}
+	if err := p.db.QueryRow(ctx, `SELECT count(*) FROM blob_removals`).Scan(&report.PendingRemovals); err != nil {
+		return report, err
+	}
+
+	// files are listed before the references are read, a file written
+	// meanwhile is referenced by then or younger than the grace period
+	var files = map[string]blobstore.Info{}
+	if err := p.Blobs.List(ctx, func(info blobstore.Info) error {
+		files[info.Key] = info
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+	var references, referencesError = p.blobReferences(ctx)
+	if referencesError != nil {
+		return report, referencesError
+	}
+	var missing []string
+	missing, report.OrphanFiles = checkFiles(files, references, time.Now().Add(-opts.Grace))
+	for _, location := range missing {
+		// stored after the listing
+		if _, err := p.Blobs.Stat(ctx, location); errors.Is(err, blobstore.ErrNotFound) {
+			report.MissingFiles = append(report.MissingFiles, location)
+		} else if err != nil {
+			return report, err
+		}
+	}
+	if opts.Repair {
+		report.Removed += p.removeBlobs(ctx, report.OrphanFiles)
+	}
+	return report, nil
+}
+
+// CollectGarbage removes the expired uploads of all users and the files of
+// pending removals, removals failing again are left for the next run. It
+// returns the number of files removed.
+func (p *Storage) CollectGarbage(ctx context.Context) (int, error) {
+	if _, err := p.db.Exec(
+		ctx,
+		`WITH expired AS (DELETE FROM uploads WHERE expires_at < now() RETURNING parts)
+		INSERT INTO blob_removals(location) SELECT unnest(parts) FROM expired ON CONFLICT DO NOTHING`,
+	); err != nil {
+		return 0, err
+	}
+	// a location in use again is kept, though locations are never reused
+	if _, err := p.db.Exec(
+		ctx,
+		`DELETE FROM blob_removals r
+		WHERE EXISTS(SELECT 1 FROM blobs WHERE location = r.location) OR EXISTS(SELECT 1 FROM revisions WHERE location = r.location)`,
+	); err != nil {
+		return 0, err
+	}
+	var rows, err = p.db.Query(ctx, `SELECT location FROM blob_removals ORDER BY created_at`)
+	if err != nil {
+		return 0, err
+	}
+	var locations, collectError = pgx.CollectRows(rows, pgx.RowTo[string])
+	if collectError != nil {
+		return 0, collectError
+	}
+	return p.removeBlobs(ctx, locations), nil
+}
+
+// checkRows reports dangling resources and orphan pieces and blobs
+func (p *Storage) checkRows(ctx context.Context, report *FsckReport) error {
+	var rows, danglingError = p.db.Query(
+		ctx,
+		`SELECT r.id FROM resources r WHERE `+danglingFilter+` ORDER BY r.id`,
+		(int)(ResourceTypePiece), (int)(ResourceTypeBlob),
+	)
+	if danglingError != nil {
+		return danglingError
+	}
+	var err error
+	if report.DanglingResources, err = pgx.CollectRows(rows, pgx.RowTo[ResourceID]); err != nil {
+		return err
+	}
+
+	if rows, err = p.db.Query(
+		ctx,
+		`SELECT p.id FROM pieces p WHERE `+orphanPieceFilter+` ORDER BY p.id`,
+		(int)(ResourceTypePiece),
+	); err != nil {
+		return err
+	}
+	if report.OrphanPieces, err = pgx.CollectRows(rows, pgx.RowTo[int]); err != nil {
+		return err
+	}
+
+	if rows, err = p.db.Query(
+		ctx,
+		`SELECT b.id FROM blobs b WHERE `+orphanBlobFilter+` ORDER BY b.id`,
+		(int)(ResourceTypeBlob),
+	); err != nil {
+		return err
+	}
+	report.OrphanBlobs, err = pgx.CollectRows(rows, pgx.RowTo[int])
+	return err
+}
+
+// repairRows deletes the dangling resources and the orphan rows of the
+// report unless fixed meanwhile. Dangling resources leave tombstones, so
+// clients drop them too, files nothing refers to anymore are scheduled for
+// removal.
+func (p *Storage) repairRows(ctx context.Context, report FsckReport) error {
+	if len(report.DanglingResources) == 0 && len(report.OrphanPieces) == 0 && len(report.OrphanBlobs) == 0 {
+		return nil
+	}
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var dangling = make([]int64, 0, len(report.DanglingResources))
+	for _, rid := range report.DanglingResources {
+		dangling = append(dangling, (int64)(rid))
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`WITH dangling AS (DELETE FROM resources r WHERE r.id = ANY($3) AND `+danglingFilter+` RETURNING r.id, r.owner, r.team_id)
+		INSERT INTO tombstones(id, owner, team_id) SELECT id, NULLIF(owner, ''), team_id FROM dangling`,
+		(int)(ResourceTypePiece), (int)(ResourceTypeBlob), dangling,
+	); err != nil {
+		return err
+	}
+	var revisionsResult, revisionsError = transaction.Query(
+		ctx,
+		`DELETE FROM revisions WHERE rid = ANY($1) AND NOT EXISTS(SELECT 1 FROM resources WHERE id = rid) RETURNING location`,
+		dangling,
+	)
+	if revisionsError != nil {
+		return revisionsError
+	}
+	var revisionLocations, collectError = pgx.CollectRows(revisionsResult, pgx.RowTo[*string])
+	if collectError != nil {
+		return collectError
+	}
+
+	if _, err := transaction.Exec(
+		ctx,
+		`DELETE FROM pieces p WHERE p.id = ANY($2) AND `+orphanPieceFilter,
+		(int)(ResourceTypePiece), report.OrphanPieces,
+	); err != nil {
+		return err
+	}
+	var blobsResult, blobsError = transaction.Query(
+		ctx,
+		`DELETE FROM blobs b WHERE b.id = ANY($2) AND `+orphanBlobFilter+` RETURNING location`,
+		(int)(ResourceTypeBlob), report.OrphanBlobs,
+	)
+	if blobsError != nil {
+		return blobsError
+	}
+	var blobLocations, blobsCollectError = pgx.CollectRows(blobsResult, pgx.RowTo[*string])
+	if blobsCollectError != nil {
+		return blobsCollectError
+	}
+
+	var locations []string
+	for _, location := range append(revisionLocations, blobLocations...) {
+		if location != nil {
+			locations = append(locations, *location)
+		}
+	}
+	if _, err := scheduleUnused(ctx, transaction, locations); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// validateContentKeys validates the foreign keys of resources to their
+// pieces and blobs, the migration adding them leaves them unvalidated while
+// resources dangle
+func (p *Storage) validateContentKeys(ctx context.Context) error {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT conname FROM pg_constraint
+		WHERE conrelid = 'resources'::regclass AND conname IN ('resources_piece_fk', 'resources_blob_fk') AND NOT convalidated`,
+	)
+	if err != nil {
+		return err
+	}
+	var constraints, collectError = pgx.CollectRows(rows, pgx.RowTo[string])
+	if collectError != nil {
+		return collectError
+	}
+	for _, constraint := range constraints {
+		if _, err := p.db.Exec(ctx, `ALTER TABLE resources VALIDATE CONSTRAINT `+constraint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobReferences returns the locations the database refers to, true for
+// those of blobs and revisions whose file must exist. Files of uploads and
+// of pending removals may be missing.
+func (p *Storage) blobReferences(ctx context.Context) (map[string]bool, error) {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT location, true FROM blobs WHERE location IS NOT NULL
+		UNION ALL SELECT location, true FROM revisions WHERE location IS NOT NULL
+		UNION ALL SELECT location, false FROM uploads
+		UNION ALL SELECT unnest(parts), false FROM uploads
+		UNION ALL SELECT location, false FROM blob_removals`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var references = map[string]bool{}
+	for rows.Next() {
+		var (
+			location string
+			required bool
+		)
+		if err := rows.Scan(&location, &required); err != nil {
+			return nil, err
+		}
+		references[location] = references[location] || required
+	}
+	return references, rows.Err()
+}
+
+// checkFiles returns the required references without a file and the files
+// modified before the cutoff nothing refers to, both sorted
+func checkFiles(files map[string]blobstore.Info, references map[string]bool, cutoff time.Time) ([]string, []string) {
+	var missing, orphans []string
+	for location, required := range references {
+		if _, ok := files[location]; required && !ok {
+			missing = append(missing, location)
+		}
+	}
+	for location, info := range files {
+		if _, ok := references[location]; !ok && info.ModTime.Before(cutoff) {
+			orphans = append(orphans, location)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(orphans)
+	return missing, orphans
+}
+
+// scheduleUnused schedules the removal of the locations referred by
+// neither a blob nor a revision and returns them, removeBlobs removes them
+// once the transaction commits.
+func scheduleUnused(ctx context.Context, tx pgx.Tx, locations []string) ([]string, error) {
+	var unused, err = unusedLocations(ctx, tx, locations)
+	if err != nil {
+		return nil, err
+	}
+	return unused, scheduleRemoval(ctx, tx, unused)
+}
+
+// scheduleRemoval schedules the removal of the locations nothing refers to
+func scheduleRemoval(ctx context.Context, tx pgx.Tx, locations []string) error {
+	if len(locations) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO blob_removals(location) SELECT unnest($1::text[]) ON CONFLICT DO NOTHING`,
+		locations,
+	)
+	return err
+}
@@ -1,24 +1,18 @@
 package postgres
 
 import (
-	"bufio"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path"
-
-	"github.com/google/uuid"
-	"github.com/jackc/pgx"
-	"github.com/jackc/pgx/v5/pgconn"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/crypto/pbkdf2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
 )
 
 var (
@@ -29,6 +23,7 @@ var (
 	ErrUserWrongPassword = fmt.Errorf("user password wrong")
 
 	ErrResourceNotFound = fmt.Errorf("resource not found")
+	ErrVersionMismatch  = fmt.Errorf("resource version mismatch")
 )
 
 const (
@@ -44,19 +39,58 @@ type (
 )
 
 type Piece struct {
-	Content []byte // Content of the piece.
-	Meta    string // Meta info of the piece.
+	Content []byte      // Content of the piece.
+	Meta    string      // Meta info of the piece.
+	Kind    secret.Kind `json:"-"` // Kind of the secret stored in the piece.
+	Opaque  bool        // Content is an envelope encrypted by the client.
+	Version int64       // Version of the resource, see Resource.
+	Team    TeamID      `json:"-"` // Team owning the piece, zero for the vault of the user.
 }
 
 type Blob struct {
-	Content io.ReadCloser // Content of the blob.
-	Meta    string        // Meta info of the blob.
+	Content     io.ReadCloser // Content of the blob, an io.ReadSeeker too when restored.
+	Meta        string        // Meta info of the blob.
+	Size        int64         // Size of the content, set by RestoreBlob.
+	Opaque      bool          // Content is an envelope encrypted by the client.
+	Version     int64         // Version of the resource, see Resource.
+	Team        TeamID        // Team owning the blob, zero for the vault of the user.
+	ContentType string        // ContentType of the content given by the client.
+	Filename    string        // Filename is the original name of the file.
+	Digest      []byte        // Digest is the SHA-256 of the content, set by RestoreBlob if known.
+}
+
+// BlobInfo describes the content of a blob resource
+type BlobInfo struct {
+	Size        int64 // Size of the content, -1 if unknown.
+	ContentType string
+	Filename    string
 }
 
 type Resource struct {
-	ID   ResourceID
-	Type ResourceType
-	Meta string
+	ID        ResourceID
+	Type      ResourceType
+	Kind      secret.Kind
+	Meta      string
+	Version   int64     // Version grows with every change of any resource.
+	UpdatedAt time.Time // UpdatedAt is the time of the last change.
+	CreatedAt time.Time // CreatedAt is the time the resource was stored.
+	Team      TeamID    // Team owning the resource, zero for the vault of the user.
+	Folder    FolderID  // Folder of the resource, zero for the root of the vault.
+	Tags      []string  // Tags of the resource, sorted.
+	Details   Details   // Details is the structured meta of the resource.
+	Blob      *BlobInfo `json:",omitempty"` // Blob describes the content of blobs, nil for pieces.
+}
+
+// resourceColumns are the columns of Resource selected from resources r,
+// scanned by Resource.fields. Type 2 is ResourceTypeBlob.
+const resourceColumns = `r.id, r.type, r.kind, r.meta, r.version, r.updated_at, r.created_at,
+	COALESCE(r.team_id, 0), COALESCE(r.folder_id, 0), r.details,
+	ARRAY(SELECT t.tag FROM resource_tags t WHERE t.rid = r.id ORDER BY t.tag),
+	(SELECT json_build_object('Size', COALESCE(b.size, -1), 'ContentType', b.content_type, 'Filename', b.filename)
+		FROM blobs b WHERE r.type = 2 AND b.id = r.resource)`
+
+func (r *Resource) fields() []any {
+	return []any{&r.ID, &r.Type, &r.Kind, &r.Meta, &r.Version, &r.UpdatedAt, &r.CreatedAt, &r.Team, &r.Folder, &r.Details, &r.Tags, &r.Blob}
 }
 
 type ComposedReadCloser struct {
@@ -72,32 +106,25 @@ func (rc *ComposedReadCloser) Close() error {
 	return rc.Closer.Close()
 }
 
+// StorePiece stores the piece in the vault of the user, or of the team of
+// the piece if the user may write it. A QuotaError is returned if the
+// vault has no room for another resource.
 func (p *Storage) StorePiece(ctx context.Context, piece Piece, c Creds) (ResourceID, error) {
 	if err := p.checkPass(ctx, c); err != nil {
 		return -1, errors.Join(err, ErrUserUnauthorized)
 	}
-
-	var (
-		salt []byte = make([]byte, 8)
-		iv   []byte = make([]byte, 12)
-		key  []byte
-	)
-	if _, err := rand.Read(salt); err != nil {
-		return -1, err
+	var vault, accessError = vaultAccess(ctx, p.db, piece.Team, c)
+	if accessError != nil {
+		return -1, accessError
 	}
-	if _, err := rand.Read(iv); err != nil {
+	if err := vault.writable(); err != nil {
 		return -1, err
 	}
-	key = pbkdf2.Key(([]byte)(c.Passw), salt, keyIter, keyLen, sha256.New)
-	var block, blockError = aes.NewCipher(key)
-	if blockError != nil {
-		return -1, blockError
-	}
-	var aesgcm, aesgcmError = cipher.NewGCM(block)
-	if aesgcmError != nil {
-		return -1, aesgcmError
+
+	var content, iv, wrappedKey, keyID, sealError = p.sealPiece(ctx, piece.Content, piece.Opaque, vault, c)
+	if sealError != nil {
+		return -1, sealError
 	}
-	var content = aesgcm.Seal(nil, iv, piece.Content, nil)
 
 	var transaction, transactionError = p.db.Begin(ctx)
 	if transactionError != nil {
@@ -105,10 +132,14 @@ func (p *Storage) StorePiece(ctx context.Context, piece Piece, c Creds) (Resourc
 	}
 	defer transaction.Rollback(ctx)
 
+	if err := lockOwner(ctx, transaction, vault.lockKey()); err != nil {
+		return -1, err
+	}
+
 	insertPieceResult := transaction.QueryRow(
 		ctx,
-		`INSERT INTO pieces(content, salt, iv) VALUES($1, $2, $3) RETURNING id`,
-		content, salt, iv,
+		`INSERT INTO pieces(content, iv, wrapped_key, key_id, opaque) VALUES($1, $2, $3, $4, $5) RETURNING id`,
+		content, iv, wrappedKey, keyID, piece.Opaque,
 	)
 	var id int
 	if err := insertPieceResult.Scan(&id); err != nil {
@@ -116,13 +147,17 @@ func (p *Storage) StorePiece(ctx context.Context, piece Piece, c Creds) (Resourc
 	}
 	insertResourceResult := transaction.QueryRow(
 		ctx,
-		`INSERT INTO resources(meta, resource, type, owner) VALUES($1, $2, $3, $4) RETURNING id`,
-		piece.Meta, id, (int)(ResourceTypePiece), c.Login,
+		`INSERT INTO resources(meta, resource, type, owner, kind, updated_by, team_id)
+		VALUES($1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, 0)) RETURNING id`,
+		piece.Meta, id, (int)(ResourceTypePiece), vault.owner, piece.Kind, c.Login, vault.team,
 	)
 	var rid int64
 	if err := insertResourceResult.Scan(&rid); err != nil {
 		return -1, err
 	}
+	if err := p.checkQuota(ctx, transaction, vault, 1, 0); err != nil {
+		return -1, err
+	}
 	if err := transaction.Commit(ctx); err != nil {
 		return -1, err
 	}
@@ -136,19 +171,28 @@ func (p *Storage) RestorePiece(ctx context.Context, rid ResourceID, c Creds) (Pi
 	}
 
 	var (
-		meta    string
-		content []byte
-		iv      []byte
-		salt    []byte
+		meta       string
+		kind       secret.Kind
+		content    []byte
+		iv         []byte
+		salt       []byte
+		wrappedKey []byte
+		keyID      *string
+		opaque     bool
+		version    int64
 	)
 
+	var resource, accessError = resourceAccess(ctx, p.db, rid, c)
+	if accessError != nil {
+		return Piece{}, accessError
+	}
 	var queryResourceResult = p.db.QueryRow(
 		ctx,
-		`SELECT meta, resource FROM resources WHERE id = $1 AND owner = $2 AND type = $3`,
-		(int64)(rid), c.Login, (int)(ResourceTypePiece),
+		`SELECT meta, kind, resource, version FROM resources WHERE id = $1 AND type = $2`,
+		(int64)(rid), (int)(ResourceTypePiece),
 	)
 	var id int
-	if err := queryResourceResult.Scan(&meta, &id); err != nil {
+	if err := queryResourceResult.Scan(&meta, &kind, &id, &version); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return Piece{}, ErrResourceNotFound
 		}
@@ -156,19 +200,21 @@ func (p *Storage) RestorePiece(ctx context.Context, rid ResourceID, c Creds) (Pi
 	}
 	var queryPieceResult = p.db.QueryRow(
 		ctx,
-		`SELECT content, iv, salt FROM pieces WHERE id = $1`,
+		`SELECT content, iv, salt, wrapped_key, key_id, opaque FROM pieces WHERE id = $1`,
 		id,
 	)
-	if err := queryPieceResult.Scan(&content, &iv, &salt); err != nil {
+	if err := queryPieceResult.Scan(&content, &iv, &salt, &wrappedKey, &keyID, &opaque); err != nil {
 		return Piece{}, err
 	}
+	if opaque {
+		return Piece{Meta: meta, Kind: kind, Content: content, Opaque: true, Version: version, Team: resource.team}, nil
+	}
 
-	var key = pbkdf2.Key(([]byte)(c.Passw), salt, keyIter, keyLen, sha256.New)
-	var block, blockError = aes.NewCipher(key)
-	if blockError != nil {
-		return Piece{}, blockError
+	var key, keyError = p.readKey(ctx, rid, resource, wrappedKey, keyID, salt, c)
+	if keyError != nil {
+		return Piece{}, keyError
 	}
-	var aesgcm, aesgcmError = cipher.NewGCM(block)
+	var aesgcm, aesgcmError = newGCM(key)
 	if aesgcmError != nil {
 		return Piece{}, aesgcmError
 	}
@@ -176,63 +222,67 @@ func (p *Storage) RestorePiece(ctx context.Context, rid ResourceID, c Creds) (Pi
 	if openError != nil {
 		return Piece{}, openError
 	}
+	if wrappedKey == nil && resource.owner == c.Login {
+		p.adoptLegacyKey(ctx, `UPDATE pieces SET wrapped_key = $2, key_id = $3 WHERE id = $1 AND wrapped_key IS NULL`, id, key, c)
+	}
 
 	var piece = Piece{
 		Meta:    meta,
+		Kind:    kind,
 		Content: decryptedContent,
+		Version: version,
+		Team:    resource.team,
 	}
 	return piece, nil
 }
 
+// StoreBlob stores the blob in the vault of the user, or of the team of the
+// blob if the user may write it. Writing the content stops with a
+// QuotaError once it exceeds the size of a blob or the bytes left to the
+// vault.
 func (p *Storage) StoreBlob(ctx context.Context, blob Blob, c Creds) (ResourceID, error) {
+	return p.storeBlob(ctx, blob, nil, c)
+}
+
+// storeBlob is StoreBlob, keep is called once the content is written unless
+// nil and drops the blob returning false, -1 is returned then
+func (p *Storage) storeBlob(ctx context.Context, blob Blob, keep func() (bool, error), c Creds) (ResourceID, error) {
 	defer blob.Content.Close()
 	if err := p.checkPass(ctx, c); err != nil {
 		return -1, errors.Join(err, ErrUserUnauthorized)
 	}
-
-	var salt []byte = make([]byte, 8)
-	if _, err := rand.Read(salt); err != nil {
+	var vault, accessError = vaultAccess(ctx, p.db, blob.Team, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := vault.writable(); err != nil {
 		return -1, err
 	}
 
-	var block, blockError = aes.NewCipher(
-		pbkdf2.Key(([]byte)(c.Passw), salt, keyIter, keyLen, sha256.New),
-	)
-	if blockError != nil {
-		return -1, blockError
+	var dek, keyError = p.blobDataKey(ctx, blob.Opaque, vault, c)
+	if keyError != nil {
+		return -1, keyError
 	}
-
-	var iv []byte = make([]byte, block.BlockSize())
-	if _, err := rand.Read(iv); err != nil {
-		return -1, err
+	var content, limitError = p.limitBlob(ctx, blob.Content, vault, 0)
+	if limitError != nil {
+		return -1, limitError
 	}
-
-	var location = path.Join(p.BlobsDir, uuid.New().String())
-	var file, createError = os.Create(location)
-	if createError != nil {
-		return -1, createError
+	var stored, writeError = p.writeBlob(ctx, content, blob.Opaque, dek)
+	if writeError != nil {
+		return -1, writeError
 	}
-
-	var (
-		writer = cipher.StreamWriter{
-			S: cipher.NewCTR(block, iv),
-			W: file,
-		}
-		reader = bufio.NewReader(blob.Content)
-	)
-	if _, err := reader.WriteTo(writer); err != nil {
-		log.Printf("failed to write file: %s\n", err.Error())
-		if err := file.Close(); err != nil {
-			log.Printf("failed to close file: %s\n", err.Error())
+	stored.contentType, stored.filename = blob.ContentType, blob.Filename
+	// removed on any failure below, cleared once a resource refers to it
+	var orphan = stored.location
+	defer func() {
+		if orphan != "" {
+			p.removeBlobs(ctx, []string{orphan})
 		}
-		if err := os.Remove(location); err != nil {
-			log.Printf("failed to remove file: %s\n", err.Error())
+	}()
+	if keep != nil {
+		if kept, err := keep(); err != nil || !kept {
+			return -1, err
 		}
-		return -1, err
-	}
-	if err := file.Close(); err != nil {
-		log.Printf("failed to close file: %s\n", err.Error())
-		return -1, err
 	}
 
 	var transaction, transactionError = p.db.Begin(ctx)
@@ -241,33 +291,53 @@ func (p *Storage) StoreBlob(ctx context.Context, blob Blob, c Creds) (ResourceID
 	}
 	defer transaction.Rollback(ctx)
 
+	if err := lockOwner(ctx, transaction, vault.lockKey()); err != nil {
+		return -1, err
+	}
+
+	var rid, insertError = insertBlob(ctx, transaction, vault, blob.Meta, stored, c)
+	if insertError != nil {
+		return -1, insertError
+	}
+	if err := p.checkQuota(ctx, transaction, vault, 1, *stored.size); err != nil {
+		return -1, err
+	}
+
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	orphan = ""
+
+	return rid, nil
+}
+
+// insertBlob adds the stored blob to the vault as a new resource with the meta
+func insertBlob(ctx context.Context, tx pgx.Tx, vault access, meta string, stored storedBlob, c Creds) (ResourceID, error) {
 	var (
 		blobID int
 		rid    int64
 	)
 
-	var insertBlobResult = transaction.QueryRow(
+	var insertBlobResult = tx.QueryRow(
 		ctx,
-		`INSERT INTO blobs(location, iv, salt) VALUES($1, $2, $3) RETURNING id`,
-		location, iv, salt,
+		`INSERT INTO blobs(location, iv, wrapped_key, key_id, opaque, format, size, digest, content_type, filename)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		stored.location, stored.iv, stored.wrappedKey, stored.keyID, stored.opaque, stored.format,
+		stored.size, stored.digest, stored.contentType, stored.filename,
 	)
 	if err := insertBlobResult.Scan(&blobID); err != nil {
 		return -1, err
 	}
 
-	var insertResourceResult = transaction.QueryRow(
+	var insertResourceResult = tx.QueryRow(
 		ctx,
-		`INSERT INTO resources(meta, owner, type, resource) VALUES($1, $2, $3, $4) RETURNING id`,
-		blob.Meta, c.Login, ResourceTypeBlob, blobID,
+		`INSERT INTO resources(meta, owner, type, resource, kind, updated_by, team_id)
+		VALUES($1, NULLIF($2, ''), $3, $4, $5, $6, NULLIF($7, 0)) RETURNING id`,
+		meta, vault.owner, ResourceTypeBlob, blobID, secret.KindBinary, c.Login, vault.team,
 	)
 	if err := insertResourceResult.Scan(&rid); err != nil {
 		return -1, err
 	}
-
-	if err := transaction.Commit(ctx); err != nil {
-		return -1, err
-	}
-
 	return (ResourceID)(rid), nil
 }
 
@@ -276,68 +346,106 @@ func (p *Storage) RestoreBlob(ctx context.Context, rid ResourceID, c Creds) (Blo
 		return Blob{}, errors.Join(err, ErrUserUnauthorized)
 	}
 
+	var resource, accessError = resourceAccess(ctx, p.db, rid, c)
+	if accessError != nil {
+		return Blob{}, accessError
+	}
 	var (
-		iv       []byte
-		salt     []byte
-		location string
-		meta     string
+		meta    string
+		version int64
+		blobID  int
 	)
-
 	var selectResourceResult = p.db.QueryRow(
 		ctx,
-		`SELECT meta, resource FROM resources WHERE id = $1 AND owner = $2`,
-		(int64)(rid), c.Login,
+		`SELECT meta, resource, version FROM resources WHERE id = $1 AND type = $2`,
+		(int64)(rid), (int)(ResourceTypeBlob),
 	)
-	var blobID int
-	if err := selectResourceResult.Scan(&meta, &blobID); err != nil {
+	if err := selectResourceResult.Scan(&meta, &blobID, &version); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Blob{}, ErrResourceNotFound
+		}
 		return Blob{}, err
 	}
 
-	var selectBlobResult = p.db.QueryRow(
-		ctx,
-		`SELECT location, iv, salt FROM blobs WHERE id = $1`,
-		blobID,
-	)
-	if err := selectBlobResult.Scan(&location, &iv, &salt); err != nil {
-		return Blob{}, err
+	var stored, selectError = p.selectBlob(ctx, blobID)
+	if selectError != nil {
+		return Blob{}, selectError
 	}
-
-	var file, fileError = os.Open(location)
-	if fileError != nil {
-		return Blob{}, fileError
+	if !stored.opaque && stored.format == blobFormatCTR && resource.owner == c.Login {
+		// written before blobs were authenticated, rewritten on the first read
+		// of the owner
+		if err := p.upgradeBlob(ctx, stored, c); err != nil {
+			log.Printf("failed to upgrade blob %s: %s\n", stored.location, err.Error())
+		} else if stored, selectError = p.selectBlob(ctx, blobID); selectError != nil {
+			return Blob{}, selectError
+		}
 	}
 
-	var block, blockError = aes.NewCipher(
-		pbkdf2.Key(([]byte)(c.Passw), salt, keyIter, keyLen, sha256.New),
-	)
-	if blockError != nil {
-		return Blob{}, blockError
+	var key []byte
+	if !stored.opaque {
+		var keyError error
+		if key, keyError = p.readKey(ctx, rid, resource, stored.wrappedKey, stored.keyID, stored.salt, c); keyError != nil {
+			return Blob{}, keyError
+		}
 	}
-
-	var blob = Blob{
-		Meta: meta,
-		Content: &ComposedReadCloser{
-			Reader: cipher.StreamReader{
-				S: cipher.NewCTR(block, iv),
-				R: file,
-			},
-			Closer: file,
-		},
+	var content, size, openError = p.openBlob(ctx, stored, key)
+	if openError != nil {
+		return Blob{}, openError
+	}
+	if !stored.opaque && stored.wrappedKey == nil && resource.owner == c.Login {
+		p.adoptLegacyKey(ctx, `UPDATE blobs SET wrapped_key = $2, key_id = $3 WHERE id = $1 AND wrapped_key IS NULL`, blobID, key, c)
+	}
+	if stored.size == nil {
+		// stored before sizes were kept
+		if _, err := p.db.Exec(ctx, `UPDATE blobs SET size = $2 WHERE id = $1 AND size IS NULL`, blobID, size); err != nil {
+			log.Printf("failed to record size of blob %s: %s\n", stored.location, err.Error())
+		}
 	}
+	var blob = Blob{
+		Meta:        meta,
+		Content:     content,
+		Size:        size,
+		Opaque:      stored.opaque,
+		Version:     version,
+		Team:        resource.team,
+		ContentType: stored.contentType,
+		Filename:    stored.filename,
+	}
+	blob.Digest = content.digest
 	return blob, nil
 }
 
+// Delete removes the resource regardless of its version
 func (p *Storage) Delete(ctx context.Context, rid ResourceID, c Creds) error {
+	return p.DeleteVersion(ctx, rid, 0, c)
+}
+
+// DeleteVersion removes the resource if its version equals the given one,
+// zero version matches any. It returns ErrVersionMismatch if the resource
+// was changed since. A tombstone is left for the change feed. Owners and
+// team members who may write delete resources, grantees don't.
+func (p *Storage) DeleteVersion(ctx context.Context, rid ResourceID, version int64, c Creds) error {
 	var transaction, transactionError = p.db.Begin(ctx)
 	if transactionError != nil {
 		return transactionError
 	}
 	defer transaction.Rollback(ctx)
 
+	var resource, accessError = resourceAccess(ctx, transaction, rid, c)
+	if accessError != nil {
+		return accessError
+	}
+	if err := resource.writable(); err != nil || resource.granted(c) {
+		return ErrPermissionDenied
+	}
+	if err := lockOwner(ctx, transaction, resource.lockKey()); err != nil {
+		return err
+	}
+
 	var deleteResourceResult = transaction.QueryRow(
 		ctx,
-		`DELETE FROM resources WHERE id = $1 AND owner = $2 RETURNING type, resource`,
-		(int64)(rid), c.Login,
+		`DELETE FROM resources WHERE id = $1 AND ($2 = 0 OR version = $2) RETURNING type, resource`,
+		(int64)(rid), version,
 	)
 	var (
 		resourceType int
@@ -345,11 +453,22 @@ func (p *Storage) Delete(ctx context.Context, rid ResourceID, c Creds) error {
 	)
 	if err := deleteResourceResult.Scan(&resourceType, &resourceID); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return ErrResourceNotFound
+			return p.missingOrChanged(ctx, transaction, rid)
 		}
 		return err
 	}
 
+	if _, err := transaction.Exec(
+		ctx,
+		`INSERT INTO tombstones(id, owner, team_id) VALUES($1, NULLIF($2, ''), NULLIF($3, 0))`,
+		(int64)(rid), resource.owner, resource.team,
+	); err != nil {
+		return err
+	}
+
+	// blob files of the resource and its revisions are scheduled for removal
+	// and removed after commit
+	var locations []string
 	switch (ResourceType)(resourceType) {
 	case ResourceTypePiece:
 		_, err := transaction.Exec(
@@ -370,67 +489,78 @@ func (p *Storage) Delete(ctx context.Context, rid ResourceID, c Creds) error {
 		if err := deleteResult.Scan(&location); err != nil {
 			return err
 		}
-		if err := os.Remove(location); err != nil {
+		locations = append(locations, location)
+	default:
+		return fmt.Errorf("unknown resource type: %d", resourceType)
+	}
+
+	var revisionsResult, revisionsError = transaction.Query(
+		ctx,
+		`DELETE FROM revisions WHERE rid = $1 RETURNING location`,
+		(int64)(rid),
+	)
+	if revisionsError != nil {
+		return revisionsError
+	}
+	for revisionsResult.Next() {
+		var location *string
+		if err := revisionsResult.Scan(&location); err != nil {
+			revisionsResult.Close()
 			return err
 		}
-	default:
-		log.Fatalf("unknown resource type: %d", resourceType)
+		if location != nil {
+			locations = append(locations, *location)
+		}
+	}
+	revisionsResult.Close()
+	if err := revisionsResult.Err(); err != nil {
+		return err
+	}
+	var unused, unusedError = scheduleUnused(ctx, transaction, locations)
+	if unusedError != nil {
+		return unusedError
 	}
 
 	if err := transaction.Commit(ctx); err != nil {
 		return err
 	}
+	p.removeBlobs(ctx, unused)
 	return nil
 }
 
-func (p *Storage) List(ctx context.Context, c Creds) ([]Resource, error) {
-	var selectResourcesResult, selectResourcesResultError = p.db.Query(
-		ctx,
-		`SELECT id, type, meta FROM resources WHERE owner = $1`,
-		c.Login,
-	)
-	if selectResourcesResultError != nil {
-		log.Fatal(selectResourcesResultError)
-		return nil, selectResourcesResultError
-	}
-	defer selectResourcesResult.Close()
-	var resources []Resource
-	for selectResourcesResult.Next() {
-		if err := selectResourcesResult.Err(); err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-		var resource Resource
-		if err := selectResourcesResult.Scan(&resource.ID, &resource.Type, &resource.Meta); err != nil {
-			log.Fatal(err)
-			return nil, err
+// sealPiece encrypts the piece content with a new key wrapped by the key of
+// the vault and the master key of the returned ID. Opaque content is
+// encrypted by the client and only checked to look like an envelope.
+func (p *Storage) sealPiece(ctx context.Context, plaintext []byte, opaque bool, vault access, c Creds) (content, iv, wrappedKey []byte, keyID *string, err error) {
+	if opaque {
+		if _, err := envelope.ParseHeader(plaintext); err != nil {
+			return nil, nil, nil, nil, err
 		}
-		resources = append(resources, resource)
+		return plaintext, nil, nil, nil, nil
 	}
-	return resources, nil
-}
-
-func (p *Storage) checkPass(ctx context.Context, c Creds) error {
-	var row = p.db.QueryRow(
-		ctx,
-		`SELECT password FROM identities WHERE username = $1`,
-		c.Login,
-	)
-	var encodedPassword string
-	if err := row.Scan(&encodedPassword); err != nil {
-		var pgerr pgconn.PgError
-		if errors.As(err, (any)(&pgerr)) {
-			return ErrUserUnauthorized
-		}
-		return err
+	var dek, keyError = p.vaultKey(ctx, vault, c)
+	if keyError != nil {
+		return nil, nil, nil, nil, keyError
+	}
+	var key []byte
+	if key, wrappedKey, keyID, err = p.newResourceKey(dek); err != nil {
+		return nil, nil, nil, nil, err
 	}
+	if content, iv, err = sealContent(key, plaintext); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return content, iv, wrappedKey, keyID, nil
+}
 
-	var decodedPassword, decodePasswordError = p.EncdP.DecodeString(encodedPassword)
-	if decodePasswordError != nil {
-		return decodePasswordError
+// sealContent encrypts the piece content with the key and a random iv
+func sealContent(key, plaintext []byte) (content, iv []byte, err error) {
+	iv = make([]byte, 12)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword(decodedPassword, ([]byte)(c.Passw)); err != nil {
-		return errors.Join(ErrUserUnauthorized, err)
+	var aesgcm, aesgcmError = newGCM(key)
+	if aesgcmError != nil {
+		return nil, nil, aesgcmError
 	}
-	return nil
+	return aesgcm.Seal(nil, iv, plaintext, nil), iv, nil
 }
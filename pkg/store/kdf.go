@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	kdfArgon2id = "argon2id"
+	kdfPBKDF2   = "pbkdf2-sha256"
+
+	// limits protect from records demanding unreasonable work
+	maxKDFMemory  = 4 * 1024 * 1024
+	maxKDFTime    = 1 << 20
+	maxKDFThreads = 64
+)
+
+var ErrUnknownKDF = fmt.Errorf("unknown key derivation")
+
+// KDF are the parameters deriving a key from a password. They are recorded
+// with every wrapped key, so the parameters can be raised while keys
+// derived with the former ones stay readable.
+type KDF struct {
+	Algorithm string // Algorithm is argon2id, pbkdf2-sha256 is kept for legacy records.
+	Time      uint32 // Time is the number of argon2 passes or pbkdf2 iterations.
+	Memory    uint32 // Memory of argon2 in KiB.
+	Threads   uint8  // Threads of argon2.
+}
+
+var (
+	// DefaultKDF is the minimal Argon2id configuration recommended by
+	// OWASP, the key is derived on every request using the vault.
+	DefaultKDF = KDF{Algorithm: kdfArgon2id, Time: 2, Memory: 19 * 1024, Threads: 1}
+	// LegacyKDF derived keys before Argon2id.
+	LegacyKDF = KDF{Algorithm: kdfPBKDF2, Time: keyIter}
+)
+
+// String encodes the parameters in the PHC string format without salt
+// and hash, e.g. argon2id$v=19$m=19456,t=2,p=1.
+func (k KDF) String() string {
+	if k.Algorithm == kdfPBKDF2 {
+		return fmt.Sprintf("%s$i=%d", kdfPBKDF2, k.Time)
+	}
+	return fmt.Sprintf("%s$v=%d$m=%d,t=%d,p=%d", k.Algorithm, argon2.Version, k.Memory, k.Time, k.Threads)
+}
+
+// ParseKDF decodes parameters encoded by KDF.String
+func ParseKDF(s string) (KDF, error) {
+	var k KDF
+	switch {
+	case strings.HasPrefix(s, kdfArgon2id+"$"):
+		var version int
+		if _, err := fmt.Sscanf(s, kdfArgon2id+"$v=%d$m=%d,t=%d,p=%d", &version, &k.Memory, &k.Time, &k.Threads); err != nil {
+			return KDF{}, fmt.Errorf("%w: %s", ErrUnknownKDF, s)
+		}
+		if version != argon2.Version {
+			return KDF{}, fmt.Errorf("%w: argon2 version %d", ErrUnknownKDF, version)
+		}
+		k.Algorithm = kdfArgon2id
+	case strings.HasPrefix(s, kdfPBKDF2+"$"):
+		if _, err := fmt.Sscanf(s, kdfPBKDF2+"$i=%d", &k.Time); err != nil {
+			return KDF{}, fmt.Errorf("%w: %s", ErrUnknownKDF, s)
+		}
+		k.Algorithm = kdfPBKDF2
+	default:
+		return KDF{}, fmt.Errorf("%w: %s", ErrUnknownKDF, s)
+	}
+	if err := k.Validate(); err != nil {
+		return KDF{}, err
+	}
+	return k, nil
+}
+
+// Validate checks the parameters are usable and within reasonable limits
+func (k KDF) Validate() error {
+	switch {
+	case k.Algorithm != kdfArgon2id && k.Algorithm != kdfPBKDF2:
+		return fmt.Errorf("%w: %s", ErrUnknownKDF, k.Algorithm)
+	case k.Time == 0 || k.Time > maxKDFTime:
+		return fmt.Errorf("%w: time %d out of range", ErrUnknownKDF, k.Time)
+	case k.Algorithm == kdfArgon2id && (k.Memory < 8*uint32(k.Threads) || k.Memory > maxKDFMemory):
+		return fmt.Errorf("%w: memory %d out of range", ErrUnknownKDF, k.Memory)
+	case k.Algorithm == kdfArgon2id && (k.Threads == 0 || k.Threads > maxKDFThreads):
+		return fmt.Errorf("%w: threads %d out of range", ErrUnknownKDF, k.Threads)
+	}
+	return nil
+}
+
+// Key derives a key from the password and the salt
+func (k KDF) Key(password string, salt []byte) []byte {
+	if k.Algorithm == kdfPBKDF2 {
+		return pbkdf2.Key(([]byte)(password), salt, int(k.Time), keyLen, sha256.New)
+	}
+	return argon2.IDKey(([]byte)(password), salt, k.Time, k.Memory, k.Threads, keyLen)
+}
@@ -0,0 +1,359 @@
+package postgres
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrPasswordEmpty = fmt.Errorf("password empty")
+
+// Content of pieces and blobs is encrypted with a random key of the resource.
+// The resource key is wrapped by the data key of the user, which in turn is
+// wrapped by a key derived from the password. Changing the password only
+// rewraps the data key.
+//
+// Resources stored before have no wrapped key, their key is derived from the
+// password and the resource salt with LegacyKDF. Such keys are wrapped by the
+// data key at login, on the next read or when the password changes, so the
+// content stays readable.
+//
+// The key wrapping the data key is derived with the KDF of the storage, the
+// parameters are recorded with the data key. A data key wrapped with other
+// parameters is rewrapped on the next use.
+//
+// With master keys of the server, resource keys wrapped by the data key are
+// wrapped by the active master key in addition, its ID is kept in key_id.
+
+// kdf returns the parameters deriving new password keys
+func (p *Storage) kdf() KDF {
+	if p.KDF == (KDF{}) {
+		return DefaultKDF
+	}
+	return p.KDF
+}
+
+// userKey returns the data key of the user kept by the session or unwrapped
+// with the password. A user registered before data keys gets a new one.
+func (p *Storage) userKey(ctx context.Context, c Creds) ([]byte, error) {
+	if c.session != "" {
+		if c.dek == nil {
+			return nil, ErrSessionKeyless
+		}
+		return c.dek, nil
+	}
+	var (
+		wrapped, salt []byte
+		params        string
+	)
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT dek, dek_salt, dek_kdf FROM identities WHERE id = $1`,
+		c.Login,
+	).Scan(&wrapped, &salt, &params); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserUnauthorized
+		}
+		return nil, err
+	}
+	if wrapped != nil {
+		var kdf, parseError = ParseKDF(params)
+		if parseError != nil {
+			return nil, parseError
+		}
+		var dek, err = unwrapKey(kdf.Key(c.Passw, salt), wrapped)
+		if err != nil {
+			return nil, ErrUserUnauthorized
+		}
+		if kdf != p.kdf() {
+			if err := p.rewrapUserKey(ctx, dek, wrapped, c); err != nil {
+				log.Printf("failed to rewrap data key of %s: %s\n", c.Login, err.Error())
+			}
+		}
+		return dek, nil
+	}
+
+	var dek, wrappedDEK, dekSalt, newError = newUserKey(c.Passw, p.kdf())
+	if newError != nil {
+		return nil, newError
+	}
+	var tag, updateError = p.db.Exec(
+		ctx,
+		`UPDATE identities SET dek = $2, dek_salt = $3, dek_kdf = $4 WHERE id = $1 AND dek IS NULL`,
+		c.Login, wrappedDEK, dekSalt, p.kdf().String(),
+	)
+	if updateError != nil {
+		return nil, updateError
+	}
+	if tag.RowsAffected() == 0 {
+		// created by a concurrent request
+		return p.userKey(ctx, c)
+	}
+	return dek, nil
+}
+
+// rewrapUserKey wraps the data key with a key derived by the current KDF,
+// unless the data key was rewrapped meanwhile.
+func (p *Storage) rewrapUserKey(ctx context.Context, dek, old []byte, c Creds) error {
+	var wrapped, salt, err = wrapUserKey(dek, c.Passw, p.kdf())
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		ctx,
+		`UPDATE identities SET dek = $2, dek_salt = $3, dek_kdf = $4 WHERE id = $1 AND dek = $5`,
+		c.Login, wrapped, salt, p.kdf().String(), old,
+	)
+	return err
+}
+
+// ChangePassword sets the new password of the user, it must satisfy the
+// policy. The data key is rewrapped with the new password, resources keep
+// their keys. Keys of resources stored before data keys are wrapped by the
+// data key first.
+func (p *Storage) ChangePassword(ctx context.Context, c Creds, password string) error {
+	if err := p.policy().Validate(c.Login, password); err != nil {
+		return err
+	}
+	// the current password is required even within a session
+	c = Creds{Login: c.Login, Passw: c.Passw}
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+	var dek, keyError = p.userKey(ctx, c)
+	if keyError != nil {
+		return keyError
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, c.Login); err != nil {
+		return err
+	}
+	if err := p.wrapLegacyKeys(ctx, transaction, dek, c); err != nil {
+		return err
+	}
+
+	var wrapped, salt, wrapError = wrapUserKey(dek, password, p.kdf())
+	if wrapError != nil {
+		return wrapError
+	}
+	var hash, hashError = hashPassword(password, p.kdf())
+	if hashError != nil {
+		return hashError
+	}
+	var tag, updateError = transaction.Exec(
+		ctx,
+		`UPDATE identities SET password_hash = $2, dek = $3, dek_salt = $4, dek_kdf = $5 WHERE id = $1`,
+		c.Login, hash, wrapped, salt, p.kdf().String(),
+	)
+	if updateError != nil {
+		return updateError
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return transaction.Commit(ctx)
+}
+
+// wrapLegacyKeys wraps the password derived keys of the user resources by
+// the data key, the content is not touched.
+func (p *Storage) wrapLegacyKeys(ctx context.Context, tx pgx.Tx, dek []byte, c Creds) error {
+	var queries = []struct {
+		selectQuery string
+		args        []any
+		updateQuery string
+	}{
+		{
+			`SELECT p.id, p.salt FROM pieces p JOIN resources r ON r.resource = p.id AND r.type = $2
+			WHERE r.owner = $1 AND p.wrapped_key IS NULL AND NOT p.opaque AND p.salt IS NOT NULL`,
+			[]any{c.Login, (int)(ResourceTypePiece)},
+			`UPDATE pieces SET wrapped_key = $2, key_id = $3 WHERE id = $1`,
+		},
+		{
+			`SELECT b.id, b.salt FROM blobs b JOIN resources r ON r.resource = b.id AND r.type = $2
+			WHERE r.owner = $1 AND b.wrapped_key IS NULL AND NOT b.opaque AND b.salt IS NOT NULL`,
+			[]any{c.Login, (int)(ResourceTypeBlob)},
+			`UPDATE blobs SET wrapped_key = $2, key_id = $3 WHERE id = $1`,
+		},
+		{
+			`SELECT id, salt FROM revisions
+			WHERE owner = $1 AND wrapped_key IS NULL AND NOT opaque AND salt IS NOT NULL`,
+			[]any{c.Login},
+			`UPDATE revisions SET wrapped_key = $2, key_id = $3 WHERE id = $1`,
+		},
+	}
+	for _, q := range queries {
+		var rows, queryError = tx.Query(ctx, q.selectQuery, q.args...)
+		if queryError != nil {
+			return queryError
+		}
+		var (
+			ids   []int
+			salts [][]byte
+		)
+		for rows.Next() {
+			var (
+				id   int
+				salt []byte
+			)
+			if err := rows.Scan(&id, &salt); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			salts = append(salts, salt)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			var wrapped, keyID, err = p.wrapResourceKey(dek, legacyKey(salts[i], c))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, q.updateQuery, id, wrapped, keyID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newUserKey returns a random data key wrapped with the password
+func newUserKey(password string, kdf KDF) (dek, wrapped, salt []byte, err error) {
+	dek = make([]byte, keyLen)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, nil, nil, err
+	}
+	if wrapped, salt, err = wrapUserKey(dek, password, kdf); err != nil {
+		return nil, nil, nil, err
+	}
+	return dek, wrapped, salt, nil
+}
+
+// wrapUserKey wraps the data key with a key derived from the password and
+// a new salt
+func wrapUserKey(dek []byte, password string, kdf KDF) (wrapped, salt []byte, err error) {
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	if wrapped, err = wrapKey(kdf.Key(password, salt), dek); err != nil {
+		return nil, nil, err
+	}
+	return wrapped, salt, nil
+}
+
+// newResourceKey returns a random resource key, the wrapped key and the ID
+// of the master key wrapping it
+func (p *Storage) newResourceKey(dek []byte) (key, wrapped []byte, keyID *string, err error) {
+	key = make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, nil, err
+	}
+	if wrapped, keyID, err = p.wrapResourceKey(dek, key); err != nil {
+		return nil, nil, nil, err
+	}
+	return key, wrapped, keyID, nil
+}
+
+// wrapResourceKey wraps the resource key by the data key and the active
+// master key, the ID of the master key is nil without master keys.
+func (p *Storage) wrapResourceKey(dek, key []byte) ([]byte, *string, error) {
+	var wrapped, err = wrapKey(dek, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Master.wrap(wrapped)
+}
+
+// resourceKey returns the key of the resource content, unwrapped by the
+// master key of the ID and the data key, or derived from the password for
+// resources without wrapped key.
+func (p *Storage) resourceKey(ctx context.Context, wrapped []byte, keyID *string, salt []byte, c Creds) ([]byte, error) {
+	if wrapped == nil {
+		if c.Passw == "" {
+			// sessions have no password, legacy keys are wrapped at login
+			return nil, ErrUserUnauthorized
+		}
+		return legacyKey(salt, c), nil
+	}
+	var dekWrapped, masterError = p.Master.unwrap(wrapped, keyID)
+	if masterError != nil {
+		return nil, masterError
+	}
+	var dek, keyError = p.userKey(ctx, c)
+	if keyError != nil {
+		return nil, keyError
+	}
+	return unwrapKey(dek, dekWrapped)
+}
+
+// adoptLegacyKey wraps the key of a resource stored before data keys by the
+// data key, the query updates the wrapped key of the row if still missing.
+// Failures are only logged, the key is derived from the password again then.
+func (p *Storage) adoptLegacyKey(ctx context.Context, query string, id int, key []byte, c Creds) {
+	var dek, keyError = p.userKey(ctx, c)
+	if keyError != nil {
+		log.Printf("failed to wrap legacy key: %s\n", keyError.Error())
+		return
+	}
+	var wrapped, keyID, wrapError = p.wrapResourceKey(dek, key)
+	if wrapError != nil {
+		log.Printf("failed to wrap legacy key: %s\n", wrapError.Error())
+		return
+	}
+	if _, err := p.db.Exec(ctx, query, id, wrapped, keyID); err != nil {
+		log.Printf("failed to wrap legacy key: %s\n", err.Error())
+	}
+}
+
+// legacyKey derives the key of resources stored before data keys
+func legacyKey(salt []byte, c Creds) []byte {
+	return LegacyKDF.Key(c.Passw, salt)
+}
+
+// wrapKey seals the key with AES-GCM, the nonce is prepended
+func wrapKey(kek, key []byte) ([]byte, error) {
+	var aead, err = newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	var aead, err = newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	var block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
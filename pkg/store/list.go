@@ -0,0 +1,268 @@
+package postgres
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+var ErrQueryInvalid = fmt.Errorf("list query invalid")
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// ListSort orders listed resources, ties are broken by the resource ID
+type ListSort string
+
+const (
+	SortID      ListSort = "id"
+	SortName    ListSort = "name"
+	SortCreated ListSort = "created"
+	SortUpdated ListSort = "updated"
+)
+
+// sortColumns maps sorts to the columns of resources r and the types of
+// their cursor values
+var sortColumns = map[ListSort][2]string{
+	SortID:      {"r.id", ""},
+	SortName:    {"r.name", "text"},
+	SortCreated: {"r.created_at", "timestamptz"},
+	SortUpdated: {"r.updated_at", "timestamptz"},
+}
+
+// ListQuery selects a page of the resources of the user and of the teams of
+// the user. Zero fields select everything.
+type ListQuery struct {
+	Type   ResourceType // Type of the resources.
+	Kind   secret.Kind  // Kind of the secrets, binary for blobs.
+	Team   *TeamID      // Team vault of the resources, zero for the vault of the user.
+	Folder *FolderID    // Folder of the resources, zero for the root.
+	Tags   []string     // Tags all resources have.
+	Search string       // Search matches titles and meta in web search syntax.
+	Sort   ListSort     // Sort of the resources, SortID by default.
+	Desc   bool         // Desc reverses the sort.
+	Limit  int          // Limit of the page, DefaultPageSize by default.
+	Cursor string       // Cursor is the Next of the previous page.
+}
+
+// ResourcePage is a page of listed resources
+type ResourcePage struct {
+	Resources []Resource
+	Next      string // Next is the cursor of the next page, empty on the last page.
+}
+
+// pageCursor is the last resource of a page. It is bound to the sort, so
+// a cursor of another sort is rejected rather than skipping resources.
+type pageCursor struct {
+	Sort  ListSort `json:"s"`
+	Desc  bool     `json:"d,omitempty"`
+	Value string   `json:"v,omitempty"`
+	ID    int64    `json:"i"`
+}
+
+// ParseListSort parses a sort name, prefixed with "-" for the descending
+// order
+func ParseListSort(sort string) (ListSort, bool, error) {
+	var (
+		desc bool
+		name = sort
+	)
+	if after, ok := strings.CutPrefix(sort, "-"); ok {
+		desc, name = true, after
+	}
+	if name == "" {
+		return SortID, desc, nil
+	}
+	if _, ok := sortColumns[ListSort(name)]; !ok {
+		return "", false, fmt.Errorf("%w: unknown sort %q", ErrQueryInvalid, sort)
+	}
+	return ListSort(name), desc, nil
+}
+
+// List returns a page of the resources of the user and of the teams of the
+// user selected by the query. Pages are stable for a cursor, resources
+// changed while paging move to the page of their new sort value.
+func (p *Storage) List(ctx context.Context, query ListQuery, c Creds) (ResourcePage, error) {
+	if err := query.normalize(); err != nil {
+		return ResourcePage{}, err
+	}
+	var statement, args, statementError = query.statement(c)
+	if statementError != nil {
+		return ResourcePage{}, statementError
+	}
+
+	var selectResourcesResult, selectResourcesResultError = p.db.Query(ctx, statement, args...)
+	if selectResourcesResultError != nil {
+		return ResourcePage{}, selectResourcesResultError
+	}
+	defer selectResourcesResult.Close()
+	var page ResourcePage
+	for selectResourcesResult.Next() {
+		var resource Resource
+		if err := selectResourcesResult.Scan(resource.fields()...); err != nil {
+			return ResourcePage{}, err
+		}
+		page.Resources = append(page.Resources, resource)
+	}
+	if err := selectResourcesResult.Err(); err != nil {
+		return ResourcePage{}, err
+	}
+
+	// one resource more than the limit is selected to know a next page exists
+	if len(page.Resources) > query.Limit {
+		page.Resources = page.Resources[:query.Limit]
+		page.Next = query.cursor(page.Resources[query.Limit-1]).encode()
+	}
+	return page, nil
+}
+
+func (q *ListQuery) normalize() error {
+	if q.Type != 0 && q.Type != ResourceTypePiece && q.Type != ResourceTypeBlob {
+		return fmt.Errorf("%w: unknown type %d", ErrQueryInvalid, q.Type)
+	}
+	if q.Kind != "" && q.Kind != secret.KindBinary && !slices.Contains(secret.Kinds, q.Kind) {
+		return fmt.Errorf("%w: unknown kind %q", ErrQueryInvalid, q.Kind)
+	}
+	if q.Sort == "" {
+		q.Sort = SortID
+	}
+	if _, ok := sortColumns[q.Sort]; !ok {
+		return fmt.Errorf("%w: unknown sort %q", ErrQueryInvalid, q.Sort)
+	}
+	switch {
+	case q.Limit < 0 || q.Limit > MaxPageSize:
+		return fmt.Errorf("%w: limit must be between 1 and %d", ErrQueryInvalid, MaxPageSize)
+	case q.Limit == 0:
+		q.Limit = DefaultPageSize
+	}
+	for i, tag := range q.Tags {
+		var normalized, err = normalizeTag(tag)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrQueryInvalid, err)
+		}
+		q.Tags[i] = normalized
+	}
+	q.Search = strings.TrimSpace(q.Search)
+	return nil
+}
+
+// statement builds the select of the query with its arguments
+func (q *ListQuery) statement(c Creds) (string, []any, error) {
+	var (
+		args  = []any{c.Login}
+		where = []string{`(r.owner = $1 OR r.team_id IN (SELECT team_id FROM team_members WHERE login = $1))`}
+	)
+	var arg = func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.Type != 0 {
+		where = append(where, `r.type = `+arg((int)(q.Type)))
+	}
+	if q.Kind != "" {
+		where = append(where, `r.kind = `+arg(q.Kind))
+	}
+	switch {
+	case q.Team == nil:
+	case *q.Team == 0:
+		where = append(where, `r.team_id IS NULL`)
+	default:
+		where = append(where, `r.team_id = `+arg(*q.Team))
+	}
+	switch {
+	case q.Folder == nil:
+	case *q.Folder == 0:
+		where = append(where, `r.folder_id IS NULL`)
+	default:
+		where = append(where, `r.folder_id = `+arg(*q.Folder))
+	}
+	for _, tag := range q.Tags {
+		where = append(where, `EXISTS(SELECT 1 FROM resource_tags t WHERE t.rid = r.id AND t.tag = `+arg(tag)+`)`)
+	}
+	if q.Search != "" {
+		where = append(where, `r.search @@ websearch_to_tsquery('simple', `+arg(q.Search)+`)`)
+	}
+
+	var (
+		column    = sortColumns[q.Sort]
+		order     = "ASC"
+		following = ">"
+	)
+	if q.Desc {
+		order, following = "DESC", "<"
+	}
+	if q.Cursor != "" {
+		var cursor, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		if cursor.Sort != q.Sort || cursor.Desc != q.Desc {
+			return "", nil, fmt.Errorf("%w: cursor of another sort", ErrQueryInvalid)
+		}
+		if q.Sort == SortID {
+			where = append(where, `r.id `+following+` `+arg(cursor.ID))
+		} else {
+			where = append(where, `(`+column[0]+`, r.id) `+following+` (`+arg(cursor.Value)+`::`+column[1]+`, `+arg(cursor.ID)+`)`)
+		}
+	}
+
+	var orderBy = `r.id ` + order
+	if q.Sort != SortID {
+		orderBy = column[0] + ` ` + order + `, ` + orderBy
+	}
+	return `SELECT ` + resourceColumns + ` FROM resources r
+		WHERE ` + strings.Join(where, ` AND `) + `
+		ORDER BY ` + orderBy + ` LIMIT ` + strconv.Itoa(q.Limit+1), args, nil
+}
+
+// cursor returns the cursor of the page ending with the resource
+func (q *ListQuery) cursor(r Resource) pageCursor {
+	var cursor = pageCursor{Sort: q.Sort, Desc: q.Desc, ID: (int64)(r.ID)}
+	switch q.Sort {
+	case SortName:
+		cursor.Value = r.name()
+	case SortCreated:
+		cursor.Value = r.CreatedAt.Format(time.RFC3339Nano)
+	case SortUpdated:
+		cursor.Value = r.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// name is the name column of the resource
+func (r *Resource) name() string {
+	if r.Details.Title != "" {
+		return r.Details.Title
+	}
+	return r.Meta
+}
+
+func (c pageCursor) encode() string {
+	var data, _ = json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var cursor pageCursor
+	var data, err = base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("%w: malformed cursor", ErrQueryInvalid)
+	}
+	if _, ok := sortColumns[cursor.Sort]; !ok {
+		return pageCursor{}, fmt.Errorf("%w: malformed cursor", ErrQueryInvalid)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,212 @@
+package postgres
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+var (
+	ErrMasterKeyUnknown = fmt.Errorf("unknown master key")
+	ErrNoMasterKey      = fmt.Errorf("no master key")
+)
+
+// rotateBatch is the number of rows rewrapped per query by RotateKeys
+const rotateBatch = 100
+
+// MasterKeys are the server keys wrapping resource keys on top of the data
+// keys of users, a copy of the database alone is not enough to read the
+// content even with the password of the user. The ID of the master key is
+// recorded with every wrapped key, former keys are kept in the keyring
+// until RotateKeys rewrapped their rows with the active key.
+type MasterKeys struct {
+	active string
+	keys   map[string][]byte
+}
+
+// ParseMasterKeys reads the keyring, one key per line or separated by
+// commas as ID:base64. Empty lines and lines starting with # are skipped.
+// New keys are wrapped by the key of the active ID, or by the last key if
+// active is empty.
+func ParseMasterKeys(r io.Reader, active string) (*MasterKeys, error) {
+	var (
+		m       = &MasterKeys{keys: make(map[string][]byte)}
+		scanner = bufio.NewScanner(r)
+		last    string
+	)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			var id, encoded, found = strings.Cut(strings.TrimSpace(entry), ":")
+			if !found || id == "" {
+				return nil, fmt.Errorf("malformed master key entry %q", entry)
+			}
+			var key, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(key) != keyLen {
+				return nil, fmt.Errorf("master key %s must be %d base64 encoded bytes", id, keyLen)
+			}
+			if _, ok := m.keys[id]; ok {
+				return nil, fmt.Errorf("duplicate master key %s", id)
+			}
+			m.keys[id] = key
+			last = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if active == "" {
+		active = last
+	}
+	if _, ok := m.keys[active]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMasterKeyUnknown, active)
+	}
+	m.active = active
+	return m, nil
+}
+
+// Active returns the ID of the key wrapping new keys
+func (m *MasterKeys) Active() string {
+	if m == nil {
+		return ""
+	}
+	return m.active
+}
+
+// wrap wraps the key by the active master key and returns its ID, the key
+// is returned as is without master keys.
+func (m *MasterKeys) wrap(key []byte) ([]byte, *string, error) {
+	if m == nil {
+		return key, nil, nil
+	}
+	var wrapped, err = wrapKey(m.keys[m.active], key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var id = m.active
+	return wrapped, &id, nil
+}
+
+// unwrap unwraps the key by the master key of the ID, the key is returned
+// as is without ID.
+func (m *MasterKeys) unwrap(wrapped []byte, id *string) ([]byte, error) {
+	if id == nil {
+		return wrapped, nil
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMasterKeyUnknown, *id)
+	}
+	var key, ok = m.keys[*id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMasterKeyUnknown, *id)
+	}
+	return unwrapKey(key, wrapped)
+}
+
+// rotation names the wrapped keys of a table with the ID of their master
+// key, first is the id below all ids of the table
+type rotation struct {
+	table   string
+	wrapped string
+	keyID   string
+	first   any
+}
+
+// rotations are the tables of keys wrapped by master keys
+var rotations = []rotation{
+	{table: "pieces", wrapped: "wrapped_key", keyID: "key_id", first: 0},
+	{table: "blobs", wrapped: "wrapped_key", keyID: "key_id", first: 0},
+	{table: "revisions", wrapped: "wrapped_key", keyID: "key_id", first: 0},
+	{table: "resource_grants", wrapped: "wrapped_key", keyID: "key_id", first: 0},
+	{table: "team_members", wrapped: "wrapped_key", keyID: "key_id", first: 0},
+	{table: "identities", wrapped: "totp_secret", keyID: "totp_key_id", first: ""},
+}
+
+// RotateKeys rewraps the resource keys of all pieces, blobs, revisions,
+// grants, the team keys and the TOTP secrets by the active master key.
+// Keys wrapped by the data key only are wrapped by the master key too.
+// Rows are rewritten one by one and skipped if changed meanwhile, so
+// servers keep running. It returns the number of rewrapped keys.
+func (p *Storage) RotateKeys(ctx context.Context) (int, error) {
+	if p.Master == nil {
+		return 0, ErrNoMasterKey
+	}
+	var rotated int
+	for _, r := range rotations {
+		var n, err = p.rotateTable(ctx, r)
+		rotated += n
+		if err != nil {
+			return rotated, fmt.Errorf("rotate %s: %w", r.table, err)
+		}
+	}
+	return rotated, nil
+}
+
+// rotateTable rewraps the keys of the table in batches ordered by id
+func (p *Storage) rotateTable(ctx context.Context, r rotation) (int, error) {
+	var (
+		selectQuery = `SELECT id, ` + r.wrapped + `, ` + r.keyID + ` FROM ` + r.table + `
+			WHERE id > $1 AND ` + r.wrapped + ` IS NOT NULL AND ` + r.keyID + ` IS DISTINCT FROM $2
+			ORDER BY id LIMIT $3`
+		updateQuery = `UPDATE ` + r.table + ` SET ` + r.wrapped + ` = $2, ` + r.keyID + ` = $3
+			WHERE id = $1 AND ` + r.wrapped + ` = $4`
+		rotated int
+		last    = r.first
+	)
+	for {
+		type row struct {
+			id      any
+			wrapped []byte
+			keyID   *string
+		}
+		var rows, queryError = p.db.Query(ctx, selectQuery, last, p.Master.active, rotateBatch)
+		if queryError != nil {
+			return rotated, queryError
+		}
+		var batch []row
+		for rows.Next() {
+			var b row
+			if err := rows.Scan(&b.id, &b.wrapped, &b.keyID); err != nil {
+				rows.Close()
+				return rotated, err
+			}
+			batch = append(batch, b)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rotated, err
+		}
+		if len(batch) == 0 {
+			return rotated, nil
+		}
+
+		for _, b := range batch {
+			last = b.id
+			var key, unwrapError = p.Master.unwrap(b.wrapped, b.keyID)
+			if unwrapError != nil {
+				return rotated, fmt.Errorf("row %v: %w", b.id, unwrapError)
+			}
+			var wrapped, keyID, wrapError = p.Master.wrap(key)
+			if wrapError != nil {
+				return rotated, wrapError
+			}
+			var tag, updateError = p.db.Exec(ctx, updateQuery, b.id, wrapped, keyID, b.wrapped)
+			if updateError != nil {
+				return rotated, updateError
+			}
+			if tag.RowsAffected() == 0 {
+				// rewritten meanwhile, new keys are wrapped by the active key already
+				log.Printf("[DEBUG] %s row %v changed while rotating", r.table, b.id)
+				continue
+			}
+			rotated++
+		}
+	}
+}
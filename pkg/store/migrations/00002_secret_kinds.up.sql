@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT '';
+UPDATE resources SET kind = 'binary' WHERE type = 2;
+
+-- +goose Down
+ALTER TABLE resources DROP COLUMN kind;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE pieces ADD COLUMN IF NOT EXISTS opaque BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS opaque BOOLEAN NOT NULL DEFAULT false;
+
+-- +goose Down
+ALTER TABLE pieces DROP COLUMN opaque;
+ALTER TABLE blobs DROP COLUMN opaque;
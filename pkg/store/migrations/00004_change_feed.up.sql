@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE SEQUENCE IF NOT EXISTS resource_version_seq;
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT nextval('resource_version_seq');
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS resources_owner_version_idx ON resources(owner, version);
+
+CREATE TABLE IF NOT EXISTS tombstones(
+    id INTEGER PRIMARY KEY,
+    owner TEXT NOT NULL,
+    version BIGINT NOT NULL DEFAULT nextval('resource_version_seq'),
+    deleted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS tombstones_owner_version_idx ON tombstones(owner, version);
+
+-- +goose Down
+DROP TABLE tombstones;
+DROP INDEX resources_owner_version_idx;
+ALTER TABLE resources DROP COLUMN updated_at;
+ALTER TABLE resources DROP COLUMN version;
+DROP SEQUENCE resource_version_seq;
@@ -0,0 +1,28 @@
+-- +goose Up
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS updated_by TEXT NOT NULL DEFAULT '';
+UPDATE resources SET updated_by = owner;
+
+CREATE TABLE IF NOT EXISTS revisions(
+    id SERIAL PRIMARY KEY,
+    rid INTEGER NOT NULL,
+    owner TEXT NOT NULL,
+    version BIGINT NOT NULL,
+    type INTEGER NOT NULL,
+    kind TEXT NOT NULL DEFAULT '',
+    meta TEXT,
+    content BYTEA,
+    location TEXT,
+    salt BYTEA,
+    iv BYTEA,
+    opaque BOOLEAN NOT NULL DEFAULT false,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (rid, version)
+);
+CREATE INDEX IF NOT EXISTS revisions_location_idx ON revisions(location);
+CREATE INDEX IF NOT EXISTS revisions_archived_at_idx ON revisions(archived_at);
+
+-- +goose Down
+DROP TABLE revisions;
+ALTER TABLE resources DROP COLUMN updated_by;
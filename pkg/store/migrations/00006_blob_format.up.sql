@@ -0,0 +1,8 @@
+-- +goose Up
+-- 0 is AES-CTR written before, 1 is the chunked AEAD stream
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS format SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS format SMALLINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE revisions DROP COLUMN format;
+ALTER TABLE blobs DROP COLUMN format;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- data key of the user wrapped by a key derived from the password
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS dek BYTEA;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS dek_salt BYTEA;
+
+-- key of the content wrapped by the data key, NULL for content encrypted
+-- with a key derived from the password directly
+ALTER TABLE pieces ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+
+-- +goose Down
+ALTER TABLE revisions DROP COLUMN wrapped_key;
+ALTER TABLE blobs DROP COLUMN wrapped_key;
+ALTER TABLE pieces DROP COLUMN wrapped_key;
+ALTER TABLE identities DROP COLUMN dek_salt;
+ALTER TABLE identities DROP COLUMN dek;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- parameters of the key wrapping the data key, data keys wrapped before
+-- were derived with PBKDF2
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS dek_kdf TEXT NOT NULL DEFAULT 'pbkdf2-sha256$i=4096';
+
+-- +goose Down
+ALTER TABLE identities DROP COLUMN dek_kdf;
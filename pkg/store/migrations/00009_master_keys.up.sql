@@ -0,0 +1,11 @@
+-- +goose Up
+-- ID of the server master key wrapping the resource key, NULL if the key is
+-- wrapped by the data key of the user only
+ALTER TABLE pieces ADD COLUMN IF NOT EXISTS key_id TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS key_id TEXT;
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS key_id TEXT;
+
+-- +goose Down
+ALTER TABLE revisions DROP COLUMN key_id;
+ALTER TABLE blobs DROP COLUMN key_id;
+ALTER TABLE pieces DROP COLUMN key_id;
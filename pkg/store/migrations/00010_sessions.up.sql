@@ -0,0 +1,16 @@
+-- +goose Up
+-- sessions opened at login, the data key of the user is wrapped by a key
+-- derived from the token key of key_id, NULL in zero knowledge mode
+CREATE TABLE IF NOT EXISTS sessions(
+    id TEXT PRIMARY KEY,
+    owner TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    wrapped_dek BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_owner_idx ON sessions(owner);
+
+-- +goose Down
+DROP TABLE sessions;
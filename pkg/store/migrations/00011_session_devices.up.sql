@@ -0,0 +1,12 @@
+-- +goose Up
+-- hash of the refresh token, the device of the session and its last use
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS refresh_hash BYTEA;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- +goose Down
+ALTER TABLE sessions DROP COLUMN last_seen;
+ALTER TABLE sessions DROP COLUMN ip;
+ALTER TABLE sessions DROP COLUMN user_agent;
+ALTER TABLE sessions DROP COLUMN refresh_hash;
@@ -0,0 +1,27 @@
+-- +goose Up
+-- TOTP secret wrapped by the master key of totp_key_id, required at login
+-- once enabled, codes of the last accepted step and before are rejected
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS totp_secret BYTEA;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS totp_key_id TEXT;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- hashes of unused recovery codes
+CREATE TABLE IF NOT EXISTS recovery_codes(
+    owner TEXT NOT NULL,
+    hash BYTEA NOT NULL,
+    PRIMARY KEY(owner, hash)
+);
+
+-- sessions waiting for the second factor and the codes tried
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS pending BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE sessions DROP COLUMN attempts;
+ALTER TABLE sessions DROP COLUMN pending;
+DROP TABLE recovery_codes;
+ALTER TABLE identities DROP COLUMN totp_last_step;
+ALTER TABLE identities DROP COLUMN totp_enabled;
+ALTER TABLE identities DROP COLUMN totp_key_id;
+ALTER TABLE identities DROP COLUMN totp_secret;
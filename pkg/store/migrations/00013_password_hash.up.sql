@@ -0,0 +1,12 @@
+-- +goose Up
+-- passwords are kept as hashes, argon2id PHC strings from now on. Passwords
+-- registered before were kept in plaintext, they are hashed with bcrypt here
+-- and rehashed with argon2id at the next login.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+ALTER TABLE identities RENAME COLUMN passw TO password_hash;
+UPDATE identities SET password_hash = crypt(password_hash, gen_salt('bf', 10))
+    WHERE password_hash IS NOT NULL AND password_hash NOT LIKE '$2_$%';
+
+-- +goose Down
+-- the plaintext is gone, the hashes are kept
+ALTER TABLE identities RENAME COLUMN password_hash TO passw;
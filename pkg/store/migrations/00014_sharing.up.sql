@@ -0,0 +1,26 @@
+-- +goose Up
+-- X25519 key pair of the user, the private key wrapped by the data key;
+-- users get one at the next login
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS public_key BYTEA;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS private_key BYTEA;
+
+-- access of other users to a resource, the resource key is wrapped to the
+-- public key of the grantee and by the master key of key_id. The wrapped
+-- key is NULL while the content is encrypted by the client.
+CREATE TABLE IF NOT EXISTS resource_grants(
+    id SERIAL PRIMARY KEY,
+    rid INTEGER NOT NULL REFERENCES resources(id) ON DELETE CASCADE,
+    grantee TEXT NOT NULL,
+    permission TEXT NOT NULL CHECK (permission IN ('read', 'write')),
+    wrapped_key BYTEA,
+    key_id TEXT,
+    granted_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE(rid, grantee)
+);
+CREATE INDEX IF NOT EXISTS resource_grants_grantee ON resource_grants(grantee);
+
+-- +goose Down
+DROP TABLE resource_grants;
+ALTER TABLE identities DROP COLUMN private_key;
+ALTER TABLE identities DROP COLUMN public_key;
@@ -0,0 +1,59 @@
+-- +goose Up
+-- organisations with the roles of their members, owners and admins manage
+-- the organisation, editors write and viewers read the team vaults
+CREATE TABLE IF NOT EXISTS orgs(
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS org_members(
+    org_id INTEGER NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+    login TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'editor', 'viewer')),
+    PRIMARY KEY(org_id, login)
+);
+CREATE INDEX IF NOT EXISTS org_members_login ON org_members(login);
+
+-- teams own vaults, the team key is wrapped to the public key of every
+-- member and by the master key of key_id
+CREATE TABLE IF NOT EXISTS teams(
+    id SERIAL PRIMARY KEY,
+    org_id INTEGER NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE(org_id, name)
+);
+CREATE TABLE IF NOT EXISTS team_members(
+    id SERIAL PRIMARY KEY,
+    team_id INTEGER NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    login TEXT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    key_id TEXT,
+    joined_version BIGINT NOT NULL DEFAULT nextval('resource_version_seq'),
+    UNIQUE(team_id, login)
+);
+CREATE INDEX IF NOT EXISTS team_members_login ON team_members(login);
+
+-- resources of a team vault have no owner
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS team_id INTEGER REFERENCES teams(id);
+CREATE INDEX IF NOT EXISTS resources_team_version_idx ON resources(team_id, version);
+ALTER TABLE revisions ALTER COLUMN owner DROP NOT NULL;
+ALTER TABLE tombstones ALTER COLUMN owner DROP NOT NULL;
+ALTER TABLE tombstones ADD COLUMN IF NOT EXISTS team_id INTEGER;
+CREATE INDEX IF NOT EXISTS tombstones_team_version_idx ON tombstones(team_id, version);
+
+-- +goose Down
+DELETE FROM tombstones WHERE owner IS NULL;
+DELETE FROM revisions WHERE owner IS NULL;
+DELETE FROM resources WHERE team_id IS NOT NULL;
+DROP INDEX tombstones_team_version_idx;
+ALTER TABLE tombstones DROP COLUMN team_id;
+ALTER TABLE tombstones ALTER COLUMN owner SET NOT NULL;
+ALTER TABLE revisions ALTER COLUMN owner SET NOT NULL;
+DROP INDEX resources_team_version_idx;
+ALTER TABLE resources DROP COLUMN team_id;
+DROP TABLE team_members;
+DROP TABLE teams;
+DROP TABLE org_members;
+DROP TABLE orgs;
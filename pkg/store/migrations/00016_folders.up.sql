@@ -0,0 +1,31 @@
+-- +goose Up
+-- folders of a vault form a tree, a folder belongs to the vault of its
+-- owner or of its team as resources do
+CREATE TABLE IF NOT EXISTS folders(
+    id SERIAL PRIMARY KEY,
+    owner TEXT,
+    team_id INTEGER REFERENCES teams(id) ON DELETE CASCADE,
+    parent_id INTEGER REFERENCES folders(id),
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((owner IS NULL) <> (team_id IS NULL))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS folders_name_idx
+    ON folders(COALESCE(owner, ''), COALESCE(team_id, 0), COALESCE(parent_id, 0), name);
+
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL;
+-- structured meta, the title, notes, urls and custom fields of the resource
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS details JSONB NOT NULL DEFAULT '{}';
+
+CREATE TABLE IF NOT EXISTS resource_tags(
+    rid INTEGER NOT NULL REFERENCES resources(id) ON DELETE CASCADE,
+    tag TEXT NOT NULL,
+    PRIMARY KEY(rid, tag)
+);
+CREATE INDEX IF NOT EXISTS resource_tags_tag_idx ON resource_tags(tag);
+
+-- +goose Down
+DROP TABLE resource_tags;
+ALTER TABLE resources DROP COLUMN details;
+ALTER TABLE resources DROP COLUMN folder_id;
+DROP TABLE folders;
@@ -0,0 +1,28 @@
+-- +goose Up
+-- resources are listed by creation time, existing ones were created no
+-- later than their last change
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+UPDATE resources SET created_at = updated_at WHERE created_at IS NULL;
+ALTER TABLE resources ALTER COLUMN created_at SET DEFAULT now();
+ALTER TABLE resources ALTER COLUMN created_at SET NOT NULL;
+
+-- name sorts resources, the title of the details or the meta
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS name TEXT
+    GENERATED ALWAYS AS (COALESCE(NULLIF(details->>'title', ''), meta, '')) STORED;
+-- search indexes titles and meta, both are stored unencrypted
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS search TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(details->>'title', '') || ' ' || COALESCE(meta, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS resources_search_idx ON resources USING GIN(search);
+CREATE INDEX IF NOT EXISTS resources_name_idx ON resources(name, id);
+CREATE INDEX IF NOT EXISTS resources_created_idx ON resources(created_at, id);
+CREATE INDEX IF NOT EXISTS resources_updated_idx ON resources(updated_at, id);
+
+-- +goose Down
+DROP INDEX resources_updated_idx;
+DROP INDEX resources_created_idx;
+DROP INDEX resources_name_idx;
+DROP INDEX resources_search_idx;
+ALTER TABLE resources DROP COLUMN search;
+ALTER TABLE resources DROP COLUMN name;
+ALTER TABLE resources DROP COLUMN created_at;
@@ -0,0 +1,27 @@
+-- +goose Up
+-- upload sessions collect the content of a new blob in parts, a part is
+-- stored per chunk and the parts are joined into location on commit. Parts
+-- of content encrypted by the server are already sealed with the key and
+-- iv of the blob, hash is the state of the checksum of the content received.
+CREATE TABLE IF NOT EXISTS uploads(
+    id TEXT PRIMARY KEY,
+    owner TEXT NOT NULL,
+    team_id INTEGER REFERENCES teams(id) ON DELETE CASCADE,
+    meta TEXT NOT NULL,
+    opaque BOOLEAN NOT NULL,
+    length BIGINT,
+    received BIGINT NOT NULL DEFAULT 0,
+    hash BYTEA NOT NULL,
+    parts TEXT[] NOT NULL DEFAULT '{}',
+    location TEXT NOT NULL,
+    iv BYTEA,
+    wrapped_key BYTEA,
+    key_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS uploads_owner_idx ON uploads(owner);
+CREATE INDEX IF NOT EXISTS uploads_expires_idx ON uploads(expires_at);
+
+-- +goose Down
+DROP TABLE uploads;
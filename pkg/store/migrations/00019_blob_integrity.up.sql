@@ -0,0 +1,28 @@
+-- +goose Up
+-- size is the plaintext size, digest the SHA-256 of the plaintext sealed
+-- by the key of the blob, or of the envelope of opaque blobs. Both are
+-- unknown for blobs stored before.
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS size BIGINT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS digest BYTEA;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS filename TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS size BIGINT;
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS digest BYTEA;
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE revisions ADD COLUMN IF NOT EXISTS filename TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS filename TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE uploads DROP COLUMN filename;
+ALTER TABLE uploads DROP COLUMN content_type;
+ALTER TABLE revisions DROP COLUMN filename;
+ALTER TABLE revisions DROP COLUMN content_type;
+ALTER TABLE revisions DROP COLUMN digest;
+ALTER TABLE revisions DROP COLUMN size;
+ALTER TABLE blobs DROP COLUMN filename;
+ALTER TABLE blobs DROP COLUMN content_type;
+ALTER TABLE blobs DROP COLUMN digest;
+ALTER TABLE blobs DROP COLUMN size;
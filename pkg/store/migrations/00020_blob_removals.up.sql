@@ -0,0 +1,13 @@
+-- +goose Up
+-- blob files are removed after the deleting transaction commits, a file
+-- is scheduled here within the transaction and unscheduled once removed,
+-- so files of removals interrupted by a failure or a crash are retried.
+CREATE TABLE IF NOT EXISTS blob_removals(
+    location TEXT PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS blobs_location_idx ON blobs(location);
+
+-- +goose Down
+DROP INDEX blobs_location_idx;
+DROP TABLE blob_removals;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- hash of the refresh token replaced by the last refresh, presenting it
+-- again closes the session as the token may be stolen
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS previous_refresh_hash BYTEA;
+
+-- +goose Down
+ALTER TABLE sessions DROP COLUMN previous_refresh_hash;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- wrong second factor codes of the account across login challenges, too
+-- many of them lock the second factor until factor_locked_until
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS factor_failures INT NOT NULL DEFAULT 0;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS factor_locked_until TIMESTAMPTZ;
+
+-- +goose Down
+ALTER TABLE identities DROP COLUMN factor_locked_until;
+ALTER TABLE identities DROP COLUMN factor_failures;
@@ -0,0 +1,28 @@
+-- +goose Up
+-- resources refer to their piece or their blob by type, the generated
+-- columns carry the foreign keys. Resources left dangling before fail the
+-- validation, which is done by fsck --repair then once they are deleted.
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS piece_id INTEGER GENERATED ALWAYS AS (CASE WHEN type = 1 THEN resource END) STORED;
+ALTER TABLE resources ADD COLUMN IF NOT EXISTS blob_id INTEGER GENERATED ALWAYS AS (CASE WHEN type = 2 THEN resource END) STORED;
+ALTER TABLE resources ADD CONSTRAINT resources_piece_fk FOREIGN KEY (piece_id) REFERENCES pieces(id) NOT VALID;
+ALTER TABLE resources ADD CONSTRAINT resources_blob_fk FOREIGN KEY (blob_id) REFERENCES blobs(id) NOT VALID;
+
+-- +goose StatementBegin
+DO $$
+BEGIN
+    IF NOT EXISTS(
+        SELECT 1 FROM resources r
+        WHERE (r.type = 1 AND NOT EXISTS(SELECT 1 FROM pieces p WHERE p.id = r.resource))
+            OR (r.type = 2 AND NOT EXISTS(SELECT 1 FROM blobs b WHERE b.id = r.resource))
+    ) THEN
+        ALTER TABLE resources VALIDATE CONSTRAINT resources_piece_fk;
+        ALTER TABLE resources VALIDATE CONSTRAINT resources_blob_fk;
+    END IF;
+END $$;
+-- +goose StatementEnd
+
+-- +goose Down
+ALTER TABLE resources DROP CONSTRAINT resources_blob_fk;
+ALTER TABLE resources DROP CONSTRAINT resources_piece_fk;
+ALTER TABLE resources DROP COLUMN blob_id;
+ALTER TABLE resources DROP COLUMN piece_id;
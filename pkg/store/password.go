@@ -0,0 +1,211 @@
+package postgres
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPasswordWeak is returned for passwords rejected by the policy, the
+	// message tells why
+	ErrPasswordWeak = fmt.Errorf("password weak")
+	ErrPasswordHash = fmt.Errorf("password hash malformed")
+)
+
+// Passwords are kept as hashes in the PHC string format, e.g.
+// $argon2id$v=19$m=19456,t=2,p=1$salt$hash, derived with the KDF of the
+// storage and a salt of their own. Passwords registered before were hashed
+// with bcrypt by the migration, such hashes and hashes of other parameters
+// are replaced at the next login.
+
+// PasswordPolicy is checked for new passwords, passwords set before are
+// accepted until changed
+type PasswordPolicy struct {
+	MinLength int                 // MinLength in characters.
+	MaxLength int                 // MaxLength in characters, bounds the hashing work.
+	breached  map[string]struct{} // breached are upper case hex SHA-1 of known passwords.
+}
+
+// DefaultPasswordPolicy follows NIST SP 800-63B without a breached list
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, MaxLength: 256}
+
+// LoadBreached reads the breached passwords of the policy, a password or
+// the hex SHA-1 of one per line. Lines of the Have I Been Pwned range files,
+// HASH:COUNT, are accepted too. Empty lines and lines starting with # are
+// skipped. It returns the number of passwords read.
+func (pp *PasswordPolicy) LoadBreached(r io.Reader) (int, error) {
+	if pp.breached == nil {
+		pp.breached = map[string]struct{}{}
+	}
+	var (
+		scanner = bufio.NewScanner(r)
+		read    int
+	)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var digest, _, _ = strings.Cut(line, ":")
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha1.Size*2 {
+			digest = breachedDigest(line)
+		}
+		pp.breached[strings.ToUpper(digest)] = struct{}{}
+		read++
+	}
+	return read, scanner.Err()
+}
+
+// Validate checks the new password of the login against the policy
+func (pp *PasswordPolicy) Validate(login, password string) error {
+	var length = utf8.RuneCountInString(password)
+	switch {
+	case password == "":
+		return ErrPasswordEmpty
+	case length < pp.MinLength:
+		return fmt.Errorf("%w: at least %d characters required", ErrPasswordWeak, pp.MinLength)
+	case pp.MaxLength > 0 && length > pp.MaxLength:
+		return fmt.Errorf("%w: at most %d characters allowed", ErrPasswordWeak, pp.MaxLength)
+	case strings.EqualFold(password, login):
+		return fmt.Errorf("%w: equals the login", ErrPasswordWeak)
+	}
+	if _, ok := pp.breached[breachedDigest(password)]; ok {
+		return fmt.Errorf("%w: found in breached passwords", ErrPasswordWeak)
+	}
+	return nil
+}
+
+// policy returns the policy of new passwords
+func (p *Storage) policy() *PasswordPolicy {
+	if p.Policy == nil {
+		return &DefaultPasswordPolicy
+	}
+	return p.Policy
+}
+
+// CheckPassword checks the password of the credentials, a session is not
+// enough.
+func (p *Storage) CheckPassword(ctx context.Context, c Creds) error {
+	return p.checkPass(ctx, Creds{Login: c.Login, Passw: c.Passw})
+}
+
+// checkPass checks the password of the user, credentials of a session
+// verified by Identity need none. A hash of other parameters is replaced.
+func (p *Storage) checkPass(ctx context.Context, c Creds) error {
+	if c.session != "" {
+		return nil
+	}
+	var encoded *string
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT password_hash FROM identities WHERE id = $1`,
+		c.Login,
+	).Scan(&encoded); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// take the time of a check, so logins don't tell users apart
+			_, _ = hashPassword(c.Passw, p.kdf())
+			return ErrUserUnauthorized
+		}
+		return err
+	}
+	if encoded == nil {
+		return ErrUserUnauthorized
+	}
+
+	var ok, current, err = verifyPassword(*encoded, c.Passw, p.kdf())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %w", ErrUserUnauthorized, ErrUserWrongPassword)
+	}
+	if !current {
+		if err := p.rehashPassword(ctx, c, *encoded); err != nil {
+			log.Printf("failed to rehash password of %s: %s\n", c.Login, err.Error())
+		}
+	}
+	return nil
+}
+
+// rehashPassword hashes the password with the current KDF, unless the hash
+// was replaced meanwhile
+func (p *Storage) rehashPassword(ctx context.Context, c Creds, old string) error {
+	var encoded, err = hashPassword(c.Passw, p.kdf())
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		ctx,
+		`UPDATE identities SET password_hash = $2 WHERE id = $1 AND password_hash = $3`,
+		c.Login, encoded, old,
+	)
+	return err
+}
+
+// hashPassword returns the PHC string of the password hashed by the KDF
+// with a random salt
+func hashPassword(password string, kdf KDF) (string, error) {
+	var salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "$" + kdf.String() +
+		"$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(kdf.Key(password, salt)), nil
+}
+
+// verifyPassword checks the password against the PHC string or bcrypt hash,
+// current is false if the hash should be replaced by one of the KDF.
+func verifyPassword(encoded, password string, kdf KDF) (ok, current bool, err error) {
+	if strings.HasPrefix(encoded, "$2") {
+		var compareError = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(compareError, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if compareError != nil {
+			return false, false, fmt.Errorf("%w: %w", ErrPasswordHash, compareError)
+		}
+		return true, false, nil
+	}
+
+	var separator = strings.LastIndex(encoded, "$")
+	var saltSeparator = strings.LastIndex(encoded[:max(separator, 0)], "$")
+	if !strings.HasPrefix(encoded, "$") || saltSeparator <= 0 {
+		return false, false, ErrPasswordHash
+	}
+	var params, parseError = ParseKDF(encoded[1:saltSeparator])
+	if parseError != nil {
+		return false, false, parseError
+	}
+	var salt, saltError = base64.RawStdEncoding.DecodeString(encoded[saltSeparator+1 : separator])
+	if saltError != nil {
+		return false, false, fmt.Errorf("%w: %w", ErrPasswordHash, saltError)
+	}
+	var hash, hashError = base64.RawStdEncoding.DecodeString(encoded[separator+1:])
+	if hashError != nil {
+		return false, false, fmt.Errorf("%w: %w", ErrPasswordHash, hashError)
+	}
+	if subtle.ConstantTimeCompare(params.Key(password, salt), hash) != 1 {
+		return false, false, nil
+	}
+	return true, params == kdf, nil
+}
+
+func breachedDigest(password string) string {
+	var sum = sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -2,33 +2,37 @@ package postgres
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
-	"github.com/golang-jwt/jwt"
 	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
-	"github.com/stsg/gophkeeper/pkg/lib"
+	"github.com/stsg/gophkeeper/pkg/token"
 )
 
 type Creds struct {
 	Login string `json:"username"`
 	Passw string `json:"password"`
+
+	session string // session verified by Identity, the password is not needed then
+	dek     []byte // data key kept by the session, nil in zero knowledge mode
 }
 
 type Storage struct {
-	cfg      *Config
-	db       *pgxpool.Pool
-	EncdP    *base64.Encoding
-	BlobsDir string
-	Secret   []byte
-	LifeSpan time.Duration
+	cfg         *Config
+	db          *pgxpool.Pool
+	Blobs       BlobBackend
+	KDF         KDF             // KDF derives password keys and hashes, DefaultKDF if zero.
+	Policy      *PasswordPolicy // Policy of new passwords, DefaultPasswordPolicy if nil.
+	Master      *MasterKeys     // Master keys wrap resource keys, nil if the server has none.
+	Tokens      *token.Issuer   // Tokens signs the access tokens of sessions.
+	LifeSpan    time.Duration   // LifeSpan of access tokens.
+	RefreshSpan time.Duration   // RefreshSpan is how long idle sessions are kept.
+	Quotas      Quotas          // Quotas of vaults, unlimited if zero.
 }
 
 func (p *Storage) Close() {
@@ -49,8 +53,8 @@ func (p *Storage) Ping(ctx context.Context) error {
 // connection string and connection timeout. If the connection fails, an error
 // is returned.
 //
-// If the "identities" table does not exist in the database, it runs the
-// migration to create the table.
+// It runs the migrations up to the configured version, migrations applied
+// before are skipped.
 //
 // Parameters:
 //   - cfg: The configuration object containing the connection string,
@@ -68,39 +72,45 @@ func New(cfg *Config) (*Storage, error) {
 		return nil, fmt.Errorf("postgres connect: %w", err)
 	}
 
-	if !lib.IsTableExist(pool, "identities") {
-		if err := migrate(pool, cfg.MigrationVersion); err != nil {
-			return nil, err
-		}
+	if err := migrate(pool, cfg.MigrationVersion); err != nil {
+		return nil, err
 	}
 
 	return &Storage{cfg: cfg, db: pool}, nil
 }
 
-func (p *Storage) GetIdentity(ctx context.Context, login string) (Creds, error) {
-	var c Creds
-
-	err := p.db.QueryRow(
-		ctx,
-		"SELECT id, passw FROM identities WHERE id=$1", login).Scan(
-		&c.Login,
-		&c.Passw,
-	)
+// Register creates the user with the password hash, a new data key and the
+// key pair of shared resources. The password must satisfy the policy,
+// ErrUniqueViolation is returned if the login is taken.
+func (p *Storage) Register(ctx context.Context, c Creds) error {
+	if c.Login == "" {
+		return ErrUserWrong
+	}
+	if err := p.policy().Validate(c.Login, c.Passw); err != nil {
+		return err
+	}
+	var hash, hashError = hashPassword(c.Passw, p.kdf())
+	if hashError != nil {
+		return hashError
+	}
+	dek, wrappedKey, keySalt, err := newUserKey(c.Passw, p.kdf())
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return Creds{}, ErrNoExists
-		}
-		return Creds{}, err
+		return err
 	}
-	return c, nil
-}
-
-func (p *Storage) Register(ctx context.Context, c Creds) error {
-	_, err := p.db.Exec(
+	publicKey, privateKey, err := newKeyPair(dek)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
 		ctx,
-		"INSERT INTO identities (id, passw) VALUES ($1, $2)",
+		"INSERT INTO identities (id, password_hash, dek, dek_salt, dek_kdf, public_key, private_key) VALUES ($1, $2, $3, $4, $5, $6, $7)",
 		c.Login,
-		c.Passw,
+		hash,
+		wrappedKey,
+		keySalt,
+		p.kdf().String(),
+		publicKey,
+		privateKey,
 	)
 	if err != nil {
 		var pgErr *pgconn.PgError
@@ -114,50 +124,3 @@ func (p *Storage) Register(ctx context.Context, c Creds) error {
 
 	return nil
 }
-func (p *Storage) Authenticate(ctx context.Context, c Creds) (t string, err error) {
-
-	if err := p.checkPass(ctx, c); err != nil {
-		return "", err
-	}
-
-	var rawToken = jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"exp": time.Now().Add(p.LifeSpan).Unix(),
-			"sub": c.Passw,
-		},
-	)
-	var token, signTokenError = rawToken.SignedString(p.Secret)
-	if signTokenError != nil {
-		return "", signTokenError
-	}
-	return token, nil
-}
-
-func (p *Storage) Identity(ctx context.Context, t string) (c Creds, err error) {
-	var parsedToken, parseTokenError = jwt.Parse(
-		t,
-		func(t *jwt.Token) (interface{}, error) {
-			return p.Secret, nil
-		},
-	)
-	if parseTokenError != nil {
-		return Creds{}, ErrUserUnauthorized
-	}
-
-	var claims = parsedToken.Claims.(jwt.MapClaims)
-	if claims.Valid() != nil {
-		return Creds{}, ErrUserUnauthorized
-	}
-
-	sub := claims["sub"].(string)
-
-	var username string
-	if sub != "" {
-		username = sub
-	} else {
-		return Creds{}, ErrUserUnauthorized
-	}
-
-	return Creds{Login: username, Passw: ""}, nil
-}
@@ -0,0 +1,276 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrQuotaExceeded is returned for a write exceeding the number of
+	// resources or the bytes of blobs of the vault, see QuotaError
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+	// ErrBlobTooLarge is returned for a blob exceeding the size of a single
+	// blob, see QuotaError
+	ErrBlobTooLarge = fmt.Errorf("blob too large")
+)
+
+// Quota limits of vaults, zero is unlimited. Sizes are those of the
+// stored content, the envelope of content encrypted by the client.
+type Quota struct {
+	Resources int64 // Resources is the number of resources.
+	Bytes     int64 // Bytes is the total size of blobs and of unfinished uploads.
+	BlobSize  int64 // BlobSize is the size of a single blob.
+}
+
+// Quotas of the vault of every user and of the team vaults of every
+// organisation together
+type Quotas struct {
+	User Quota
+	Org  Quota
+}
+
+// Quota names of QuotaError
+const (
+	QuotaResources = "resources"
+	QuotaBytes     = "bytes"
+	QuotaBlobSize  = "blob_size"
+)
+
+// QuotaError tells which quota a write exceeds, it wraps ErrBlobTooLarge
+// for the blob size and ErrQuotaExceeded otherwise
+type QuotaError struct {
+	Quota string // Quota is QuotaResources, QuotaBytes or QuotaBlobSize.
+	Limit int64
+	Used  int64 // Used is the usage of the vault before the write.
+	Org   OrgID // Org of team vaults, zero for the vault of the user.
+}
+
+func (e *QuotaError) Error() string {
+	var limit = strconv.FormatInt(e.Limit, 10)
+	if e.Quota == QuotaBlobSize {
+		return fmt.Sprintf("%s: limit of %s bytes", ErrBlobTooLarge, limit)
+	}
+	return fmt.Sprintf("%s: %s %d of %s used", ErrQuotaExceeded, e.Quota, e.Used, limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	if e.Quota == QuotaBlobSize {
+		return ErrBlobTooLarge
+	}
+	return ErrQuotaExceeded
+}
+
+// Usage of a vault, the team vaults of an organisation are used together
+type Usage struct {
+	Resources int64
+	Bytes     int64 // Bytes of blobs and their revisions, blobs stored before sizes were recorded are not counted.
+	Uploads   int64 // Uploads is the content received by unfinished uploads.
+}
+
+// VaultUsage is the usage of the vault of the user or of the team vaults
+// of an organisation with its quota
+type VaultUsage struct {
+	Usage
+	Quota Quota
+	Org   OrgID  // Org of team vaults, zero for the vault of the user.
+	Name  string // Name of the organisation.
+}
+
+// AccountUsage returns the usage of the vault of the user followed by the
+// usage of the organisations of the user
+func (p *Storage) AccountUsage(ctx context.Context, c Creds) ([]VaultUsage, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return nil, errors.Join(err, ErrUserUnauthorized)
+	}
+	var usage, usageError = vaultUsage(ctx, p.db, c.Login, 0)
+	if usageError != nil {
+		return nil, usageError
+	}
+	var vaults = []VaultUsage{{Usage: usage, Quota: p.Quotas.User}}
+
+	var orgs, orgsError = p.Orgs(ctx, c)
+	if orgsError != nil {
+		return nil, orgsError
+	}
+	for _, o := range orgs {
+		var usage, err = vaultUsage(ctx, p.db, "", o.ID)
+		if err != nil {
+			return nil, err
+		}
+		vaults = append(vaults, VaultUsage{Usage: usage, Quota: p.Quotas.Org, Org: o.ID, Name: o.Name})
+	}
+	return vaults, nil
+}
+
+// vaultQuota returns the quota of the vault and the organisation of team
+// vaults
+func (p *Storage) vaultQuota(ctx context.Context, q queryRower, vault access) (Quota, OrgID, error) {
+	if vault.team == 0 {
+		return p.Quotas.User, 0, nil
+	}
+	var org OrgID
+	if err := q.QueryRow(ctx, `SELECT org_id FROM teams WHERE id = $1`, vault.team).Scan(&org); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Quota{}, 0, ErrTeamNotFound
+		}
+		return Quota{}, 0, err
+	}
+	return p.Quotas.Org, org, nil
+}
+
+// limitBlob limits the content of a new blob of the vault past the offset
+// to the blob size and to the bytes left by the quota
+func (p *Storage) limitBlob(ctx context.Context, content io.Reader, vault access, offset int64) (io.Reader, error) {
+	var limit, exceeded, err = p.blobLimit(ctx, vault, offset)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return content, nil
+	}
+	return &quotaReader{r: content, limit: limit, err: exceeded}, nil
+}
+
+// blobLimit returns the bytes a new blob of the vault may have past the
+// offset with the error of exceeding them, -1 if unlimited. The check is
+// not transactional, it stops writing blobs which can't fit, checkQuota
+// enforces the quota.
+func (p *Storage) blobLimit(ctx context.Context, vault access, offset int64) (int64, *QuotaError, error) {
+	var quota, org, quotaError = p.vaultQuota(ctx, p.db, vault)
+	if quotaError != nil {
+		return 0, nil, quotaError
+	}
+	var (
+		limit    int64 = -1
+		exceeded *QuotaError
+	)
+	if quota.BlobSize > 0 {
+		limit = max(quota.BlobSize-offset, 0)
+		exceeded = &QuotaError{Quota: QuotaBlobSize, Limit: quota.BlobSize, Org: org}
+	}
+	if quota.Bytes > 0 {
+		var usage, usageError = vaultUsage(ctx, p.db, vault.owner, org)
+		if usageError != nil {
+			return 0, nil, usageError
+		}
+		var used = usage.Bytes + usage.Uploads
+		if left := max(quota.Bytes-used, 0); limit < 0 || left < limit {
+			limit = left
+			exceeded = &QuotaError{Quota: QuotaBytes, Limit: quota.Bytes, Used: used, Org: org}
+		}
+	}
+	return limit, exceeded, nil
+}
+
+// checkQuota returns a QuotaError if the vault exceeds its quota with the
+// changes of the transaction, which added the resources and the bytes to
+// the vault. Only limits the changes add to are checked, so a vault over a
+// lowered quota may still shrink. Team vaults of an organisation are locked
+// together until the transaction ends.
+func (p *Storage) checkQuota(ctx context.Context, tx pgx.Tx, vault access, resources, bytes int64) error {
+	var quota, org, quotaError = p.vaultQuota(ctx, tx, vault)
+	if quotaError != nil {
+		return quotaError
+	}
+	if (quota.Resources == 0 || resources <= 0) && (quota.Bytes == 0 || bytes <= 0) {
+		return nil
+	}
+	if org != 0 {
+		if err := lockOwner(ctx, tx, orgLock(org)); err != nil {
+			return err
+		}
+	}
+	var usage, usageError = vaultUsage(ctx, tx, vault.owner, org)
+	if usageError != nil {
+		return usageError
+	}
+	if quota.Resources > 0 && resources > 0 && usage.Resources > quota.Resources {
+		return &QuotaError{Quota: QuotaResources, Limit: quota.Resources, Used: usage.Resources - resources, Org: org}
+	}
+	if used := usage.Bytes + usage.Uploads; quota.Bytes > 0 && bytes > 0 && used > quota.Bytes {
+		return &QuotaError{Quota: QuotaBytes, Limit: quota.Bytes, Used: used - bytes, Org: org}
+	}
+	return nil
+}
+
+// vaultUsage returns the usage of the vault of the owner or of the team
+// vaults of the organisation
+func vaultUsage(ctx context.Context, q queryRower, owner string, org OrgID) (Usage, error) {
+	var (
+		usage   Usage
+		arg     any = owner
+		filter      = `r.owner = $1 AND r.team_id IS NULL`
+		uploads     = `SELECT COALESCE(sum(received), 0) FROM uploads WHERE owner = $1 AND team_id IS NULL AND expires_at > now()`
+	)
+	if org != 0 {
+		arg = org
+		filter = `r.team_id IN (SELECT id FROM teams WHERE org_id = $1)`
+		uploads = `SELECT COALESCE(sum(received), 0) FROM uploads
+		WHERE team_id IN (SELECT id FROM teams WHERE org_id = $1) AND expires_at > now()`
+	}
+	if err := q.QueryRow(
+		ctx,
+		`SELECT count(*), COALESCE(sum(b.size), 0) FROM resources r
+		LEFT JOIN blobs b ON r.type = 2 AND b.id = r.resource
+		WHERE `+filter,
+		arg,
+	).Scan(&usage.Resources, &usage.Bytes); err != nil {
+		return Usage{}, err
+	}
+	// revisions share locations with each other and with the current blob
+	// after a restore, each file is counted once
+	var revisions int64
+	if err := q.QueryRow(
+		ctx,
+		`SELECT COALESCE(sum(size), 0) FROM (
+			SELECT DISTINCT ON (v.location) v.size FROM revisions v JOIN resources r ON r.id = v.rid
+			WHERE `+filter+` AND v.location IS NOT NULL AND NOT EXISTS(SELECT 1 FROM blobs WHERE location = v.location)
+		) AS kept`,
+		arg,
+	).Scan(&revisions); err != nil {
+		return Usage{}, err
+	}
+	usage.Bytes += revisions
+	if err := q.QueryRow(ctx, uploads, arg).Scan(&usage.Uploads); err != nil {
+		return Usage{}, err
+	}
+	return usage, nil
+}
+
+// orgLock is the lockOwner key of the team vaults of the organisation
+func orgLock(org OrgID) string {
+	return "org " + strconv.FormatInt((int64)(org), 10)
+}
+
+// quotaReader fails with err once more than limit bytes are read, unless
+// the limit is negative
+type quotaReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+	err   error
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	if qr.limit < 0 {
+		return qr.r.Read(p)
+	}
+	if qr.n > qr.limit {
+		return 0, qr.err
+	}
+	// one byte past the limit tells a content of the limit from a larger one
+	if left := qr.limit - qr.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	var n, err = qr.r.Read(p)
+	qr.n += int64(n)
+	if qr.n > qr.limit {
+		return n - int(qr.n-qr.limit), qr.err
+	}
+	return n, err
+}
@@ -0,0 +1,275 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrRevisionNotFound = fmt.Errorf("revision not found")
+
+// Revision describes a state of a resource. Every update keeps the state
+// it replaces as a revision which can be restored later.
+type Revision struct {
+	Version   int64
+	Meta      string
+	UpdatedBy string    // UpdatedBy is the user who made the revision.
+	UpdatedAt time.Time // UpdatedAt is the time the revision was made.
+	Current   bool      // Current marks the actual state of the resource.
+}
+
+// Retention limits kept revisions, zero fields are not limited
+type Retention struct {
+	Keep   int           // Keep is the number of revisions kept per resource.
+	MaxAge time.Duration // MaxAge is how long revisions are kept after being replaced.
+}
+
+// Revisions returns the current state of the resource followed by its
+// kept revisions, newest first. Grantees don't see revisions.
+func (p *Storage) Revisions(ctx context.Context, rid ResourceID, c Creds) ([]Revision, error) {
+	var resource, accessError = resourceAccess(ctx, p.db, rid, c)
+	if accessError != nil {
+		return nil, accessError
+	}
+	if resource.granted(c) {
+		return nil, ErrPermissionDenied
+	}
+	var current = Revision{Current: true}
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT version, meta, updated_by, updated_at FROM resources WHERE id = $1`,
+		(int64)(rid),
+	).Scan(&current.Version, &current.Meta, &current.UpdatedBy, &current.UpdatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, err
+	}
+
+	var rows, queryError = p.db.Query(
+		ctx,
+		`SELECT version, COALESCE(meta, ''), updated_by, updated_at FROM revisions
+		WHERE rid = $1 ORDER BY version DESC`,
+		(int64)(rid),
+	)
+	if queryError != nil {
+		return nil, queryError
+	}
+	defer rows.Close()
+
+	var revisions = []Revision{current}
+	for rows.Next() {
+		var revision Revision
+		if err := rows.Scan(&revision.Version, &revision.Meta, &revision.UpdatedBy, &revision.UpdatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// RestoreRevision makes the content and meta of the given revision the new
+// state of the resource, the replaced state is kept as a revision too.
+// Versions are checked as in UpdatePiece, the new version is returned. The
+// restore adds no bytes to the vault, the revision is counted already.
+func (p *Storage) RestoreRevision(ctx context.Context, rid ResourceID, revision, version int64, c Creds) (int64, error) {
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return -1, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var resource, accessError = resourceAccess(ctx, transaction, rid, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := resource.writable(); err != nil || resource.granted(c) {
+		return -1, ErrPermissionDenied
+	}
+	if err := lockOwner(ctx, transaction, resource.lockKey()); err != nil {
+		return -1, err
+	}
+
+	var (
+		resourceType int
+		meta         *string
+		content      []byte
+		location     *string
+		salt         []byte
+		iv           []byte
+		wrappedKey   []byte
+		keyID        *string
+		opaque       bool
+		format       blobFormat
+		size         *int64
+		digest       []byte
+		contentType  string
+		filename     string
+	)
+	// shared lock keeps the pruning job from removing the revision meanwhile
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT type, meta, content, location, salt, iv, wrapped_key, key_id, opaque, format, size, digest, content_type, filename
+		FROM revisions WHERE rid = $1 AND version = $2 FOR SHARE`,
+		(int64)(rid), revision,
+	).Scan(&resourceType, &meta, &content, &location, &salt, &iv, &wrappedKey, &keyID, &opaque, &format,
+		&size, &digest, &contentType, &filename); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return -1, ErrRevisionNotFound
+		}
+		return -1, err
+	}
+
+	var id, _, lockError = lockResource(ctx, transaction, rid, (ResourceType)(resourceType), version)
+	if lockError != nil {
+		return -1, lockError
+	}
+	if err := archiveResource(ctx, transaction, rid); err != nil {
+		return -1, err
+	}
+
+	var restoreError error
+	switch (ResourceType)(resourceType) {
+	case ResourceTypePiece:
+		_, restoreError = transaction.Exec(
+			ctx,
+			`UPDATE pieces SET content = $2, salt = $3, iv = $4, wrapped_key = $5, key_id = $6, opaque = $7 WHERE id = $1`,
+			id, content, salt, iv, wrappedKey, keyID, opaque,
+		)
+	case ResourceTypeBlob:
+		_, restoreError = transaction.Exec(
+			ctx,
+			`UPDATE blobs SET location = $2, salt = $3, iv = $4, wrapped_key = $5, key_id = $6, opaque = $7, format = $8,
+			size = $9, digest = $10, content_type = $11, filename = $12 WHERE id = $1`,
+			id, location, salt, iv, wrappedKey, keyID, opaque, format, size, digest, contentType, filename,
+		)
+	default:
+		restoreError = fmt.Errorf("unknown resource type: %d", resourceType)
+	}
+	if restoreError != nil {
+		return -1, restoreError
+	}
+	if err := p.rewrapGrants(ctx, transaction, rid, opaque, func() ([]byte, error) {
+		return p.readKey(ctx, rid, resource, wrappedKey, keyID, salt, c)
+	}); err != nil {
+		return -1, err
+	}
+
+	if meta == nil {
+		meta = new(string)
+	}
+	var newVersion, bumpError = bumpResource(ctx, transaction, rid, meta, c)
+	if bumpError != nil {
+		return -1, bumpError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	return newVersion, nil
+}
+
+// PruneRevisions removes revisions exceeding the retention limits along
+// with blobs nothing refers to anymore. It returns the number of
+// removed revisions.
+func (p *Storage) PruneRevisions(ctx context.Context, retention Retention) (int64, error) {
+	if retention.Keep <= 0 && retention.MaxAge <= 0 {
+		return 0, nil
+	}
+	var cutoff *time.Time
+	if retention.MaxAge > 0 {
+		t := time.Now().Add(-retention.MaxAge)
+		cutoff = &t
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return 0, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var rows, deleteError = transaction.Query(
+		ctx,
+		`WITH ranked AS (
+			SELECT id, archived_at, row_number() OVER (PARTITION BY rid ORDER BY version DESC) AS n FROM revisions
+		)
+		DELETE FROM revisions WHERE id IN (
+			SELECT id FROM ranked WHERE ($1 > 0 AND n > $1) OR ($2::timestamptz IS NOT NULL AND archived_at < $2)
+		) RETURNING location`,
+		retention.Keep, cutoff,
+	)
+	if deleteError != nil {
+		return 0, deleteError
+	}
+	var (
+		pruned    int64
+		locations []string
+	)
+	for rows.Next() {
+		var location *string
+		if err := rows.Scan(&location); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pruned++
+		if location != nil {
+			locations = append(locations, *location)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	unused, err := scheduleUnused(ctx, transaction, locations)
+	if err != nil {
+		return 0, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return 0, err
+	}
+	p.removeBlobs(ctx, unused)
+	return pruned, nil
+}
+
+// archiveResource keeps the current state of the locked resource as a revision
+func archiveResource(ctx context.Context, tx pgx.Tx, rid ResourceID) error {
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO revisions(rid, owner, version, type, kind, meta, content, location, salt, iv, wrapped_key, key_id, opaque, format,
+			size, digest, content_type, filename, updated_by, updated_at)
+		SELECT r.id, r.owner, r.version, r.type, r.kind, r.meta,
+			p.content, b.location, COALESCE(p.salt, b.salt), COALESCE(p.iv, b.iv), COALESCE(p.wrapped_key, b.wrapped_key),
+			COALESCE(p.key_id, b.key_id),
+			COALESCE(p.opaque, b.opaque, false), COALESCE(b.format, 0),
+			b.size, b.digest, COALESCE(b.content_type, ''), COALESCE(b.filename, ''), r.updated_by, r.updated_at
+		FROM resources r
+		LEFT JOIN pieces p ON r.type = $2 AND p.id = r.resource
+		LEFT JOIN blobs b ON r.type = $3 AND b.id = r.resource
+		WHERE r.id = $1
+		ON CONFLICT (rid, version) DO NOTHING`,
+		(int64)(rid), (int)(ResourceTypePiece), (int)(ResourceTypeBlob),
+	)
+	return err
+}
+
+// unusedLocations returns blob locations referred by neither a blob nor a revision
+func unusedLocations(ctx context.Context, tx pgx.Tx, locations []string) ([]string, error) {
+	var unused []string
+	for _, location := range locations {
+		var used bool
+		if err := tx.QueryRow(
+			ctx,
+			`SELECT EXISTS(SELECT 1 FROM blobs WHERE location = $1) OR EXISTS(SELECT 1 FROM revisions WHERE location = $1)`,
+			location,
+		).Scan(&used); err != nil {
+			return nil, err
+		}
+		if !used {
+			unused = append(unused, location)
+		}
+	}
+	return unused, nil
+}
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+var ErrSecretKindMismatch = fmt.Errorf("secret kind mismatch")
+
+// StoreSecret validates a typed secret and stores it encrypted as a piece in
+// the vault of the user, or of the team if not zero.
+//
+// Opaque secrets are encrypted by the client, their Data is a JSON string
+// with the base64 encoded envelope and only the kind can be checked.
+func (p *Storage) StoreSecret(ctx context.Context, s secret.Secret, team TeamID, c Creds) (ResourceID, error) {
+	content, err := secretContent(&s)
+	if err != nil {
+		return -1, err
+	}
+	return p.StorePiece(ctx, Piece{Content: content, Meta: s.Meta, Kind: s.Kind, Opaque: s.Opaque, Team: team}, c)
+}
+
+// UpdateSecret validates a typed secret and replaces the secret stored with
+// the given id, both its data and meta. The stored secret must be of the same
+// kind. Versions are checked as in UpdatePiece, the new version is returned.
+func (p *Storage) UpdateSecret(ctx context.Context, rid ResourceID, version int64, s secret.Secret, c Creds) (int64, error) {
+	content, err := secretContent(&s)
+	if err != nil {
+		return -1, err
+	}
+	return p.UpdatePiece(ctx, rid, version, PieceUpdate{Meta: &s.Meta, Content: content, Opaque: s.Opaque, Kind: s.Kind}, c)
+}
+
+// RestoreSecret restores a typed secret stored by StoreSecret along with its
+// version. It returns ErrSecretKindMismatch when the resource holds a secret
+// of another kind.
+func (p *Storage) RestoreSecret(ctx context.Context, kind secret.Kind, rid ResourceID, c Creds) (secret.Secret, int64, error) {
+	piece, err := p.RestorePiece(ctx, rid, c)
+	if err != nil {
+		return secret.Secret{}, 0, err
+	}
+	if piece.Kind != kind {
+		return secret.Secret{}, 0, ErrSecretKindMismatch
+	}
+	if piece.Opaque {
+		data, err := json.Marshal(piece.Content)
+		if err != nil {
+			return secret.Secret{}, 0, err
+		}
+		return secret.Secret{Kind: piece.Kind, Meta: piece.Meta, Data: data, Opaque: true}, piece.Version, nil
+	}
+	return secret.Secret{Kind: piece.Kind, Meta: piece.Meta, Data: piece.Content}, piece.Version, nil
+}
+
+// secretContent returns the piece content of a typed secret. Opaque data is
+// a JSON string with the base64 encoded envelope, other secrets are normalized.
+func secretContent(s *secret.Secret) ([]byte, error) {
+	if s.Opaque {
+		if _, err := secret.New(s.Kind); err != nil {
+			return nil, err
+		}
+		var content []byte
+		if err := json.Unmarshal(s.Data, &content); err != nil {
+			return nil, fmt.Errorf("%w: opaque data must be a base64 string", secret.ErrInvalid)
+		}
+		return content, nil
+	}
+	if err := s.Normalize(time.Now()); err != nil {
+		return nil, err
+	}
+	return s.Data, nil
+}
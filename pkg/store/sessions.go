@@ -0,0 +1,387 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrSessionKeyless is returned for content encrypted by the server
+	// within a zero knowledge session
+	ErrSessionKeyless  = fmt.Errorf("%w: session holds no data key", ErrUserUnauthorized)
+	ErrSessionNotFound = fmt.Errorf("session not found")
+	// ErrRefreshReused is returned for the refresh token replaced last, the
+	// session is closed since the token may be stolen
+	ErrRefreshReused = fmt.Errorf("%w: refresh token reused", ErrUserUnauthorized)
+)
+
+// lastSeenInterval limits updates of the last seen time of sessions
+const lastSeenInterval = time.Minute
+
+// Sessions replace the password after login. The access token names the
+// session and the server key which signed it, the session keeps the data
+// key of the user encrypted by a key derived from the same server key, so
+// neither the token nor the database alone reveal it. Sessions opened in
+// zero knowledge mode keep no data key, only content encrypted by the
+// client can be read and written then.
+//
+// Access tokens live for LifeSpan, the refresh token of the session gets
+// the next pair until the session is idle for RefreshSpan. Every refresh
+// token is used once, presenting the one replaced last closes the session.
+//
+// Sessions of users with a second factor are pending until VerifyLogin,
+// they can't be used or refreshed.
+
+// Device describes the client of a session
+type Device struct {
+	UserAgent string
+	IP        string
+}
+
+// SessionTokens authorize the session, the access token until Expires. If
+// the second factor is required only Challenge is set, it expires instead.
+type SessionTokens struct {
+	Access    string
+	Refresh   string
+	Challenge string
+	Expires   time.Time
+}
+
+// Session is an open session of the user
+type Session struct {
+	ID            string
+	UserAgent     string
+	IP            string
+	ZeroKnowledge bool      // ZeroKnowledge sessions keep no data key.
+	Current       bool      // Current marks the session of the request.
+	CreatedAt     time.Time // CreatedAt is the time of the login.
+	LastSeen      time.Time // LastSeen is updated once a minute at most.
+	ExpiresAt     time.Time // ExpiresAt is extended by every refresh.
+}
+
+// Authenticate checks the password, opens a session of the user on the
+// device and returns its tokens, or the challenge of VerifyLogin if the
+// user enabled the second factor. Keys of resources stored before data keys
+// are wrapped by the data key first, the session has no password to derive
+// them. Users registered before sharing get their key pair.
+func (p *Storage) Authenticate(ctx context.Context, c Creds, zeroKnowledge bool, device Device) (SessionTokens, error) {
+	var account = Creds{Login: c.Login, Passw: c.Passw}
+	if err := p.checkPass(ctx, account); err != nil {
+		return SessionTokens{}, err
+	}
+	var dek, keyError = p.userKey(ctx, account)
+	if keyError != nil {
+		return SessionTokens{}, keyError
+	}
+
+	var sessionID = make([]byte, 16)
+	if _, err := rand.Read(sessionID); err != nil {
+		return SessionTokens{}, err
+	}
+	var (
+		sid     = base64.RawURLEncoding.EncodeToString(sessionID)
+		keyID   = p.Tokens.Active()
+		wrapped []byte
+	)
+	if !zeroKnowledge {
+		var err error
+		if wrapped, err = p.wrapSessionKey(keyID, sid, dek); err != nil {
+			return SessionTokens{}, err
+		}
+	}
+	var secret, secretHash, secretError = newRefreshSecret()
+	if secretError != nil {
+		return SessionTokens{}, secretError
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return SessionTokens{}, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, c.Login); err != nil {
+		return SessionTokens{}, err
+	}
+	if err := p.wrapLegacyKeys(ctx, transaction, dek, account); err != nil {
+		return SessionTokens{}, err
+	}
+	if err := ensureKeyPair(ctx, transaction, c.Login, dek); err != nil {
+		return SessionTokens{}, err
+	}
+	var pending bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT totp_enabled FROM identities WHERE id = $1`,
+		c.Login,
+	).Scan(&pending); err != nil {
+		return SessionTokens{}, err
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`DELETE FROM sessions WHERE owner = $1 AND expires_at < now()`,
+		c.Login,
+	); err != nil {
+		return SessionTokens{}, err
+	}
+	// the secret of a pending session is the secret of its challenge
+	var expires = time.Now().Add(p.RefreshSpan)
+	if pending {
+		expires = time.Now().Add(challengeSpan)
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`INSERT INTO sessions(id, owner, key_id, wrapped_dek, refresh_hash, user_agent, ip, pending, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		sid, c.Login, keyID, wrapped, secretHash, device.UserAgent, device.IP, pending, expires,
+	); err != nil {
+		return SessionTokens{}, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return SessionTokens{}, err
+	}
+
+	if pending {
+		return SessionTokens{Challenge: sid + "." + secret, Expires: expires}, nil
+	}
+	return p.sessionTokens(c.Login, sid, secret)
+}
+
+// Refresh replaces the refresh token by a new one and returns it with a
+// new access token. The refresh token replaced last closes the session and
+// ErrRefreshReused is returned, other secrets are rejected with
+// ErrUserUnauthorized since the session ID alone is no secret. The data
+// key of the session is rewrapped if the token key was replaced meanwhile.
+func (p *Storage) Refresh(ctx context.Context, refresh string, device Device) (SessionTokens, error) {
+	var sid, presented, found = strings.Cut(refresh, ".")
+	if !found || sid == "" || presented == "" {
+		return SessionTokens{}, ErrUserUnauthorized
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return SessionTokens{}, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var (
+		owner      string
+		keyID      string
+		wrapped    []byte
+		secretHash []byte
+		previous   []byte
+	)
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT owner, key_id, wrapped_dek, refresh_hash, previous_refresh_hash FROM sessions
+		WHERE id = $1 AND NOT pending AND expires_at > now() FOR UPDATE`,
+		sid,
+	).Scan(&owner, &keyID, &wrapped, &secretHash, &previous); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return SessionTokens{}, ErrUserUnauthorized
+		}
+		return SessionTokens{}, err
+	}
+
+	if err := checkRefresh(presented, secretHash, previous); err != nil {
+		if !errors.Is(err, ErrRefreshReused) {
+			return SessionTokens{}, err
+		}
+		if _, err := transaction.Exec(ctx, `DELETE FROM sessions WHERE id = $1`, sid); err != nil {
+			return SessionTokens{}, err
+		}
+		if err := transaction.Commit(ctx); err != nil {
+			return SessionTokens{}, err
+		}
+		return SessionTokens{}, ErrRefreshReused
+	}
+
+	if wrapped != nil && keyID != p.Tokens.Active() {
+		var dek, err = p.unwrapSessionKey(keyID, sid, wrapped)
+		if err != nil {
+			return SessionTokens{}, errors.Join(ErrUserUnauthorized, err)
+		}
+		if wrapped, err = p.wrapSessionKey(p.Tokens.Active(), sid, dek); err != nil {
+			return SessionTokens{}, err
+		}
+	}
+	var secret, newHash, secretError = newRefreshSecret()
+	if secretError != nil {
+		return SessionTokens{}, secretError
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`UPDATE sessions SET key_id = $2, wrapped_dek = $3, refresh_hash = $4, previous_refresh_hash = refresh_hash,
+			user_agent = $5, ip = $6, last_seen = now(), expires_at = $7
+		WHERE id = $1`,
+		sid, p.Tokens.Active(), wrapped, newHash, device.UserAgent, device.IP, time.Now().Add(p.RefreshSpan),
+	); err != nil {
+		return SessionTokens{}, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return SessionTokens{}, err
+	}
+
+	return p.sessionTokens(owner, sid, secret)
+}
+
+// Identity verifies the access token and returns the credentials of its
+// session, ErrUserUnauthorized is returned for invalid tokens and sessions
+// expired or closed. The credentials carry the data key instead of the
+// password.
+func (p *Storage) Identity(ctx context.Context, t string) (Creds, error) {
+	var claims, _, parseError = p.Tokens.Parse(strings.TrimPrefix(t, "Bearer "))
+	if parseError != nil {
+		return Creds{}, errors.Join(ErrUserUnauthorized, parseError)
+	}
+
+	var (
+		owner        string
+		sessionKeyID string
+		wrapped      []byte
+	)
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT owner, key_id, wrapped_dek FROM sessions WHERE id = $1 AND NOT pending AND expires_at > now()`,
+		claims.SessionID,
+	).Scan(&owner, &sessionKeyID, &wrapped); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Creds{}, ErrUserUnauthorized
+		}
+		return Creds{}, err
+	}
+	if owner != claims.Subject {
+		return Creds{}, ErrUserUnauthorized
+	}
+
+	var c = Creds{Login: owner, session: claims.SessionID}
+	if wrapped != nil {
+		// the key of the token may differ from the session key until refresh
+		var dek, unwrapError = p.unwrapSessionKey(sessionKeyID, claims.SessionID, wrapped)
+		if unwrapError != nil {
+			return Creds{}, errors.Join(ErrUserUnauthorized, unwrapError)
+		}
+		c.dek = dek
+	}
+	return c, nil
+}
+
+// SeenSession records the use of the session by the device, once a minute
+// at most
+func (p *Storage) SeenSession(ctx context.Context, c Creds, device Device) error {
+	_, err := p.db.Exec(
+		ctx,
+		`UPDATE sessions SET last_seen = now(), user_agent = $2, ip = $3
+		WHERE id = $1 AND last_seen < now() - make_interval(secs => $4)`,
+		c.session, device.UserAgent, device.IP, lastSeenInterval.Seconds(),
+	)
+	return err
+}
+
+// Sessions returns the open sessions of the user, recently used first
+func (p *Storage) Sessions(ctx context.Context, c Creds) ([]Session, error) {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT id, user_agent, ip, wrapped_dek IS NULL, created_at, last_seen, expires_at FROM sessions
+		WHERE owner = $1 AND NOT pending AND expires_at > now() ORDER BY last_seen DESC, id`,
+		c.Login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions = []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.ZeroKnowledge, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == c.session
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Logout closes the session of the credentials
+func (p *Storage) Logout(ctx context.Context, c Creds) error {
+	return p.RevokeSession(ctx, c.session, c)
+}
+
+// RevokeSession closes the session of the user, its tokens are rejected
+// from now on. ErrSessionNotFound is returned for unknown sessions.
+func (p *Storage) RevokeSession(ctx context.Context, id string, c Creds) error {
+	var tag, err = p.db.Exec(ctx, `DELETE FROM sessions WHERE id = $1 AND owner = $2`, id, c.Login)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// sessionTokens issues the access token and composes the refresh token
+func (p *Storage) sessionTokens(login, sid, secret string) (SessionTokens, error) {
+	var expires = time.Now().Add(p.LifeSpan)
+	var access, err = p.Tokens.Issue(login, sid, expires)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	return SessionTokens{Access: access, Refresh: sid + "." + secret, Expires: expires}, nil
+}
+
+func (p *Storage) wrapSessionKey(keyID, sid string, dek []byte) ([]byte, error) {
+	var sessionKey, err = p.Tokens.SessionKey(keyID, sid)
+	if err != nil {
+		return nil, err
+	}
+	return wrapKey(sessionKey, dek)
+}
+
+func (p *Storage) unwrapSessionKey(keyID, sid string, wrapped []byte) ([]byte, error) {
+	var sessionKey, err = p.Tokens.SessionKey(keyID, sid)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(sessionKey, wrapped)
+}
+
+// newRefreshSecret returns a random refresh secret and its hash kept by
+// the session
+func newRefreshSecret() (string, []byte, error) {
+	var raw = make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	var secret = base64.RawURLEncoding.EncodeToString(raw)
+	var hash = sha256.Sum256([]byte(secret))
+	return secret, hash[:], nil
+}
+
+// checkRefresh checks the presented secret against the hash of the current
+// refresh token, ErrRefreshReused is returned for the token replaced last
+func checkRefresh(secret string, current, previous []byte) error {
+	switch {
+	case checkRefreshSecret(secret, current):
+		return nil
+	case previous != nil && checkRefreshSecret(secret, previous):
+		return ErrRefreshReused
+	default:
+		return ErrUserUnauthorized
+	}
+}
+
+func checkRefreshSecret(secret string, hash []byte) bool {
+	var presented = sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(presented[:], hash) == 1
+}
@@ -0,0 +1,471 @@
+package postgres
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrGranteeNotFound = fmt.Errorf("grantee not found")
+	// ErrGranteeKeyless is returned for grantees without a key pair, they
+	// get one at the next login
+	ErrGranteeKeyless = fmt.Errorf("grantee has no key pair")
+	ErrGrantNotFound  = fmt.Errorf("grant not found")
+	ErrGrantInvalid   = fmt.Errorf("grant invalid")
+	// ErrGrantStale is returned to grantees of a resource with content
+	// encrypted by the client
+	ErrGrantStale       = fmt.Errorf("grant holds no key of the content")
+	ErrPermissionDenied = fmt.Errorf("permission denied")
+)
+
+// Resources are shared by wrapping the resource key to the X25519 public
+// key of the grantee. Every user has a key pair, the private key is wrapped
+// by the data key of the user, so only sessions holding the data key can
+// read shared resources. The wrapped key of a grant is wrapped by the
+// master key in addition, as resource keys are.
+//
+// The owner changing the content rewraps the new key to the grantees, the
+// public keys are enough for it. Grantees with write permission keep the key
+// of the resource, the owner could not read the content otherwise. Content
+// encrypted by the client can't be shared, the server has no key of it.
+
+// Permission of a grantee
+type Permission string
+
+const (
+	PermissionRead  Permission = "read"
+	PermissionWrite Permission = "write"
+)
+
+// grantInfo binds the key wrapping the resource key to the resource
+const grantInfo = "gophkeeper grant "
+
+// Grant is the access of a grantee to a resource
+type Grant struct {
+	Grantee    string
+	Permission Permission
+	GrantedBy  string
+	CreatedAt  time.Time
+}
+
+// SharedResource is a resource shared with the user
+type SharedResource struct {
+	Resource
+	Owner      string
+	Permission Permission
+}
+
+// Share grants the user access to the resource of the owner, a grant given
+// before is replaced. ErrGranteeKeyless is returned if the grantee did not
+// log in since key pairs were introduced.
+func (p *Storage) Share(ctx context.Context, rid ResourceID, grantee string, permission Permission, c Creds) error {
+	if permission != PermissionRead && permission != PermissionWrite {
+		return fmt.Errorf("%w: unknown permission %q", ErrGrantInvalid, permission)
+	}
+	if grantee == c.Login {
+		return fmt.Errorf("%w: resource shared with its owner", ErrGrantInvalid)
+	}
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var public []byte
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT public_key FROM identities WHERE id = $1`,
+		grantee,
+	).Scan(&public); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrGranteeNotFound
+		}
+		return err
+	}
+	if public == nil {
+		return ErrGranteeKeyless
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var (
+		wrappedKey []byte
+		keyID      *string
+		salt       []byte
+		opaque     bool
+	)
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT COALESCE(p.wrapped_key, b.wrapped_key), COALESCE(p.key_id, b.key_id), COALESCE(p.salt, b.salt),
+			COALESCE(p.opaque, b.opaque, false)
+		FROM resources r
+		LEFT JOIN pieces p ON r.type = $3 AND p.id = r.resource
+		LEFT JOIN blobs b ON r.type = $4 AND b.id = r.resource
+		WHERE r.id = $1 AND r.owner = $2
+		FOR SHARE OF r`,
+		(int64)(rid), c.Login, (int)(ResourceTypePiece), (int)(ResourceTypeBlob),
+	).Scan(&wrappedKey, &keyID, &salt, &opaque); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrResourceNotFound
+		}
+		return err
+	}
+	if opaque {
+		return fmt.Errorf("%w: content encrypted by the client", ErrGrantInvalid)
+	}
+	var key, keyError = p.resourceKey(ctx, wrappedKey, keyID, salt, c)
+	if keyError != nil {
+		return keyError
+	}
+	var sealed, sealedID, sealError = p.sealTo(grantBinding(rid), public, key)
+	if sealError != nil {
+		return sealError
+	}
+
+	if _, err := transaction.Exec(
+		ctx,
+		`INSERT INTO resource_grants(rid, grantee, permission, wrapped_key, key_id, granted_by)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (rid, grantee) DO UPDATE
+		SET permission = EXCLUDED.permission, wrapped_key = EXCLUDED.wrapped_key, key_id = EXCLUDED.key_id,
+			granted_by = EXCLUDED.granted_by, created_at = now()`,
+		(int64)(rid), grantee, permission, sealed, sealedID, c.Login,
+	); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// Grants returns the grants of the resource, only the owner may list them
+func (p *Storage) Grants(ctx context.Context, rid ResourceID, c Creds) ([]Grant, error) {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT g.grantee, g.permission, g.granted_by, g.created_at FROM resource_grants g
+		JOIN resources r ON r.id = g.rid
+		WHERE g.rid = $1 AND r.owner = $2 ORDER BY g.grantee`,
+		(int64)(rid), c.Login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants = []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Grantee, &g.Permission, &g.GrantedBy, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(grants) == 0 {
+		if err := p.checkOwner(ctx, rid, c); err != nil {
+			return nil, err
+		}
+	}
+	return grants, nil
+}
+
+// Revoke drops the grant of the grantee, the owner may revoke any grant
+// and grantees their own one.
+func (p *Storage) Revoke(ctx context.Context, rid ResourceID, grantee string, c Creds) error {
+	var tag, err = p.db.Exec(
+		ctx,
+		`DELETE FROM resource_grants g USING resources r
+		WHERE g.rid = $1 AND g.grantee = $2 AND r.id = g.rid AND (r.owner = $3 OR g.grantee = $3)`,
+		(int64)(rid), grantee, c.Login,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrGrantNotFound
+	}
+	return nil
+}
+
+// SharedWithMe returns the resources shared with the user
+func (p *Storage) SharedWithMe(ctx context.Context, c Creds) ([]SharedResource, error) {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT `+resourceColumns+`, r.owner, g.permission
+		FROM resource_grants g JOIN resources r ON r.id = g.rid
+		WHERE g.grantee = $1 ORDER BY r.id`,
+		c.Login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resources = []SharedResource{}
+	for rows.Next() {
+		var s SharedResource
+		if err := rows.Scan(append(s.fields(), &s.Owner, &s.Permission)...); err != nil {
+			return nil, err
+		}
+		resources = append(resources, s)
+	}
+	return resources, rows.Err()
+}
+
+// checkOwner returns ErrResourceNotFound unless the user owns the resource
+func (p *Storage) checkOwner(ctx context.Context, rid ResourceID, c Creds) error {
+	var exists bool
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM resources WHERE id = $1 AND owner = $2)`,
+		(int64)(rid), c.Login,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// sealShared encrypts new piece content of a grantee with the key of the
+// resource, so the owner and other grantees keep reading it
+func (p *Storage) sealShared(ctx context.Context, rid ResourceID, plaintext []byte, opaque bool, c Creds) (content, iv []byte, err error) {
+	if opaque {
+		return nil, nil, fmt.Errorf("%w: shared content encrypted by the client", ErrGrantInvalid)
+	}
+	var key, keyError = p.grantKey(ctx, rid, c)
+	if keyError != nil {
+		return nil, nil, keyError
+	}
+	return sealContent(key, plaintext)
+}
+
+// grantKey returns the resource key of the grant of the user
+func (p *Storage) grantKey(ctx context.Context, rid ResourceID, c Creds) ([]byte, error) {
+	var (
+		sealed []byte
+		keyID  *string
+	)
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT wrapped_key, key_id FROM resource_grants WHERE rid = $1 AND grantee = $2`,
+		(int64)(rid), c.Login,
+	).Scan(&sealed, &keyID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, err
+	}
+	if sealed == nil {
+		return nil, ErrGrantStale
+	}
+	var private, privateError = p.privateKey(ctx, c)
+	if privateError != nil {
+		return nil, privateError
+	}
+	var unwrapped, masterError = p.Master.unwrap(sealed, keyID)
+	if masterError != nil {
+		return nil, masterError
+	}
+	return openKey(grantBinding(rid), private, unwrapped)
+}
+
+// rewrapGrants wraps the new key of the resource to its grantees, the key
+// is asked only if the resource has grants. Grants of content encrypted by
+// the client lose their key.
+func (p *Storage) rewrapGrants(ctx context.Context, tx pgx.Tx, rid ResourceID, opaque bool, key func() ([]byte, error)) error {
+	if opaque {
+		_, err := tx.Exec(ctx, `UPDATE resource_grants SET wrapped_key = NULL, key_id = NULL WHERE rid = $1`, (int64)(rid))
+		return err
+	}
+
+	var rows, queryError = tx.Query(
+		ctx,
+		`SELECT g.id, i.public_key FROM resource_grants g JOIN identities i ON i.id = g.grantee WHERE g.rid = $1`,
+		(int64)(rid),
+	)
+	if queryError != nil {
+		return queryError
+	}
+	type grantee struct {
+		id     int
+		public []byte
+	}
+	var grantees []grantee
+	for rows.Next() {
+		var g grantee
+		if err := rows.Scan(&g.id, &g.public); err != nil {
+			rows.Close()
+			return err
+		}
+		grantees = append(grantees, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(grantees) == 0 {
+		return nil
+	}
+
+	var resourceKey, keyError = key()
+	if keyError != nil {
+		return keyError
+	}
+	for _, g := range grantees {
+		var sealed, keyID, err = p.sealTo(grantBinding(rid), g.public, resourceKey)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			ctx,
+			`UPDATE resource_grants SET wrapped_key = $2, key_id = $3 WHERE id = $1`,
+			g.id, sealed, keyID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureKeyPair gives the user a key pair unless there is one
+func ensureKeyPair(ctx context.Context, tx pgx.Tx, login string, dek []byte) error {
+	var public, wrapped, err = newKeyPair(dek)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE identities SET public_key = $2, private_key = $3 WHERE id = $1 AND public_key IS NULL`,
+		login, public, wrapped,
+	)
+	return err
+}
+
+// privateKey returns the private key of the user unwrapped by the data key
+func (p *Storage) privateKey(ctx context.Context, c Creds) (*ecdh.PrivateKey, error) {
+	var dek, keyError = p.userKey(ctx, c)
+	if keyError != nil {
+		return nil, keyError
+	}
+	var wrapped []byte
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT private_key FROM identities WHERE id = $1`,
+		c.Login,
+	).Scan(&wrapped); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserUnauthorized
+		}
+		return nil, err
+	}
+	if wrapped == nil {
+		return nil, ErrGranteeKeyless
+	}
+	var private, unwrapError = unwrapKey(dek, wrapped)
+	if unwrapError != nil {
+		return nil, unwrapError
+	}
+	return ecdh.X25519().NewPrivateKey(private)
+}
+
+// sealTo wraps the key to the public key and by the master key
+func (p *Storage) sealTo(binding string, public, key []byte) ([]byte, *string, error) {
+	var sealed, err = sealKey(binding, public, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Master.wrap(sealed)
+}
+
+// newKeyPair returns a new X25519 public key and the private key wrapped by
+// the data key
+func newKeyPair(dek []byte) (public, wrapped []byte, err error) {
+	var private, generateError = ecdh.X25519().GenerateKey(rand.Reader)
+	if generateError != nil {
+		return nil, nil, generateError
+	}
+	if wrapped, err = wrapKey(dek, private.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	return private.PublicKey().Bytes(), wrapped, nil
+}
+
+// sealKey wraps the key to the X25519 public key. The key wrapping it is
+// agreed with an ephemeral key pair, the ephemeral public key is prepended.
+// The binding names what the key is for, it must be given to open it.
+func sealKey(binding string, public, key []byte) ([]byte, error) {
+	var recipient, publicError = ecdh.X25519().NewPublicKey(public)
+	if publicError != nil {
+		return nil, publicError
+	}
+	var ephemeral, generateError = ecdh.X25519().GenerateKey(rand.Reader)
+	if generateError != nil {
+		return nil, generateError
+	}
+	var shared, sharedError = ephemeral.ECDH(recipient)
+	if sharedError != nil {
+		return nil, sharedError
+	}
+	var ephemeralPublic = ephemeral.PublicKey().Bytes()
+	var kek, kekError = sealKEK(binding, shared, ephemeralPublic, public)
+	if kekError != nil {
+		return nil, kekError
+	}
+	var wrapped, wrapError = wrapKey(kek, key)
+	if wrapError != nil {
+		return nil, wrapError
+	}
+	return slices.Concat(ephemeralPublic, wrapped), nil
+}
+
+// openKey unwraps the key sealed by sealKey with the private key
+func openKey(binding string, private *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	var size = len(private.PublicKey().Bytes())
+	if len(sealed) < size {
+		return nil, fmt.Errorf("%w: sealed key too short", ErrGrantInvalid)
+	}
+	var ephemeral, publicError = ecdh.X25519().NewPublicKey(sealed[:size])
+	if publicError != nil {
+		return nil, publicError
+	}
+	var shared, sharedError = private.ECDH(ephemeral)
+	if sharedError != nil {
+		return nil, sharedError
+	}
+	var kek, kekError = sealKEK(binding, shared, sealed[:size], private.PublicKey().Bytes())
+	if kekError != nil {
+		return nil, kekError
+	}
+	return unwrapKey(kek, sealed[size:])
+}
+
+func sealKEK(binding string, shared, ephemeral, recipient []byte) ([]byte, error) {
+	var (
+		kek    = make([]byte, keyLen)
+		reader = hkdf.New(sha256.New, shared, slices.Concat(ephemeral, recipient), []byte(binding))
+	)
+	if _, err := io.ReadFull(reader, kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// grantBinding binds keys of grants to the resource
+func grantBinding(rid ResourceID) string {
+	return grantInfo + strconv.FormatInt((int64)(rid), 10)
+}
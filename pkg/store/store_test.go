@@ -1,10 +1,38 @@
 package postgres
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stsg/gophkeeper/pkg/archive"
+	"github.com/stsg/gophkeeper/pkg/blobstore"
+	"github.com/stsg/gophkeeper/pkg/envelope"
+	"github.com/stsg/gophkeeper/pkg/secret"
+	"github.com/stsg/gophkeeper/pkg/stream"
+	"github.com/stsg/gophkeeper/pkg/token"
+	"github.com/stsg/gophkeeper/pkg/totp"
 )
 
 // Function successfully connects to the database using provided configuration
@@ -18,3 +46,904 @@ func TestNewSuccessDatabaseConnection(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, storage)
 }
+
+func TestKDF(t *testing.T) {
+	for _, kdf := range []KDF{DefaultKDF, LegacyKDF, {Algorithm: kdfArgon2id, Time: 1, Memory: 64, Threads: 2}} {
+		parsed, err := ParseKDF(kdf.String())
+		require.NoError(t, err)
+		assert.Equal(t, kdf, parsed)
+	}
+	assert.Equal(t, "argon2id$v=19$m=19456,t=2,p=1", DefaultKDF.String())
+	assert.Equal(t, "pbkdf2-sha256$i=4096", LegacyKDF.String())
+
+	for _, s := range []string{"", "scrypt$n=1", "argon2id$v=16$m=64,t=1,p=1", "argon2id$v=19$m=64,t=0,p=1", "argon2id$v=19$m=1,t=1,p=1", "pbkdf2-sha256$i=x"} {
+		_, err := ParseKDF(s)
+		assert.ErrorIs(t, err, ErrUnknownKDF, s)
+	}
+
+	salt := []byte("0123456789abcdef")
+	fast := KDF{Algorithm: kdfArgon2id, Time: 1, Memory: 64, Threads: 1}
+	assert.Len(t, fast.Key("password", salt), keyLen)
+	assert.Equal(t, fast.Key("password", salt), fast.Key("password", salt))
+	assert.NotEqual(t, fast.Key("password", salt), fast.Key("password", []byte("fedcba9876543210")))
+	assert.NotEqual(t, fast.Key("password", salt), KDF{Algorithm: kdfArgon2id, Time: 2, Memory: 64, Threads: 1}.Key("password", salt))
+	assert.Equal(t, legacyKey(salt, Creds{Passw: "password"}), LegacyKDF.Key("password", salt))
+}
+
+func TestMasterKeys(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, keyLen))
+	k2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, keyLen))
+
+	old, err := ParseMasterKeys(strings.NewReader("# keyring\nk1:"+k1+"\n"), "")
+	require.NoError(t, err)
+	assert.Equal(t, "k1", old.Active())
+	m, err := ParseMasterKeys(strings.NewReader("k1:"+k1+"\n\nk2:"+k2), "")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", m.Active())
+	m1, err := ParseMasterKeys(strings.NewReader("k1:"+k1+", k2:"+k2), "k1")
+	require.NoError(t, err)
+	assert.Equal(t, "k1", m1.Active())
+
+	for _, keyring := range []string{"k1", "k1:short", ":" + k1, "k1:" + k1 + "\nk1:" + k2} {
+		_, err := ParseMasterKeys(strings.NewReader(keyring), "")
+		assert.Error(t, err, keyring)
+	}
+	_, err = ParseMasterKeys(strings.NewReader("k1:"+k1), "k3")
+	assert.ErrorIs(t, err, ErrMasterKeyUnknown)
+
+	dek := bytes.Repeat([]byte{3}, keyLen)
+	key := bytes.Repeat([]byte{4}, keyLen)
+
+	p := &Storage{}
+	wrapped, keyID, err := p.wrapResourceKey(dek, key)
+	require.NoError(t, err)
+	assert.Nil(t, keyID)
+	unwrapped, err := unwrapKey(dek, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	p.Master = old
+	wrapped, keyID, err = p.wrapResourceKey(dek, key)
+	require.NoError(t, err)
+	require.NotNil(t, keyID)
+	assert.Equal(t, "k1", *keyID)
+	_, err = unwrapKey(dek, wrapped)
+	assert.Error(t, err, "master key must be unwrapped first")
+
+	// rotated keyring still reads keys of the former master key
+	dekWrapped, err := m.unwrap(wrapped, keyID)
+	require.NoError(t, err)
+	unwrapped, err = unwrapKey(dek, dekWrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	var none *MasterKeys
+	_, err = none.unwrap(wrapped, keyID)
+	assert.ErrorIs(t, err, ErrMasterKeyUnknown)
+	unknown := "k9"
+	_, err = m.unwrap(wrapped, &unknown)
+	assert.ErrorIs(t, err, ErrMasterKeyUnknown)
+}
+
+func TestPasswordHash(t *testing.T) {
+	kdf := KDF{Algorithm: kdfArgon2id, Time: 1, Memory: 64, Threads: 1}
+	encoded, err := hashPassword("correct horse", kdf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"), encoded)
+	assert.NotContains(t, encoded, "correct horse")
+
+	ok, current, err := verifyPassword(encoded, "correct horse", kdf)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, current)
+	ok, _, err = verifyPassword(encoded, "wrong horse", kdf)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	stronger := KDF{Algorithm: kdfArgon2id, Time: 2, Memory: 64, Threads: 1}
+	ok, current, err = verifyPassword(encoded, "correct horse", stronger)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, current, "hash of other parameters is replaced")
+
+	// hashed by the migration
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ok, current, err = verifyPassword(string(bcrypted), "correct horse", kdf)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, current)
+	ok, _, err = verifyPassword(string(bcrypted), "wrong horse", kdf)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, malformed := range []string{"", "plaintext", "$argon2id$v=19$m=64,t=1,p=1$", "$unknown$c2FsdA$aGFzaA", "$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaA"} {
+		_, _, err = verifyPassword(malformed, "plaintext", kdf)
+		assert.Error(t, err, malformed)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := DefaultPasswordPolicy
+	n, err := policy.LoadBreached(strings.NewReader(
+		"# breached\npassword123\n\n" +
+			"B0399D2029F64D445BD131FFAA399A42D2F8E7DC\n" + // qwertyuiop
+			"b80a9aed8af17118e51d4d0c2d7872ae26e2109e:9\n", // 1q2w3e4r5t
+	))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	assert.NoError(t, policy.Validate("octocat", "correct horse"))
+	assert.ErrorIs(t, policy.Validate("octocat", ""), ErrPasswordEmpty)
+	assert.ErrorIs(t, policy.Validate("octocat", "short"), ErrPasswordWeak)
+	assert.ErrorIs(t, policy.Validate("octocat", "пароль"), ErrPasswordWeak, "length in characters")
+	assert.NoError(t, policy.Validate("octocat", "пароль-ок"))
+	assert.ErrorIs(t, policy.Validate("octocat", strings.Repeat("x", 257)), ErrPasswordWeak)
+	assert.ErrorIs(t, policy.Validate("octocat123", "OctoCat123"), ErrPasswordWeak)
+	for _, breached := range []string{"password123", "qwertyuiop", "1q2w3e4r5t"} {
+		assert.ErrorIs(t, policy.Validate("octocat", breached), ErrPasswordWeak, breached)
+	}
+	assert.Empty(t, DefaultPasswordPolicy.breached, "default policy is not changed")
+}
+
+func TestRefreshSecret(t *testing.T) {
+	secret, hash, err := newRefreshSecret()
+	require.NoError(t, err)
+	assert.True(t, checkRefreshSecret(secret, hash))
+	assert.False(t, checkRefreshSecret(secret+"x", hash))
+
+	next, nextHash, err := newRefreshSecret()
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, next)
+	assert.False(t, checkRefreshSecret(secret, nextHash), "replaced secret must not match")
+
+	assert.NoError(t, checkRefresh(next, nextHash, hash))
+	assert.ErrorIs(t, checkRefresh(secret, nextHash, hash), ErrRefreshReused)
+	// knowing the session ID is not enough to close the session
+	err = checkRefresh("guessed", nextHash, hash)
+	assert.ErrorIs(t, err, ErrUserUnauthorized)
+	assert.NotErrorIs(t, err, ErrRefreshReused)
+	assert.ErrorIs(t, checkRefresh(secret, nextHash, nil), ErrUserUnauthorized)
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`, code)
+	assert.Equal(t, recoveryCodeHash(code), recoveryCodeHash(strings.ToLower(strings.ReplaceAll(code, "-", " "))))
+
+	other, err := newRecoveryCode()
+	require.NoError(t, err)
+	assert.NotEqual(t, recoveryCodeHash(code), recoveryCodeHash(other))
+}
+
+// testDatabase returns the storage of the local test database with a new
+// user, the test is skipped without the database
+func testDatabase(t *testing.T) (*Storage, Creds) {
+	p, err := New(&Config{
+		ConnectTimeout:   5 * time.Second,
+		ConnectionString: "host=localhost port=5432 user=postgres dbname=postgres password=postgres sslmode=disable",
+		MigrationVersion: 23,
+	})
+	if err != nil {
+		t.Skipf("no database: %s", err)
+	}
+	t.Cleanup(p.Close)
+	p.KDF = KDF{Algorithm: kdfArgon2id, Time: 1, Memory: 64, Threads: 1}
+	p.LifeSpan, p.RefreshSpan = time.Minute, time.Hour
+	p.Tokens, err = token.NewIssuer(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	p.Master, err = testMasterKeys("test-1", "test-1", "test-2")
+	require.NoError(t, err)
+	p.Blobs, err = blobstore.NewFS(t.TempDir())
+	require.NoError(t, err)
+
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	require.NoError(t, err)
+	c := Creds{Login: "test-" + hex.EncodeToString(suffix), Passw: "correct horse battery"}
+	require.NoError(t, p.Register(context.Background(), c))
+	return p, c
+}
+
+// testMasterKeys returns the keyring of the IDs, keys of the same ID are
+// equal in every test
+func testMasterKeys(active string, ids ...string) (*MasterKeys, error) {
+	var entries []string
+	for _, id := range ids {
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[len(id)-1:]), keyLen)))
+	}
+	return ParseMasterKeys(strings.NewReader(strings.Join(entries, ",")), active)
+}
+
+func TestRotateKeys_TOTP(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	enrollment, err := p.EnrollTOTP(ctx, c)
+	require.NoError(t, err)
+
+	p.Master, err = testMasterKeys("test-2", "test-1", "test-2")
+	require.NoError(t, err)
+	_, err = p.RotateKeys(ctx)
+	require.NoError(t, err)
+
+	// the retired key is not needed for the secret anymore
+	p.Master, err = testMasterKeys("test-2", "test-2")
+	require.NoError(t, err)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	_, err = p.EnableTOTP(ctx, c, totp.Code(secret, totp.Step(time.Now())))
+	require.NoError(t, err)
+
+	p.Master = nil
+	_, err = p.EnrollTOTP(ctx, c)
+	assert.ErrorIs(t, err, ErrNoMasterKey)
+}
+
+func TestVerifyLogin_AccountLockout(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	enrollment, err := p.EnrollTOTP(ctx, c)
+	require.NoError(t, err)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	now := totp.Step(time.Now())
+	_, err = p.EnableTOTP(ctx, c, totp.Code(secret, now-1))
+	require.NoError(t, err)
+
+	wrong := "000000"
+	for code := 0; wrong == totp.Code(secret, now-1) || wrong == totp.Code(secret, now) || wrong == totp.Code(secret, now+1); code++ {
+		wrong = fmt.Sprintf("%06d", code*111111%1_000_000)
+	}
+	// fewer wrong codes per challenge than challengeAttempts, every
+	// challenge is new
+	for failures := 0; failures < factorAttempts; failures += 2 {
+		tokens, err := p.Authenticate(ctx, c, false, Device{})
+		require.NoError(t, err)
+		require.NotEmpty(t, tokens.Challenge)
+		for i := 0; i < 2; i++ {
+			_, err = p.VerifyLogin(ctx, tokens.Challenge, wrong, Device{})
+			assert.ErrorIs(t, err, ErrSecondFactorWrong)
+		}
+	}
+
+	tokens, err := p.Authenticate(ctx, c, false, Device{})
+	require.NoError(t, err)
+	_, err = p.VerifyLogin(ctx, tokens.Challenge, totp.Code(secret, now+1), Device{})
+	assert.ErrorIs(t, err, ErrSecondFactorLocked, "the right code is rejected while locked")
+
+	// a code accepted after the lockout starts the count over
+	_, err = p.db.Exec(ctx, `UPDATE identities SET factor_locked_until = now() WHERE id = $1`, c.Login)
+	require.NoError(t, err)
+	_, err = p.VerifyLogin(ctx, tokens.Challenge, wrong, Device{})
+	assert.ErrorIs(t, err, ErrSecondFactorWrong)
+	session, err := p.VerifyLogin(ctx, tokens.Challenge, totp.Code(secret, now+1), Device{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.Access)
+	var failures int
+	require.NoError(t, p.db.QueryRow(ctx, `SELECT factor_failures FROM identities WHERE id = $1`, c.Login).Scan(&failures))
+	assert.Zero(t, failures)
+}
+
+func TestImport_BlobContent(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	rid, err := p.StoreBlob(ctx, Blob{Content: io.NopCloser(strings.NewReader("first!")), Meta: "notes", Filename: "notes.txt"}, c)
+	require.NoError(t, err)
+
+	archived := func(content string) io.Reader {
+		var buf bytes.Buffer
+		w, err := archive.NewWriter(&buf, "export passphrase", envelope.KDFParams{Time: 1, Memory: 1024, Threads: 1}, archive.Manifest{
+			Resources: []archive.Resource{{ID: 1, Type: "blob", Kind: "binary", Meta: "notes", Filename: "notes.txt"}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, w.WriteEntry(archive.Entry{ID: 1, Size: int64(len(content))}, strings.NewReader(content)))
+		require.NoError(t, w.Close())
+		return &buf
+	}
+
+	// same meta and size, other content
+	report, err := p.Import(ctx, 0, "export passphrase", archived("second"), c)
+	require.NoError(t, err)
+	require.Len(t, report.Resources, 1)
+	assert.False(t, report.Resources[0].Duplicate)
+	assert.NotEqual(t, rid, report.Resources[0].RID)
+	blob, err := p.RestoreBlob(ctx, report.Resources[0].RID, c)
+	require.NoError(t, err)
+	got, err := io.ReadAll(blob.Content)
+	require.NoError(t, err)
+	require.NoError(t, blob.Content.Close())
+	assert.Equal(t, "second", string(got))
+
+	report, err = p.Import(ctx, 0, "export passphrase", archived("first!"), c)
+	require.NoError(t, err)
+	require.Len(t, report.Resources, 1)
+	assert.True(t, report.Resources[0].Duplicate)
+	assert.Equal(t, rid, report.Resources[0].RID)
+}
+
+func TestQuota_UpdateAndRestore(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	p.Quotas.User.Bytes = 100
+	content := func(b byte, n int) io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(bytes.Repeat([]byte{b}, n)))
+	}
+	used := func() int64 {
+		vaults, err := p.AccountUsage(ctx, c)
+		require.NoError(t, err)
+		return vaults[0].Bytes
+	}
+
+	rid, err := p.StoreBlob(ctx, Blob{Content: content('a', 60)}, c)
+	require.NoError(t, err)
+	// the replaced blob stays with its revision
+	_, err = p.UpdateBlob(ctx, rid, 0, BlobUpdate{Content: content('b', 60)}, c)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = p.UpdateBlob(ctx, rid, 0, BlobUpdate{Content: content('c', 40)}, c)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), used())
+
+	// restoring the larger revision adds nothing, even over a lowered quota
+	p.Quotas.User.Bytes = 90
+	revisions, err := p.Revisions(ctx, rid, c)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	_, err = p.RestoreRevision(ctx, rid, revisions[1].Version, 0, c)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), used())
+	blob, err := p.RestoreBlob(ctx, rid, c)
+	require.NoError(t, err)
+	require.NoError(t, blob.Content.Close())
+	assert.Equal(t, int64(60), blob.Size)
+}
+
+func TestResources_ContentKeys(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	for _, resourceType := range []ResourceType{ResourceTypePiece, ResourceTypeBlob} {
+		_, err := p.db.Exec(
+			ctx,
+			`INSERT INTO resources(meta, resource, type, owner, kind, updated_by) VALUES('', -1, $1, $2, 'text', $2)`,
+			(int)(resourceType), c.Login,
+		)
+		var pgErr *pgconn.PgError
+		require.ErrorAs(t, err, &pgErr)
+		assert.Equal(t, pgerrcode.ForeignKeyViolation, pgErr.Code)
+	}
+}
+
+func TestRefresh_Race(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	tokens, err := p.Authenticate(ctx, c, false, Device{})
+	require.NoError(t, err)
+
+	// an unknown secret of the session leaves it open
+	sid, _, _ := strings.Cut(tokens.Refresh, ".")
+	_, err = p.Refresh(ctx, sid+".unknown", Device{})
+	assert.ErrorIs(t, err, ErrUserUnauthorized)
+	assert.NotErrorIs(t, err, ErrRefreshReused)
+
+	// the token refreshed twice at once is rotated once, the late refresh
+	// presents the replaced token and closes the session
+	type result struct {
+		tokens SessionTokens
+		err    error
+	}
+	var results = make(chan result, 2)
+	for range 2 {
+		go func() {
+			tokens, err := p.Refresh(ctx, tokens.Refresh, Device{})
+			results <- result{tokens, err}
+		}()
+	}
+	first, second := <-results, <-results
+	if first.err != nil {
+		first, second = second, first
+	}
+	require.NoError(t, first.err)
+	assert.ErrorIs(t, second.err, ErrRefreshReused)
+	_, err = p.Refresh(ctx, first.tokens.Refresh, Device{})
+	assert.ErrorIs(t, err, ErrUserUnauthorized)
+}
+
+func TestChanges_InFlightTeamWrite(t *testing.T) {
+	ctx := context.Background()
+	p, c := testDatabase(t)
+	org, err := p.CreateOrg(ctx, c.Login, c)
+	require.NoError(t, err)
+	team, err := p.CreateTeam(ctx, org, "team", c)
+	require.NoError(t, err)
+	teamRID, err := p.StorePiece(ctx, Piece{Content: []byte("team"), Kind: secret.KindText, Team: team}, c)
+	require.NoError(t, err)
+	since, err := p.Changes(ctx, 0, c)
+	require.NoError(t, err)
+
+	// a team write takes its version and stays in flight while a write of
+	// the owner with a higher version commits
+	writer, err := p.db.Begin(ctx)
+	require.NoError(t, err)
+	defer writer.Rollback(ctx)
+	require.NoError(t, lockOwner(ctx, writer, teamLock(team)))
+	teamVersion, err := bumpResource(ctx, writer, teamRID, nil, c)
+	require.NoError(t, err)
+	ownerRID, err := p.StorePiece(ctx, Piece{Content: []byte("owner"), Kind: secret.KindText}, c)
+	require.NoError(t, err)
+
+	var done = make(chan Changes)
+	go func() {
+		changes, err := p.Changes(ctx, since.Cursor, c)
+		assert.NoError(t, err)
+		done <- changes
+	}()
+	select {
+	case <-done:
+		t.Fatal("changes returned while a team write is in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.NoError(t, writer.Commit(ctx))
+
+	changes := <-done
+	var versions = map[ResourceID]int64{}
+	for _, resource := range changes.Resources {
+		versions[resource.ID] = resource.Version
+	}
+	assert.Equal(t, teamVersion, versions[teamRID])
+	assert.Contains(t, versions, ownerRID)
+	assert.Greater(t, changes.Cursor, teamVersion)
+}
+
+func TestSealKey(t *testing.T) {
+	dek := make([]byte, keyLen)
+	public, wrapped, err := newKeyPair(dek)
+	require.NoError(t, err)
+	privateBytes, err := unwrapKey(dek, wrapped)
+	require.NoError(t, err)
+	private, err := ecdh.X25519().NewPrivateKey(privateBytes)
+	require.NoError(t, err)
+	require.Equal(t, public, private.PublicKey().Bytes())
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := sealKey(grantBinding(7), public, key)
+	require.NoError(t, err)
+	opened, err := openKey(grantBinding(7), private, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, key, opened)
+
+	again, err := sealKey(grantBinding(7), public, key)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "ephemeral keys must differ")
+
+	_, err = openKey(grantBinding(8), private, sealed)
+	assert.Error(t, err, "grant bound to another resource")
+
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = openKey(grantBinding(7), other, sealed)
+	assert.Error(t, err, "grant of another user")
+
+	_, err = openKey(grantBinding(7), private, sealed[:10])
+	assert.ErrorIs(t, err, ErrGrantInvalid)
+
+	_, err = openKey(teamBinding(7), private, sealed)
+	assert.Error(t, err, "grant key opened as a team key")
+}
+
+func TestRole(t *testing.T) {
+	for _, role := range []Role{RoleOwner, RoleAdmin, RoleEditor, RoleViewer} {
+		assert.True(t, role.valid(), role)
+	}
+	assert.False(t, Role("root").valid())
+
+	assert.True(t, RoleOwner.manages())
+	assert.True(t, RoleAdmin.manages())
+	assert.False(t, RoleEditor.manages())
+	assert.False(t, RoleViewer.manages())
+
+	assert.Equal(t, PermissionWrite, RoleEditor.permission())
+	assert.Equal(t, PermissionRead, RoleViewer.permission())
+}
+
+func TestAccess(t *testing.T) {
+	c := Creds{Login: "alice"}
+
+	own := access{owner: "alice", permission: PermissionWrite}
+	assert.NoError(t, own.writable())
+	assert.False(t, own.granted(c))
+	assert.Equal(t, "alice", own.lockKey())
+
+	shared := access{owner: "bob", permission: PermissionRead}
+	assert.ErrorIs(t, shared.writable(), ErrPermissionDenied)
+	assert.True(t, shared.granted(c))
+	assert.Equal(t, "bob", shared.lockKey())
+
+	team := access{team: 3, permission: RoleViewer.permission()}
+	assert.ErrorIs(t, team.writable(), ErrPermissionDenied)
+	assert.False(t, team.granted(c))
+	assert.Equal(t, teamLock(3), team.lockKey())
+}
+
+func TestBlob_Authenticated(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, err := blobstore.NewFS(root)
+	require.NoError(t, err)
+	p := &Storage{Blobs: fs}
+	dek, wrappedDEK, salt, err := newUserKey("password", DefaultKDF)
+	require.NoError(t, err)
+	unwrapped, err := unwrapKey(DefaultKDF.Key("password", salt), wrappedDEK)
+	require.NoError(t, err)
+	assert.Equal(t, dek, unwrapped)
+	_, err = unwrapKey(DefaultKDF.Key("wrong", salt), wrappedDEK)
+	assert.Error(t, err)
+
+	content := make([]byte, 3*stream.SegmentSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+
+	b, err := p.writeBlob(ctx, bytes.NewReader(content), false, dek)
+	require.NoError(t, err)
+	assert.Equal(t, blobFormatAEAD, b.format)
+	key, err := unwrapKey(dek, b.wrappedKey)
+	require.NoError(t, err)
+
+	r, size, err := p.openBlob(ctx, b, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+
+	file := filepath.Join(root, b.location[:2], b.location[2:4], b.location)
+	sealed, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	// flipped bit
+	tampered := bytes.Clone(sealed)
+	tampered[stream.SegmentSize+10] ^= 1
+	require.NoError(t, os.WriteFile(file, tampered, 0o600))
+	r, _, err = p.openBlob(ctx, b, key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, stream.ErrAuth)
+	r.Close()
+
+	// dropped final segment
+	require.NoError(t, os.WriteFile(file, sealed[:3*(stream.SegmentSize+16)], 0o600))
+	_, _, err = p.openBlob(ctx, b, key)
+	assert.ErrorIs(t, err, ErrBlobCorrupted)
+	unsized := b
+	unsized.size = nil // stored before sizes were kept
+	r, _, err = p.openBlob(ctx, unsized, key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+	r.Close()
+
+	// content moved to another blob
+	require.NoError(t, os.WriteFile(file, sealed, 0o600))
+	other, err := p.writeBlob(ctx, bytes.NewReader(content), false, dek)
+	require.NoError(t, err)
+	other.iv, other.digest = b.iv, b.digest
+	require.NoError(t, os.WriteFile(filepath.Join(root, other.location[:2], other.location[2:4], other.location), sealed, 0o600))
+	r, _, err = p.openBlob(ctx, other, key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, stream.ErrAuth)
+	r.Close()
+}
+
+func TestBlob_Seek(t *testing.T) {
+	ctx := context.Background()
+	fs, err := blobstore.NewFS(t.TempDir())
+	require.NoError(t, err)
+	p := &Storage{Blobs: fs}
+	key := make([]byte, keyLen)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	content := make([]byte, 2*stream.SegmentSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+
+	aeadBlob, err := p.putBlob(ctx, storedBlob{location: "aead", format: blobFormatAEAD}, bytes.NewReader(content), key)
+	require.NoError(t, err)
+
+	ctrBlob := storedBlob{location: "ctr", iv: make([]byte, aes.BlockSize), format: blobFormatCTR}
+	ctrBlob.iv[len(ctrBlob.iv)-1] = 0xff // the counter carries
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	sealed := make([]byte, len(content))
+	cipher.NewCTR(block, ctrBlob.iv).XORKeyStream(sealed, content)
+	_, err = fs.Put(ctx, ctrBlob.location, bytes.NewReader(sealed))
+	require.NoError(t, err)
+
+	_, err = fs.Put(ctx, "opaque", bytes.NewReader(content))
+	require.NoError(t, err)
+	opaqueBlob := storedBlob{location: "opaque", opaque: true}
+
+	for name, b := range map[string]storedBlob{"aead": aeadBlob, "ctr": ctrBlob, "opaque": opaqueBlob} {
+		t.Run(name, func(t *testing.T) {
+			r, size, err := p.openBlob(ctx, b, key)
+			require.NoError(t, err)
+			defer r.Close()
+			assert.Equal(t, int64(len(content)), size)
+			for _, offset := range []int64{0, 17, stream.SegmentSize, stream.SegmentSize + 1, size - 1, size} {
+				_, err := r.Seek(offset, io.SeekStart)
+				require.NoError(t, err)
+				got, err := io.ReadAll(io.LimitReader(r, 1000))
+				require.NoError(t, err, offset)
+				assert.Equal(t, content[offset:min(offset+1000, size)], got, offset)
+			}
+			end, err := r.Seek(-10, io.SeekEnd)
+			require.NoError(t, err)
+			assert.Equal(t, size-10, end)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, content[size-10:], got)
+		})
+	}
+}
+
+func TestBlob_Digest(t *testing.T) {
+	ctx := context.Background()
+	fs, err := blobstore.NewFS(t.TempDir())
+	require.NoError(t, err)
+	p := &Storage{Blobs: fs}
+	key := make([]byte, keyLen)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	content := make([]byte, stream.SegmentSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+
+	b, err := p.putBlob(ctx, storedBlob{location: "sealed", format: blobFormatAEAD}, bytes.NewReader(content), key)
+	require.NoError(t, err)
+	require.NotNil(t, b.size)
+	assert.Equal(t, int64(len(content)), *b.size)
+	digest, err := unwrapKey(key, b.digest)
+	require.NoError(t, err)
+	assert.Equal(t, sum[:], digest)
+	r, _, err := p.openBlob(ctx, b, key)
+	require.NoError(t, err)
+	assert.Equal(t, sum[:], r.digest)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// opaque content is checked as stored
+	_, err = fs.Put(ctx, "opaque", bytes.NewReader(content))
+	require.NoError(t, err)
+	size := int64(len(content))
+	opaque := storedBlob{location: "opaque", opaque: true, size: &size, digest: sum[:]}
+	r, _, err = p.openBlob(ctx, opaque, nil)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	corrupted := bytes.Clone(content)
+	corrupted[len(corrupted)-1] ^= 1
+	_, err = fs.Put(ctx, "opaque", bytes.NewReader(corrupted))
+	require.NoError(t, err)
+	r, _, err = p.openBlob(ctx, opaque, nil)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrBlobCorrupted)
+	assert.Less(t, len(got), len(content), "the last bytes are held back")
+
+	// ranges are not checked
+	_, err = r.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, corrupted[10:], got)
+	require.NoError(t, r.Close())
+
+	// truncated
+	_, err = fs.Put(ctx, "opaque", bytes.NewReader(content[:10]))
+	require.NoError(t, err)
+	_, _, err = p.openBlob(ctx, opaque, nil)
+	assert.ErrorIs(t, err, ErrBlobCorrupted)
+}
+
+func TestUpload_Parts(t *testing.T) {
+	ctx := context.Background()
+	fs, err := blobstore.NewFS(t.TempDir())
+	require.NoError(t, err)
+	p := &Storage{Blobs: fs}
+	key := make([]byte, keyLen)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	aead, err := stream.NewAEAD(key)
+	require.NoError(t, err)
+	content := make([]byte, 3*stream.SegmentSize+100)
+	_, err = rand.Read(content)
+	require.NoError(t, err)
+
+	// chunks sealed one by one join into the stream of the blob
+	b := storedBlob{location: "blob", iv: make([]byte, stream.NoncePrefixSize), format: blobFormatAEAD}
+	var parts []string
+	for i, chunk := range [][]byte{content[:2*stream.SegmentSize], content[2*stream.SegmentSize:]} {
+		var sealed bytes.Buffer
+		w, err := stream.NewWriterAt(&sealed, aead, b.iv, []byte(b.location), int64(i)*2*stream.SegmentSize)
+		require.NoError(t, err)
+		cr := &chunkReader{r: bytes.NewReader(chunk), limit: int64(len(content) - i*2*stream.SegmentSize)}
+		_, err = io.Copy(w, cr)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(chunk)), cr.n)
+		if i == 0 {
+			require.NoError(t, w.Flush())
+		} else {
+			require.NoError(t, w.Close())
+		}
+		part := fmt.Sprintf("part%d", i)
+		_, err = fs.Put(ctx, part, &sealed)
+		require.NoError(t, err)
+		parts = append(parts, part)
+	}
+	joined := &partsReader{ctx: ctx, blobs: fs, parts: parts}
+	_, err = fs.Put(ctx, b.location, joined)
+	require.NoError(t, err)
+	require.NoError(t, joined.Close())
+
+	r, _, err := p.openBlob(ctx, b, key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+
+	// chunks past the length of the upload
+	_, err = io.Copy(io.Discard, &chunkReader{r: bytes.NewReader(content), limit: 10})
+	assert.ErrorIs(t, err, ErrUploadInvalid)
+	_, err = io.Copy(io.Discard, &chunkReader{r: bytes.NewReader(content), limit: -1})
+	assert.NoError(t, err)
+}
+
+func TestFolderNames(t *testing.T) {
+	assert.NoError(t, checkFolderName("work"))
+	assert.ErrorIs(t, checkFolderName(" "), ErrFolderInvalid)
+	assert.ErrorIs(t, checkFolderName("a/b"), ErrFolderInvalid)
+	assert.ErrorIs(t, checkFolderName(strings.Repeat("x", maxNameLen+1)), ErrFolderInvalid)
+
+	tag, err := normalizeTag(" Work ")
+	require.NoError(t, err)
+	assert.Equal(t, "work", tag)
+	_, err = normalizeTag("a,b")
+	assert.ErrorIs(t, err, ErrTagInvalid)
+	_, err = normalizeTag("")
+	assert.ErrorIs(t, err, ErrTagInvalid)
+}
+
+func TestDetails_Validate(t *testing.T) {
+	valid := Details{
+		Title:  "Prod DB",
+		URLs:   []string{"https://db.example.com"},
+		Fields: []Field{{Name: "port", Value: "5432"}, {Name: "region", Value: "eu"}},
+	}
+	assert.NoError(t, valid.validate())
+	assert.NoError(t, Details{}.validate())
+
+	for name, details := range map[string]Details{
+		"relative url":    {URLs: []string{"db.example.com"}},
+		"unnamed field":   {Fields: []Field{{Value: "x"}}},
+		"duplicate field": {Fields: []Field{{Name: "a"}, {Name: "a"}}},
+		"long title":      {Title: strings.Repeat("x", maxTitleLen+1)},
+		"long notes":      {Notes: strings.Repeat("x", maxNotesLen+1)},
+	} {
+		assert.ErrorIs(t, details.validate(), ErrDetailsInvalid, name)
+	}
+}
+
+func TestListQuery(t *testing.T) {
+	sort, desc, err := ParseListSort("-updated")
+	require.NoError(t, err)
+	assert.Equal(t, SortUpdated, sort)
+	assert.True(t, desc)
+	sort, desc, err = ParseListSort("")
+	require.NoError(t, err)
+	assert.Equal(t, SortID, sort)
+	assert.False(t, desc)
+	_, _, err = ParseListSort("size")
+	assert.ErrorIs(t, err, ErrQueryInvalid)
+
+	query := ListQuery{Sort: SortName, Tags: []string{" Prod "}, Search: "db"}
+	require.NoError(t, query.normalize())
+	assert.Equal(t, DefaultPageSize, query.Limit)
+	assert.Equal(t, []string{"prod"}, query.Tags)
+
+	resource := Resource{ID: 7, Meta: "db", Details: Details{Title: "Prod DB"}}
+	query.Cursor = query.cursor(resource).encode()
+	cursor, err := decodeCursor(query.Cursor)
+	require.NoError(t, err)
+	assert.Equal(t, pageCursor{Sort: SortName, Value: "Prod DB", ID: 7}, cursor)
+
+	statement, args, err := query.statement(Creds{Login: "alice"})
+	require.NoError(t, err)
+	assert.Contains(t, statement, "ORDER BY r.name ASC, r.id ASC LIMIT 101")
+	assert.Equal(t, []any{"alice", "prod", "db", "Prod DB", int64(7)}, args)
+
+	// a cursor is bound to its sort
+	query.Desc = true
+	_, _, err = query.statement(Creds{Login: "alice"})
+	assert.ErrorIs(t, err, ErrQueryInvalid)
+	query.Cursor = "not a cursor"
+	_, _, err = query.statement(Creds{Login: "alice"})
+	assert.ErrorIs(t, err, ErrQueryInvalid)
+
+	for name, query := range map[string]ListQuery{
+		"limit": {Limit: MaxPageSize + 1},
+		"kind":  {Kind: "note"},
+		"type":  {Type: 9},
+		"tag":   {Tags: []string{"a,b"}},
+	} {
+		assert.ErrorIs(t, query.normalize(), ErrQueryInvalid, name)
+	}
+}
+
+func TestSameDetails(t *testing.T) {
+	assert.True(t, Details{}.empty())
+	assert.True(t, Details{URLs: []string{}}.empty())
+	assert.False(t, Details{Title: "x"}.empty())
+
+	stored := Details{Title: "db", URLs: []string{}, Fields: []Field{{Name: "port", Value: "5432"}}}
+	assert.True(t, sameDetails(stored, Details{Title: "db", Fields: []Field{{Name: "port", Value: "5432"}}}))
+	assert.False(t, sameDetails(stored, Details{Title: "db"}))
+}
+
+func TestQuotaReader(t *testing.T) {
+	exceeded := &QuotaError{Quota: QuotaBytes, Limit: 10, Used: 6}
+	tbl := []struct {
+		content string
+		limit   int64
+		err     error
+	}{
+		{"1234", 4, nil},
+		{"12345", 4, exceeded},
+		{"", 0, nil},
+		{"1", 0, exceeded},
+		{"12345", -1, nil},
+	}
+	for _, tt := range tbl {
+		t.Run(fmt.Sprintf("%q/%d", tt.content, tt.limit), func(t *testing.T) {
+			r := &quotaReader{r: iotest.OneByteReader(strings.NewReader(tt.content)), limit: tt.limit, err: exceeded}
+			got, err := io.ReadAll(r)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, ErrQuotaExceeded)
+				assert.Equal(t, tt.content[:tt.limit], string(got), "nothing past the limit is returned")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.content, string(got))
+		})
+	}
+
+	tooLarge := &QuotaError{Quota: QuotaBlobSize, Limit: 1024, Org: 3}
+	assert.ErrorIs(t, tooLarge, ErrBlobTooLarge)
+	assert.NotErrorIs(t, tooLarge, ErrQuotaExceeded)
+	assert.Equal(t, "blob too large: limit of 1024 bytes", tooLarge.Error())
+	assert.Equal(t, "quota exceeded: bytes 6 of 10 used", exceeded.Error())
+}
+
+func TestCheckFiles(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-time.Hour)
+	files := map[string]blobstore.Info{
+		"blob":    {Key: "blob", ModTime: now.Add(-48 * time.Hour)},
+		"part":    {Key: "part", ModTime: now.Add(-48 * time.Hour)},
+		"orphan":  {Key: "orphan", ModTime: now.Add(-48 * time.Hour)},
+		"writing": {Key: "writing", ModTime: now},
+	}
+	references := map[string]bool{
+		"blob":     true,
+		"part":     false,
+		"missing":  true,
+		"uploaded": false, // the location of an upload is written on commit
+	}
+	missing, orphans := checkFiles(files, references, cutoff)
+	assert.Equal(t, []string{"missing"}, missing)
+	assert.Equal(t, []string{"orphan"}, orphans, "files younger than the cutoff may be written meanwhile")
+}
@@ -0,0 +1,641 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrOrgNotFound    = fmt.Errorf("organisation not found")
+	ErrOrgExists      = fmt.Errorf("organisation exists")
+	ErrOrgInvalid     = fmt.Errorf("organisation invalid")
+	ErrTeamNotFound   = fmt.Errorf("team not found")
+	ErrTeamNotEmpty   = fmt.Errorf("team vault not empty")
+	ErrMemberNotFound = fmt.Errorf("member not found")
+	// ErrLastOwner is returned for changes leaving an organisation without owner
+	ErrLastOwner = fmt.Errorf("organisation needs an owner")
+)
+
+// Organisations group users by roles, owners and admins manage members and
+// teams, editors write and viewers read the vaults of their teams. Teams
+// own vaults, resources of a team vault have no owner and are accessed by
+// the team members only.
+//
+// Resource keys of a team vault are wrapped by the team key instead of the
+// data key of a user. The team key is wrapped to the public key of every
+// member as keys of grants are, so only members can add members. Members
+// removed keep no wrapped team key, the team key itself is not replaced.
+
+type (
+	OrgID  int64
+	TeamID int64
+	Role   string
+)
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+// teamInfo binds the key wrapping the team key to the team
+const teamInfo = "gophkeeper team "
+
+// Org is an organisation with the role of the user
+type Org struct {
+	ID   OrgID
+	Name string
+	Role Role
+}
+
+// Team of an organisation, Member tells if the user is a member
+type Team struct {
+	ID     TeamID
+	Org    OrgID
+	Name   string
+	Member bool
+}
+
+// Member of an organisation or a team with the role in the organisation
+type Member struct {
+	Login string
+	Role  Role
+}
+
+func (r Role) valid() bool {
+	switch r {
+	case RoleOwner, RoleAdmin, RoleEditor, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// manages tells if the role manages members and teams
+func (r Role) manages() bool {
+	return r == RoleOwner || r == RoleAdmin
+}
+
+// permission returns the permission of the role in the team vaults
+func (r Role) permission() Permission {
+	if r == RoleViewer {
+		return PermissionRead
+	}
+	return PermissionWrite
+}
+
+// CreateOrg creates the organisation, the user becomes its owner
+func (p *Storage) CreateOrg(ctx context.Context, name string, c Creds) (OrgID, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf("%w: name required", ErrOrgInvalid)
+	}
+	if err := p.checkPass(ctx, c); err != nil {
+		return 0, errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return 0, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var id OrgID
+	if err := transaction.QueryRow(
+		ctx,
+		`INSERT INTO orgs(name, created_by) VALUES($1, $2) RETURNING id`,
+		name, c.Login,
+	).Scan(&id); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return 0, ErrOrgExists
+		}
+		return 0, err
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`INSERT INTO org_members(org_id, login, role) VALUES($1, $2, $3)`,
+		id, c.Login, RoleOwner,
+	); err != nil {
+		return 0, err
+	}
+	return id, transaction.Commit(ctx)
+}
+
+// Orgs returns the organisations of the user
+func (p *Storage) Orgs(ctx context.Context, c Creds) ([]Org, error) {
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT o.id, o.name, m.role FROM orgs o JOIN org_members m ON m.org_id = o.id
+		WHERE m.login = $1 ORDER BY o.name`,
+		c.Login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs = []Org{}
+	for rows.Next() {
+		var o Org
+		if err := rows.Scan(&o.ID, &o.Name, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// OrgMembers returns the members of the organisation of the user
+func (p *Storage) OrgMembers(ctx context.Context, org OrgID, c Creds) ([]Member, error) {
+	if _, err := orgRole(ctx, p.db, org, c.Login); err != nil {
+		return nil, err
+	}
+	return p.members(
+		ctx,
+		`SELECT login, role FROM org_members WHERE org_id = $1 ORDER BY login`,
+		org,
+	)
+}
+
+// SetOrgMember adds the user of the login to the organisation or changes
+// the role of the member. Admins manage editors and viewers, owners manage
+// any member. The last owner can't step down.
+func (p *Storage) SetOrgMember(ctx context.Context, org OrgID, login string, role Role, c Creds) error {
+	if !role.valid() {
+		return fmt.Errorf("%w: unknown role %q", ErrOrgInvalid, role)
+	}
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var current, lockError = lockOrg(ctx, transaction, org, login, c)
+	if lockError != nil {
+		return lockError
+	}
+	if role.manages() {
+		if err := requireOwner(ctx, transaction, org, c); err != nil {
+			return err
+		}
+	}
+	if current == "" {
+		var exists bool
+		if err := transaction.QueryRow(
+			ctx,
+			`SELECT EXISTS(SELECT 1 FROM identities WHERE id = $1)`,
+			login,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+	}
+
+	if _, err := transaction.Exec(
+		ctx,
+		`INSERT INTO org_members(org_id, login, role) VALUES($1, $2, $3)
+		ON CONFLICT (org_id, login) DO UPDATE SET role = EXCLUDED.role`,
+		org, login, role,
+	); err != nil {
+		return err
+	}
+	if err := checkOwners(ctx, transaction, org); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// RemoveOrgMember removes the member from the organisation and its teams,
+// members may leave by themselves. Roles are checked as in SetOrgMember.
+func (p *Storage) RemoveOrgMember(ctx context.Context, org OrgID, login string, c Creds) error {
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var current, lockError = lockOrg(ctx, transaction, org, login, c)
+	if lockError != nil && !(errors.Is(lockError, ErrPermissionDenied) && login == c.Login) {
+		return lockError
+	}
+	if current == "" {
+		return ErrMemberNotFound
+	}
+
+	if _, err := transaction.Exec(
+		ctx,
+		`DELETE FROM team_members m USING teams t WHERE m.team_id = t.id AND t.org_id = $1 AND m.login = $2`,
+		org, login,
+	); err != nil {
+		return err
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`DELETE FROM org_members WHERE org_id = $1 AND login = $2`,
+		org, login,
+	); err != nil {
+		return err
+	}
+	if err := checkOwners(ctx, transaction, org); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// CreateTeam creates the team of the organisation with a new team key, the
+// user becomes its first member. Only owners and admins create teams.
+func (p *Storage) CreateTeam(ctx context.Context, org OrgID, name string, c Creds) (TeamID, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf("%w: team name required", ErrOrgInvalid)
+	}
+	if err := p.checkPass(ctx, c); err != nil {
+		return 0, errors.Join(err, ErrUserUnauthorized)
+	}
+	var role, roleError = orgRole(ctx, p.db, org, c.Login)
+	if roleError != nil {
+		return 0, roleError
+	}
+	if !role.manages() {
+		return 0, ErrPermissionDenied
+	}
+	var key = make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return 0, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var id TeamID
+	if err := transaction.QueryRow(
+		ctx,
+		`INSERT INTO teams(org_id, name) VALUES($1, $2) RETURNING id`,
+		org, name,
+	).Scan(&id); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return 0, fmt.Errorf("%w: team %s exists", ErrOrgInvalid, name)
+		}
+		return 0, err
+	}
+	if err := p.addTeamMember(ctx, transaction, id, c.Login, key); err != nil {
+		return 0, err
+	}
+	return id, transaction.Commit(ctx)
+}
+
+// Teams returns the teams of the organisation of the user
+func (p *Storage) Teams(ctx context.Context, org OrgID, c Creds) ([]Team, error) {
+	if _, err := orgRole(ctx, p.db, org, c.Login); err != nil {
+		return nil, err
+	}
+	var rows, err = p.db.Query(
+		ctx,
+		`SELECT t.id, t.org_id, t.name, EXISTS(SELECT 1 FROM team_members m WHERE m.team_id = t.id AND m.login = $2)
+		FROM teams t WHERE t.org_id = $1 ORDER BY t.name`,
+		org, c.Login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams = []Team{}
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.ID, &t.Org, &t.Name, &t.Member); err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// DeleteTeam removes the team, its vault must be empty
+func (p *Storage) DeleteTeam(ctx context.Context, org OrgID, team TeamID, c Creds) error {
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+	var role, roleError = orgRole(ctx, p.db, org, c.Login)
+	if roleError != nil {
+		return roleError
+	}
+	if !role.manages() {
+		return ErrPermissionDenied
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, teamLock(team)); err != nil {
+		return err
+	}
+	var empty bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT NOT EXISTS(SELECT 1 FROM resources WHERE team_id = $1)`,
+		team,
+	).Scan(&empty); err != nil {
+		return err
+	}
+	if !empty {
+		return ErrTeamNotEmpty
+	}
+	var tag, err = transaction.Exec(ctx, `DELETE FROM teams WHERE id = $1 AND org_id = $2`, team, org)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTeamNotFound
+	}
+	return transaction.Commit(ctx)
+}
+
+// TeamMembers returns the members of the team with their roles
+func (p *Storage) TeamMembers(ctx context.Context, org OrgID, team TeamID, c Creds) ([]Member, error) {
+	if _, err := orgRole(ctx, p.db, org, c.Login); err != nil {
+		return nil, err
+	}
+	if err := checkTeam(ctx, p.db, org, team); err != nil {
+		return nil, err
+	}
+	return p.members(
+		ctx,
+		`SELECT m.login, o.role FROM team_members m
+		JOIN teams t ON t.id = m.team_id
+		JOIN org_members o ON o.org_id = t.org_id AND o.login = m.login
+		WHERE m.team_id = $1 ORDER BY m.login`,
+		team,
+	)
+}
+
+// AddTeamMember adds the member of the organisation to the team. The team
+// key is wrapped to the new member, so only owners and admins being members
+// of the team add members.
+func (p *Storage) AddTeamMember(ctx context.Context, org OrgID, team TeamID, login string, c Creds) error {
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+	var role, roleError = orgRole(ctx, p.db, org, c.Login)
+	if roleError != nil {
+		return roleError
+	}
+	if !role.manages() {
+		return ErrPermissionDenied
+	}
+	if err := checkTeam(ctx, p.db, org, team); err != nil {
+		return err
+	}
+	if _, err := orgRole(ctx, p.db, org, login); err != nil {
+		if errors.Is(err, ErrOrgNotFound) {
+			return ErrMemberNotFound
+		}
+		return err
+	}
+	var key, keyError = p.teamKey(ctx, team, c)
+	if keyError != nil {
+		if errors.Is(keyError, ErrTeamNotFound) {
+			return fmt.Errorf("%w: only members hold the team key", ErrPermissionDenied)
+		}
+		return keyError
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := p.addTeamMember(ctx, transaction, team, login, key); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// RemoveTeamMember removes the member from the team, owners and admins
+// remove any member and members may leave by themselves
+func (p *Storage) RemoveTeamMember(ctx context.Context, org OrgID, team TeamID, login string, c Creds) error {
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+	var role, roleError = orgRole(ctx, p.db, org, c.Login)
+	if roleError != nil {
+		return roleError
+	}
+	if !role.manages() && login != c.Login {
+		return ErrPermissionDenied
+	}
+	var tag, err = p.db.Exec(
+		ctx,
+		`DELETE FROM team_members m USING teams t WHERE m.team_id = t.id AND t.id = $1 AND t.org_id = $2 AND m.login = $3`,
+		team, org, login,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
+
+// addTeamMember wraps the team key to the public key of the user. The join
+// is a change of the vault of the user, see Changes.
+func (p *Storage) addTeamMember(ctx context.Context, tx pgx.Tx, team TeamID, login string, key []byte) error {
+	var public []byte
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT public_key FROM identities WHERE id = $1`,
+		login,
+	).Scan(&public); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrMemberNotFound
+		}
+		return err
+	}
+	if public == nil {
+		return ErrGranteeKeyless
+	}
+	var sealed, keyID, sealError = p.sealTo(teamBinding(team), public, key)
+	if sealError != nil {
+		return sealError
+	}
+	if err := lockOwner(ctx, tx, login); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO team_members(team_id, login, wrapped_key, key_id) VALUES($1, $2, $3, $4)
+		ON CONFLICT (team_id, login) DO NOTHING`,
+		team, login, sealed, keyID,
+	)
+	return err
+}
+
+// teamKey returns the team key unwrapped by the private key of the member
+func (p *Storage) teamKey(ctx context.Context, team TeamID, c Creds) ([]byte, error) {
+	var (
+		sealed []byte
+		keyID  *string
+	)
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT wrapped_key, key_id FROM team_members WHERE team_id = $1 AND login = $2`,
+		team, c.Login,
+	).Scan(&sealed, &keyID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTeamNotFound
+		}
+		return nil, err
+	}
+	var private, privateError = p.privateKey(ctx, c)
+	if privateError != nil {
+		return nil, privateError
+	}
+	var unwrapped, masterError = p.Master.unwrap(sealed, keyID)
+	if masterError != nil {
+		return nil, masterError
+	}
+	return openKey(teamBinding(team), private, unwrapped)
+}
+
+// members returns the logins and roles selected by the query
+func (p *Storage) members(ctx context.Context, query string, args ...any) ([]Member, error) {
+	var rows, err = p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members = []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Login, &m.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// lockOrg serializes membership changes of the organisation and returns
+// the role of the login, empty if not a member. The user must manage the
+// organisation, owners and admins are managed by owners only.
+func lockOrg(ctx context.Context, tx pgx.Tx, org OrgID, login string, c Creds) (Role, error) {
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM orgs WHERE id = $1 FOR UPDATE`, org); err != nil {
+		return "", err
+	}
+	var role, roleError = orgRole(ctx, tx, org, c.Login)
+	if roleError != nil {
+		return "", roleError
+	}
+	var current Role
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT role FROM org_members WHERE org_id = $1 AND login = $2`,
+		org, login,
+	).Scan(&current); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+	if !role.manages() || (current.manages() && role != RoleOwner) {
+		return current, ErrPermissionDenied
+	}
+	return current, nil
+}
+
+// requireOwner returns ErrPermissionDenied unless the user owns the organisation
+func requireOwner(ctx context.Context, q queryRower, org OrgID, c Creds) error {
+	var role, err = orgRole(ctx, q, org, c.Login)
+	if err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// checkOwners returns ErrLastOwner if the organisation has no owner left
+func checkOwners(ctx context.Context, tx pgx.Tx, org OrgID) error {
+	var owned bool
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = $1 AND role = $2)`,
+		org, RoleOwner,
+	).Scan(&owned); err != nil {
+		return err
+	}
+	if !owned {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// orgRole returns the role of the login in the organisation, ErrOrgNotFound
+// if not a member
+func orgRole(ctx context.Context, q queryRower, org OrgID, login string) (Role, error) {
+	var role Role
+	if err := q.QueryRow(
+		ctx,
+		`SELECT role FROM org_members WHERE org_id = $1 AND login = $2`,
+		org, login,
+	).Scan(&role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrOrgNotFound
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// checkTeam returns ErrTeamNotFound unless the team belongs to the organisation
+func checkTeam(ctx context.Context, q queryRower, org OrgID, team TeamID) error {
+	var exists bool
+	if err := q.QueryRow(
+		ctx,
+		`SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND org_id = $2)`,
+		team, org,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTeamNotFound
+	}
+	return nil
+}
+
+// teamBinding binds wrapped team keys to the team
+func teamBinding(team TeamID) string {
+	return teamInfo + strconv.FormatInt((int64)(team), 10)
+}
+
+// teamLock is the lockOwner key of the team vault
+func teamLock(team TeamID) string {
+	return "team " + strconv.FormatInt((int64)(team), 10)
+}
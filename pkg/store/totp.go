@@ -0,0 +1,460 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/totp"
+)
+
+var (
+	ErrTOTPNotEnrolled = fmt.Errorf("totp not enrolled")
+	ErrTOTPEnabled     = fmt.Errorf("totp enabled already")
+	// ErrSecondFactorWrong is returned for a wrong or used code, the
+	// challenge is closed after challengeAttempts of them and the second
+	// factor of the account locked after factorAttempts
+	ErrSecondFactorWrong = fmt.Errorf("%w: second factor wrong", ErrUserUnauthorized)
+	// ErrSecondFactorLocked is returned while the second factor of the
+	// account is locked after factorAttempts wrong codes
+	ErrSecondFactorLocked = fmt.Errorf("%w: second factor locked", ErrUserUnauthorized)
+)
+
+const (
+	// totpIssuer names the service in authenticator apps
+	totpIssuer = "gophkeeper"
+	// challengeSpan is the lifetime of the login challenge
+	challengeSpan = 5 * time.Minute
+	// challengeAttempts limits the codes tried against a challenge
+	challengeAttempts = 5
+	// factorAttempts limits the wrong codes of an account across challenges
+	// until a code is accepted, reaching it locks the second factor
+	factorAttempts = 10
+	// factorLockout is how long the second factor stays locked
+	factorLockout = 15 * time.Minute
+	// recoveryCodes is the number of recovery codes given at once
+	recoveryCodes = 10
+)
+
+// Users may enable a second factor, a TOTP of an authenticator app. The
+// secret is wrapped by the master key of the server, servers without one
+// don't enroll users. It is rewrapped by the active key on the next
+// verification or by RotateKeys. Recovery codes replace the app
+// once each, only their hashes are kept.
+//
+// Login of such users opens a pending session and returns a challenge
+// instead of the tokens. VerifyLogin checks the code against the challenge
+// and activates the session. A code is accepted once, codes of earlier
+// steps are rejected too. Wrong codes are counted per challenge and per
+// account, so opening new challenges does not allow more guesses.
+
+// TOTPEnrollment is the secret of the enrollment to add to the app
+type TOTPEnrollment struct {
+	Secret string // Secret in base32, typed into the app.
+	URI    string // URI is the otpauth:// payload of the QR code.
+}
+
+// TOTPStatus tells if the second factor is enabled
+type TOTPStatus struct {
+	Enabled       bool
+	RecoveryCodes int // RecoveryCodes is the number of unused recovery codes.
+}
+
+// EnrollTOTP generates a new TOTP secret of the user, the second factor is
+// enabled by EnableTOTP once the app gives the right code. ErrTOTPEnabled is
+// returned if it is enabled already, ErrNoMasterKey if the secret can't be
+// wrapped.
+func (p *Storage) EnrollTOTP(ctx context.Context, c Creds) (TOTPEnrollment, error) {
+	if p.Master == nil {
+		return TOTPEnrollment{}, ErrNoMasterKey
+	}
+	var secret, secretError = totp.NewSecret()
+	if secretError != nil {
+		return TOTPEnrollment{}, secretError
+	}
+	var wrapped, keyID, wrapError = p.Master.wrap(secret)
+	if wrapError != nil {
+		return TOTPEnrollment{}, wrapError
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return TOTPEnrollment{}, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var enabled bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT totp_enabled FROM identities WHERE id = $1 FOR UPDATE`,
+		c.Login,
+	).Scan(&enabled); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TOTPEnrollment{}, ErrUserNotFound
+		}
+		return TOTPEnrollment{}, err
+	}
+	if enabled {
+		return TOTPEnrollment{}, ErrTOTPEnabled
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`UPDATE identities SET totp_secret = $2, totp_key_id = $3, totp_last_step = 0 WHERE id = $1`,
+		c.Login, wrapped, keyID,
+	); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{Secret: totp.Encode(secret), URI: totp.URI(totpIssuer, c.Login, secret)}, nil
+}
+
+// EnableTOTP requires the second factor at login from now on, the code of
+// the enrolled secret proves the app is set up. It returns new recovery
+// codes, they are not shown again.
+func (p *Storage) EnableTOTP(ctx context.Context, c Creds, code string) ([]string, error) {
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return nil, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var enabled bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT totp_enabled FROM identities WHERE id = $1 FOR UPDATE`,
+		c.Login,
+	).Scan(&enabled); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	if err := p.checkSecondFactor(ctx, transaction, c.Login, code, false); err != nil {
+		if errors.Is(err, ErrSecondFactorWrong) {
+			// the wrong code counts towards the lockout
+			if commitError := transaction.Commit(ctx); commitError != nil {
+				return nil, commitError
+			}
+		}
+		return nil, err
+	}
+	if _, err := transaction.Exec(ctx, `UPDATE identities SET totp_enabled = true WHERE id = $1`, c.Login); err != nil {
+		return nil, err
+	}
+	var codes, codesError = replaceRecoveryCodes(ctx, transaction, c.Login)
+	if codesError != nil {
+		return nil, codesError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP drops the second factor and the recovery codes of the user,
+// the password is required even within a session.
+func (p *Storage) DisableTOTP(ctx context.Context, c Creds) error {
+	c = Creds{Login: c.Login, Passw: c.Passw}
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var tag, updateError = transaction.Exec(
+		ctx,
+		`UPDATE identities SET totp_enabled = false, totp_secret = NULL, totp_key_id = NULL, totp_last_step = 0
+		WHERE id = $1`,
+		c.Login,
+	)
+	if updateError != nil {
+		return updateError
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := transaction.Exec(ctx, `DELETE FROM recovery_codes WHERE owner = $1`, c.Login); err != nil {
+		return err
+	}
+	return transaction.Commit(ctx)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, the
+// password is required even within a session.
+func (p *Storage) RegenerateRecoveryCodes(ctx context.Context, c Creds) ([]string, error) {
+	c = Creds{Login: c.Login, Passw: c.Passw}
+	if err := p.checkPass(ctx, c); err != nil {
+		return nil, errors.Join(err, ErrUserUnauthorized)
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return nil, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var enabled bool
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT totp_enabled FROM identities WHERE id = $1 FOR UPDATE`,
+		c.Login,
+	).Scan(&enabled); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTOTPNotEnrolled
+	}
+	var codes, codesError = replaceRecoveryCodes(ctx, transaction, c.Login)
+	if codesError != nil {
+		return nil, codesError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TOTPStatus returns the second factor state of the user
+func (p *Storage) TOTPStatus(ctx context.Context, c Creds) (TOTPStatus, error) {
+	var status TOTPStatus
+	if err := p.db.QueryRow(
+		ctx,
+		`SELECT totp_enabled, (SELECT count(*) FROM recovery_codes WHERE owner = $1) FROM identities WHERE id = $1`,
+		c.Login,
+	).Scan(&status.Enabled, &status.RecoveryCodes); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TOTPStatus{}, ErrUserNotFound
+		}
+		return TOTPStatus{}, err
+	}
+	return status, nil
+}
+
+// VerifyLogin checks the TOTP or recovery code against the challenge of the
+// login and returns the tokens of the session. Too many wrong codes close
+// the challenge, too many of the account lock the second factor and
+// ErrSecondFactorLocked is returned until factorLockout passes.
+func (p *Storage) VerifyLogin(ctx context.Context, challenge, code string, device Device) (SessionTokens, error) {
+	var sid, presented, found = strings.Cut(challenge, ".")
+	if !found || sid == "" || presented == "" {
+		return SessionTokens{}, ErrUserUnauthorized
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return SessionTokens{}, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	var (
+		owner      string
+		secretHash []byte
+		attempts   int
+	)
+	if err := transaction.QueryRow(
+		ctx,
+		`SELECT owner, refresh_hash, attempts FROM sessions WHERE id = $1 AND pending AND expires_at > now() FOR UPDATE`,
+		sid,
+	).Scan(&owner, &secretHash, &attempts); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return SessionTokens{}, ErrUserUnauthorized
+		}
+		return SessionTokens{}, err
+	}
+	if !checkRefreshSecret(presented, secretHash) {
+		return SessionTokens{}, ErrUserUnauthorized
+	}
+
+	var factorError = p.checkSecondFactor(ctx, transaction, owner, code, true)
+	if errors.Is(factorError, ErrSecondFactorWrong) {
+		var query = `UPDATE sessions SET attempts = attempts + 1 WHERE id = $1`
+		if attempts+1 >= challengeAttempts {
+			query = `DELETE FROM sessions WHERE id = $1`
+		}
+		if _, err := transaction.Exec(ctx, query, sid); err != nil {
+			return SessionTokens{}, err
+		}
+		if err := transaction.Commit(ctx); err != nil {
+			return SessionTokens{}, err
+		}
+		return SessionTokens{}, factorError
+	}
+	if factorError != nil {
+		return SessionTokens{}, factorError
+	}
+
+	var secret, newHash, secretError = newRefreshSecret()
+	if secretError != nil {
+		return SessionTokens{}, secretError
+	}
+	if _, err := transaction.Exec(
+		ctx,
+		`UPDATE sessions SET pending = false, attempts = 0, refresh_hash = $2, user_agent = $3, ip = $4,
+			last_seen = now(), expires_at = $5
+		WHERE id = $1`,
+		sid, newHash, device.UserAgent, device.IP, time.Now().Add(p.RefreshSpan),
+	); err != nil {
+		return SessionTokens{}, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return SessionTokens{}, err
+	}
+
+	return p.sessionTokens(owner, sid, secret)
+}
+
+// checkSecondFactor checks the code against the TOTP secret of the user or,
+// if allowed, against the recovery codes, within the transaction. The step
+// of the code is kept and the recovery code is dropped, so neither is
+// accepted again. A wrong code is counted towards the lockout of the
+// account, callers commit the transaction on ErrSecondFactorWrong to keep
+// the count.
+func (p *Storage) checkSecondFactor(ctx context.Context, tx pgx.Tx, login, code string, recovery bool) error {
+	var (
+		wrapped  []byte
+		keyID    *string
+		lastStep int64
+		locked   bool
+	)
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT totp_secret, totp_key_id, totp_last_step, COALESCE(factor_locked_until > now(), false)
+		FROM identities WHERE id = $1 FOR UPDATE`,
+		login,
+	).Scan(&wrapped, &keyID, &lastStep, &locked); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserUnauthorized
+		}
+		return err
+	}
+	if wrapped == nil {
+		return ErrTOTPNotEnrolled
+	}
+	if locked {
+		return ErrSecondFactorLocked
+	}
+
+	var secret, unwrapError = p.Master.unwrap(wrapped, keyID)
+	if unwrapError != nil {
+		return unwrapError
+	}
+	if step, ok := totp.Verify(secret, code, time.Now()); ok {
+		if step <= lastStep {
+			return failSecondFactor(ctx, tx, login)
+		}
+		// the secret is rewrapped by the active master key along the way
+		var rewrapped, rewrappedID, wrapError = p.Master.wrap(secret)
+		if wrapError != nil {
+			return wrapError
+		}
+		_, err := tx.Exec(
+			ctx,
+			`UPDATE identities SET totp_last_step = $2, totp_secret = $3, totp_key_id = $4,
+				factor_failures = 0, factor_locked_until = NULL
+			WHERE id = $1`,
+			login, step, rewrapped, rewrappedID,
+		)
+		return err
+	}
+
+	if !recovery {
+		return failSecondFactor(ctx, tx, login)
+	}
+	var tag, err = tx.Exec(
+		ctx,
+		`DELETE FROM recovery_codes WHERE owner = $1 AND hash = $2`,
+		login, recoveryCodeHash(code),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return failSecondFactor(ctx, tx, login)
+	}
+	_, err = tx.Exec(ctx, `UPDATE identities SET factor_failures = 0, factor_locked_until = NULL WHERE id = $1`, login)
+	return err
+}
+
+// failSecondFactor counts a wrong code of the user and returns
+// ErrSecondFactorWrong, the factorAttempts-th one locks the second factor
+// for factorLockout and starts the count over
+func failSecondFactor(ctx context.Context, tx pgx.Tx, login string) error {
+	if _, err := tx.Exec(
+		ctx,
+		`UPDATE identities SET
+			factor_failures = CASE WHEN factor_failures + 1 >= $2 THEN 0 ELSE factor_failures + 1 END,
+			factor_locked_until = CASE WHEN factor_failures + 1 >= $2 THEN now() + make_interval(secs => $3) END
+		WHERE id = $1`,
+		login, factorAttempts, factorLockout.Seconds(),
+	); err != nil {
+		return err
+	}
+	return ErrSecondFactorWrong
+}
+
+// replaceRecoveryCodes drops the recovery codes of the user and returns new
+// ones, their hashes are kept
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, login string) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE owner = $1`, login); err != nil {
+		return nil, err
+	}
+	var codes = make([]string, 0, recoveryCodes)
+	for len(codes) < recoveryCodes {
+		var code, err = newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			ctx,
+			`INSERT INTO recovery_codes(owner, hash) VALUES($1, $2)`,
+			login, recoveryCodeHash(code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns 80 random bits in four groups of base32, so the
+// unsalted hash is as hard to reverse as the code is to guess
+func newRecoveryCode() (string, error) {
+	var raw = make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	var encoded = base32.StdEncoding.EncodeToString(raw)
+	return encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16], nil
+}
+
+// recoveryCodeHash hashes the code regardless of case and separators
+func recoveryCodeHash(code string) []byte {
+	var normalized = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	var hash = sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
@@ -0,0 +1,297 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/secret"
+)
+
+// PieceUpdate is a change of a piece, nil fields are left as is
+type PieceUpdate struct {
+	Meta    *string     // New meta info of the piece.
+	Content []byte      // New content of the piece.
+	Opaque  bool        // Content is an envelope encrypted by the client.
+	Kind    secret.Kind // Kind the piece must hold, any if empty.
+}
+
+// BlobUpdate is a change of a blob, nil fields are left as is
+type BlobUpdate struct {
+	Meta        *string       // New meta info of the blob.
+	Content     io.ReadCloser // New content of the blob.
+	Opaque      bool          // Content is an envelope encrypted by the client.
+	ContentType string        // ContentType of the new content, kept if empty.
+	Filename    string        // Filename of the new content, kept if empty.
+}
+
+// UpdatePiece changes content and meta of the piece keeping its id. The
+// update is applied only if the resource version equals the given one, zero
+// version matches any, otherwise ErrVersionMismatch is returned. It returns
+// the new version of the resource. Grantees with write permission update
+// shared pieces too, the content keeps the key of the resource then. Team
+// pieces are updated by members whose role may write.
+func (p *Storage) UpdatePiece(ctx context.Context, rid ResourceID, version int64, update PieceUpdate, c Creds) (int64, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return -1, errors.Join(err, ErrUserUnauthorized)
+	}
+	var resource, accessError = resourceAccess(ctx, p.db, rid, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := resource.writable(); err != nil {
+		return -1, err
+	}
+
+	var (
+		content    []byte
+		iv         []byte
+		wrappedKey []byte
+		keyID      *string
+	)
+	if update.Content != nil {
+		var sealError error
+		if resource.granted(c) {
+			content, iv, sealError = p.sealShared(ctx, rid, update.Content, update.Opaque, c)
+		} else {
+			content, iv, wrappedKey, keyID, sealError = p.sealPiece(ctx, update.Content, update.Opaque, resource, c)
+		}
+		if sealError != nil {
+			return -1, sealError
+		}
+	}
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return -1, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, resource.lockKey()); err != nil {
+		return -1, err
+	}
+
+	var pieceID, kind, lockError = lockResource(ctx, transaction, rid, ResourceTypePiece, version)
+	if lockError != nil {
+		return -1, lockError
+	}
+	if update.Kind != "" && update.Kind != kind {
+		return -1, ErrSecretKindMismatch
+	}
+	if err := archiveResource(ctx, transaction, rid); err != nil {
+		return -1, err
+	}
+
+	switch {
+	case update.Content == nil:
+	case resource.granted(c):
+		var tag, err = transaction.Exec(
+			ctx,
+			`UPDATE pieces SET content = $2, iv = $3 WHERE id = $1 AND NOT opaque`,
+			pieceID, content, iv,
+		)
+		if err != nil {
+			return -1, err
+		}
+		if tag.RowsAffected() == 0 {
+			return -1, ErrGrantStale
+		}
+	default:
+		if _, err := transaction.Exec(
+			ctx,
+			`UPDATE pieces SET content = $2, salt = NULL, iv = $3, wrapped_key = $4, key_id = $5, opaque = $6 WHERE id = $1`,
+			pieceID, content, iv, wrappedKey, keyID, update.Opaque,
+		); err != nil {
+			return -1, err
+		}
+		if err := p.rewrapGrants(ctx, transaction, rid, update.Opaque, func() ([]byte, error) {
+			return p.readKey(ctx, rid, resource, wrappedKey, keyID, nil, c)
+		}); err != nil {
+			return -1, err
+		}
+	}
+
+	var newVersion, bumpError = bumpResource(ctx, transaction, rid, update.Meta, c)
+	if bumpError != nil {
+		return -1, bumpError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	return newVersion, nil
+}
+
+// UpdateBlob changes content and meta of the blob keeping its id. New
+// content is written to a new blob, the old blob stays with the revision.
+// Versions and grantees are handled as in UpdatePiece. New content is
+// limited by the quota of the vault as in StoreBlob, the old blob still
+// counts with the revision.
+func (p *Storage) UpdateBlob(ctx context.Context, rid ResourceID, version int64, update BlobUpdate, c Creds) (int64, error) {
+	if update.Content != nil {
+		defer update.Content.Close()
+	}
+	if err := p.checkPass(ctx, c); err != nil {
+		return -1, errors.Join(err, ErrUserUnauthorized)
+	}
+	var resource, accessError = resourceAccess(ctx, p.db, rid, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := resource.writable(); err != nil {
+		return -1, err
+	}
+
+	var stored storedBlob
+	if update.Content != nil {
+		var content, limitError = p.limitBlob(ctx, update.Content, resource, 0)
+		if limitError != nil {
+			return -1, limitError
+		}
+		var writeError error
+		if stored, writeError = p.writeUpdatedBlob(ctx, rid, resource, content, update.Opaque, c); writeError != nil {
+			return -1, writeError
+		}
+	}
+	// removed on any failure below, cleared once the blob points to it
+	var orphan = stored.location
+	defer func() {
+		if orphan == "" {
+			return
+		}
+		p.removeBlobs(ctx, []string{orphan})
+	}()
+
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return -1, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	if err := lockOwner(ctx, transaction, resource.lockKey()); err != nil {
+		return -1, err
+	}
+
+	var blobID, _, lockError = lockResource(ctx, transaction, rid, ResourceTypeBlob, version)
+	if lockError != nil {
+		return -1, lockError
+	}
+	if err := archiveResource(ctx, transaction, rid); err != nil {
+		return -1, err
+	}
+
+	switch {
+	case update.Content == nil:
+	case resource.granted(c):
+		var tag, err = transaction.Exec(
+			ctx,
+			`UPDATE blobs SET location = $2, iv = $3, format = $4, size = $5, digest = $6,
+			content_type = COALESCE(NULLIF($7, ''), content_type), filename = COALESCE(NULLIF($8, ''), filename)
+			WHERE id = $1 AND NOT opaque`,
+			blobID, stored.location, stored.iv, stored.format, stored.size, stored.digest, update.ContentType, update.Filename,
+		)
+		if err != nil {
+			return -1, err
+		}
+		if tag.RowsAffected() == 0 {
+			return -1, ErrGrantStale
+		}
+	default:
+		if _, err := transaction.Exec(
+			ctx,
+			`UPDATE blobs SET location = $2, salt = $3, iv = $4, wrapped_key = $5, key_id = $6, opaque = $7, format = $8,
+			size = $9, digest = $10,
+			content_type = COALESCE(NULLIF($11, ''), content_type), filename = COALESCE(NULLIF($12, ''), filename)
+			WHERE id = $1`,
+			blobID, stored.location, stored.salt, stored.iv, stored.wrappedKey, stored.keyID, stored.opaque, stored.format,
+			stored.size, stored.digest, update.ContentType, update.Filename,
+		); err != nil {
+			return -1, err
+		}
+		if err := p.rewrapGrants(ctx, transaction, rid, stored.opaque, func() ([]byte, error) {
+			return p.readKey(ctx, rid, resource, stored.wrappedKey, stored.keyID, nil, c)
+		}); err != nil {
+			return -1, err
+		}
+	}
+
+	if update.Content != nil {
+		if err := p.checkQuota(ctx, transaction, resource, 0, *stored.size); err != nil {
+			return -1, err
+		}
+	}
+
+	var newVersion, bumpError = bumpResource(ctx, transaction, rid, update.Meta, c)
+	if bumpError != nil {
+		return -1, bumpError
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	// the new blob is in use now
+	orphan = ""
+	return newVersion, nil
+}
+
+// writeUpdatedBlob writes the new content of the blob, with a new key of
+// the vault or the key of the resource for a grantee
+func (p *Storage) writeUpdatedBlob(ctx context.Context, rid ResourceID, resource access, content io.Reader, opaque bool, c Creds) (storedBlob, error) {
+	if resource.granted(c) {
+		if opaque {
+			return storedBlob{}, fmt.Errorf("%w: shared content encrypted by the client", ErrGrantInvalid)
+		}
+		var key, keyError = p.grantKey(ctx, rid, c)
+		if keyError != nil {
+			return storedBlob{}, keyError
+		}
+		return p.writeSharedBlob(ctx, content, key)
+	}
+	var dek, keyError = p.blobDataKey(ctx, opaque, resource, c)
+	if keyError != nil {
+		return storedBlob{}, keyError
+	}
+	return p.writeBlob(ctx, content, opaque, dek)
+}
+
+// lockResource locks the resource row for the update and checks its type
+// and version. It returns the id of the piece or blob and the secret kind.
+func lockResource(ctx context.Context, tx pgx.Tx, rid ResourceID, resourceType ResourceType, version int64) (int, secret.Kind, error) {
+	var (
+		id            int
+		kind          secret.Kind
+		actualType    int
+		actualVersion int64
+	)
+	if err := tx.QueryRow(
+		ctx,
+		`SELECT resource, kind, type, version FROM resources WHERE id = $1 FOR UPDATE`,
+		(int64)(rid),
+	).Scan(&id, &kind, &actualType, &actualVersion); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, "", ErrResourceNotFound
+		}
+		return 0, "", err
+	}
+	if (ResourceType)(actualType) != resourceType {
+		return 0, "", ErrResourceNotFound
+	}
+	if version != 0 && version != actualVersion {
+		return 0, "", ErrVersionMismatch
+	}
+	return id, kind, nil
+}
+
+// bumpResource sets the new meta if given and moves the resource to the
+// next version changed by the user.
+func bumpResource(ctx context.Context, tx pgx.Tx, rid ResourceID, meta *string, c Creds) (int64, error) {
+	var version int64
+	err := tx.QueryRow(
+		ctx,
+		`UPDATE resources SET meta = COALESCE($2, meta), version = nextval('resource_version_seq'), updated_at = now(), updated_by = $3
+		WHERE id = $1 RETURNING version`,
+		(int64)(rid), meta, c.Login,
+	).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,495 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophkeeper/pkg/stream"
+)
+
+var (
+	ErrUploadNotFound = fmt.Errorf("upload not found")
+	// ErrUploadOffset is returned for a chunk not starting at the offset of
+	// the upload, the client resumes from the offset of GetUpload
+	ErrUploadOffset     = fmt.Errorf("upload offset mismatch")
+	ErrUploadInvalid    = fmt.Errorf("upload invalid")
+	ErrUploadIncomplete = fmt.Errorf("upload incomplete")
+	ErrUploadChecksum   = fmt.Errorf("upload checksum mismatch")
+)
+
+// UploadLifetime is the time an upload is kept after its last chunk
+const UploadLifetime = 24 * time.Hour
+
+// Uploads store a blob in chunks, so a broken transfer of a large blob is
+// resumed from the last chunk received instead of starting over. Every
+// chunk is kept as a part in the backend until CommitUpload joins the
+// parts into the blob and checks the SHA-256 checksum of the content.
+// Content encrypted by the server is sealed chunk by chunk with the key of
+// the new blob, chunks but the last one must be multiples of
+// stream.SegmentSize then. Uploads are private to their creator and expire
+// after UploadLifetime without chunks.
+
+// Upload is an upload session of a new blob
+type Upload struct {
+	ID        string
+	Meta      string
+	Opaque    bool   // Opaque content is encrypted by the client.
+	Team      TeamID // Team of the vault of the blob, zero for the vault of the user.
+	Length    int64  // Length of the content, -1 if unknown, only allowed for opaque content.
+	Offset    int64  // Offset is the length of the content received.
+	ExpiresAt time.Time
+
+	ContentType string // ContentType of the content given by the client.
+	Filename    string // Filename is the original name of the file.
+}
+
+// storedUpload is a row of the uploads table
+type storedUpload struct {
+	Upload
+	hash  []byte
+	parts []string
+	blob  storedBlob
+}
+
+// CreateUpload starts the upload of a new blob to the vault of the user or
+// of the team. Expired uploads of the user are removed. A QuotaError is
+// returned if the length exceeds the size of a blob or the bytes left to
+// the vault, content received by uploads counts as used.
+func (p *Storage) CreateUpload(ctx context.Context, u Upload, c Creds) (Upload, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return Upload{}, errors.Join(err, ErrUserUnauthorized)
+	}
+	if u.Length < -1 || (u.Length == -1 && !u.Opaque) {
+		return Upload{}, fmt.Errorf("%w: length required", ErrUploadInvalid)
+	}
+	var vault, accessError = vaultAccess(ctx, p.db, u.Team, c)
+	if accessError != nil {
+		return Upload{}, accessError
+	}
+	if err := vault.writable(); err != nil {
+		return Upload{}, err
+	}
+	p.removeExpiredUploads(ctx, c)
+	if u.Length > 0 {
+		var limit, exceeded, limitError = p.blobLimit(ctx, vault, 0)
+		if limitError != nil {
+			return Upload{}, limitError
+		}
+		if limit >= 0 && u.Length > limit {
+			return Upload{}, exceeded
+		}
+	}
+
+	var b = storedBlob{location: uuid.New().String(), opaque: u.Opaque, format: blobFormatAEAD}
+	if !u.Opaque {
+		var dek, keyError = p.vaultKey(ctx, vault, c)
+		if keyError != nil {
+			return Upload{}, keyError
+		}
+		var err error
+		if _, b.wrappedKey, b.keyID, err = p.newResourceKey(dek); err != nil {
+			return Upload{}, err
+		}
+		b.iv = make([]byte, stream.NoncePrefixSize)
+		if _, err := rand.Read(b.iv); err != nil {
+			return Upload{}, err
+		}
+	}
+	var hash, hashError = sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if hashError != nil {
+		return Upload{}, hashError
+	}
+
+	u.ID = uuid.New().String()
+	u.Offset = 0
+	var length *int64
+	if u.Length >= 0 {
+		length = &u.Length
+	}
+	if err := p.db.QueryRow(
+		ctx,
+		`INSERT INTO uploads(id, owner, team_id, meta, opaque, length, hash, location, iv, wrapped_key, key_id, expires_at,
+			content_type, filename)
+		VALUES($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, $9, $10, $11, now() + make_interval(secs => $12), $13, $14)
+		RETURNING expires_at`,
+		u.ID, c.Login, u.Team, u.Meta, u.Opaque, length, hash, b.location, b.iv, b.wrappedKey, b.keyID, UploadLifetime.Seconds(),
+		u.ContentType, u.Filename,
+	).Scan(&u.ExpiresAt); err != nil {
+		return Upload{}, err
+	}
+	return u, nil
+}
+
+// GetUpload returns the upload with the offset to resume it from
+func (p *Storage) GetUpload(ctx context.Context, id string, c Creds) (Upload, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return Upload{}, errors.Join(err, ErrUserUnauthorized)
+	}
+	var u, err = selectUpload(ctx, p.db, id, false, c)
+	return u.Upload, err
+}
+
+// WriteUpload stores the chunk of the content at the offset, which must be
+// the offset of the upload. The chunk is read until EOF and must not exceed
+// the length of the upload nor the quota of the vault. The new offset is
+// returned.
+func (p *Storage) WriteUpload(ctx context.Context, id string, offset int64, chunk io.Reader, c Creds) (int64, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return -1, errors.Join(err, ErrUserUnauthorized)
+	}
+	var u, selectError = selectUpload(ctx, p.db, id, false, c)
+	if selectError != nil {
+		return -1, selectError
+	}
+	if offset != u.Offset {
+		return -1, ErrUploadOffset
+	}
+
+	var hash = sha256.New()
+	if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.hash); err != nil {
+		return -1, err
+	}
+	var remaining = int64(-1)
+	if u.Length >= 0 {
+		remaining = u.Length - u.Offset
+	}
+	var vault, accessError = vaultAccess(ctx, p.db, u.Team, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	var limited, limitError = p.limitBlob(ctx, chunk, vault, u.Offset)
+	if limitError != nil {
+		return -1, limitError
+	}
+	var counter = &chunkReader{r: io.TeeReader(limited, hash), limit: remaining}
+
+	var (
+		part   = uuid.New().String()
+		source io.Reader
+	)
+	if u.Opaque {
+		source = counter
+	} else {
+		var key, keyError = p.readKey(ctx, 0, vault, u.blob.wrappedKey, u.blob.keyID, nil, c)
+		if keyError != nil {
+			return -1, keyError
+		}
+		var aead, aeadError = stream.NewAEAD(key)
+		if aeadError != nil {
+			return -1, aeadError
+		}
+		var pipeReader, pipeWriter = io.Pipe()
+		defer pipeReader.Close() // stops the encryption if Put fails early
+		var sw, writerError = stream.NewWriterAt(pipeWriter, aead, u.blob.iv, []byte(u.blob.location), u.Offset)
+		if writerError != nil {
+			return -1, fmt.Errorf("%w: %w", ErrUploadInvalid, writerError)
+		}
+		go func() {
+			var _, err = io.Copy(sw, counter)
+			if err == nil {
+				// only the chunk completing the content holds the final segment
+				if u.Offset+counter.n == u.Length {
+					err = sw.Close()
+				} else if err = sw.Flush(); errors.Is(err, stream.ErrAlignment) {
+					err = fmt.Errorf("%w: chunk is not a multiple of %d bytes", ErrUploadInvalid, stream.SegmentSize)
+				}
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+		source = pipeReader
+	}
+
+	if _, err := p.Blobs.Put(ctx, part, source); err != nil {
+		p.removeBlobs(ctx, []string{part})
+		return -1, err
+	}
+	if counter.n == 0 {
+		p.removeBlobs(ctx, []string{part})
+		return u.Offset, nil
+	}
+
+	var state, stateError = hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if stateError != nil {
+		p.removeBlobs(ctx, []string{part})
+		return -1, stateError
+	}
+	var received = u.Offset + counter.n
+	var tag, updateError = p.db.Exec(
+		ctx,
+		`UPDATE uploads SET received = $3, hash = $4, parts = array_append(parts, $5),
+		expires_at = now() + make_interval(secs => $6)
+		WHERE id = $1 AND received = $2`,
+		u.ID, u.Offset, received, state, part, UploadLifetime.Seconds(),
+	)
+	if updateError != nil || tag.RowsAffected() == 0 {
+		// another chunk of the same offset won
+		p.removeBlobs(ctx, []string{part})
+		if updateError != nil {
+			return -1, updateError
+		}
+		return -1, ErrUploadOffset
+	}
+	return received, nil
+}
+
+// CommitUpload checks the SHA-256 checksum of the complete content, joins
+// the parts into the blob and stores it in the vault like StoreBlob. The
+// upload is removed, a QuotaError keeps it.
+func (p *Storage) CommitUpload(ctx context.Context, id string, checksum []byte, c Creds) (ResourceID, error) {
+	if err := p.checkPass(ctx, c); err != nil {
+		return -1, errors.Join(err, ErrUserUnauthorized)
+	}
+	var transaction, transactionError = p.db.Begin(ctx)
+	if transactionError != nil {
+		return -1, transactionError
+	}
+	defer transaction.Rollback(ctx)
+
+	// the row lock keeps chunks and other commits out until done
+	var u, selectError = selectUpload(ctx, transaction, id, true, c)
+	if selectError != nil {
+		return -1, selectError
+	}
+	if u.Length >= 0 && u.Offset != u.Length {
+		return -1, fmt.Errorf("%w: %d of %d bytes received", ErrUploadIncomplete, u.Offset, u.Length)
+	}
+	var hash = sha256.New()
+	if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.hash); err != nil {
+		return -1, err
+	}
+	if subtle.ConstantTimeCompare(hash.Sum(nil), checksum) != 1 {
+		return -1, ErrUploadChecksum
+	}
+	var vault, accessError = vaultAccess(ctx, transaction, u.Team, c)
+	if accessError != nil {
+		return -1, accessError
+	}
+	if err := vault.writable(); err != nil {
+		return -1, err
+	}
+
+	var stored, writeError = p.joinParts(ctx, u, vault, hash.Sum(nil), c)
+	if writeError != nil {
+		return -1, writeError
+	}
+	stored.contentType, stored.filename = u.ContentType, u.Filename
+	// removed on any failure below, cleared once a blob refers to it
+	var orphan = stored.location
+	defer func() {
+		if orphan != "" {
+			p.removeBlobs(ctx, []string{orphan})
+		}
+	}()
+
+	if err := lockOwner(ctx, transaction, vault.lockKey()); err != nil {
+		return -1, err
+	}
+	var rid, insertError = insertBlob(ctx, transaction, vault, u.Meta, stored, c)
+	if insertError != nil {
+		return -1, insertError
+	}
+	// the content of the upload counts as the blob from now
+	if _, err := transaction.Exec(ctx, `DELETE FROM uploads WHERE id = $1`, u.ID); err != nil {
+		return -1, err
+	}
+	if err := scheduleRemoval(ctx, transaction, u.parts); err != nil {
+		return -1, err
+	}
+	if err := p.checkQuota(ctx, transaction, vault, 1, *stored.size); err != nil {
+		return -1, err
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		return -1, err
+	}
+	orphan = ""
+	p.removeBlobs(ctx, u.parts)
+	return rid, nil
+}
+
+// AbortUpload removes the upload and its parts
+func (p *Storage) AbortUpload(ctx context.Context, id string, c Creds) error {
+	if err := p.checkPass(ctx, c); err != nil {
+		return errors.Join(err, ErrUserUnauthorized)
+	}
+	var parts []string
+	if err := p.db.QueryRow(
+		ctx,
+		`WITH aborted AS (DELETE FROM uploads WHERE id = $1 AND owner = $2 RETURNING parts),
+		scheduled AS (INSERT INTO blob_removals(location) SELECT unnest(parts) FROM aborted ON CONFLICT DO NOTHING)
+		SELECT parts FROM aborted`,
+		id, c.Login,
+	).Scan(&parts); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUploadNotFound
+		}
+		return err
+	}
+	p.removeBlobs(ctx, parts)
+	return nil
+}
+
+// joinParts writes the parts of the upload into the blob. Parts of opaque
+// content are checked to start with an envelope header, sealed parts are
+// copied as is since they form the stream of the blob together, the digest
+// of their plaintext is sealed by the key of the blob. Content without
+// parts is empty.
+func (p *Storage) joinParts(ctx context.Context, u storedUpload, vault access, digest []byte, c Creds) (storedBlob, error) {
+	var content = &partsReader{ctx: ctx, blobs: p.Blobs, parts: u.parts}
+	defer content.Close()
+	if u.Opaque {
+		return p.putBlob(ctx, u.blob, content, nil)
+	}
+	var key, keyError = p.readKey(ctx, 0, vault, u.blob.wrappedKey, u.blob.keyID, nil, c)
+	if keyError != nil {
+		return storedBlob{}, keyError
+	}
+	if len(u.parts) == 0 {
+		return p.putBlob(ctx, u.blob, bytes.NewReader(nil), key)
+	}
+
+	var b = u.blob
+	var sealError error
+	if b.digest, sealError = wrapKey(key, digest); sealError != nil {
+		return storedBlob{}, sealError
+	}
+	b.size = &u.Offset
+	if _, err := p.Blobs.Put(ctx, b.location, content); err != nil {
+		log.Printf("failed to write blob: %s\n", err.Error())
+		if err := p.Blobs.Delete(ctx, b.location); err != nil {
+			log.Printf("failed to remove blob: %s\n", err.Error())
+		}
+		return storedBlob{}, err
+	}
+	return b, nil
+}
+
+// removeExpiredUploads removes the expired uploads of the user, failures
+// are only logged
+func (p *Storage) removeExpiredUploads(ctx context.Context, c Creds) {
+	var rows, err = p.db.Query(
+		ctx,
+		`WITH expired AS (DELETE FROM uploads WHERE owner = $1 AND expires_at < now() RETURNING parts),
+		scheduled AS (INSERT INTO blob_removals(location) SELECT unnest(parts) FROM expired ON CONFLICT DO NOTHING)
+		SELECT parts FROM expired`,
+		c.Login,
+	)
+	if err != nil {
+		log.Printf("failed to remove expired uploads: %s\n", err.Error())
+		return
+	}
+	var partsList, collectError = pgx.CollectRows(rows, pgx.RowTo[[]string])
+	if collectError != nil {
+		log.Printf("failed to remove expired uploads: %s\n", collectError.Error())
+		return
+	}
+	for _, parts := range partsList {
+		p.removeBlobs(ctx, parts)
+	}
+}
+
+// selectUpload returns the upload of the user unless expired, locked for
+// update within a transaction if asked
+func selectUpload(ctx context.Context, q queryRower, id string, lock bool, c Creds) (storedUpload, error) {
+	var query = `SELECT id, team_id, meta, opaque, length, received, hash, parts, location, iv, wrapped_key, key_id, expires_at,
+		content_type, filename FROM uploads WHERE id = $1 AND owner = $2 AND expires_at > now()`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	var (
+		u      = storedUpload{blob: storedBlob{format: blobFormatAEAD}}
+		team   *TeamID
+		length *int64
+	)
+	if _, err := uuid.Parse(id); err != nil {
+		return storedUpload{}, ErrUploadNotFound
+	}
+	if err := q.QueryRow(ctx, query, id, c.Login).Scan(
+		&u.ID, &team, &u.Meta, &u.Opaque, &length, &u.Offset, &u.hash, &u.parts,
+		&u.blob.location, &u.blob.iv, &u.blob.wrappedKey, &u.blob.keyID, &u.ExpiresAt,
+		&u.ContentType, &u.Filename,
+	); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storedUpload{}, ErrUploadNotFound
+		}
+		return storedUpload{}, err
+	}
+	if team != nil {
+		u.Team = *team
+	}
+	u.Length = -1
+	if length != nil {
+		u.Length = *length
+	}
+	u.blob.opaque = u.Opaque
+	return u, nil
+}
+
+// chunkReader counts the bytes read and fails past the limit unless it is
+// negative
+type chunkReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	var n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.limit >= 0 && cr.n > cr.limit {
+		return n, fmt.Errorf("%w: chunk exceeds the upload length", ErrUploadInvalid)
+	}
+	return n, err
+}
+
+// partsReader reads the parts one after another, every part is opened on
+// its first read
+type partsReader struct {
+	ctx     context.Context
+	blobs   BlobBackend
+	parts   []string
+	current io.ReadCloser
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.current == nil {
+			if len(pr.parts) == 0 {
+				return 0, io.EOF
+			}
+			var part, err = pr.blobs.Get(pr.ctx, pr.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			pr.current, pr.parts = part, pr.parts[1:]
+		}
+		var n, err = pr.current.Read(p)
+		if err == io.EOF {
+			pr.current.Close()
+			pr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.current == nil {
+		return nil
+	}
+	return pr.current.Close()
+}
@@ -0,0 +1,303 @@
+// Package stream implements chunked AEAD encryption of byte streams.
+//
+// The plaintext is split into segments of SegmentSize bytes and every segment
+// is sealed separately. The nonce of a segment is built from a random prefix,
+// the segment counter and a flag marking the final segment, so reordered,
+// dropped or truncated segments fail authentication instead of producing
+// corrupted plaintext.
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	SegmentSize     = 64 * 1024
+	NoncePrefixSize = 7
+	nonceSize       = NoncePrefixSize + 4 + 1
+)
+
+var (
+	ErrAuth      = fmt.Errorf("stream segment authentication failed")
+	ErrTruncated = fmt.Errorf("stream truncated")
+	ErrOverflow  = fmt.Errorf("stream too long")
+	ErrClosed    = fmt.Errorf("stream closed")
+	ErrAlignment = fmt.Errorf("stream offset not at a segment boundary")
+)
+
+// NewAEAD returns AES-256-GCM for the given 32 bytes key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedSize returns the size of the encrypted stream for the given plaintext size
+func EncryptedSize(size int64, overhead int) int64 {
+	segments := (size + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1 // empty stream still has the final segment
+	}
+	return size + segments*int64(overhead)
+}
+
+// PlaintextSize returns the plaintext size of an encrypted stream of the
+// given size, the inverse of EncryptedSize.
+func PlaintextSize(size int64, overhead int) int64 {
+	segment := int64(SegmentSize + overhead)
+	segments := (size + segment - 1) / segment
+	if segments == 0 {
+		segments = 1
+	}
+	return max(size-segments*int64(overhead), 0)
+}
+
+// SealedOffset returns the offset in the encrypted stream of the segment
+// holding the plaintext offset
+func SealedOffset(offset int64, overhead int) int64 {
+	return offset / SegmentSize * int64(SegmentSize+overhead)
+}
+
+// segmentCounter returns the counter of the segment holding the plaintext
+// offset
+func segmentCounter(offset int64) (uint32, error) {
+	segment := offset / SegmentSize
+	if offset < 0 || segment >= int64(^uint32(0)) {
+		return 0, ErrOverflow
+	}
+	return uint32(segment), nil
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, nonceSize)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[NoncePrefixSize:], counter)
+	if last {
+		n[nonceSize-1] = 1
+	}
+	return n
+}
+
+// Writer encrypts everything written to it and writes segments to the
+// underlying writer. Close must be called to write the final segment.
+type Writer struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	prefix  []byte
+	aad     []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewWriter returns a Writer sealing segments with aead. The nonce prefix
+// must be unique for the key, aad is authenticated with every segment.
+func NewWriter(w io.Writer, aead cipher.AEAD, prefix, aad []byte) (*Writer, error) {
+	if aead.NonceSize() != nonceSize {
+		return nil, fmt.Errorf("unsupported nonce size %d", aead.NonceSize())
+	}
+	if len(prefix) != NoncePrefixSize {
+		return nil, fmt.Errorf("nonce prefix must be %d bytes", NoncePrefixSize)
+	}
+	return &Writer{
+		aead:   aead,
+		w:      w,
+		prefix: prefix,
+		aad:    aad,
+		buf:    make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+// NewWriterAt returns a Writer continuing the stream at the plaintext
+// offset, which must be at a segment boundary. Writers of consecutive parts
+// of a stream produce the same segments as a single Writer when every part
+// but the last ends with Flush.
+func NewWriterAt(w io.Writer, aead cipher.AEAD, prefix, aad []byte, offset int64) (*Writer, error) {
+	if offset%SegmentSize != 0 {
+		return nil, ErrAlignment
+	}
+	counter, err := segmentCounter(offset)
+	if err != nil {
+		return nil, err
+	}
+	sw, err := NewWriter(w, aead, prefix, aad)
+	if err != nil {
+		return nil, err
+	}
+	sw.counter = counter
+	return sw, nil
+}
+
+// Write buffers p and seals every complete segment. A full segment is kept
+// until more data arrives because only Close knows which segment is final.
+func (sw *Writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, ErrClosed
+	}
+	var n int
+	for len(p) > 0 {
+		if len(sw.buf) == SegmentSize {
+			if err := sw.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(sw.buf[len(sw.buf):SegmentSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Flush seals the buffered segment as an intermediate one, so the stream
+// can be continued by NewWriterAt. The data written must fill whole
+// segments, ErrAlignment is returned otherwise. The Writer is closed.
+func (sw *Writer) Flush() error {
+	if sw.closed {
+		return ErrClosed
+	}
+	sw.closed = true
+	switch len(sw.buf) {
+	case 0:
+		return nil
+	case SegmentSize:
+		return sw.flush(false)
+	}
+	return ErrAlignment
+}
+
+// Close seals the final segment, the underlying writer is not closed
+func (sw *Writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.flush(true)
+}
+
+func (sw *Writer) flush(last bool) error {
+	if sw.counter == ^uint32(0) {
+		return ErrOverflow
+	}
+	sealed := sw.aead.Seal(nil, nonce(sw.prefix, sw.counter, last), sw.buf, sw.aad)
+	if _, err := sw.w.Write(sealed); err != nil {
+		return err
+	}
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// Reader decrypts a stream produced by Writer. Read returns ErrAuth for
+// tampered segments and ErrTruncated when the final segment is missing.
+type Reader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	prefix  []byte
+	aad     []byte
+	in      []byte // sealed segment plus one byte of lookahead
+	pending int    // bytes of the next segment already read into in
+	plain   []byte
+	out     []byte
+	counter uint32
+	skip    int // plaintext bytes of the first segment before the start
+	done    bool
+	err     error
+}
+
+// NewReader returns a Reader opening segments sealed by Writer with the
+// same aead, nonce prefix and aad.
+func NewReader(r io.Reader, aead cipher.AEAD, prefix, aad []byte) (*Reader, error) {
+	if aead.NonceSize() != nonceSize {
+		return nil, fmt.Errorf("unsupported nonce size %d", aead.NonceSize())
+	}
+	if len(prefix) != NoncePrefixSize {
+		return nil, fmt.Errorf("nonce prefix must be %d bytes", NoncePrefixSize)
+	}
+	return &Reader{
+		aead:   aead,
+		r:      r,
+		prefix: prefix,
+		aad:    aad,
+		in:     make([]byte, SegmentSize+aead.Overhead()+1),
+		plain:  make([]byte, 0, SegmentSize),
+	}, nil
+}
+
+// NewReaderAt returns a Reader of the stream starting at the plaintext
+// offset. r reads the sealed stream from SealedOffset of the offset to its
+// end.
+func NewReaderAt(r io.Reader, aead cipher.AEAD, prefix, aad []byte, offset int64) (*Reader, error) {
+	counter, err := segmentCounter(offset)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := NewReader(r, aead, prefix, aad)
+	if err != nil {
+		return nil, err
+	}
+	sr.counter = counter
+	sr.skip = int(offset % SegmentSize)
+	return sr, nil
+}
+
+// Read implements io.Reader
+func (sr *Reader) Read(p []byte) (int, error) {
+	for len(sr.out) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.next()
+	}
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+// next reads and opens one segment. It reads one byte past the segment to
+// find out whether the segment is the final one.
+func (sr *Reader) next() error {
+	full := SegmentSize + sr.aead.Overhead()
+	n, err := io.ReadFull(sr.r, sr.in[sr.pending:])
+	n += sr.pending
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < sr.aead.Overhead() {
+		return ErrTruncated
+	}
+	if sr.counter == ^uint32(0) {
+		return ErrOverflow
+	}
+
+	last := n <= full
+	size := min(n, full)
+	opened, openErr := sr.aead.Open(sr.plain[:0], nonce(sr.prefix, sr.counter, last), sr.in[:size], sr.aad)
+	if openErr != nil {
+		if _, err := sr.aead.Open(sr.plain[:0], nonce(sr.prefix, sr.counter, !last), sr.in[:size], sr.aad); err == nil && last {
+			// a valid intermediate segment at the end of input, the rest was cut off
+			return ErrTruncated
+		}
+		return ErrAuth
+	}
+	sr.counter++
+	sr.out = opened[min(sr.skip, len(opened)):]
+	sr.skip = 0
+
+	if last {
+		sr.done = true
+		return nil
+	}
+	sr.in[0] = sr.in[full]
+	sr.pending = 1
+	return nil
+}
@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seal(t *testing.T, plaintext, key, prefix []byte) []byte {
+	aead, err := NewAEAD(key)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, aead, prefix, []byte("aad"))
+	require.NoError(t, err)
+	// write in odd sized pieces to cross segment boundaries
+	for len(plaintext) > 0 {
+		n := min(len(plaintext), 10007)
+		_, err := w.Write(plaintext[:n])
+		require.NoError(t, err)
+		plaintext = plaintext[n:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func open(key, prefix, sealed []byte) ([]byte, error) {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(bytes.NewReader(sealed), aead, prefix, []byte("aad"))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, NoncePrefixSize)
+	_, _ = rand.Read(key)
+	_, _ = rand.Read(prefix)
+
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+		sealed := seal(t, plaintext, key, prefix)
+		assert.Equal(t, EncryptedSize(int64(size), 16), int64(len(sealed)), "size %d", size)
+		assert.Equal(t, int64(size), PlaintextSize(int64(len(sealed)), 16), "size %d", size)
+
+		opened, err := open(key, prefix, sealed)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, plaintext, opened, "size %d", size)
+	}
+}
+
+func TestStream_Tampering(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, NoncePrefixSize)
+	plaintext := make([]byte, 3*SegmentSize+100)
+	_, _ = rand.Read(plaintext)
+	sealed := seal(t, plaintext, key, prefix)
+	full := SegmentSize + 16
+
+	// truncated at a segment boundary
+	_, err := open(key, prefix, sealed[:2*full])
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	// truncated inside a segment
+	_, err = open(key, prefix, sealed[:2*full+100])
+	assert.ErrorIs(t, err, ErrAuth)
+
+	// flipped bit
+	corrupted := bytes.Clone(sealed)
+	corrupted[full+10] ^= 1
+	_, err = open(key, prefix, corrupted)
+	assert.ErrorIs(t, err, ErrAuth)
+
+	// swapped segments
+	swapped := bytes.Clone(sealed)
+	copy(swapped[:full], sealed[full:2*full])
+	copy(swapped[full:2*full], sealed[:full])
+	_, err = open(key, prefix, swapped)
+	assert.ErrorIs(t, err, ErrAuth)
+
+	// appended data after the final segment
+	_, err = open(key, prefix, append(bytes.Clone(sealed), sealed[:full]...))
+	assert.Error(t, err)
+
+	// wrong key
+	_, err = open(make([]byte, 32), []byte("1234567"), sealed)
+	assert.ErrorIs(t, err, ErrAuth)
+}
+
+func TestStream_Parts(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, NoncePrefixSize)
+	_, _ = rand.Read(key)
+	_, _ = rand.Read(prefix)
+	aead, err := NewAEAD(key)
+	require.NoError(t, err)
+	plaintext := make([]byte, 3*SegmentSize+100)
+	_, _ = rand.Read(plaintext)
+	sealed := seal(t, plaintext, key, prefix)
+
+	// parts written separately make the same stream
+	var parts bytes.Buffer
+	for _, part := range [][2]int{{0, SegmentSize}, {SegmentSize, 3 * SegmentSize}, {3 * SegmentSize, len(plaintext)}} {
+		w, err := NewWriterAt(&parts, aead, prefix, []byte("aad"), int64(part[0]))
+		require.NoError(t, err)
+		_, err = w.Write(plaintext[part[0]:part[1]])
+		require.NoError(t, err)
+		if part[1] == len(plaintext) {
+			require.NoError(t, w.Close())
+		} else {
+			require.NoError(t, w.Flush())
+		}
+	}
+	assert.Equal(t, sealed, parts.Bytes())
+
+	_, err = NewWriterAt(&parts, aead, prefix, []byte("aad"), 100)
+	assert.ErrorIs(t, err, ErrAlignment)
+	w, err := NewWriterAt(io.Discard, aead, prefix, []byte("aad"), SegmentSize)
+	require.NoError(t, err)
+	_, err = w.Write(plaintext[:100])
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Flush(), ErrAlignment)
+
+	// read from any offset
+	for _, offset := range []int64{0, 1, SegmentSize - 1, SegmentSize, 2*SegmentSize + 5, 3 * SegmentSize, int64(len(plaintext)) - 1} {
+		r, err := NewReaderAt(bytes.NewReader(sealed[SealedOffset(offset, aead.Overhead()):]), aead, prefix, []byte("aad"), offset)
+		require.NoError(t, err)
+		opened, err := io.ReadAll(r)
+		require.NoError(t, err, "offset %d", offset)
+		assert.Equal(t, plaintext[offset:], opened, "offset %d", offset)
+	}
+
+	// a segment of another position fails
+	r, err := NewReaderAt(bytes.NewReader(sealed), aead, prefix, []byte("aad"), SegmentSize)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrAuth)
+}
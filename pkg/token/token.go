@@ -0,0 +1,124 @@
+// Package token issues and verifies the access tokens of sessions.
+//
+// A token is a JWT signed with HMAC-SHA256. Its subject is the login of the
+// user, the sid claim names the session kept by the server and the kid
+// header names the server key which signed the token. No secret of the user
+// is carried by the token, the server keeps what it needs in the session
+// encrypted by a key derived from the same server key.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrInvalid    = fmt.Errorf("invalid token")
+	ErrUnknownKey = fmt.Errorf("unknown token key")
+	ErrNoKey      = fmt.Errorf("no token key")
+)
+
+// Claims of the access token, the subject is the login of the user
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid"`
+}
+
+// Issuer signs and verifies tokens. The first key signs new tokens, the
+// others are only accepted, so the key can be replaced without logging
+// everybody out at once.
+type Issuer struct {
+	active string
+	keys   map[string][]byte
+}
+
+// NewIssuer returns an issuer signing with the first of the keys
+func NewIssuer(keys ...[]byte) (*Issuer, error) {
+	if len(keys) == 0 || len(keys[0]) == 0 {
+		return nil, ErrNoKey
+	}
+	var i = &Issuer{keys: make(map[string][]byte, len(keys))}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrNoKey
+		}
+		i.keys[KeyID(key)] = key
+	}
+	i.active = KeyID(keys[0])
+	return i, nil
+}
+
+// KeyID identifies the key without revealing it
+func KeyID(key []byte) string {
+	var mac = hmac.New(sha256.New, key)
+	mac.Write([]byte("gophkeeper key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Active returns the ID of the key signing new tokens
+func (i *Issuer) Active() string {
+	return i.active
+}
+
+// Issue returns a token of the session of the user valid until expires
+func (i *Issuer) Issue(login, sessionID string, expires time.Time) (string, error) {
+	var token = jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   login,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		SessionID: sessionID,
+	})
+	token.Header["kid"] = i.active
+	return token.SignedString(i.keys[i.active])
+}
+
+// Parse verifies the token and returns its claims and the ID of the key
+// which signed it. Expired tokens and tokens without subject or session
+// are rejected with ErrInvalid.
+func (i *Issuer) Parse(t string) (Claims, string, error) {
+	var (
+		claims Claims
+		keyID  string
+	)
+	var token, err = jwt.ParseWithClaims(t, &claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("%w: signing method %v", ErrInvalid, token.Header["alg"])
+		}
+		keyID, _ = token.Header["kid"].(string)
+		var key, ok = i.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+		}
+		return key, nil
+	})
+	if err != nil || !token.Valid {
+		return Claims{}, "", fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if claims.Subject == "" || claims.SessionID == "" || claims.ExpiresAt == nil {
+		return Claims{}, "", fmt.Errorf("%w: subject, session and expiry required", ErrInvalid)
+	}
+	return claims, keyID, nil
+}
+
+// SessionKey derives the key encrypting the server side state of the
+// session from the token key of the ID
+func (i *Issuer) SessionKey(keyID, sessionID string) ([]byte, error) {
+	var key, ok = i.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	var sessionKey = make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("gophkeeper session "+sessionID)), sessionKey); err != nil {
+		return nil, err
+	}
+	return sessionKey, nil
+}
@@ -0,0 +1,99 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuer(t *testing.T) {
+	issuer, err := NewIssuer([]byte("secret"))
+	require.NoError(t, err)
+
+	token, err := issuer.Issue("octocat", "sid", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.NotContains(t, token, "secret")
+
+	claims, keyID, err := issuer.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, "octocat", claims.Subject)
+	assert.Equal(t, "sid", claims.SessionID)
+	assert.Equal(t, issuer.Active(), keyID)
+	assert.Equal(t, KeyID([]byte("secret")), keyID)
+
+	_, _, err = issuer.Parse(token + "x")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	expired, err := issuer.Issue("octocat", "sid", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	_, _, err = issuer.Parse(expired)
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	other, err := NewIssuer([]byte("other"))
+	require.NoError(t, err)
+	_, _, err = other.Parse(token)
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	_, err = NewIssuer()
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestIssuer_Rotation(t *testing.T) {
+	old, err := NewIssuer([]byte("old"))
+	require.NoError(t, err)
+	token, err := old.Issue("octocat", "sid", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	oldKey, err := old.SessionKey(old.Active(), "sid")
+	require.NoError(t, err)
+
+	issuer, err := NewIssuer([]byte("new"), []byte("old"))
+	require.NoError(t, err)
+	assert.NotEqual(t, old.Active(), issuer.Active())
+	_, keyID, err := issuer.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, old.Active(), keyID)
+
+	key, err := issuer.SessionKey(keyID, "sid")
+	require.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	otherSession, err := issuer.SessionKey(keyID, "other")
+	require.NoError(t, err)
+	assert.NotEqual(t, key, otherSession)
+
+	_, err = issuer.SessionKey("unknown", "sid")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestIssuer_Rejects(t *testing.T) {
+	issuer, err := NewIssuer([]byte("secret"))
+	require.NoError(t, err)
+	expires := jwt.NewNumericDate(time.Now().Add(time.Minute))
+
+	sign := func(claims Claims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = issuer.Active()
+		signed, err := token.SignedString([]byte("secret"))
+		require.NoError(t, err)
+		return signed
+	}
+	_, _, err = issuer.Parse(sign(Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "octocat", ExpiresAt: expires}}))
+	assert.ErrorIs(t, err, ErrInvalid, "session required")
+	_, _, err = issuer.Parse(sign(Claims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expires}, SessionID: "sid"}))
+	assert.ErrorIs(t, err, ErrInvalid, "subject required")
+	_, _, err = issuer.Parse(sign(Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "octocat"}, SessionID: "sid"}))
+	assert.ErrorIs(t, err, ErrInvalid, "expiry required")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "octocat", ExpiresAt: expires}, SessionID: "sid"})
+	token.Header["kid"] = issuer.Active()
+	signed, err := token.SignedString(rsaKey)
+	require.NoError(t, err)
+	_, _, err = issuer.Parse(signed)
+	assert.ErrorIs(t, err, ErrInvalid, "unexpected signing method")
+}
@@ -0,0 +1,101 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 in
+// the form authenticator apps expect: HMAC-SHA1, six digits, 30 second
+// steps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of a code
+	Digits = 6
+	// Period is the lifetime of a code
+	Period = 30 * time.Second
+	// Skew is the number of steps before and after the current one accepted
+	// to make up for clock drift
+	Skew = 1
+	// SecretSize is the size of new secrets, the size of SHA-1 as RFC 4226
+	// recommends
+	SecretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret
+func NewSecret() ([]byte, error) {
+	var secret = make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Encode returns the secret in base32 without padding, the form typed into
+// authenticator apps
+func Encode(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns the otpauth:// URI of the secret, the payload of the QR code
+// scanned by authenticator apps
+func URI(issuer, account string, secret []byte) string {
+	var query = url.Values{}
+	query.Set("secret", Encode(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(Digits))
+	query.Set("period", strconv.Itoa(int(Period/time.Second)))
+	var uri = url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// Step returns the time step of t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of the secret at the time step
+func Code(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	var mac = hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	var sum = mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000)
+}
+
+// Verify checks the code at t within Skew steps and returns the matching
+// step, callers keep it to reject the same code again.
+func Verify(secret []byte, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	var now = Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	// test vectors of RFC 6238 appendix B, SHA-1, last six digits
+	secret := []byte("12345678901234567890")
+	tbl := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.code, Code(secret, Step(time.Unix(tt.unix, 0))), "time %d", tt.unix)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, SecretSize)
+
+	now := time.Now()
+	step, ok := Verify(secret, Code(secret, Step(now)), now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	step, ok = Verify(secret, " "+Code(secret, Step(now)-1)+" ", now)
+	assert.True(t, ok, "previous step accepted")
+	assert.Equal(t, Step(now)-1, step)
+
+	_, ok = Verify(secret, Code(secret, Step(now)-2), now)
+	assert.False(t, ok, "outside of skew")
+	_, ok = Verify(secret, "12345", now)
+	assert.False(t, ok)
+	_, ok = Verify(secret, "", now)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	uri, err := url.Parse(URI("gophkeeper", "octo cat", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/gophkeeper:octo cat", uri.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	assert.Equal(t, Encode(secret), uri.Query().Get("secret"))
+	assert.Equal(t, "gophkeeper", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}